@@ -0,0 +1,800 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --------------------------- ActivityPub -----------------------
+// The blog is a single ActivityPub actor, found through WebFinger as
+// @fediverse_user@host. Remote servers follow it by posting a signed Follow
+// to its inbox; creating, editing and deleting public articles puts
+// Create/Update/Delete activities in its outbox and queues a signed
+// delivery to every follower's inbox, retried with backoff like webmentions.
+// State lives in .blog/activitypub/: the signing key, followers, the outbox
+// and the delivery queue.
+
+const (
+	activityPubDir    = "activitypub"
+	apKeyFile         = "key.pem"
+	apFollowersFile   = "followers.json"
+	apOutboxFile      = "outbox.json"
+	apQueueFile       = "deliveries.json"
+	apContentType     = "application/activity+json"
+	apOutboxSize      = 200 // activities kept in the outbox
+	apAttempts        = 8
+	apRetryBase       = time.Minute
+	apSweep           = 30 * time.Second
+	apMaxBody         = 256 << 10
+	apClockSkew       = 12 * time.Hour // how far a signed Date may be off
+	asPublic          = "https://www.w3.org/ns/activitystreams#Public"
+	activityStreamsNS = "https://www.w3.org/ns/activitystreams"
+)
+
+type apFollower struct {
+	ID          string    `json:"id"` // the remote actor
+	Inbox       string    `json:"inbox"`
+	SharedInbox string    `json:"shared_inbox,omitempty"`
+	FollowID    string    `json:"follow_id"` // the Follow activity, for Undo
+	Followed    time.Time `json:"followed"`
+}
+
+type apDelivery struct {
+	Inbox    string          `json:"inbox"`
+	Activity json.RawMessage `json:"activity"`
+	Queued   time.Time       `json:"queued"`
+	NextTry  time.Time       `json:"next_try"`
+	Attempts int             `json:"attempts,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+type apActivity struct {
+	Context   string    `json:"@context,omitempty"`
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Actor     string    `json:"actor"`
+	Published time.Time `json:"published,omitzero"`
+	To        []string  `json:"to,omitempty"`
+	CC        []string  `json:"cc,omitempty"`
+	Object    any       `json:"object"`
+}
+
+type apArticle struct {
+	ID           string    `json:"id"`
+	Type         string    `json:"type"`
+	Name         string    `json:"name"`
+	Content      string    `json:"content"`
+	URL          string    `json:"url"`
+	AttributedTo string    `json:"attributedTo"`
+	Published    time.Time `json:"published"`
+	Updated      time.Time `json:"updated,omitzero"`
+	To           []string  `json:"to"`
+	CC           []string  `json:"cc"`
+	Tag          []apTag   `json:"tag,omitempty"`
+}
+
+type apTag struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+}
+
+type apTombstone struct {
+	ID      string    `json:"id"`
+	Type    string    `json:"type"`
+	Deleted time.Time `json:"deleted"`
+}
+
+// apRemoteActor is what the inbox needs from a sender's actor document.
+type apRemoteActor struct {
+	ID        string `json:"id"`
+	Inbox     string `json:"inbox"`
+	Endpoints struct {
+		SharedInbox string `json:"sharedInbox"`
+	} `json:"endpoints"`
+	PublicKey struct {
+		ID           string `json:"id"`
+		Owner        string `json:"owner"`
+		PublicKeyPem string `json:"publicKeyPem"`
+	} `json:"publicKey"`
+}
+
+var apMu sync.Mutex
+
+// federation delivers queued activities; it is woken by article saves and
+// follows.
+var federation = newWorker(apSweep)
+
+func apActorID() string     { return cfg.BaseURL + "/ap/actor" }
+func apFollowersID() string { return cfg.BaseURL + "/ap/followers" }
+func apObjectID(slug string) string {
+	return cfg.BaseURL + "/ap/articles/" + slug
+}
+func apActivityID() string { return cfg.BaseURL + "/ap/activities/" + newToken(24) }
+
+// --------------------------- ActivityPub storage ---------------
+
+func apPath(name string) string { return filepath.Join(metaDir(), activityPubDir, name) }
+
+// apLoad reads one of the JSON files in the activitypub directory into v;
+// a missing file leaves v alone.
+func apLoad(name string, v any) error {
+	b, err := os.ReadFile(apPath(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func apSave(name string, v any) error {
+	if err := os.MkdirAll(filepath.Join(metaDir(), activityPubDir), 0o700); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	return writeFileAtomic(apPath(name), b, 0o600)
+}
+
+func loadFollowers() ([]apFollower, error) {
+	var fs []apFollower
+	return fs, apLoad(apFollowersFile, &fs)
+}
+
+func loadAPOutbox() ([]json.RawMessage, error) {
+	var acts []json.RawMessage
+	return acts, apLoad(apOutboxFile, &acts)
+}
+
+func loadAPQueue() ([]apDelivery, error) {
+	var q []apDelivery
+	return q, apLoad(apQueueFile, &q)
+}
+
+// actorKey returns the key activities are signed with, creating it on
+// first use. Callers hold apMu.
+func actorKey() (*rsa.PrivateKey, error) {
+	b, err := os.ReadFile(apPath(apKeyFile))
+	if errors.Is(err, os.ErrNotExist) {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Join(metaDir(), activityPubDir), 0o700); err != nil {
+			return nil, err
+		}
+		storeMu.RLock()
+		defer storeMu.RUnlock()
+		return key, writeFileAtomic(apPath(apKeyFile), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", apKeyFile)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an RSA key", apKeyFile)
+	}
+	return rsaKey, nil
+}
+
+// --------------------------- Activities ------------------------
+
+func apObject(a Article) apArticle {
+	o := apArticle{
+		ID:           apObjectID(a.Slug),
+		Type:         "Article",
+		Name:         a.Title,
+		Content:      markdownToXHTML(a.Content, func(string) string { return "" }),
+		URL:          cfg.BaseURL + "/article/" + a.Slug,
+		AttributedTo: apActorID(),
+		Published:    a.Published.UTC(),
+		Updated:      a.UpdatedAt.UTC(),
+		To:           []string{asPublic},
+		CC:           []string{apFollowersID()},
+	}
+	for _, t := range a.Tags {
+		o.Tag = append(o.Tag, apTag{Type: "Hashtag", Name: "#" + strings.ReplaceAll(t, " ", "")})
+	}
+	return o
+}
+
+// articleActivities maps a save to what followers are told: edits of a
+// public article are Updates, and anything that takes an article off the
+// public site (deleting, unpublishing, or a new slug) is a Delete of the
+// old object, followed by a Create when a new one appears.
+func articleActivities(before, after Article, now time.Time) []apActivity {
+	public := func(a Article) bool { return a.Slug != "" && !a.Draft }
+	activity := func(typ string, obj any) apActivity {
+		return apActivity{Context: activityStreamsNS, ID: apActivityID(), Type: typ, Actor: apActorID(), Published: now.UTC(),
+			To: []string{asPublic}, CC: []string{apFollowersID()}, Object: obj}
+	}
+	if public(before) && public(after) && before.Slug == after.Slug {
+		return []apActivity{activity("Update", apObject(after))}
+	}
+	var acts []apActivity
+	if public(before) {
+		acts = append(acts, activity("Delete", apTombstone{ID: apObjectID(before.Slug), Type: "Tombstone", Deleted: now.UTC()}))
+	}
+	if public(after) {
+		acts = append(acts, activity("Create", apObject(after)))
+	}
+	return acts
+}
+
+// queueActivityPub adds the activities for a save to the outbox and queues
+// them for every follower, once per shared inbox. Failures are logged: the
+// article itself has been saved by then.
+func queueActivityPub(before, after Article) {
+	if !cfg.Federating() {
+		return
+	}
+	acts := articleActivities(before, after, time.Now())
+	if len(acts) == 0 {
+		return
+	}
+	apMu.Lock()
+	defer apMu.Unlock()
+	if err := apPublish(acts); err != nil {
+		slog.Error("queue activitypub", "err", err)
+		return
+	}
+	federation.wake()
+}
+
+func apPublish(acts []apActivity) error {
+	followers, err := loadFollowers()
+	if err != nil {
+		return err
+	}
+	outbox, err := loadAPOutbox()
+	if err != nil {
+		return err
+	}
+	var inboxes []string
+	for _, f := range followers {
+		inbox := f.Inbox
+		if f.SharedInbox != "" {
+			inbox = f.SharedInbox
+		}
+		if !slices.Contains(inboxes, inbox) {
+			inboxes = append(inboxes, inbox)
+		}
+	}
+	var msgs []json.RawMessage
+	for _, act := range acts {
+		b, err := json.Marshal(act)
+		if err != nil {
+			return err
+		}
+		msgs = append(msgs, b)
+	}
+	outbox = append(outbox, msgs...)
+	if n := len(outbox); n > apOutboxSize {
+		outbox = outbox[n-apOutboxSize:]
+	}
+	if err := apSave(apOutboxFile, outbox); err != nil {
+		return err
+	}
+	return apEnqueue(inboxes, msgs...)
+}
+
+// apEnqueue queues each activity for each inbox. Callers hold apMu.
+func apEnqueue(inboxes []string, msgs ...json.RawMessage) error {
+	if len(inboxes) == 0 {
+		return nil
+	}
+	q, err := loadAPQueue()
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	for _, m := range msgs {
+		for _, inbox := range inboxes {
+			q = append(q, apDelivery{Inbox: inbox, Activity: m, Queued: now, NextTry: now})
+		}
+	}
+	return apSave(apQueueFile, q)
+}
+
+// --------------------------- HTTP Signatures -------------------
+// Requests between servers are signed with the draft-cavage HTTP
+// Signatures scheme Mastodon uses: rsa-sha256 over the request target,
+// Host, Date and a SHA-256 Digest of the body.
+
+var apSignedHeaders = []string{"(request-target)", "host", "date", "digest"}
+
+func signingString(method, target, host string, h http.Header, headers []string) string {
+	lines := make([]string, len(headers))
+	for i, name := range headers {
+		switch name {
+		case "(request-target)":
+			lines[i] = name + ": " + strings.ToLower(method) + " " + target
+		case "host":
+			lines[i] = "host: " + host
+		default:
+			lines[i] = name + ": " + strings.Join(h.Values(name), ", ")
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func bodyDigest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// signRequest signs req, whose body is body, as keyID.
+func signRequest(req *http.Request, body []byte, key *rsa.PrivateKey, keyID string) error {
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("Digest", bodyDigest(body))
+	sum := sha256.Sum256([]byte(signingString(req.Method, req.URL.RequestURI(), req.URL.Host, req.Header, apSignedHeaders)))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Signature", fmt.Sprintf(`keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		keyID, strings.Join(apSignedHeaders, " "), base64.StdEncoding.EncodeToString(sig)))
+	return nil
+}
+
+var sigParamRe = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// verifySignature checks the signature on an inbox POST and returns the
+// actor whose key made it. The key is fetched from its keyId.
+func verifySignature(ctx context.Context, r *http.Request, body []byte) (apRemoteActor, error) {
+	var actor apRemoteActor
+	params := map[string]string{}
+	for _, m := range sigParamRe.FindAllStringSubmatch(r.Header.Get("Signature"), -1) {
+		params[m[1]] = m[2]
+	}
+	keyID, headers := params["keyId"], strings.Fields(strings.ToLower(params["headers"]))
+	sig, err := base64.StdEncoding.DecodeString(params["signature"])
+	if keyID == "" || err != nil || len(sig) == 0 {
+		return actor, errors.New("missing or malformed Signature header")
+	}
+	for _, h := range apSignedHeaders {
+		if !slices.Contains(headers, h) {
+			return actor, fmt.Errorf("signature must cover %s", h)
+		}
+	}
+	date, err := http.ParseTime(r.Header.Get("Date"))
+	if err != nil || time.Since(date).Abs() > apClockSkew {
+		return actor, errors.New("missing or stale Date")
+	}
+	if r.Header.Get("Digest") != bodyDigest(body) {
+		return actor, errors.New("Digest does not match the body")
+	}
+
+	if actor, err = fetchActor(ctx, stripFragment(keyID)); err != nil {
+		return actor, fmt.Errorf("fetch key: %w", err)
+	}
+	if actor.PublicKey.ID != keyID || actor.PublicKey.Owner != actor.ID {
+		return actor, errors.New("key is not the actor's")
+	}
+	block, _ := pem.Decode([]byte(actor.PublicKey.PublicKeyPem))
+	if block == nil {
+		return actor, errors.New("key has no PEM data")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if err != nil || !ok {
+		return actor, errors.New("key is not an RSA public key")
+	}
+	sum := sha256.Sum256([]byte(signingString(r.Method, r.URL.RequestURI(), r.Host, r.Header, headers)))
+	if err := rsa.VerifyPKCS1v15(rsaPub, crypto.SHA256, sum[:], sig); err != nil {
+		return actor, errors.New("bad signature")
+	}
+	return actor, nil
+}
+
+// fetchActor GETs a remote actor document through the public-only client.
+func fetchActor(ctx context.Context, id string) (apRemoteActor, error) {
+	var actor apRemoteActor
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, id, nil)
+	if err != nil {
+		return actor, err
+	}
+	req.Header.Set("Accept", apContentType+`, application/ld+json; profile="https://www.w3.org/ns/activitystreams"`)
+	req.Header.Set("User-Agent", "blog-activitypub ("+cfg.SiteTitle+")")
+	resp, err := webClient.Do(req)
+	if err != nil {
+		return actor, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return actor, fmt.Errorf("GET %s: %s", id, resp.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, apMaxBody)).Decode(&actor); err != nil {
+		return actor, fmt.Errorf("GET %s: %v", id, err)
+	}
+	if actor.ID != id || actor.Inbox == "" {
+		return actor, fmt.Errorf("GET %s: not an actor", id)
+	}
+	return actor, nil
+}
+
+// --------------------------- Delivery --------------------------
+
+func processFederation(ctx context.Context) {
+	if err := deliverActivities(ctx); err != nil {
+		slog.Error("deliver activities", "err", err)
+	}
+}
+
+// deliverActivities posts the queued activities that are due, signed with
+// the actor's key. Client errors other than 429 aren't retried.
+func deliverActivities(ctx context.Context) error {
+	apMu.Lock()
+	q, err := loadAPQueue()
+	var key *rsa.PrivateKey
+	if err == nil && len(q) > 0 {
+		key, err = actorKey()
+	}
+	apMu.Unlock()
+	if err != nil {
+		return err
+	}
+	type result struct {
+		d   apDelivery
+		err error
+	}
+	var done []result
+	now := time.Now()
+	for _, d := range q {
+		if d.NextTry.After(now) {
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		done = append(done, result{d, postActivity(ctx, key, d)})
+	}
+	if len(done) == 0 {
+		return nil
+	}
+
+	apMu.Lock()
+	defer apMu.Unlock()
+	if q, err = loadAPQueue(); err != nil {
+		return err
+	}
+	for _, r := range done {
+		i := slices.IndexFunc(q, func(d apDelivery) bool {
+			return d.Inbox == r.d.Inbox && d.Queued.Equal(r.d.Queued) && bytes.Equal(d.Activity, r.d.Activity)
+		})
+		if i < 0 {
+			continue
+		}
+		var perm *permanentError
+		switch {
+		case r.err == nil:
+			slog.Debug("activity delivered", "inbox", r.d.Inbox)
+		case errors.As(r.err, &perm) || q[i].Attempts+1 >= apAttempts:
+			slog.Warn("activity delivery failed", "inbox", r.d.Inbox, "err", r.err)
+		default:
+			q[i].Attempts++
+			q[i].Error = r.err.Error()
+			q[i].NextTry = time.Now().Add(apRetryBase << (q[i].Attempts - 1)).UTC()
+			continue
+		}
+		q = append(q[:i], q[i+1:]...)
+	}
+	return apSave(apQueueFile, q)
+}
+
+func postActivity(ctx context.Context, key *rsa.PrivateKey, d apDelivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.Inbox, bytes.NewReader(d.Activity))
+	if err != nil {
+		return permanent("%v", err)
+	}
+	req.Header.Set("Content-Type", apContentType)
+	req.Header.Set("User-Agent", "blog-activitypub ("+cfg.SiteTitle+")")
+	if err := signRequest(req, d.Activity, key, apActorID()+"#main-key"); err != nil {
+		return err
+	}
+	resp, err := webClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, apMaxBody))
+	switch {
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return fmt.Errorf("POST %s: %s", d.Inbox, resp.Status)
+	case resp.StatusCode >= 400:
+		return permanent("POST %s: %s", d.Inbox, resp.Status)
+	}
+	return nil
+}
+
+// --------------------------- Handlers (ActivityPub) ------------
+
+func writeActivityJSON(w http.ResponseWriter, r *http.Request, contentType string, v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	_, _ = w.Write(b)
+}
+
+// webfingerHandler answers acct:user@host lookups for the blog's actor.
+func webfingerHandler(w http.ResponseWriter, r *http.Request) {
+	if !cfg.Federating() {
+		http.NotFound(w, r)
+		return
+	}
+	host := strings.TrimPrefix(strings.TrimPrefix(cfg.BaseURL, "https://"), "http://")
+	resource := r.URL.Query().Get("resource")
+	acct := "acct:" + cfg.FediverseUser + "@" + host
+	if !strings.EqualFold(resource, acct) && resource != apActorID() && resource != cfg.BaseURL && resource != cfg.BaseURL+"/" {
+		http.NotFound(w, r)
+		return
+	}
+	writeActivityJSON(w, r, "application/jrd+json", map[string]any{
+		"subject": acct,
+		"aliases": []string{apActorID(), cfg.BaseURL + "/"},
+		"links": []map[string]string{
+			{"rel": "self", "type": apContentType, "href": apActorID()},
+			{"rel": "http://webfinger.net/rel/profile-page", "type": "text/html", "href": cfg.BaseURL + "/"},
+		},
+	})
+}
+
+func apActorHandler(w http.ResponseWriter, r *http.Request) {
+	if !cfg.Federating() {
+		http.NotFound(w, r)
+		return
+	}
+	apMu.Lock()
+	key, err := actorKey()
+	apMu.Unlock()
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	summary := "Posts from " + cfg.SiteTitle
+	if cfg.Author != "" {
+		summary += " by " + cfg.Author
+	}
+	writeActivityJSON(w, r, apContentType, map[string]any{
+		"@context":                  []string{activityStreamsNS, "https://w3id.org/security/v1"},
+		"id":                        apActorID(),
+		"type":                      "Person",
+		"preferredUsername":         cfg.FediverseUser,
+		"name":                      cfg.SiteTitle,
+		"summary":                   summary,
+		"url":                       cfg.BaseURL + "/",
+		"inbox":                     cfg.BaseURL + "/ap/inbox",
+		"outbox":                    cfg.BaseURL + "/ap/outbox",
+		"followers":                 apFollowersID(),
+		"manuallyApprovesFollowers": false,
+		"discoverable":              true,
+		"publicKey": map[string]string{
+			"id":           apActorID() + "#main-key",
+			"owner":        apActorID(),
+			"publicKeyPem": string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+		},
+	})
+}
+
+// apOutboxHandler lists the recent activities, newest first.
+func apOutboxHandler(w http.ResponseWriter, r *http.Request) {
+	if !cfg.Federating() {
+		http.NotFound(w, r)
+		return
+	}
+	apMu.Lock()
+	acts, err := loadAPOutbox()
+	apMu.Unlock()
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	slices.Reverse(acts)
+	if acts == nil {
+		acts = []json.RawMessage{}
+	}
+	writeActivityJSON(w, r, apContentType, map[string]any{
+		"@context":     activityStreamsNS,
+		"id":           cfg.BaseURL + "/ap/outbox",
+		"type":         "OrderedCollection",
+		"totalItems":   len(acts),
+		"orderedItems": acts,
+	})
+}
+
+// apFollowersHandler only gives the count; who follows stays private.
+func apFollowersHandler(w http.ResponseWriter, r *http.Request) {
+	if !cfg.Federating() {
+		http.NotFound(w, r)
+		return
+	}
+	apMu.Lock()
+	fs, err := loadFollowers()
+	apMu.Unlock()
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	writeActivityJSON(w, r, apContentType, map[string]any{
+		"@context":   activityStreamsNS,
+		"id":         apFollowersID(),
+		"type":       "OrderedCollection",
+		"totalItems": len(fs),
+	})
+}
+
+// apArticleHandler serves /ap/articles/{slug}, the object behind an
+// article's activities.
+func apArticleHandler(w http.ResponseWriter, r *http.Request) {
+	slug := strings.TrimPrefix(r.URL.Path, "/ap/articles/")
+	if !cfg.Federating() || slug == "" || slug != makeSlug(slug) {
+		http.NotFound(w, r)
+		return
+	}
+	a, err := loadArticle(slug)
+	if errors.Is(err, os.ErrNotExist) && articleGone(slug) {
+		http.Error(w, "gone", http.StatusGone)
+		return
+	}
+	if err != nil || a.Draft {
+		http.NotFound(w, r)
+		return
+	}
+	obj := struct {
+		Context string `json:"@context"`
+		apArticle
+	}{activityStreamsNS, apObject(a)}
+	writeActivityJSON(w, r, apContentType, obj)
+}
+
+// apInboxPost accepts Follow and Undo of a Follow; other activities are
+// acknowledged and dropped. Every POST must carry a valid HTTP Signature by
+// the activity's actor.
+func apInboxPost(w http.ResponseWriter, r *http.Request) {
+	if !cfg.Federating() {
+		http.NotFound(w, r)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, apMaxBody))
+	if err != nil {
+		http.Error(w, "body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	var act struct {
+		ID     string          `json:"id"`
+		Type   string          `json:"type"`
+		Actor  string          `json:"actor"`
+		Object json.RawMessage `json:"object"`
+	}
+	if err := json.Unmarshal(body, &act); err != nil || act.Actor == "" {
+		http.Error(w, "not an activity", http.StatusBadRequest)
+		return
+	}
+	sender, err := verifySignature(r.Context(), r, body)
+	if err == nil && sender.ID != act.Actor {
+		err = errors.New("signer is not the actor")
+	}
+	if err != nil {
+		slog.InfoContext(r.Context(), "inbox signature rejected", "actor", act.Actor, "err", err)
+		http.Error(w, "signature: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	switch act.Type {
+	case "Follow":
+		var target string
+		if json.Unmarshal(act.Object, &target) != nil || target != apActorID() {
+			break
+		}
+		err = addFollower(sender, act.ID, body)
+	case "Undo":
+		var inner struct {
+			ID   string `json:"id"`
+			Type string `json:"type"`
+		}
+		if json.Unmarshal(act.Object, &inner.ID) != nil {
+			_ = json.Unmarshal(act.Object, &inner)
+		}
+		err = removeFollower(sender.ID, inner.ID, inner.Type == "Follow")
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// addFollower records (or refreshes) a follower and queues the Accept.
+func addFollower(actor apRemoteActor, followID string, follow json.RawMessage) error {
+	apMu.Lock()
+	defer apMu.Unlock()
+	fs, err := loadFollowers()
+	if err != nil {
+		return err
+	}
+	f := apFollower{ID: actor.ID, Inbox: actor.Inbox, SharedInbox: actor.Endpoints.SharedInbox, FollowID: followID, Followed: time.Now().UTC()}
+	if i := slices.IndexFunc(fs, func(old apFollower) bool { return old.ID == actor.ID }); i >= 0 {
+		fs[i] = f
+	} else {
+		fs = append(fs, f)
+	}
+	if err := apSave(apFollowersFile, fs); err != nil {
+		return err
+	}
+	accept, err := json.Marshal(apActivity{Context: activityStreamsNS, ID: apActivityID(), Type: "Accept", Actor: apActorID(), Object: follow})
+	if err != nil {
+		return err
+	}
+	if err := apEnqueue([]string{actor.Inbox}, accept); err != nil {
+		return err
+	}
+	slog.Info("new follower", "actor", actor.ID)
+	federation.wake()
+	return nil
+}
+
+// removeFollower drops actor when followID names its Follow, or when the
+// Undo carried the Follow itself (anyFollow).
+func removeFollower(actor, followID string, anyFollow bool) error {
+	apMu.Lock()
+	defer apMu.Unlock()
+	fs, err := loadFollowers()
+	if err != nil {
+		return err
+	}
+	n := len(fs)
+	fs = slices.DeleteFunc(fs, func(f apFollower) bool {
+		return f.ID == actor && (anyFollow || f.FollowID == followID)
+	})
+	if len(fs) == n {
+		return nil
+	}
+	slog.Info("follower left", "actor", actor)
+	return apSave(apFollowersFile, fs)
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// apRemote stands in for another fediverse server with one actor, alice,
+// whose inbox checks our signatures and answers with status.
+type apRemote struct {
+	srv    *httptest.Server
+	key    *rsa.PrivateKey
+	actor  string
+	mu     sync.Mutex
+	status int
+	got    []map[string]any
+	sigErr error
+}
+
+func newAPRemote(t *testing.T) *apRemote {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	rm := &apRemote{key: key, status: http.StatusAccepted}
+	rm.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/users/alice":
+			w.Header().Set("Content-Type", apContentType)
+			_ = json.NewEncoder(w).Encode(map[string]any{
+				"id": rm.actor, "type": "Person", "inbox": rm.actor + "/inbox",
+				"publicKey": map[string]string{"id": rm.actor + "#main-key", "owner": rm.actor, "publicKeyPem": string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))},
+			})
+		case "/users/alice/inbox":
+			body, _ := io.ReadAll(r.Body)
+			_, err := verifySignature(r.Context(), r, body)
+			var act map[string]any
+			_ = json.Unmarshal(body, &act)
+			rm.mu.Lock()
+			defer rm.mu.Unlock()
+			rm.got = append(rm.got, act)
+			if err != nil {
+				rm.sigErr = err
+			}
+			w.WriteHeader(rm.status)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(rm.srv.Close)
+	rm.actor = rm.srv.URL + "/users/alice"
+	return rm
+}
+
+func (rm *apRemote) received(t *testing.T) []map[string]any {
+	t.Helper()
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	if rm.sigErr != nil {
+		t.Fatalf("our signature was rejected: %v", rm.sigErr)
+	}
+	return append([]map[string]any(nil), rm.got...)
+}
+
+// post sends a signed activity to our inbox; tamper alters the request
+// after signing.
+func (rm *apRemote) post(t *testing.T, inbox string, act map[string]any, tamper func(*http.Request)) int {
+	t.Helper()
+	body, _ := json.Marshal(act)
+	req, _ := http.NewRequest(http.MethodPost, inbox, bytes.NewReader(body))
+	req.Header.Set("Content-Type", apContentType)
+	if err := signRequest(req, body, rm.key, rm.actor+"#main-key"); err != nil {
+		t.Fatal(err)
+	}
+	if tamper != nil {
+		tamper(req)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// startFederatedServer serves the blog with base_url pointing at itself.
+func startFederatedServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	resetStorage(t)
+	useLocalWebClient(t)
+	ts := httptest.NewServer(buildMux())
+	t.Cleanup(ts.Close)
+	saved := cfg
+	t.Cleanup(func() { cfg = saved })
+	cfg.BaseURL, cfg.FediverseUser = ts.URL, "blog"
+	return ts
+}
+
+func getJSON(t *testing.T, u string, v any) *http.Response {
+	t.Helper()
+	resp, err := http.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("GET %s: %v", u, err)
+	}
+	return resp
+}
+
+func TestActivityPub_FollowAndReceiveArticles(t *testing.T) {
+	ts := startFederatedServer(t)
+	cookie := login(t, ts.URL, cfg.AdminUser, cfg.AdminPass)
+	remote := newAPRemote(t)
+
+	// discovery: WebFinger, then the actor document
+	var jrd struct {
+		Subject string
+		Links   []struct{ Rel, Type, Href string }
+	}
+	host := strings.TrimPrefix(ts.URL, "http://")
+	resp := getJSON(t, ts.URL+"/.well-known/webfinger?resource="+url.QueryEscape("acct:blog@"+host), &jrd)
+	if resp.Header.Get("Content-Type") != "application/jrd+json" || jrd.Subject != "acct:blog@"+host || jrd.Links[0].Href != ts.URL+"/ap/actor" {
+		t.Fatalf("webfinger: %+v", jrd)
+	}
+	if resp, _ := http.Get(ts.URL + "/.well-known/webfinger?resource=acct:someone@" + host); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unknown account: %d", resp.StatusCode)
+	}
+	var actor apRemoteActor
+	if resp := getJSON(t, ts.URL+"/ap/actor", &actor); resp.Header.Get("Content-Type") != apContentType ||
+		actor.Inbox != ts.URL+"/ap/inbox" || actor.PublicKey.Owner != actor.ID || !strings.Contains(actor.PublicKey.PublicKeyPem, "PUBLIC KEY") {
+		t.Fatalf("actor: %+v", actor)
+	}
+
+	// a public article from before the follow isn't delivered
+	postForm(t, ts.URL, "/admin/new", cookie, url.Values{"title": {"Before"}, "content": {"x"}, "date": {"2024-05-05"}})
+
+	follow := map[string]any{"@context": activityStreamsNS, "id": remote.actor + "#follow-1", "type": "Follow", "actor": remote.actor, "object": actor.ID}
+	if code := remote.post(t, actor.Inbox, follow, nil); code != http.StatusAccepted {
+		t.Fatalf("follow: %d", code)
+	}
+	if fs, _ := loadFollowers(); len(fs) != 1 || fs[0].ID != remote.actor || fs[0].Inbox != remote.actor+"/inbox" {
+		t.Fatalf("followers: %+v", fs)
+	}
+	var followers struct{ TotalItems int }
+	if getJSON(t, ts.URL+"/ap/followers", &followers); followers.TotalItems != 1 {
+		t.Fatalf("followers collection: %+v", followers)
+	}
+
+	// a draft, its publication, an edit and a delete
+	postForm(t, ts.URL, "/admin/new", cookie, url.Values{"title": {"Hello Fediverse"}, "content": {"Hi **all**"}, "date": {"2024-05-06"}, "draft": {"on"}, "tags": {"go, web dev"}})
+	postForm(t, ts.URL, "/admin/edit/hello-fediverse", cookie, url.Values{"title": {"Hello Fediverse"}, "content": {"Hi **all**"}, "date": {"2024-05-06"}, "tags": {"go, web dev"}})
+	postForm(t, ts.URL, "/admin/edit/hello-fediverse", cookie, url.Values{"title": {"Hello Fediverse"}, "content": {"Hi again"}, "date": {"2024-05-06"}})
+	var obj apArticle
+	if getJSON(t, ts.URL+"/ap/articles/hello-fediverse", &obj); obj.Name != "Hello Fediverse" || obj.URL != ts.URL+"/article/hello-fediverse" {
+		t.Fatalf("object: %+v", obj)
+	}
+	postForm(t, ts.URL, "/admin/delete/hello-fediverse", cookie, url.Values{})
+	processFederation(context.Background())
+
+	got := remote.received(t)
+	want := []string{"Accept", "Create", "Update", "Delete"}
+	if len(got) != len(want) {
+		t.Fatalf("remote got %d activities, want %v: %v", len(got), want, got)
+	}
+	for i, typ := range want {
+		if got[i]["type"] != typ || got[i]["actor"] != actor.ID {
+			t.Fatalf("activity %d: %v", i, got[i])
+		}
+	}
+	if accepted := got[0]["object"].(map[string]any); accepted["id"] != follow["id"] {
+		t.Fatalf("accept object: %v", accepted)
+	}
+	created := got[1]["object"].(map[string]any)
+	if created["id"] != ts.URL+"/ap/articles/hello-fediverse" || created["type"] != "Article" || !strings.Contains(created["content"].(string), "<strong>all</strong>") {
+		t.Fatalf("create object: %v", created)
+	}
+	if tags := created["tag"].([]any); len(tags) != 2 || tags[1].(map[string]any)["name"] != "#webdev" {
+		t.Fatalf("tags: %v", created["tag"])
+	}
+	if deleted := got[3]["object"].(map[string]any); deleted["type"] != "Tombstone" || deleted["id"] != created["id"] {
+		t.Fatalf("delete object: %v", deleted)
+	}
+	if resp, _ := http.Get(ts.URL + "/ap/articles/hello-fediverse"); resp.StatusCode != http.StatusGone {
+		t.Fatalf("deleted object: %d", resp.StatusCode)
+	}
+
+	var outbox struct {
+		TotalItems   int
+		OrderedItems []apActivity
+	}
+	getJSON(t, ts.URL+"/ap/outbox", &outbox)
+	if outbox.TotalItems != 4 || outbox.OrderedItems[0].Type != "Delete" || outbox.OrderedItems[3].Type != "Create" {
+		t.Fatalf("outbox: %+v", outbox)
+	}
+	if q, _ := loadAPQueue(); len(q) != 0 {
+		t.Fatalf("queue not drained: %+v", q)
+	}
+
+	// Undo ends the follow, and nothing more is delivered
+	undo := map[string]any{"id": remote.actor + "#undo-1", "type": "Undo", "actor": remote.actor, "object": follow}
+	if code := remote.post(t, actor.Inbox, undo, nil); code != http.StatusAccepted {
+		t.Fatalf("undo: %d", code)
+	}
+	if fs, _ := loadFollowers(); len(fs) != 0 {
+		t.Fatalf("still following: %+v", fs)
+	}
+	postForm(t, ts.URL, "/admin/new", cookie, url.Values{"title": {"After"}, "content": {"x"}, "date": {"2024-05-07"}})
+	processFederation(context.Background())
+	if n := len(remote.received(t)); n != 4 {
+		t.Fatalf("%d activities after unfollowing", n)
+	}
+	if _, body := getBody(t, ts.URL, "/article/after", ""); !strings.Contains(body, `type="application/activity+json" href="`+ts.URL+`/ap/articles/after"`) {
+		t.Fatalf("article page doesn't link its object:\n%s", body)
+	}
+}
+
+func TestActivityPub_InboxRequiresValidSignature(t *testing.T) {
+	ts := startFederatedServer(t)
+	remote := newAPRemote(t)
+	impostor := newAPRemote(t)
+	inbox := ts.URL + "/ap/inbox"
+	follow := map[string]any{"id": remote.actor + "#f", "type": "Follow", "actor": remote.actor, "object": ts.URL + "/ap/actor"}
+
+	cases := map[string]func(*http.Request){
+		"unsigned": func(r *http.Request) { r.Header.Del("Signature") },
+		"body changed after signing": func(r *http.Request) {
+			b, _ := json.Marshal(map[string]any{"id": "x", "type": "Follow", "actor": impostor.actor, "object": ts.URL + "/ap/actor"})
+			r.Body, r.ContentLength = io.NopCloser(bytes.NewReader(b)), int64(len(b))
+		},
+		"digest forged": func(r *http.Request) { r.Header.Set("Digest", bodyDigest([]byte("other"))) },
+		"stale date": func(r *http.Request) {
+			r.Header.Set("Date", time.Now().Add(-24*time.Hour).UTC().Format(http.TimeFormat))
+		},
+		"other key": func(r *http.Request) {
+			r.Header.Set("Signature", strings.Replace(r.Header.Get("Signature"), remote.actor, impostor.actor, 1))
+		},
+	}
+	for name, tamper := range cases {
+		if code := remote.post(t, inbox, follow, tamper); code != http.StatusUnauthorized {
+			t.Fatalf("%s: %d", name, code)
+		}
+	}
+	// a valid signature by someone else than the activity's actor
+	if code := impostor.post(t, inbox, follow, nil); code != http.StatusUnauthorized {
+		t.Fatalf("impostor: %d", code)
+	}
+	if fs, _ := loadFollowers(); len(fs) != 0 {
+		t.Fatalf("followers: %+v", fs)
+	}
+	if code := remote.post(t, inbox, follow, nil); code != http.StatusAccepted {
+		t.Fatalf("valid follow: %d", code)
+	}
+}
+
+func TestActivityPub_DeliveryRetries(t *testing.T) {
+	ts := startFederatedServer(t)
+	cookie := login(t, ts.URL, cfg.AdminUser, cfg.AdminPass)
+	remote := newAPRemote(t)
+	remote.status = http.StatusServiceUnavailable
+	follow := map[string]any{"id": remote.actor + "#f", "type": "Follow", "actor": remote.actor, "object": ts.URL + "/ap/actor"}
+	if code := remote.post(t, ts.URL+"/ap/inbox", follow, nil); code != http.StatusAccepted {
+		t.Fatalf("follow: %d", code)
+	}
+	postForm(t, ts.URL, "/admin/new", cookie, url.Values{"title": {"Retry"}, "content": {"x"}, "date": {"2024-05-06"}})
+
+	processFederation(context.Background())
+	q, _ := loadAPQueue()
+	if len(q) != 2 || q[0].Attempts != 1 || !strings.Contains(q[0].Error, "503") || time.Until(q[0].NextTry) < apRetryBase-time.Second {
+		t.Fatalf("after a failure: %+v", q)
+	}
+	processFederation(context.Background())
+	if n := len(remote.received(t)); n != 2 {
+		t.Fatalf("retried before due: %d requests", n)
+	}
+
+	// a client error is final; a success clears the rest
+	remote.mu.Lock()
+	remote.status = http.StatusGone
+	remote.mu.Unlock()
+	q[0].NextTry = time.Now().Add(-time.Second)
+	if err := apSave(apQueueFile, q); err != nil {
+		t.Fatal(err)
+	}
+	processFederation(context.Background())
+	if q, _ = loadAPQueue(); len(q) != 1 || q[0].Attempts != 1 {
+		t.Fatalf("after a 410: %+v", q)
+	}
+	remote.mu.Lock()
+	remote.status = http.StatusAccepted
+	remote.mu.Unlock()
+	q[0].NextTry = time.Now().Add(-time.Second)
+	if err := apSave(apQueueFile, q); err != nil {
+		t.Fatal(err)
+	}
+	processFederation(context.Background())
+	if q, _ = loadAPQueue(); len(q) != 0 {
+		t.Fatalf("after success: %+v", q)
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --------------------------- Audit log -------------------------
+
+// auditFile is appended to inside the storage dir. The .jsonl suffix keeps it out
+// of allArticles, which only reads *.json.
+const auditFile = "audit.jsonl"
+
+// auditPageLimit caps how many entries /admin/audit renders; the CSV export
+// always contains every match.
+const auditPageLimit = 500
+
+type auditEntry struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	Actor     string    `json:"actor,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Slug      string    `json:"slug,omitempty"`
+	Summary   string    `json:"summary,omitempty"`
+}
+
+// auditActions lists every action written by the handlers, for the filter form.
+var auditActions = []string{
+	"login", "login.failed", "login.throttled", "logout",
+	"article.create", "article.update", "article.delete",
+	"lockout.clear",
+	"article.import", "article.export", "user.add", "user.passwd", "user.delete",
+	"backup.create", "backup.restore", "storage.migrate",
+	"comment.approve", "comment.reject", "comment.spam", "comment.delete",
+	"webhook.add", "webhook.delete", "webhook.redeliver",
+	"newsletter.send", "newsletter.export", "subscriber.delete",
+	"token.create", "token.revoke", "article.undelete", "media.upload",
+}
+
+var auditMu sync.Mutex
+
+// appendAudit adds one entry to the log. The file is only ever opened for
+// appending; entries are never rewritten.
+func appendAudit(e auditEntry) error {
+	if err := ensureStorage(); err != nil {
+		return err
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	f, err := os.OpenFile(filepath.Join(cfg.StorageDir, auditFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// audit records an action performed during r. The actor is the logged-in
+// user, or actor when given (e.g. the username tried at login).
+func audit(r *http.Request, action, actor, slug, summary string) {
+	if actor == "" {
+		actor = sessionUser(r)
+	}
+	e := auditEntry{
+		Time:      time.Now().UTC(),
+		Action:    action,
+		Actor:     actor,
+		IP:        clientIP(r),
+		UserAgent: r.UserAgent(),
+		Slug:      slug,
+		Summary:   summary,
+	}
+	if err := appendAudit(e); err != nil {
+		slog.ErrorContext(r.Context(), "audit write failed", "action", action, "err", err)
+	}
+}
+
+// auditCLI records an action performed from the command line; the actor is
+// the local OS user.
+func auditCLI(action, slug, summary string) {
+	e := auditEntry{
+		Time:      time.Now().UTC(),
+		Action:    action,
+		Actor:     "cli:" + os.Getenv("USER"),
+		UserAgent: "blog-cli",
+		Slug:      slug,
+		Summary:   summary,
+	}
+	if err := appendAudit(e); err != nil {
+		slog.Error("audit write failed", "action", action, "err", err)
+	}
+}
+
+type auditFilter struct {
+	Action string
+	Actor  string
+	Slug   string
+	Query  string    // substring of the summary, IP or user agent
+	Since  time.Time // inclusive
+	Until  time.Time // exclusive
+}
+
+// auditFilterFromRequest reads the filter from the query string; dates are YYYY-MM-DD
+// in the site's timezone and "to" includes the whole day.
+func auditFilterFromRequest(r *http.Request) auditFilter {
+	q := r.URL.Query()
+	f := auditFilter{
+		Action: strings.TrimSpace(q.Get("action")),
+		Actor:  strings.TrimSpace(q.Get("actor")),
+		Slug:   strings.TrimSpace(q.Get("slug")),
+		Query:  strings.TrimSpace(q.Get("q")),
+	}
+	if t, err := time.ParseInLocation("2006-01-02", q.Get("from"), cfg.Location()); err == nil {
+		f.Since = t
+	}
+	if t, err := time.ParseInLocation("2006-01-02", q.Get("to"), cfg.Location()); err == nil {
+		f.Until = t.AddDate(0, 0, 1)
+	}
+	return f
+}
+
+func (f auditFilter) match(e auditEntry) bool {
+	if f.Action != "" && e.Action != f.Action {
+		return false
+	}
+	if f.Actor != "" && !strings.EqualFold(e.Actor, f.Actor) {
+		return false
+	}
+	if f.Slug != "" && e.Slug != f.Slug {
+		return false
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !e.Time.Before(f.Until) {
+		return false
+	}
+	if f.Query != "" {
+		q := strings.ToLower(f.Query)
+		hay := strings.ToLower(e.Summary + " " + e.IP + " " + e.UserAgent)
+		if !strings.Contains(hay, q) {
+			return false
+		}
+	}
+	return true
+}
+
+// readAudit returns matching entries, newest first. A missing log is empty.
+func readAudit(f auditFilter) ([]auditEntry, error) {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	fh, err := os.Open(filepath.Join(cfg.StorageDir, auditFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	var list []auditEntry
+	sc := bufio.NewScanner(fh)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		var e auditEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			continue // a torn final line from a crash shouldn't hide the rest
+		}
+		if f.match(e) {
+			list = append(list, e)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(list)-1; i < j; i, j = i+1, j-1 {
+		list[i], list[j] = list[j], list[i]
+	}
+	return list, nil
+}
+
+// articleChanges summarises which fields differ between two versions.
+func articleChanges(old, updated Article) string {
+	var parts []string
+	if old.Title != updated.Title {
+		parts = append(parts, fmt.Sprintf("title %q → %q", old.Title, updated.Title))
+	}
+	if old.Slug != updated.Slug {
+		parts = append(parts, fmt.Sprintf("slug %s → %s", old.Slug, updated.Slug))
+	}
+	if old.Content != updated.Content {
+		parts = append(parts, fmt.Sprintf("content %d → %d chars", len(old.Content), len(updated.Content)))
+	}
+	if !old.Published.Equal(updated.Published) {
+		parts = append(parts, fmt.Sprintf("published %s → %s", old.Published.Format("2006-01-02"), updated.Published.Format("2006-01-02")))
+	}
+	if !slices.Equal(old.Tags, updated.Tags) {
+		parts = append(parts, fmt.Sprintf("tags [%s] → [%s]", strings.Join(old.Tags, ", "), strings.Join(updated.Tags, ", ")))
+	}
+	if !slices.Equal(old.Aliases, updated.Aliases) {
+		parts = append(parts, fmt.Sprintf("aliases %d → %d", len(old.Aliases), len(updated.Aliases)))
+	}
+	if old.Draft != updated.Draft {
+		parts = append(parts, fmt.Sprintf("draft %t → %t", old.Draft, updated.Draft))
+	}
+	if old.CommentsClosed != updated.CommentsClosed {
+		parts = append(parts, fmt.Sprintf("comments closed %t → %t", old.CommentsClosed, updated.CommentsClosed))
+	}
+	if len(parts) == 0 {
+		return "no changes"
+	}
+	return strings.Join(parts, "; ")
+}
+
+// --------------------------- Handlers (Audit) ------------------
+
+func adminAuditGet(w http.ResponseWriter, r *http.Request) {
+	f := auditFilterFromRequest(r)
+	entries, err := readAudit(f)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	total := len(entries)
+	if total > auditPageLimit {
+		entries = entries[:auditPageLimit]
+	}
+	q := r.URL.Query()
+	data := map[string]any{
+		"Active":  "admin_audit",
+		"Title":   "Audit Log",
+		"Entries": entries,
+		"Total":   total,
+		"Actions": auditActions,
+		"Filter":  map[string]string{"action": q.Get("action"), "actor": q.Get("actor"), "slug": q.Get("slug"), "q": q.Get("q"), "from": q.Get("from"), "to": q.Get("to")},
+		"Query":   r.URL.RawQuery,
+	}
+	render(w, r, data)
+}
+
+func adminAuditCSV(w http.ResponseWriter, r *http.Request) {
+	entries, err := readAudit(auditFilterFromRequest(r))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit.csv"`)
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"time", "action", "actor", "ip", "user_agent", "slug", "summary"})
+	for _, e := range entries {
+		_ = cw.Write([]string{e.Time.Format(time.RFC3339), e.Action, csvCell(e.Actor), e.IP, csvCell(e.UserAgent), csvCell(e.Slug), csvCell(e.Summary)})
+	}
+	cw.Flush()
+}
+
+// csvCell stops spreadsheets from reading a value as a formula: actors and
+// user agents come straight from failed logins.
+func csvCell(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// --------------------------- Templates (Audit) -----------------
+
+const adminAuditHTML = `{{define "admin_audit"}}
+  <div class="card bar">
+    <div><h2 class="m-0">Audit Log</h2></div>
+    <div>
+      <a href="/admin/audit.csv{{if .Query}}?{{.Query}}{{end}}"><button>Export CSV</button></a>
+      <a class="ml-8" href="/admin">Back</a>
+    </div>
+  </div>
+  <div class="card">
+    <form method="get" action="/admin/audit">
+      <div class="row">
+        <div>
+          <label>Action</label>
+          <select name="action">
+            <option value="">Any</option>
+            {{$sel := .Filter.action}}
+            {{range .Actions}}<option value="{{.}}"{{if eq . $sel}} selected{{end}}>{{.}}</option>{{end}}
+          </select>
+        </div>
+        <div>
+          <label>Actor</label>
+          <input name="actor" value="{{.Filter.actor}}" />
+        </div>
+        <div>
+          <label>Slug</label>
+          <input name="slug" value="{{.Filter.slug}}" />
+        </div>
+        <div>
+          <label>Search (summary, IP, user agent)</label>
+          <input name="q" value="{{.Filter.q}}" />
+        </div>
+        <div>
+          <label>From</label>
+          <input name="from" type="date" value="{{.Filter.from}}" />
+        </div>
+        <div>
+          <label>To</label>
+          <input name="to" type="date" value="{{.Filter.to}}" />
+        </div>
+      </div>
+      <div class="mt-12"><button type="submit">Filter</button> <a class="ml-8" href="/admin/audit">Reset</a></div>
+    </form>
+  </div>
+  <div class="card">
+    <div class="muted mb-8">{{.Total}} matching entries{{if gt .Total (len .Entries)}}, showing the newest {{len .Entries}}{{end}}</div>
+    <table>
+      <thead>
+        <tr><th>Time</th><th>Action</th><th>Actor</th><th>IP</th><th>Slug</th><th>Summary</th></tr>
+      </thead>
+      <tbody>
+        {{if not .Entries}}
+          <tr><td colspan="6" class="muted">No entries.</td></tr>
+        {{end}}
+        {{range .Entries}}
+        <tr>
+          <td>{{.Time.Format "2006-01-02 15:04:05"}}</td>
+          <td>{{.Action}}</td>
+          <td>{{.Actor}}</td>
+          <td title="{{.UserAgent}}">{{.IP}}</td>
+          <td>{{if .Slug}}<a href="/article/{{.Slug}}">{{.Slug}}</a>{{end}}</td>
+          <td>{{.Summary}}</td>
+        </tr>
+        {{end}}
+      </tbody>
+    </table>
+  </div>
+{{end}}`
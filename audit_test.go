@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/csv"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// postForm sends an authenticated form POST without following redirects.
+func postForm(t *testing.T, base, path, cookie string, form url.Values) *http.Response {
+	t.Helper()
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse }}
+	req, _ := http.NewRequest(http.MethodPost, base+path, strings.NewReader(form.Encode()))
+	req.Header.Set("Cookie", cookie)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+// getBody fetches path with the given cookie and returns status and body.
+func getBody(t *testing.T, base, path, cookie string) (int, string) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, base+path, nil)
+	if cookie != "" {
+		req.Header.Set("Cookie", cookie)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(b)
+}
+
+func TestAudit_RecordsAdminActions(t *testing.T) {
+	resetStorage(t)
+	ts := httptest.NewServer(buildMux())
+	defer ts.Close()
+
+	postForm(t, ts.URL, "/admin/login", "", url.Values{"username": {cfg.AdminUser}, "password": {"nope"}})
+	cookie := login(t, ts.URL, cfg.AdminUser, cfg.AdminPass)
+
+	postForm(t, ts.URL, "/admin/new", cookie, url.Values{"title": {"Audit Me"}, "content": {"first"}, "date": {"2024-01-02"}})
+	postForm(t, ts.URL, "/admin/edit/audit-me", cookie, url.Values{"title": {"Audit Me"}, "content": {"second draft"}, "date": {"2024-01-03"}})
+	postForm(t, ts.URL, "/admin/delete/audit-me", cookie, nil)
+
+	entries, err := readAudit(auditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Action)
+	}
+	want := []string{"article.delete", "article.update", "article.create", "login", "login.failed"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("actions=%v, want %v", got, want)
+	}
+	upd := entries[1]
+	if upd.Actor != cfg.AdminUser || upd.Slug != "audit-me" || upd.IP == "" || upd.UserAgent == "" {
+		t.Fatalf("update entry missing context: %+v", upd)
+	}
+	if !strings.Contains(upd.Summary, "content 5 → 12 chars") || !strings.Contains(upd.Summary, "published 2024-01-02 → 2024-01-03") {
+		t.Fatalf("update summary=%q", upd.Summary)
+	}
+	if entries[4].Actor != cfg.AdminUser {
+		t.Fatalf("failed login should record the attempted username, got %q", entries[4].Actor)
+	}
+
+	status, body := getBody(t, ts.URL, "/admin/audit?action=article.update", cookie)
+	if status != http.StatusOK {
+		t.Fatalf("audit page status=%d", status)
+	}
+	if !strings.Contains(body, "1 matching entries") || strings.Contains(body, "<td>article.create</td>") {
+		t.Fatalf("audit page should show only the update: %s", body)
+	}
+
+	status, body = getBody(t, ts.URL, "/admin/audit.csv?slug=audit-me", cookie)
+	if status != http.StatusOK {
+		t.Fatalf("csv status=%d", status)
+	}
+	rows, err := csv.NewReader(strings.NewReader(body)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 4 || rows[0][1] != "action" || rows[1][1] != "article.delete" {
+		t.Fatalf("unexpected csv rows: %v", rows)
+	}
+}
+
+func TestAudit_CSVDefusesFormulas(t *testing.T) {
+	resetStorage(t)
+	ts := httptest.NewServer(buildMux())
+	defer ts.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/admin/login", strings.NewReader(url.Values{"username": {`=HYPERLINK("https://evil.example","x")`}, "password": {"nope"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", "@SUM(1+1)")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	cookie := login(t, ts.URL, cfg.AdminUser, cfg.AdminPass)
+	_, body := getBody(t, ts.URL, "/admin/audit.csv?action=login.failed", cookie)
+	rows, err := csv.NewReader(strings.NewReader(body)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[1][2] != `'=HYPERLINK("https://evil.example","x")` || rows[1][4] != "'@SUM(1+1)" {
+		t.Fatalf("unexpected csv rows: %q", rows)
+	}
+}
+
+func TestAudit_DatesUseSiteTimezone(t *testing.T) {
+	saved := cfg
+	defer func() { cfg = saved }()
+	cfg.location = time.FixedZone("UTC-5", -5*3600)
+
+	f := auditFilterFromRequest(httptest.NewRequest(http.MethodGet, "/admin/audit?from=2024-03-01&to=2024-03-01", nil))
+	if want := time.Date(2024, 3, 1, 5, 0, 0, 0, time.UTC); !f.Since.Equal(want) || !f.Until.Equal(want.AddDate(0, 0, 1)) {
+		t.Fatalf("since %v until %v, want the local day from %v", f.Since, f.Until, want)
+	}
+}
+
+func TestAudit_RequiresAuth(t *testing.T) {
+	resetStorage(t)
+	ts := httptest.NewServer(buildMux())
+	defer ts.Close()
+
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse }}
+	for _, p := range []string{"/admin/audit", "/admin/audit.csv"} {
+		resp, err := client.Get(ts.URL + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusFound {
+			t.Fatalf("%s status=%d, want 302", p, resp.StatusCode)
+		}
+	}
+}
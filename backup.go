@@ -0,0 +1,382 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// --------------------------- Backup & restore ------------------
+// A backup is a tar.gz of the whole storage dir (articles, tombstones, the
+// audit log and everything under .blog) plus manifest.json with a checksum
+// per file. It is taken while holding storeMu, so no write is half-done.
+
+const (
+	backupFormat   = 1 // layout of the archive itself
+	backupManifest = "manifest.json"
+	backupDataDir  = "data/"
+)
+
+type backupFile struct {
+	Path   string `json:"path"` // slash-separated, relative to the storage dir
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type BackupManifest struct {
+	Format        int          `json:"format"`
+	SchemaVersion int          `json:"schema_version"`
+	Created       time.Time    `json:"created"`
+	Site          string       `json:"site"`
+	Articles      int          `json:"articles"`
+	Files         []backupFile `json:"files"`
+}
+
+// snapshotFile is one file of the storage dir, read into memory.
+type snapshotFile struct {
+	backupFile
+	mode fs.FileMode
+	body []byte
+}
+
+// isArticlePath reports whether a storage-relative path is an article file
+// (what walkArticles reads).
+func isArticlePath(p string) bool {
+	if !strings.HasSuffix(p, ".json") {
+		return false
+	}
+	for _, seg := range strings.Split(p, "/") {
+		if strings.HasPrefix(seg, ".") {
+			return false
+		}
+	}
+	return true
+}
+
+// readStorage reads every regular file below the storage dir, skipping
+// leftovers of interrupted atomic writes and the page cache stamp.
+func readStorage() ([]snapshotFile, error) {
+	var files []snapshotFile
+	err := filepath.WalkDir(cfg.StorageDir, func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && p == cfg.StorageDir {
+			return fs.SkipAll
+		}
+		if err != nil || d.IsDir() || !d.Type().IsRegular() {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && strings.Contains(d.Name(), ".tmp") || p == pageStampPath() {
+			return nil
+		}
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(cfg.StorageDir, p)
+		files = append(files, snapshotFile{
+			backupFile: backupFile{Path: filepath.ToSlash(rel), Size: int64(len(b)), SHA256: contentHash(b)},
+			mode:       info.Mode().Perm(),
+			body:       b,
+		})
+		return nil
+	})
+	return files, err
+}
+
+// snapshotStorage reads the storage dir with all writers paused.
+func snapshotStorage() ([]snapshotFile, BackupManifest, error) {
+	storeMu.Lock()
+	files, err := readStorage()
+	storeMu.Unlock()
+	m := BackupManifest{Format: backupFormat, SchemaVersion: schemaVersion, Created: time.Now().UTC(), Site: cfg.SiteTitle}
+	for _, f := range files {
+		m.Files = append(m.Files, f.backupFile)
+		if isArticlePath(f.Path) {
+			m.Articles++
+		}
+	}
+	return files, m, err
+}
+
+// writeBackup writes the manifest and then every file as a tar.gz.
+func writeBackup(w io.Writer, files []snapshotFile, m BackupManifest) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	mb, _ := json.MarshalIndent(m, "", "  ")
+	add := func(name string, mode fs.FileMode, b []byte) error {
+		hdr := &tar.Header{Name: name, Mode: int64(mode), Size: int64(len(b)), ModTime: m.Created, Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(b)
+		return err
+	}
+	if err := add(backupManifest, 0o644, mb); err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := add(backupDataDir+f.Path, f.mode, f.body); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// readBackup reads an archive and checks it completely before anything is
+// touched: known format, schema not newer than this binary, safe paths,
+// and every file present with the size and checksum the manifest lists.
+func readBackup(r io.Reader) (BackupManifest, []snapshotFile, error) {
+	var m BackupManifest
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return m, nil, fmt.Errorf("not a backup archive: %v", err)
+	}
+	tr := tar.NewReader(gz)
+	var haveManifest bool
+	got := map[string]snapshotFile{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return m, nil, fmt.Errorf("corrupt archive: %v", err)
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			return m, nil, fmt.Errorf("corrupt archive: %s: %v", hdr.Name, err)
+		}
+		switch name := hdr.Name; {
+		case hdr.Typeflag != tar.TypeReg:
+			return m, nil, fmt.Errorf("unexpected entry %s (type %c)", name, hdr.Typeflag)
+		case name == backupManifest:
+			if err := json.Unmarshal(b, &m); err != nil {
+				return m, nil, fmt.Errorf("%s: %v", backupManifest, err)
+			}
+			haveManifest = true
+		case strings.HasPrefix(name, backupDataDir) && fs.ValidPath(strings.TrimPrefix(name, backupDataDir)):
+			p := strings.TrimPrefix(name, backupDataDir)
+			got[p] = snapshotFile{backupFile: backupFile{Path: p, Size: int64(len(b)), SHA256: contentHash(b)}, mode: fs.FileMode(hdr.Mode).Perm(), body: b}
+		default:
+			return m, nil, fmt.Errorf("unexpected entry %s", name)
+		}
+	}
+	switch {
+	case !haveManifest:
+		return m, nil, errors.New("archive has no " + backupManifest)
+	case m.Format != backupFormat:
+		return m, nil, fmt.Errorf("backup format %d is not supported (want %d)", m.Format, backupFormat)
+	case m.SchemaVersion > schemaVersion:
+		return m, nil, fmt.Errorf("backup has schema version %d, newer than this binary's %d; upgrade first", m.SchemaVersion, schemaVersion)
+	}
+	files := make([]snapshotFile, 0, len(m.Files))
+	for _, want := range m.Files {
+		f, ok := got[want.Path]
+		switch {
+		case !ok:
+			return m, nil, fmt.Errorf("%s is listed in the manifest but missing", want.Path)
+		case f.backupFile != want:
+			return m, nil, fmt.Errorf("%s: checksum mismatch", want.Path)
+		}
+		delete(got, want.Path)
+		files = append(files, f)
+	}
+	for p := range got {
+		return m, nil, fmt.Errorf("%s is not listed in the manifest", p)
+	}
+	return m, files, nil
+}
+
+// RestoreDiff lists how the storage dir would change.
+type RestoreDiff struct {
+	Added, Changed, Removed []string
+}
+
+func diffRestore(files []snapshotFile) (RestoreDiff, error) {
+	var d RestoreDiff
+	current, err := readStorage()
+	if err != nil {
+		return d, err
+	}
+	have := map[string]string{}
+	for _, f := range current {
+		have[f.Path] = f.SHA256
+	}
+	for _, f := range files {
+		sum, ok := have[f.Path]
+		switch {
+		case !ok:
+			d.Added = append(d.Added, f.Path)
+		case sum != f.SHA256:
+			d.Changed = append(d.Changed, f.Path)
+		}
+		delete(have, f.Path)
+	}
+	for p := range have {
+		d.Removed = append(d.Removed, p)
+	}
+	sort.Strings(d.Added)
+	sort.Strings(d.Changed)
+	sort.Strings(d.Removed)
+	return d, nil
+}
+
+// restoreBackup writes files into a staging dir next to the storage dir
+// and swaps it in. The previous data is kept, renamed, and its path
+// returned ("" if there was none).
+func restoreBackup(files []snapshotFile) (string, error) {
+	dir := filepath.Clean(cfg.StorageDir)
+	staging := dir + ".restoring"
+	if err := os.RemoveAll(staging); err != nil {
+		return "", err
+	}
+	for _, f := range files {
+		p := filepath.Join(staging, filepath.FromSlash(f.Path))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			return "", err
+		}
+		if err := os.WriteFile(p, f.body, f.mode); err != nil {
+			return "", err
+		}
+	}
+	if err := os.MkdirAll(staging, 0o755); err != nil { // an empty backup
+		return "", err
+	}
+
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	old := dir + ".pre-restore-" + time.Now().Format("20060102-150405")
+	if err := os.Rename(dir, old); errors.Is(err, fs.ErrNotExist) {
+		old = ""
+	} else if err != nil {
+		return "", err
+	}
+	if err := os.Rename(staging, dir); err != nil {
+		return "", err
+	}
+	pages.reset()
+	return old, nil
+}
+
+// backupName is the default file name for a backup taken now.
+func backupName() string {
+	return "blog-backup-" + time.Now().Format("20060102-150405") + ".tar.gz"
+}
+
+// --------------------------- Commands (backup) -----------------
+
+func runBackup(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	out := fs.String("out", "", "archive to write, - for stdout (default blog-backup-<time>.tar.gz)")
+	configure(fs, args)
+	files, m, err := snapshotStorage()
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		*out = backupName()
+	}
+	if *out == "-" {
+		return writeBackup(stdout, files, m)
+	}
+	var buf bytes.Buffer
+	if err := writeBackup(&buf, files, m); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(*out, buf.Bytes(), 0o600); err != nil {
+		return err
+	}
+	auditCLI("backup.create", "", fmt.Sprintf("%d files, %d articles", len(m.Files), m.Articles))
+	fmt.Fprintf(stdout, "wrote %s: %d files, %d articles\n", *out, len(m.Files), m.Articles)
+	return nil
+}
+
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "only verify the archive and print what would change")
+	configure(fs, args)
+	if fs.NArg() != 1 {
+		return errors.New("restore: want one archive (- for stdin)")
+	}
+	var r io.Reader = stdin
+	if fs.Arg(0) != "-" {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	m, files, err := readBackup(r)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "backup of %q from %s: %d files, %d articles, schema %d (checksums ok)\n", m.Site, m.Created.Format(time.RFC3339), len(files), m.Articles, m.SchemaVersion)
+	d, err := diffRestore(files)
+	if err != nil {
+		return err
+	}
+	for _, l := range []struct {
+		mark  string
+		paths []string
+	}{{"+", d.Added}, {"~", d.Changed}, {"-", d.Removed}} {
+		for _, p := range l.paths {
+			fmt.Fprintf(stdout, "%s %s\n", l.mark, p)
+		}
+	}
+	fmt.Fprintf(stdout, "%d added, %d changed, %d removed\n", len(d.Added), len(d.Changed), len(d.Removed))
+	if *dryRun {
+		fmt.Fprintln(stdout, "dry run: nothing written")
+		return nil
+	}
+	old, err := restoreBackup(files)
+	if err != nil {
+		return err
+	}
+	auditCLI("backup.restore", "", fmt.Sprintf("%d files from backup of %s", len(files), m.Created.Format(time.RFC3339)))
+	if old != "" {
+		fmt.Fprintf(stdout, "restored; previous data moved to %s\n", old)
+	} else {
+		fmt.Fprintln(stdout, "restored")
+	}
+	return nil
+}
+
+// --------------------------- Handlers (Backup) -----------------
+
+// adminBackup downloads a backup of the storage dir.
+func adminBackup(w http.ResponseWriter, r *http.Request) {
+	files, m, err := snapshotStorage()
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+backupName()+`"`)
+	w.Header().Set("Cache-Control", "no-store")
+	if err := writeBackup(w, files, m); err != nil {
+		// the download has started; all that is left is to log it
+		slog.ErrorContext(r.Context(), "backup download failed", "err", err)
+		return
+	}
+	audit(r, "backup.create", "", "", fmt.Sprintf("%d files, %d articles", len(m.Files), m.Articles))
+}
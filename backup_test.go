@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackup_CLIRoundTripWithDryRunDiff(t *testing.T) {
+	resetStorage(t)
+	pub := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	for _, a := range []Article{
+		{Title: "Keep", Slug: "keep", Content: "k", Published: pub},
+		{Title: "Lose", Slug: "lose", Content: "l", Published: pub},
+	} {
+		if err := saveArticle(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := setUser("editor", "correct horse", false); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(t.TempDir(), "b.tar.gz")
+	out, err := runCLI(t, "", "backup", "-out", archive)
+	if err != nil || !strings.Contains(out, "3 files, 2 articles") {
+		t.Fatalf("backup: %v\n%s", err, out)
+	}
+
+	// change things after the backup
+	if err := deleteArticle("lose"); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveArticle(Article{Title: "Keep", Slug: "keep", Content: "edited", Published: pub}); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err = runCLI(t, "", "restore", "-dry-run", archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"checksums ok", "+ lose.json", "~ keep.json", "- lose.gone", "- audit.jsonl", "dry run"} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("dry run missing %q:\n%s", want, out)
+		}
+	}
+	if articleExists("lose") {
+		t.Fatal("dry run restored a file")
+	}
+
+	out, err = runCLI(t, "", "restore", archive)
+	if err != nil {
+		t.Fatalf("restore: %v\n%s", err, out)
+	}
+	if a, err := loadArticle("keep"); err != nil || a.Content != "k" {
+		t.Fatalf("keep after restore: %+v, %v", a, err)
+	}
+	if !articleExists("lose") || articleGone("lose") || !authenticate("editor", "correct horse") {
+		t.Fatal("restore did not bring back the backed-up state")
+	}
+	old := strings.TrimSpace(out[strings.LastIndex(out, " ")+1:])
+	defer os.RemoveAll(old)
+	if _, err := os.Stat(filepath.Join(old, "lose.gone")); err != nil {
+		t.Fatalf("previous data not kept at %q: %v", old, err)
+	}
+	if entries, _ := readAudit(auditFilter{Action: "backup.restore"}); len(entries) != 1 {
+		t.Fatal("restore not audited")
+	}
+}
+
+func TestBackup_RejectsTamperedOrNewerArchives(t *testing.T) {
+	resetStorage(t)
+	if err := saveArticle(Article{Title: "A", Slug: "a", Content: "a", Published: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	files, m, err := snapshotStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := func(files []snapshotFile, m BackupManifest) io.Reader {
+		var buf bytes.Buffer
+		if err := writeBackup(&buf, files, m); err != nil {
+			t.Fatal(err)
+		}
+		return &buf
+	}
+	if _, got, err := readBackup(archive(files, m)); err != nil || len(got) != 1 {
+		t.Fatalf("clean archive: %v", err)
+	}
+
+	tampered := []snapshotFile{files[0]}
+	tampered[0].body = []byte(`{"title":"B"}`)
+	if _, _, err := readBackup(archive(tampered, m)); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("tampered file: %v", err)
+	}
+	newer := m
+	newer.SchemaVersion = schemaVersion + 1
+	if _, _, err := readBackup(archive(files, newer)); err == nil || !strings.Contains(err.Error(), "newer than this binary") {
+		t.Fatalf("newer schema: %v", err)
+	}
+	if _, _, err := readBackup(archive(nil, m)); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Fatalf("missing file: %v", err)
+	}
+	if _, _, err := readBackup(strings.NewReader("not gzip")); err == nil {
+		t.Fatal("garbage accepted")
+	}
+}
+
+func TestBackup_AdminDownload(t *testing.T) {
+	resetStorage(t)
+	if err := saveArticle(Article{Title: "A", Slug: "a", Content: "a", Published: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(buildMux())
+	defer ts.Close()
+	if _, body := getBody(t, ts.URL, "/admin/backup", ""); !strings.Contains(body, "Admin Login") {
+		t.Fatal("backup must require auth")
+	}
+	cookie := login(t, ts.URL, cfg.AdminUser, cfg.AdminPass)
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/admin/backup", nil)
+	req.Header.Set("Cookie", cookie)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "application/gzip" || !strings.Contains(resp.Header.Get("Content-Disposition"), "blog-backup-") {
+		t.Fatalf("headers: %v", resp.Header)
+	}
+	m, files, err := readBackup(resp.Body)
+	if err != nil || m.Articles != 1 || len(files) < 2 { // the article and the login's audit entry
+		t.Fatalf("downloaded backup: %+v, %d files, %v", m, len(files), err)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// --------------------------- Static export ---------------------
+// `blog build` renders every public route through the same handlers and
+// templates the server uses and writes them out as plain files.
+
+// buildManifest records the content hash of every file a build wrote, so
+// the next build only rewrites what changed and removes what disappeared.
+const buildManifest = ".build-manifest.json"
+
+type staticBuildKey struct{}
+
+// isStaticBuild reports whether the request is being rendered for export;
+// templates drop links that only work on a live server.
+func isStaticBuild(ctx context.Context) bool {
+	v, _ := ctx.Value(staticBuildKey{}).(bool)
+	return v
+}
+
+// memResponse captures a handler's response in memory.
+type memResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (m *memResponse) Header() http.Header { return m.header }
+
+func (m *memResponse) WriteHeader(code int) {
+	if m.status == 0 {
+		m.status = code
+	}
+}
+
+func (m *memResponse) Write(b []byte) (int, error) {
+	if m.status == 0 {
+		m.status = http.StatusOK
+	}
+	return m.body.Write(b)
+}
+
+// buildFile is one output file.
+type buildFile struct {
+	name string // slash-separated path below the output directory
+	body []byte
+}
+
+// BuildReport summarises a build.
+type BuildReport struct {
+	Written, Unchanged, Removed []string
+}
+
+// outputName maps a route to its file: pages become dir/index.html so the
+// same URLs work on a static host.
+func outputName(route string) string {
+	if route == "/" {
+		return "index.html"
+	}
+	name := strings.TrimPrefix(route, "/")
+	if path.Ext(name) != "" {
+		return name
+	}
+	return strings.TrimSuffix(name, "/") + "/index.html"
+}
+
+var rootLink = regexp.MustCompile(`(href|src|action)="(/[^"]*)"`)
+
+// rewriteLinks adjusts root-relative links in a page written to name. In
+// relative mode they become relative to the file (and point at index.html
+// so they also work from file://); otherwise the base_url path, if any, is
+// prefixed so the site can live below a subdirectory.
+func rewriteLinks(body []byte, name string, relative bool) []byte {
+	prefix := ""
+	if relative {
+		prefix = strings.Repeat("../", strings.Count(name, "/"))
+	} else if u, err := url.Parse(cfg.BaseURL); err == nil {
+		prefix = strings.TrimSuffix(u.Path, "/")
+	}
+	if prefix == "" && !relative {
+		return body
+	}
+	return rootLink.ReplaceAllFunc(body, func(m []byte) []byte {
+		sub := rootLink.FindSubmatch(m)
+		link := string(sub[2])
+		if strings.HasPrefix(link, "//") {
+			return m // protocol-relative, not ours
+		}
+		if !relative {
+			return []byte(fmt.Sprintf(`%s="%s%s"`, sub[1], prefix, link))
+		}
+		target := outputName(link)
+		if prefix == "" {
+			prefix = "./"
+		}
+		return []byte(fmt.Sprintf(`%s="%s%s"`, sub[1], prefix, target))
+	})
+}
+
+// sitemap lists every page with absolute URLs; it needs base_url.
+func sitemap(routes []string, modified map[string]time.Time) []byte {
+	type entry struct {
+		Loc     string `xml:"loc"`
+		LastMod string `xml:"lastmod,omitempty"`
+	}
+	set := struct {
+		XMLName xml.Name `xml:"urlset"`
+		NS      string   `xml:"xmlns,attr"`
+		URLs    []entry  `xml:"url"`
+	}{NS: "http://www.sitemaps.org/schemas/sitemap/0.9"}
+	for _, r := range routes {
+		e := entry{Loc: cfg.BaseURL + r}
+		if t, ok := modified[r]; ok && !t.IsZero() {
+			e.LastMod = t.UTC().Format(time.RFC3339)
+		}
+		set.URLs = append(set.URLs, e)
+	}
+	b, _ := xml.MarshalIndent(set, "", "  ")
+	return append([]byte(xml.Header), append(b, '\n')...)
+}
+
+// renderSite renders every public route in memory.
+func renderSite(relative bool) ([]buildFile, error) {
+	arts, err := publicArticles()
+	if err != nil {
+		return nil, err
+	}
+	pagesN := max((len(arts)+cfg.PageSize-1)/cfg.PageSize, 1)
+	var paths []string
+	modified := map[string]time.Time{}
+	for n := 1; n <= pagesN; n++ {
+		paths = append(paths, pageURL(n))
+	}
+	for _, a := range arts {
+		r := "/article/" + a.Slug
+		paths = append(paths, r)
+		modified[r] = a.Modified()
+	}
+
+	h := routes()
+	ctx := context.WithValue(context.Background(), staticBuildKey{}, true)
+	get := func(route string) (*memResponse, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, route, nil)
+		if err != nil {
+			return nil, err
+		}
+		res := &memResponse{header: http.Header{}}
+		h.ServeHTTP(res, req)
+		return res, nil
+	}
+
+	var files []buildFile
+	for _, route := range append(paths, "/static/style.css") {
+		res, err := get(route)
+		if err != nil {
+			return nil, err
+		}
+		if res.status != http.StatusOK {
+			return nil, fmt.Errorf("render %s: status %d", route, res.status)
+		}
+		name := outputName(route)
+		body := res.body.Bytes()
+		if strings.HasSuffix(name, ".html") {
+			body = rewriteLinks(body, name, relative)
+		}
+		files = append(files, buildFile{name: name, body: body})
+	}
+	// uploads from Micropub are linked from articles as /media/<name>
+	media, err := os.ReadDir(filepath.Join(cfg.StorageDir, mediaDir))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	for _, e := range media {
+		if !mediaNameRe.MatchString(e.Name()) {
+			continue
+		}
+		body, err := os.ReadFile(filepath.Join(cfg.StorageDir, mediaDir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, buildFile{name: mediaDir + "/" + e.Name(), body: body})
+	}
+	// static hosts commonly serve 404.html for unknown paths
+	if res, err := get("/404"); err == nil && res.status == http.StatusNotFound {
+		files = append(files, buildFile{name: "404.html", body: rewriteLinks(res.body.Bytes(), "404.html", relative)})
+	}
+	if cfg.BaseURL != "" {
+		files = append(files, buildFile{name: "sitemap.xml", body: sitemap(paths, modified)})
+	}
+	return files, nil
+}
+
+func contentHash(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// buildSite renders the site into out. Files whose hash matches the last
+// build's manifest are left alone; files the last build wrote but this one
+// did not are removed. Anything else in out is never touched.
+func buildSite(out string, relative bool) (BuildReport, error) {
+	var rep BuildReport
+	files, err := renderSite(relative)
+	if err != nil {
+		return rep, err
+	}
+	if err := os.MkdirAll(out, 0o755); err != nil {
+		return rep, err
+	}
+	old := map[string]string{}
+	if b, err := os.ReadFile(filepath.Join(out, buildManifest)); err == nil {
+		if err := json.Unmarshal(b, &old); err != nil {
+			return rep, fmt.Errorf("%s: %v", buildManifest, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return rep, err
+	}
+
+	manifest := map[string]string{}
+	for _, f := range files {
+		sum := contentHash(f.body)
+		manifest[f.name] = sum
+		p := filepath.Join(out, filepath.FromSlash(f.name))
+		if old[f.name] == sum {
+			if _, err := os.Stat(p); err == nil {
+				rep.Unchanged = append(rep.Unchanged, f.name)
+				continue
+			}
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			return rep, err
+		}
+		if err := os.WriteFile(p, f.body, 0o644); err != nil {
+			return rep, err
+		}
+		rep.Written = append(rep.Written, f.name)
+	}
+	for name := range old {
+		if _, ok := manifest[name]; ok {
+			continue
+		}
+		p := filepath.Join(out, filepath.FromSlash(name))
+		if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return rep, err
+		}
+		// drop directories the removal emptied, e.g. article/<slug>/
+		for dir := filepath.Dir(p); dir != filepath.Clean(out); dir = filepath.Dir(dir) {
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+		rep.Removed = append(rep.Removed, name)
+	}
+	sort.Strings(rep.Removed)
+
+	b, _ := json.MarshalIndent(manifest, "", "  ")
+	if err := os.WriteFile(filepath.Join(out, buildManifest), b, 0o644); err != nil {
+		return rep, err
+	}
+	return rep, nil
+}
+
+// runBuild implements `blog build`.
+func runBuild(args []string) error {
+	fs := flag.NewFlagSet("build", flag.ExitOnError)
+	out := fs.String("out", "public", "output directory")
+	relative := fs.Bool("relative", false, "write relative links, for hosting below an unknown path or browsing from disk")
+	configure(fs, args)
+	rep, err := buildSite(*out, *relative)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "built %s: %d written, %d unchanged, %d removed\n", *out, len(rep.Written), len(rep.Unchanged), len(rep.Removed))
+	return nil
+}
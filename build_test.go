@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readOut(t *testing.T, out, name string) string {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join(out, filepath.FromSlash(name)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestBuildSite_RendersRoutesIncrementally(t *testing.T) {
+	resetStorage(t)
+	saved := cfg
+	defer func() { cfg = saved }()
+	cfg.PageSize = 1
+	cfg.BaseURL = "https://example.com/blog"
+
+	pub := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	for _, a := range []Article{
+		{Title: "First", Slug: "first", Content: "one", Published: pub},
+		{Title: "Second", Slug: "second", Content: "two", Published: pub.AddDate(0, 0, 1)},
+	} {
+		if err := saveArticle(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out := filepath.Join(t.TempDir(), "public")
+	if err := os.MkdirAll(out, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(out, "CNAME"), []byte("example.com"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	rep, err := buildSite(out, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"index.html", "page/2/index.html", "article/second/index.html", "article/first/index.html", "static/style.css", "404.html", "sitemap.xml"}
+	if !slices.Equal(rep.Written, want) {
+		t.Fatalf("written %v, want %v", rep.Written, want)
+	}
+	home := readOut(t, out, "index.html")
+	if !strings.Contains(home, `href="/blog/article/second"`) || !strings.Contains(home, `href="/blog/static/style.css"`) || !strings.Contains(home, `href="/blog/page/2"`) {
+		t.Fatalf("links not prefixed with the base_url path:\n%s", home)
+	}
+	if strings.Contains(home, `/admin`) {
+		t.Fatalf("static pages should not link to the admin:\n%s", home)
+	}
+	if sm := readOut(t, out, "sitemap.xml"); !strings.Contains(sm, "<loc>https://example.com/blog/article/first</loc>") {
+		t.Fatalf("sitemap: %s", sm)
+	}
+
+	// only the edited article and the listing that shows it change
+	if err := saveArticle(Article{Title: "Second", Slug: "second", Content: "two, edited", Published: pub.AddDate(0, 0, 1)}); err != nil {
+		t.Fatal(err)
+	}
+	if rep, err = buildSite(out, false); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(rep.Written, []string{"article/second/index.html"}) || len(rep.Unchanged) != len(want)-1 {
+		t.Fatalf("incremental build wrote %v", rep.Written)
+	}
+
+	// deleted articles disappear from the output; foreign files stay
+	if err := deleteArticle("first"); err != nil {
+		t.Fatal(err)
+	}
+	if rep, err = buildSite(out, false); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(rep.Removed, []string{"article/first/index.html", "page/2/index.html"}) {
+		t.Fatalf("removed %v", rep.Removed)
+	}
+	if _, err := os.Stat(filepath.Join(out, "article", "first")); !os.IsNotExist(err) {
+		t.Fatalf("empty article dir left behind: %v", err)
+	}
+	if readOut(t, out, "CNAME") != "example.com" {
+		t.Fatal("files not written by the build must be left alone")
+	}
+}
+
+func TestBuildSite_RelativeLinks(t *testing.T) {
+	resetStorage(t)
+	if err := saveArticle(Article{Title: "Only", Slug: "only", Content: "x", Published: time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)}); err != nil {
+		t.Fatal(err)
+	}
+	out := t.TempDir()
+	if _, err := buildSite(out, true); err != nil {
+		t.Fatal(err)
+	}
+	home := readOut(t, out, "index.html")
+	if !strings.Contains(home, `href="./article/only/index.html"`) || !strings.Contains(home, `href="./static/style.css"`) {
+		t.Fatalf("home links not relative:\n%s", home)
+	}
+	art := readOut(t, out, "article/only/index.html")
+	if !strings.Contains(art, `href="../../index.html"`) || !strings.Contains(art, `href="../../static/style.css"`) {
+		t.Fatalf("article links not relative:\n%s", art)
+	}
+}
@@ -0,0 +1,675 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// --------------------------- CLI -------------------------------
+// Subcommands of the blog binary. Every command that changes content goes
+// through the same store functions as the admin UI and is audited.
+
+// stdin and stdout are swapped in tests.
+var (
+	stdin  io.Reader = os.Stdin
+	stdout io.Writer = os.Stdout
+)
+
+type command struct {
+	name  string
+	args  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands = []command{
+	{"serve", "", "run the web server (default)", runServe},
+	{"new", "[-title t] [-date d] [-slug s] [-draft] [file]", "create an article; content from file or stdin", runNew},
+	{"edit", "<slug>", "edit an article as JSON in $EDITOR", runEdit},
+	{"list", "[-json] [-status s]", "list articles", runList},
+	{"publish", "[-now] <slug>", "publish a draft", runPublish},
+	{"unpublish", "<slug>", "turn an article back into a draft", runUnpublish},
+	{"delete", "<slug>", "delete an article (its URL answers 410)", runDelete},
+	{"import", "[-overwrite] [-dry-run] <file|dir|zip|xml>", "import a JSON export, Markdown files or a WordPress export", runImport},
+	{"export", "[-format json|markdown|epub] [-tag t] [-from date] [-to date] [-out path]", "export articles as JSON, Markdown files or an EPUB", runExport},
+	{"reindex", "", "rewrite article files so names and format match their slugs", runReindex},
+	{"check", "", "validate every file in the storage dir", runCheck},
+	{"user", "add|passwd|del|list [name]", "manage admin accounts", runUser},
+	{"token", "add|list|revoke [-name n] [-scope s] [id]", "manage API tokens for Micropub clients", runToken},
+	{"backup", "[-out file]", "write a tar.gz snapshot of the storage dir", runBackup},
+	{"migrate", "[-dry-run] [-backup file]", "back up, then upgrade article files to the current schema", runMigrate},
+	{"restore", "[-dry-run] <file>", "verify a backup and replace the storage dir with it (stop the server first)", runRestore},
+	{"build", "[-out dir] [-relative]", "export the public site as static files", runBuild},
+}
+
+func findCommand(name string) (command, bool) {
+	for _, c := range commands {
+		if c.name == name {
+			return c, true
+		}
+	}
+	return command{}, false
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "usage: blog <command> [config flags] [args]")
+	fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 2, 4, 2, ' ', 0)
+	for _, c := range commands {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", c.name, c.args, c.usage)
+	}
+	tw.Flush()
+	fmt.Fprintln(w, "\nEvery command accepts the config flags; run `blog <command> -h` to list them.")
+}
+
+// oneSlug returns the single positional argument of fs.
+func oneSlug(fs *flag.FlagSet) (string, error) {
+	if fs.NArg() != 1 {
+		return "", fmt.Errorf("%s: want exactly one slug, got %d arguments", fs.Name(), fs.NArg())
+	}
+	return fs.Arg(0), nil
+}
+
+// validateArticle applies the rules the admin form enforces.
+func validateArticle(a Article) error {
+	switch {
+	case strings.TrimSpace(a.Title) == "":
+		return errors.New("title is required")
+	case strings.TrimSpace(a.Content) == "":
+		return errors.New("content is required")
+	case a.Slug == "" || a.Slug != makeSlug(a.Slug):
+		return fmt.Errorf("invalid slug %q", a.Slug)
+	case a.Published.IsZero():
+		return errors.New("publication date is required")
+	}
+	return nil
+}
+
+func articleExists(slug string) bool {
+	_, err := loadArticle(slug)
+	return err == nil
+}
+
+// --------------------------- Commands (content) ----------------
+
+func runNew(args []string) error {
+	fs := flag.NewFlagSet("new", flag.ExitOnError)
+	title := fs.String("title", "", "article title (required)")
+	date := fs.String("date", "", "publication date, YYYY-MM-DD (default today)")
+	slug := fs.String("slug", "", "slug (default derived from the title)")
+	draft := fs.Bool("draft", false, "save as a draft")
+	force := fs.Bool("force", false, "overwrite an existing article with the same slug")
+	configure(fs, args)
+
+	var r io.Reader = stdin
+	if fs.NArg() > 0 && fs.Arg(0) != "-" {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	pub := time.Now().In(cfg.Location())
+	pub = time.Date(pub.Year(), pub.Month(), pub.Day(), 0, 0, 0, 0, cfg.Location())
+	if *date != "" {
+		if pub, err = time.ParseInLocation("2006-01-02", *date, cfg.Location()); err != nil {
+			return fmt.Errorf("invalid -date (use YYYY-MM-DD): %v", err)
+		}
+	}
+	a := Article{Title: strings.TrimSpace(*title), Slug: *slug, Content: strings.TrimSpace(string(content)), Published: pub, UpdatedAt: time.Now().UTC(), Draft: *draft}
+	if a.Slug == "" {
+		a.Slug = makeSlug(a.Title)
+	}
+	if err := validateArticle(a); err != nil {
+		return err
+	}
+	if articleExists(a.Slug) && !*force {
+		return fmt.Errorf("article %q already exists (use -force to overwrite)", a.Slug)
+	}
+	if err := saveArticle(a); err != nil {
+		return err
+	}
+	auditCLI("article.create", a.Slug, fmt.Sprintf("title %q; content %d chars; published %s", a.Title, len(a.Content), a.Published.Format("2006-01-02")))
+	articleWritten(Article{}, a)
+	fmt.Fprintln(stdout, a.Slug)
+	return nil
+}
+
+func runEdit(args []string) error {
+	fs := flag.NewFlagSet("edit", flag.ExitOnError)
+	configure(fs, args)
+	slug, err := oneSlug(fs)
+	if err != nil {
+		return err
+	}
+	orig, err := loadArticle(slug)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp("", "blog-"+slug+"-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	b, _ := json.MarshalIndent(orig, "", "  ")
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	editor := strings.Fields(os.Getenv("EDITOR"))
+	if len(editor) == 0 {
+		editor = []string{"vi"}
+	}
+	cmd := exec.Command(editor[0], append(editor[1:], f.Name())...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("editor: %v", err)
+	}
+	edited, err := os.ReadFile(f.Name())
+	if err != nil {
+		return err
+	}
+	var updated Article
+	dec := json.NewDecoder(bytes.NewReader(edited))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&updated); err != nil {
+		return fmt.Errorf("edited file: %v", err)
+	}
+	if articleChanges(orig, updated) == "no changes" {
+		fmt.Fprintln(stdout, "no changes")
+		return nil
+	}
+	if err := validateArticle(updated); err != nil {
+		return err
+	}
+	if updated.Slug != orig.Slug && articleExists(updated.Slug) {
+		return fmt.Errorf("article %q already exists", updated.Slug)
+	}
+	updated.UpdatedAt = time.Now().UTC()
+	if err := updateArticle(orig, updated); err != nil {
+		return err
+	}
+	auditCLI("article.update", updated.Slug, articleChanges(orig, updated))
+	articleWritten(orig, updated)
+	fmt.Fprintln(stdout, updated.Slug)
+	return nil
+}
+
+// articleStatus is draft, scheduled or published.
+func articleStatus(a Article) string {
+	switch {
+	case a.Draft:
+		return "draft"
+	case a.Published.After(time.Now()):
+		return "scheduled"
+	}
+	return "published"
+}
+
+func runList(args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print JSON instead of a table")
+	status := fs.String("status", "", "only articles with this status: published, scheduled or draft")
+	configure(fs, args)
+	arts, err := allArticles()
+	if err != nil {
+		return err
+	}
+	shown := []Article{}
+	for _, a := range arts {
+		if *status == "" || articleStatus(a) == *status {
+			shown = append(shown, a)
+		}
+	}
+	if *asJSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(shown)
+	}
+	tw := tabwriter.NewWriter(stdout, 2, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SLUG\tTITLE\tPUBLISHED\tSTATUS")
+	for _, a := range shown {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", a.Slug, a.Title, a.Published.In(cfg.Location()).Format("2006-01-02"), articleStatus(a))
+	}
+	return tw.Flush()
+}
+
+// setDraft publishes or unpublishes slug, optionally moving the date.
+func setDraft(slug string, draft bool, pub time.Time) error {
+	orig, err := loadArticle(slug)
+	if err != nil {
+		return err
+	}
+	updated := orig
+	updated.Draft = draft
+	if !pub.IsZero() {
+		updated.Published = pub
+	}
+	if articleChanges(orig, updated) == "no changes" {
+		fmt.Fprintf(stdout, "%s is already %s\n", slug, articleStatus(orig))
+		return nil
+	}
+	updated.UpdatedAt = time.Now().UTC()
+	if err := saveArticle(updated); err != nil {
+		return err
+	}
+	auditCLI("article.update", slug, articleChanges(orig, updated))
+	articleWritten(orig, updated)
+	fmt.Fprintf(stdout, "%s is now %s\n", slug, articleStatus(updated))
+	return nil
+}
+
+func runPublish(args []string) error {
+	fs := flag.NewFlagSet("publish", flag.ExitOnError)
+	now := fs.Bool("now", false, "also set the publication date to today")
+	configure(fs, args)
+	slug, err := oneSlug(fs)
+	if err != nil {
+		return err
+	}
+	var pub time.Time
+	if *now {
+		t := time.Now().In(cfg.Location())
+		pub = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, cfg.Location())
+	}
+	return setDraft(slug, false, pub)
+}
+
+func runUnpublish(args []string) error {
+	fs := flag.NewFlagSet("unpublish", flag.ExitOnError)
+	configure(fs, args)
+	slug, err := oneSlug(fs)
+	if err != nil {
+		return err
+	}
+	return setDraft(slug, true, time.Time{})
+}
+
+func runDelete(args []string) error {
+	fs := flag.NewFlagSet("delete", flag.ExitOnError)
+	configure(fs, args)
+	slug, err := oneSlug(fs)
+	if err != nil {
+		return err
+	}
+	a, err := loadArticle(slug)
+	if err != nil {
+		return err
+	}
+	if err := deleteArticle(slug); err != nil {
+		return err
+	}
+	auditCLI("article.delete", slug, fmt.Sprintf("title %q", a.Title))
+	articleWritten(a, Article{})
+	return nil
+}
+
+// --------------------------- Commands (import/export) ----------
+
+// runExport writes articles as one JSON document, as Markdown files with
+// front matter (a directory, or a .zip when -out ends in .zip), or as an
+// EPUB of the published ones.
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", "json", "json, markdown or epub")
+	out := fs.String("out", "", "output file or directory (default: stdout for json, ./export for markdown, blog.epub)")
+	tag := fs.String("tag", "", "only articles with this tag")
+	from := fs.String("from", "", "only articles published on or after this date (YYYY-MM-DD)")
+	to := fs.String("to", "", "only articles published on or before this date (YYYY-MM-DD)")
+	title := fs.String("title", "", "EPUB book title (default: the site title)")
+	images := fs.String("images", "", "directory local image paths are resolved against for the EPUB (default: the storage dir)")
+	configure(fs, args)
+	f, err := parseExportFilter(*tag, *from, *to)
+	if err != nil {
+		return err
+	}
+
+	switch *format {
+	case "json":
+		arts, err := allArticles()
+		if err != nil {
+			return err
+		}
+		sel := []Article{}
+		for _, a := range arts {
+			if f.match(a) {
+				sel = append(sel, a)
+			}
+		}
+		b, err := json.MarshalIndent(sel, "", "  ")
+		if err != nil {
+			return err
+		}
+		b = append(b, '\n')
+		if *out == "" || *out == "-" {
+			_, err = stdout.Write(b)
+			return err
+		}
+		return os.WriteFile(*out, b, 0o644)
+
+	case "markdown":
+		arts, err := selectArticles(f, true)
+		if err != nil {
+			return err
+		}
+		if *out == "" {
+			*out = "export"
+		}
+		if strings.HasSuffix(strings.ToLower(*out), ".zip") {
+			var buf bytes.Buffer
+			if err := writeMarkdownZip(&buf, arts); err != nil {
+				return err
+			}
+			err = writeFileAtomic(*out, buf.Bytes(), 0o644)
+		} else {
+			err = writeMarkdownDir(*out, arts)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "exported %d articles to %s\n", len(arts), *out)
+		return nil
+
+	case "epub":
+		arts, err := selectArticles(f, false)
+		if err != nil {
+			return err
+		}
+		if len(arts) == 0 {
+			return errors.New("export: no published articles match")
+		}
+		if *out == "" {
+			*out = "blog.epub"
+		}
+		if *title == "" {
+			*title = cfg.SiteTitle
+		}
+		if *images == "" {
+			*images = cfg.StorageDir
+		}
+		var buf bytes.Buffer
+		if err := writeEPUB(&buf, *title, arts, *images); err != nil {
+			return err
+		}
+		if err := writeFileAtomic(*out, buf.Bytes(), 0o644); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "exported %d articles to %s\n", len(arts), *out)
+		return nil
+	}
+	return fmt.Errorf("export: unknown format %q (want json, markdown or epub)", *format)
+}
+
+// runImport reads a JSON export, a WordPress WXR file (.xml), or Markdown
+// files with front matter from a directory or .zip.
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	overwrite := fs.Bool("overwrite", false, "replace existing articles with the same slug")
+	dryRun := fs.Bool("dry-run", false, "only print what would change")
+	configure(fs, args)
+	if fs.NArg() != 1 {
+		return errors.New("import: want one JSON file (- for stdin), directory or .zip")
+	}
+	entries, err := readImport(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	steps := planImport(entries, *overwrite)
+	for _, s := range steps {
+		switch {
+		case s.Err != nil:
+			fmt.Fprintf(stdout, "%-8s %s: %v\n", s.Action, s.Source, s.Err)
+		case s.Note != "":
+			fmt.Fprintf(stdout, "%-8s %s (%s)\n", s.Action, s.Article.Slug, s.Note)
+		default:
+			fmt.Fprintf(stdout, "%-8s %s\n", s.Action, s.Article.Slug)
+		}
+	}
+	if *dryRun {
+		fmt.Fprintln(stdout, "dry run: nothing written")
+		return nil
+	}
+	err = applyImport(steps, func(s importStep) {
+		auditCLI("article.import", s.Article.Slug, fmt.Sprintf("%s from %s: title %q", s.Action, s.Source, s.Article.Title))
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, importSummary(steps))
+	for _, s := range steps {
+		if s.Action == "error" {
+			return errors.New("some files could not be imported")
+		}
+	}
+	return nil
+}
+
+// readImport picks the importer by the kind of source.
+func readImport(src string) ([]importEntry, error) {
+	if src == "-" {
+		return jsonEntries(stdin, "stdin")
+	}
+	if fi, err := os.Stat(src); err == nil && fi.IsDir() {
+		return markdownEntries(os.DirFS(src))
+	}
+	if strings.EqualFold(filepath.Ext(src), ".xml") {
+		f, err := os.Open(src)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return wxrEntries(f, filepath.Base(src))
+	}
+	if strings.EqualFold(filepath.Ext(src), ".zip") {
+		zr, err := zip.OpenReader(src)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return markdownEntries(zr)
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return jsonEntries(f, filepath.Base(src))
+}
+
+// --------------------------- Commands (maintenance) ------------
+
+func runReindex(args []string) error {
+	fs := flag.NewFlagSet("reindex", flag.ExitOnError)
+	configure(fs, args)
+	type file struct {
+		path string
+		a    Article
+	}
+	var files []file
+	err := walkArticles(func(path string, b []byte) error {
+		a, err := decodeArticle(b)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		files = append(files, file{path, a})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	var rewritten int
+	for _, f := range files {
+		if f.a.Slug == "" {
+			return fmt.Errorf("%s: missing slug", f.path)
+		}
+		want := filepath.Join(cfg.StorageDir, f.a.Slug+".json")
+		canonical, _ := encodeArticle(f.a)
+		if cur, _ := os.ReadFile(f.path); f.path == want && bytes.Equal(cur, canonical) {
+			continue
+		}
+		if err := saveArticle(f.a); err != nil {
+			return err
+		}
+		if f.path != want {
+			if err := os.Remove(f.path); err != nil {
+				return err
+			}
+			fmt.Fprintf(stdout, "moved     %s -> %s\n", f.path, want)
+		} else {
+			fmt.Fprintf(stdout, "rewrote   %s\n", f.path)
+		}
+		rewritten++
+	}
+	fmt.Fprintf(stdout, "%d files, %d rewritten\n", len(files), rewritten)
+	return nil
+}
+
+func runCheck(args []string) error {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	configure(fs, args)
+	var problems []string
+	report := func(path, format string, a ...any) {
+		problems = append(problems, path+": "+fmt.Sprintf(format, a...))
+	}
+	seen := map[string]string{}
+	var n, outdated int
+	err := walkArticles(func(path string, b []byte) error {
+		n++
+		b, from, err := upgradeArticle(b)
+		if err != nil {
+			report(path, "%v", err)
+			return nil
+		}
+		if from < schemaVersion {
+			outdated++
+		}
+		var s storedArticle
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&s); err != nil {
+			report(path, "%v", err)
+			return nil
+		}
+		a := s.Article
+		if err := validateArticle(a); err != nil {
+			report(path, "%v", err)
+		}
+		if a.Slug != "" && filepath.Base(path) != a.Slug+".json" {
+			report(path, "file name does not match slug %q", a.Slug)
+		}
+		if other, dup := seen[a.Slug]; dup {
+			report(path, "slug %q also used by %s", a.Slug, other)
+		}
+		seen[a.Slug] = path
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := loadUsers(); err != nil {
+		report(usersPath(), "%v", err)
+	}
+	gone, _ := filepath.Glob(filepath.Join(cfg.StorageDir, "*.gone"))
+	for _, g := range gone {
+		if _, err := os.Stat(strings.TrimSuffix(g, ".gone") + ".json"); err == nil {
+			report(g, "tombstone for an article that exists")
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	sort.Strings(problems)
+	for _, p := range problems {
+		fmt.Fprintln(stdout, p)
+	}
+	if outdated > 0 {
+		fmt.Fprintf(stdout, "%d files use an older schema (run `blog migrate`)\n", outdated)
+	}
+	fmt.Fprintf(stdout, "%d article files checked, %d problems\n", n, len(problems))
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problems found", len(problems))
+	}
+	return nil
+}
+
+// readPassword reads one line from stdin, prompting when it is a terminal.
+func readPassword() (string, error) {
+	if f, ok := stdin.(*os.File); ok {
+		if fi, err := f.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+			fmt.Fprint(os.Stderr, "Password (input is echoed): ")
+		}
+	}
+	line, err := bufio.NewReader(stdin).ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+		return "", fmt.Errorf("reading password: %v", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func runUser(args []string) error {
+	fs := flag.NewFlagSet("user", flag.ExitOnError)
+	configure(fs, args)
+	if fs.NArg() == 0 {
+		return errors.New("user: want add, passwd, del or list")
+	}
+	sub, rest := fs.Arg(0), fs.Args()[1:]
+	if sub == "list" {
+		users, err := listUsers()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(stdout, 2, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "USERNAME\tCREATED")
+		fmt.Fprintf(tw, "%s\t(config)\n", cfg.AdminUser)
+		for _, u := range users {
+			if u.Username != cfg.AdminUser {
+				fmt.Fprintf(tw, "%s\t%s\n", u.Username, u.Created.In(cfg.Location()).Format("2006-01-02 15:04"))
+			}
+		}
+		return tw.Flush()
+	}
+	if len(rest) != 1 {
+		return fmt.Errorf("user %s: want exactly one username", sub)
+	}
+	name := rest[0]
+	switch sub {
+	case "add", "passwd":
+		pass, err := readPassword()
+		if err != nil {
+			return err
+		}
+		if err := setUser(name, pass, sub == "passwd"); err != nil {
+			return err
+		}
+		auditCLI("user."+sub, "", name)
+	case "del":
+		if err := deleteUser(name); err != nil {
+			return err
+		}
+		auditCLI("user.delete", "", name)
+	default:
+		return fmt.Errorf("user: unknown subcommand %q", sub)
+	}
+	return nil
+}
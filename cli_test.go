@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runCLI runs a subcommand with the given stdin and returns its output.
+// configure replaces cfg and the logger, so both are restored afterwards.
+func runCLI(t *testing.T, input string, name string, args ...string) (string, error) {
+	t.Helper()
+	savedCfg, savedLog, savedLevel := cfg, slog.Default(), logLevel.Level()
+	savedIn, savedOut := stdin, stdout
+	logOut, logFlags := log.Writer(), log.Flags() // slog.SetDefault redirects package log
+	defer func() {
+		cfg, stdin, stdout = savedCfg, savedIn, savedOut
+		slog.SetDefault(savedLog)
+		logLevel.Set(savedLevel)
+		log.SetOutput(logOut)
+		log.SetFlags(logFlags)
+	}()
+	cmd, ok := findCommand(name)
+	if !ok {
+		t.Fatalf("no command %q", name)
+	}
+	var out bytes.Buffer
+	stdin, stdout = strings.NewReader(input), &out
+	err := cmd.run(append([]string{"-storage", cfg.StorageDir, "-log-level", "error"}, args...))
+	return out.String(), err
+}
+
+func TestCLI_ArticleLifecycle(t *testing.T) {
+	resetStorage(t)
+
+	out, err := runCLI(t, "Hello from the shell.", "new", "-title", "Shell Post", "-date", "2024-03-01", "-draft")
+	if err != nil || strings.TrimSpace(out) != "shell-post" {
+		t.Fatalf("new: %q, %v", out, err)
+	}
+	if _, err := runCLI(t, "again", "new", "-title", "Shell Post"); err == nil {
+		t.Fatal("new should refuse an existing slug without -force")
+	}
+	out, _ = runCLI(t, "", "list", "-status", "draft")
+	if !strings.Contains(out, "shell-post") || !strings.Contains(out, "2024-03-01") {
+		t.Fatalf("list drafts:\n%s", out)
+	}
+
+	// drafts are visible to admins only
+	ts := httptest.NewServer(buildMux())
+	defer ts.Close()
+	if code, _ := getBody(t, ts.URL, "/article/shell-post", ""); code != http.StatusNotFound {
+		t.Fatalf("guest draft status=%d, want 404", code)
+	}
+	if _, body := getBody(t, ts.URL, "/", ""); strings.Contains(body, "Shell Post") {
+		t.Fatal("draft listed on the home page")
+	}
+	cookie := login(t, ts.URL, cfg.AdminUser, cfg.AdminPass)
+	if code, _ := getBody(t, ts.URL, "/article/shell-post", cookie); code != http.StatusOK {
+		t.Fatalf("admin draft status=%d", code)
+	}
+
+	if out, err := runCLI(t, "", "publish", "shell-post"); err != nil || !strings.Contains(out, "now published") {
+		t.Fatalf("publish: %q, %v", out, err)
+	}
+	if code, _ := getBody(t, ts.URL, "/article/shell-post", ""); code != http.StatusOK {
+		t.Fatalf("published status=%d", code)
+	}
+
+	// edit through $EDITOR: a script that rewrites the title
+	script := filepath.Join(t.TempDir(), "ed.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\nsed -i 's/Shell Post/Edited Post/' \"$1\"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("EDITOR", script)
+	if _, err := runCLI(t, "", "edit", "shell-post"); err != nil {
+		t.Fatalf("edit: %v", err)
+	}
+	if a, err := loadArticle("shell-post"); err != nil || a.Title != "Edited Post" || a.UpdatedAt.IsZero() {
+		t.Fatalf("after edit: %+v, %v", a, err)
+	}
+	t.Setenv("EDITOR", "true")
+	if out, _ := runCLI(t, "", "edit", "shell-post"); strings.TrimSpace(out) != "no changes" {
+		t.Fatalf("untouched edit: %q", out)
+	}
+
+	if _, err := runCLI(t, "", "delete", "shell-post"); err != nil {
+		t.Fatal(err)
+	}
+	if !articleGone("shell-post") {
+		t.Fatal("delete should leave a tombstone")
+	}
+	entries, _ := readAudit(auditFilter{Actor: "cli:" + os.Getenv("USER")})
+	if len(entries) != 4 { // create, publish, edit, delete
+		t.Fatalf("audited %d CLI actions, want 4", len(entries))
+	}
+}
+
+func TestCLI_ExportImportRoundTrip(t *testing.T) {
+	resetStorage(t)
+	pub := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	for _, a := range []Article{
+		{Title: "One", Slug: "one", Content: "1", Published: pub},
+		{Title: "Two", Slug: "two", Content: "2", Published: pub, Draft: true},
+	} {
+		if err := saveArticle(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dump, err := runCLI(t, "", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var arts []Article
+	if err := json.Unmarshal([]byte(dump), &arts); err != nil || len(arts) != 2 {
+		t.Fatalf("export: %v\n%s", err, dump)
+	}
+
+	if err := deleteArticle("two"); err != nil {
+		t.Fatal(err)
+	}
+	out, err := runCLI(t, dump, "import", "-dry-run", "-")
+	if err != nil || !strings.Contains(out, "create   two") || !strings.Contains(out, "skip     one") {
+		t.Fatalf("dry run: %q, %v", out, err)
+	}
+	if _, err := loadArticle("two"); err == nil {
+		t.Fatal("dry run wrote an article")
+	}
+	if out, err = runCLI(t, dump, "import", "-"); err != nil || !strings.Contains(out, "1 created, 0 replaced, 1 skipped") {
+		t.Fatalf("import: %q, %v", out, err)
+	}
+	if a, err := loadArticle("two"); err != nil || !a.Draft {
+		t.Fatalf("imported: %+v, %v", a, err)
+	}
+}
+
+func TestCLI_ReindexAndCheck(t *testing.T) {
+	resetStorage(t)
+	a := Article{Title: "Moved", Slug: "moved", Content: "x", Published: time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)}
+	b, _ := json.Marshal(a) // not indented and under the wrong name
+	if err := os.WriteFile(filepath.Join(cfg.StorageDir, "old-name.json"), b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(cfg.StorageDir, "broken.json"), []byte(`{"title":"B","slug":"broken","extra":1}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := runCLI(t, "", "check")
+	if err == nil || !strings.Contains(out, "does not match slug") || !strings.Contains(out, `unknown field "extra"`) {
+		t.Fatalf("check: %v\n%s", err, out)
+	}
+	if err := os.Remove(filepath.Join(cfg.StorageDir, "broken.json")); err != nil {
+		t.Fatal(err)
+	}
+	if out, err = runCLI(t, "", "reindex"); err != nil || !strings.Contains(out, "1 files, 1 rewritten") {
+		t.Fatalf("reindex: %q, %v", out, err)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.StorageDir, "old-name.json")); !os.IsNotExist(err) {
+		t.Fatal("old file left behind")
+	}
+	if out, err = runCLI(t, "", "check"); err != nil {
+		t.Fatalf("check after reindex: %v\n%s", err, out)
+	}
+}
+
+func TestCLI_UsersCanLogIn(t *testing.T) {
+	resetStorage(t)
+	if _, err := runCLI(t, "short\n", "user", "add", "editor"); err == nil {
+		t.Fatal("short password accepted")
+	}
+	if _, err := runCLI(t, "correct horse\n", "user", "add", "editor"); err != nil {
+		t.Fatal(err)
+	}
+	if out, _ := runCLI(t, "", "user", "list"); !strings.Contains(out, "editor") {
+		t.Fatalf("user list:\n%s", out)
+	}
+	if fi, err := os.Stat(usersPath()); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Fatalf("users file: %v, %v", fi, err)
+	}
+	if b, _ := os.ReadFile(usersPath()); bytes.Contains(b, []byte("correct horse")) {
+		t.Fatal("password stored in clear text")
+	}
+
+	ts := httptest.NewServer(buildMux())
+	defer ts.Close()
+	cookie := login(t, ts.URL, "editor", "correct horse")
+
+	if _, err := runCLI(t, "", "user", "del", "editor"); err != nil {
+		t.Fatal(err)
+	}
+	if authenticate("editor", "correct horse") {
+		t.Fatal("deleted user can still log in")
+	}
+	if _, body := getBody(t, ts.URL, "/admin", cookie); !strings.Contains(body, `name="password"`) {
+		t.Fatal("deleted user's session still works")
+	}
+}
@@ -0,0 +1,669 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --------------------------- Comments --------------------------
+// Readers comment through a form under each article. Every comment waits
+// in the moderation queue at /admin/comments; likely spam goes straight to
+// the spam folder. Comments are stored per article in
+// .blog/comments/<slug>.json and rendered from Markdown.
+
+const (
+	commentsDir = "comments"
+
+	commentPending  = "pending"
+	commentApproved = "approved"
+	commentRejected = "rejected"
+	commentSpam     = "spam"
+
+	commentMaxName  = 80
+	commentMaxEmail = 254
+	commentMaxBody  = 8000
+	commentMaxDepth = 4 // replies nest this deep; deeper ones get no Reply link
+
+	// the form carries a signed render time: faster submissions are bots,
+	// older forms must be reloaded
+	commentMinDelay = 3 * time.Second
+	commentTokenTTL = 24 * time.Hour
+	// pages with a form leave the page cache after commentFormTTL, so the
+	// token in them stays fresh
+	commentFormTTL = time.Hour
+)
+
+// commentStatuses is the order of the moderation tabs.
+var commentStatuses = []string{commentPending, commentApproved, commentSpam, commentRejected}
+
+type Comment struct {
+	ID        string    `json:"id"`
+	Parent    string    `json:"parent,omitempty"` // ID of the comment replied to
+	Name      string    `json:"name"`
+	Email     string    `json:"email,omitempty"` // never shown publicly
+	Body      string    `json:"body"`            // Markdown
+	Created   time.Time `json:"created"`
+	Status    string    `json:"status"`
+	Moderated time.Time `json:"moderated,omitzero"`
+	IP        string    `json:"ip,omitempty"`
+	Score     float64   `json:"score"`             // spam probability when submitted
+	Trained   string    `json:"trained,omitempty"` // "spam" or "ham" once the filter learnt from it
+}
+
+var (
+	commentsMu sync.Mutex
+	// commentKey signs form tokens; forms rendered before a restart have to
+	// be reloaded.
+	commentKey = []byte(newToken(32))
+)
+
+// --------------------------- Storage (comments) ----------------
+
+func commentsPath(slug string) string {
+	return filepath.Join(metaDir(), commentsDir, slug+".json")
+}
+
+// loadComments returns the comments of slug, oldest first.
+func loadComments(slug string) ([]Comment, error) {
+	b, err := os.ReadFile(commentsPath(slug))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cs []Comment
+	if err := json.Unmarshal(b, &cs); err != nil {
+		return nil, fmt.Errorf("%s: %v", commentsPath(slug), err)
+	}
+	return cs, nil
+}
+
+// saveComments replaces the comments of slug; callers hold commentsMu.
+func saveComments(slug string, cs []Comment) error {
+	if err := os.MkdirAll(filepath.Dir(commentsPath(slug)), 0o700); err != nil {
+		return err
+	}
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	if len(cs) == 0 {
+		if err := os.Remove(commentsPath(slug)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	b, err := json.MarshalIndent(cs, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(commentsPath(slug), b, 0o600)
+}
+
+// addComment appends c to the comments of slug.
+func addComment(slug string, c Comment) error {
+	commentsMu.Lock()
+	defer commentsMu.Unlock()
+	cs, err := loadComments(slug)
+	if err != nil {
+		return err
+	}
+	if err := saveComments(slug, append(cs, c)); err != nil {
+		return err
+	}
+	if c.Status == commentApproved {
+		pages.invalidate(articleDep(slug))
+	}
+	return nil
+}
+
+// mergeComments adds the comments whose ID slug does not have yet, e.g.
+// from an import, and trains the spam filter on their status.
+func mergeComments(slug string, add []Comment) (int, error) {
+	commentsMu.Lock()
+	defer commentsMu.Unlock()
+	cs, err := loadComments(slug)
+	if err != nil {
+		return 0, err
+	}
+	have := map[string]bool{}
+	for _, c := range cs {
+		have[c.ID] = true
+	}
+	var fresh []Comment
+	for _, c := range add {
+		if !have[c.ID] {
+			fresh = append(fresh, c)
+		}
+	}
+	if len(fresh) == 0 {
+		return 0, nil
+	}
+	if fresh, err = trainSpam(fresh); err != nil {
+		return 0, err
+	}
+	cs = append(cs, fresh...)
+	sort.SliceStable(cs, func(i, j int) bool { return cs[i].Created.Before(cs[j].Created) })
+	if err := saveComments(slug, cs); err != nil {
+		return 0, err
+	}
+	pages.invalidate(articleDep(slug))
+	return len(fresh), nil
+}
+
+// moveComments follows an article to its new slug.
+func moveComments(from, to string) error {
+	commentsMu.Lock()
+	defer commentsMu.Unlock()
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	err := os.Rename(commentsPath(from), commentsPath(to))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// commentRef is a comment with the article it belongs to.
+type commentRef struct {
+	Comment
+	Slug  string
+	Title string
+}
+
+// Ref identifies the comment in moderation forms.
+func (c commentRef) Ref() string { return c.Slug + "/" + c.ID }
+
+func (c commentRef) SpamPercent() float64 { return 100 * c.Score }
+
+// allComments returns the comments of every article, newest first.
+func allComments() ([]commentRef, error) {
+	files, err := filepath.Glob(filepath.Join(metaDir(), commentsDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var out []commentRef
+	for _, f := range files {
+		slug := strings.TrimSuffix(filepath.Base(f), ".json")
+		cs, err := loadComments(slug)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range cs {
+			out = append(out, commentRef{Comment: c, Slug: slug})
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Created.After(out[j].Created) })
+	return out, nil
+}
+
+// moderateComments applies action (approve, reject, spam or delete) to the
+// comments named by refs ("slug/id"), trains the spam filter on the
+// outcome and returns the comments it changed.
+func moderateComments(refs []string, action string) ([]commentRef, error) {
+	status := map[string]string{"approve": commentApproved, "reject": commentRejected, "spam": commentSpam, "delete": ""}
+	to, ok := status[action]
+	if !ok {
+		return nil, fmt.Errorf("unknown action %q", action)
+	}
+	bySlug := map[string]map[string]bool{}
+	for _, ref := range refs {
+		slug, id, ok := strings.Cut(ref, "/")
+		if !ok || slug != makeSlug(slug) {
+			continue
+		}
+		if bySlug[slug] == nil {
+			bySlug[slug] = map[string]bool{}
+		}
+		bySlug[slug][id] = true
+	}
+
+	commentsMu.Lock()
+	defer commentsMu.Unlock()
+	var changed []commentRef
+	for slug, ids := range bySlug {
+		cs, err := loadComments(slug)
+		if err != nil {
+			return changed, err
+		}
+		var touched []int
+		for i, c := range cs {
+			if ids[c.ID] && (c.Status != to || action == "delete") {
+				cs[i].Status, cs[i].Moderated = to, time.Now().UTC()
+				touched = append(touched, i)
+			}
+		}
+		if len(touched) == 0 {
+			continue
+		}
+		sub := make([]Comment, len(touched))
+		for k, i := range touched {
+			sub[k] = cs[i]
+		}
+		// a deleted comment has no status, which untrains it
+		sub, err = trainSpam(sub)
+		if err != nil {
+			return changed, err
+		}
+		for k, i := range touched {
+			cs[i] = sub[k]
+			changed = append(changed, commentRef{Comment: sub[k], Slug: slug})
+		}
+		if action == "delete" {
+			kept := cs[:0]
+			for _, c := range cs {
+				if !ids[c.ID] {
+					kept = append(kept, c)
+				}
+			}
+			cs = kept
+		}
+		if err := saveComments(slug, cs); err != nil {
+			return changed, err
+		}
+		pages.invalidate(articleDep(slug))
+	}
+	return changed, nil
+}
+
+// --------------------------- Rendering (comments) --------------
+
+// commentNode is an approved comment with its visible replies.
+type commentNode struct {
+	Comment
+	HTML     template.HTML
+	Nested   bool
+	ReplyURL string
+	Replies  []*commentNode
+}
+
+// commentHTML renders a comment body. Images are shown as links and links
+// carry rel="nofollow ugc".
+func commentHTML(body string) template.HTML {
+	out := markdownToXHTML(body, func(string) string { return "" })
+	return template.HTML(strings.ReplaceAll(out, "<a href=", `<a rel="nofollow ugc" href=`))
+}
+
+// commentThread nests the approved comments under their parents. Replies
+// whose parent is not shown appear at the top level.
+func commentThread(cs []Comment, slug string, canReply bool) (roots []*commentNode, n int) {
+	nodes := map[string]*commentNode{}
+	for _, c := range cs {
+		if c.Status == commentApproved {
+			nodes[c.ID] = &commentNode{Comment: c, HTML: commentHTML(c.Body)}
+		}
+	}
+	for _, c := range cs {
+		node := nodes[c.ID]
+		if node == nil {
+			continue
+		}
+		n++
+		if p := nodes[c.Parent]; p != nil && c.Parent != c.ID {
+			p.Replies = append(p.Replies, node)
+		} else {
+			roots = append(roots, node)
+		}
+	}
+	var link func(list []*commentNode, depth int)
+	link = func(list []*commentNode, depth int) {
+		for _, node := range list {
+			node.Nested = depth > 0
+			if canReply && depth < commentMaxDepth {
+				node.ReplyURL = "/article/" + slug + "?reply=" + node.ID + "#comment-form"
+			}
+			link(node.Replies, depth+1)
+		}
+	}
+	link(roots, 0)
+	return roots, n
+}
+
+// commentForm is what the reader typed, re-shown after a rejected post.
+type commentForm struct {
+	Name, Email, Body, Parent string
+	Token                     string
+	Error                     string
+}
+
+// commentToken signs the time a form for slug was rendered.
+func commentToken(slug string, t time.Time) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, commentKey)
+	mac.Write([]byte(slug + "|" + ts))
+	return ts + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// checkCommentToken rejects forged tokens and forms submitted implausibly
+// fast or after they expired.
+func checkCommentToken(slug, tok string, now time.Time) error {
+	ts, _, _ := strings.Cut(tok, ".")
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || !hmac.Equal([]byte(tok), []byte(commentToken(slug, time.Unix(sec, 0)))) {
+		return errors.New("This form has expired. Please submit it again.")
+	}
+	switch age := now.Sub(time.Unix(sec, 0)); {
+	case age < commentMinDelay:
+		return errors.New("That was quick! Please take a moment and submit again.")
+	case age > commentTokenTTL:
+		return errors.New("This form has expired. Please submit it again.")
+	}
+	return nil
+}
+
+// addCommentData puts the thread and, when comments are open, the form
+// into the article page's data.
+func addCommentData(w http.ResponseWriter, r *http.Request, a Article, form commentForm, data map[string]any) error {
+	cs, err := loadComments(a.Slug)
+	if err != nil {
+		return err
+	}
+	open := !a.CommentsClosed && !a.Draft && !isStaticBuild(r.Context())
+	thread, n := commentThread(cs, a.Slug, open)
+	data["Thread"], data["CommentCount"], data["CommentsOpen"] = thread, n, open
+
+	modified := a.Modified()
+	for _, c := range cs {
+		if c.Status == commentApproved && c.Moderated.After(modified) {
+			modified = c.Moderated
+		}
+	}
+	data["Modified"] = modified
+	if !open {
+		return nil
+	}
+	if form.Parent != "" {
+		data["ReplyTo"] = nil
+		for _, c := range cs {
+			if c.ID == form.Parent && c.Status == commentApproved {
+				data["ReplyTo"] = c
+			}
+		}
+		if data["ReplyTo"] == nil {
+			form.Parent = ""
+		}
+	}
+	if r.URL.Query().Get("comment") == "received" {
+		data["CommentNotice"] = "Thanks! Your comment will appear once it has been approved."
+	}
+	form.Token = commentToken(a.Slug, time.Now())
+	data["CommentForm"] = form
+	limitCache(w, commentFormTTL)
+	return nil
+}
+
+// --------------------------- Handlers (comments) ---------------
+
+// commentPost handles the comment form under an article.
+func commentPost(w http.ResponseWriter, r *http.Request, a Article) {
+	if a.CommentsClosed || a.Draft {
+		renderError(w, r, http.StatusForbidden, nil)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 64<<10)
+	if err := r.ParseForm(); err != nil {
+		renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	done := "/article/" + a.Slug + "?comment=received#comments"
+	// bots fill in every field; people never see this one
+	if r.PostFormValue("website") != "" {
+		slog.InfoContext(r.Context(), "comment dropped", "slug", a.Slug, "reason", "honeypot", "ip", clientIP(r))
+		http.Redirect(w, r, done, http.StatusFound)
+		return
+	}
+	form := commentForm{
+		Name:   strings.TrimSpace(r.PostFormValue("name")),
+		Email:  strings.TrimSpace(r.PostFormValue("email")),
+		Body:   strings.TrimSpace(strings.ReplaceAll(r.PostFormValue("body"), "\r\n", "\n")),
+		Parent: r.PostFormValue("parent"),
+	}
+	if err := checkCommentToken(a.Slug, r.PostFormValue("token"), time.Now()); err != nil {
+		form.Error = err.Error()
+	} else if err := validateComment(a.Slug, form); err != nil {
+		form.Error = err.Error()
+	}
+	if form.Error != "" {
+		renderArticle(w, r, a, form)
+		return
+	}
+
+	c := Comment{
+		ID:      newToken(12),
+		Parent:  form.Parent,
+		Name:    form.Name,
+		Email:   form.Email,
+		Body:    form.Body,
+		Created: time.Now().UTC(),
+		Status:  commentPending,
+		IP:      clientIP(r),
+	}
+	c.Score = spamScore(c)
+	if c.Score >= spamThreshold {
+		c.Status = commentSpam
+	}
+	if err := addComment(a.Slug, c); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	slog.InfoContext(r.Context(), "comment received", "slug", a.Slug, "id", c.ID, "status", c.Status, "score", c.Score)
+	http.Redirect(w, r, done, http.StatusFound)
+}
+
+func validateComment(slug string, f commentForm) error {
+	switch {
+	case f.Name == "" || f.Body == "":
+		return errors.New("Please fill in your name and a comment.")
+	case len(f.Name) > commentMaxName:
+		return fmt.Errorf("Names are limited to %d characters.", commentMaxName)
+	case len(f.Body) > commentMaxBody:
+		return fmt.Errorf("Comments are limited to %d characters.", commentMaxBody)
+	}
+	if f.Email != "" {
+		if addr, err := mail.ParseAddress(f.Email); err != nil || addr.Address != f.Email || len(f.Email) > commentMaxEmail {
+			return errors.New("That email address doesn't look right.")
+		}
+	}
+	if f.Parent != "" {
+		cs, err := loadComments(slug)
+		if err != nil {
+			return err
+		}
+		for _, c := range cs {
+			if c.ID == f.Parent && c.Status == commentApproved {
+				return nil
+			}
+		}
+		return errors.New("The comment you replied to is no longer available.")
+	}
+	return nil
+}
+
+func adminCommentsGet(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = commentPending
+	}
+	all, err := allComments()
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	arts, err := allArticles()
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	titles := map[string]string{}
+	for _, a := range arts {
+		titles[a.Slug] = a.Title
+	}
+	counts := map[string]int{}
+	var list []commentRef
+	for _, c := range all {
+		counts[c.Status]++
+		if c.Status == status {
+			c.Title = titles[c.Slug]
+			if c.Title == "" {
+				c.Title = c.Slug
+			}
+			list = append(list, c)
+		}
+	}
+	type tab struct {
+		Status string
+		Count  int
+	}
+	tabs := make([]tab, len(commentStatuses))
+	for i, s := range commentStatuses {
+		tabs[i] = tab{s, counts[s]}
+	}
+	render(w, r, map[string]any{"Active": "admin_comments", "Title": "Comments", "Status": status, "Tabs": tabs, "Comments": list, "Threshold": 100 * spamThreshold})
+}
+
+// adminCommentsPost applies a row button ("row" = "<action> <slug>/<id>")
+// or a bulk action to the ticked comments.
+func adminCommentsPost(w http.ResponseWriter, r *http.Request) {
+	_ = r.ParseForm()
+	action, refs := r.FormValue("action"), r.Form["id"]
+	if row := r.FormValue("row"); row != "" {
+		act, ref, _ := strings.Cut(row, " ")
+		action, refs = act, []string{ref}
+	}
+	changed, err := moderateComments(refs, action)
+	for _, c := range changed {
+		audit(r, "comment."+action, "", c.Slug, fmt.Sprintf("comment %s by %q", c.ID, c.Name))
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, "/admin/comments?status="+r.FormValue("status"), http.StatusFound)
+}
+
+// pendingComments counts the comments waiting for moderation.
+func pendingComments() int {
+	all, err := allComments()
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for _, c := range all {
+		if c.Status == commentPending {
+			n++
+		}
+	}
+	return n
+}
+
+// --------------------------- Templates (comments) --------------
+
+const commentsHTML = `{{define "comments"}}
+  <section class="card" id="comments">
+    <h2 class="mt-0">Comments{{if .CommentCount}} ({{.CommentCount}}){{end}}</h2>
+    {{if not .Thread}}<p class="muted">No comments yet.</p>{{end}}
+    {{template "comment_thread" .Thread}}
+    {{if .CommentsOpen}}
+    <form method="post" action="/article/{{.Article.Slug}}#comments" id="comment-form" class="mt-12">
+      <h3>{{with .ReplyTo}}Reply to {{.Name}} <a class="muted ml-8" href="/article/{{$.Article.Slug}}#comment-form">cancel</a>{{else}}Leave a comment{{end}}</h3>
+      {{with .CommentNotice}}<div class="card mb-12">{{.}}</div>{{end}}
+      {{with .CommentForm.Error}}<div class="card danger mb-12">{{.}}</div>{{end}}
+      <input type="hidden" name="parent" value="{{.CommentForm.Parent}}" />
+      <input type="hidden" name="token" value="{{.CommentForm.Token}}" />
+      <div class="hp" aria-hidden="true"><label>Leave this empty <input name="website" tabindex="-1" autocomplete="off" /></label></div>
+      <div class="row">
+        <div>
+          <label>Name</label>
+          <input name="name" value="{{.CommentForm.Name}}" maxlength="80" required />
+        </div>
+        <div>
+          <label>Email (optional, never shown)</label>
+          <input name="email" type="email" value="{{.CommentForm.Email}}" />
+        </div>
+      </div>
+      <div class="mt-12">
+        <label>Comment (Markdown)</label>
+        <textarea name="body" class="short" required>{{.CommentForm.Body}}</textarea>
+      </div>
+      <div class="mt-12"><button type="submit">Post comment</button> <span class="muted ml-8">Comments are moderated.</span></div>
+    </form>
+    {{else if not .Static}}
+    <p class="muted">Comments are closed.</p>
+    {{end}}
+  </section>
+{{end}}
+
+{{define "comment_thread"}}{{range .}}
+    <div class="comment{{if .Nested}} reply{{end}}" id="comment-{{.ID}}">
+      <div class="muted">{{.Name}} · {{date .Created}}{{with .ReplyURL}} · <a href="{{.}}">Reply</a>{{end}}</div>
+      <div class="comment-body">{{.HTML}}</div>
+      {{template "comment_thread" .Replies}}
+    </div>
+{{end}}{{end}}`
+
+const adminCommentsHTML = `{{define "admin_comments"}}
+  <div class="card bar">
+    <div><h2 class="m-0">Comments</h2></div>
+    <div><a href="/admin">Back</a></div>
+  </div>
+  <div class="card">
+    <nav>
+      {{range .Tabs}}<a href="/admin/comments?status={{.Status}}" class="{{if eq .Status $.Status}}active{{end}}">{{.Status}} ({{.Count}})</a>{{end}}
+    </nav>
+  </div>
+  <form method="post" action="/admin/comments">
+    <input type="hidden" name="status" value="{{.Status}}" />
+    <div class="card">
+      {{if not .Comments}}
+        <p class="muted m-0">No {{.Status}} comments.</p>
+      {{else}}
+      <div class="mb-12">
+        With selected:
+        <button class="ml-8" name="action" value="approve">Approve</button>
+        <button class="ml-8" name="action" value="reject">Reject</button>
+        <button class="ml-8" name="action" value="spam">Spam</button>
+        <button class="ml-8 danger" name="action" value="delete">Delete</button>
+      </div>
+      <table>
+        <thead>
+          <tr><th></th><th>Comment</th><th>Article</th><th>Spam</th><th class="w-220">Actions</th></tr>
+        </thead>
+        <tbody>
+          {{range .Comments}}
+          <tr>
+            <td><input type="checkbox" name="id" value="{{.Ref}}" /></td>
+            <td>
+              <strong>{{.Name}}</strong>{{with .Email}} <span class="muted">&lt;{{.}}&gt;</span>{{end}}
+              <div class="muted">{{.Created.Format "Jan 02 15:04"}}{{with .IP}} · {{.}}{{end}}{{if .Parent}} · reply{{end}}</div>
+              <div class="pre mt-4">{{.Body}}</div>
+            </td>
+            <td><a href="/article/{{.Slug}}#comment-{{.ID}}">{{.Title}}</a></td>
+            <td>{{printf "%.0f" .SpamPercent}}%</td>
+            <td>
+              {{if ne .Status "approved"}}<button name="row" value="approve {{.Ref}}">Approve</button>{{end}}
+              {{if ne .Status "rejected"}}<button name="row" value="reject {{.Ref}}">Reject</button>{{end}}
+              {{if ne .Status "spam"}}<button name="row" value="spam {{.Ref}}" class="danger">Spam</button>{{end}}
+            </td>
+          </tr>
+          {{end}}
+        </tbody>
+      </table>
+      {{end}}
+    </div>
+  </form>
+  <p class="muted">Approving and marking as spam teach the spam filter. New comments it scores at {{printf "%.0f" .Threshold}}% or more go straight to spam.</p>
+{{end}}`
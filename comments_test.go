@@ -0,0 +1,212 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// postComment submits the comment form with a token rendered a minute ago.
+func postComment(t *testing.T, base, slug string, form url.Values) (int, string, string) {
+	t.Helper()
+	if form.Get("token") == "" {
+		form.Set("token", commentToken(slug, time.Now().Add(-time.Minute)))
+	}
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.PostForm(base+"/article/"+slug, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, resp.Header.Get("Location"), string(b)
+}
+
+// moderate posts the moderation form as the logged-in admin.
+func moderate(t *testing.T, base, cookie string, form url.Values) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, base+"/admin/comments", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Cookie", cookie)
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("moderation status %d", resp.StatusCode)
+	}
+}
+
+func TestComments_PostModerateAndReply(t *testing.T) {
+	resetStorage(t)
+	if err := saveArticle(Article{Title: "Talk", Slug: "talk", Content: "x", Published: time.Now().Add(-time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(buildMux())
+	defer ts.Close()
+
+	if _, body := getBody(t, ts.URL, "/article/talk", ""); !strings.Contains(body, "No comments yet.") || !strings.Contains(body, `name="token"`) {
+		t.Fatalf("article page has no comment form:\n%s", body)
+	}
+	code, loc, _ := postComment(t, ts.URL, "talk", url.Values{"name": {"Ann"}, "email": {"ann@example.com"}, "body": {"I *like* it. <script>x</script>"}})
+	if code != http.StatusFound || loc != "/article/talk?comment=received#comments" {
+		t.Fatalf("post: %d %q", code, loc)
+	}
+	if _, body := getBody(t, ts.URL, "/article/talk?comment=received", ""); !strings.Contains(body, "once it has been approved") || strings.Contains(body, "Ann") {
+		t.Fatalf("pending comment shown or no notice:\n%s", body)
+	}
+
+	cookie := login(t, ts.URL, cfg.AdminUser, cfg.AdminPass)
+	if _, body := getBody(t, ts.URL, "/admin", cookie); !strings.Contains(body, "Comments (1)") {
+		t.Fatal("dashboard does not show the pending count")
+	}
+	_, body := getBody(t, ts.URL, "/admin/comments", cookie)
+	if !strings.Contains(body, "ann@example.com") || !strings.Contains(body, "pending (1)") {
+		t.Fatalf("moderation queue:\n%s", body)
+	}
+	cs, _ := loadComments("talk")
+	moderate(t, ts.URL, cookie, url.Values{"row": {"approve talk/" + cs[0].ID}, "status": {"pending"}})
+
+	_, body = getBody(t, ts.URL, "/article/talk", "")
+	if !strings.Contains(body, "Comments (1)") || !strings.Contains(body, "I <em>like</em> it. &lt;script&gt;") || strings.Contains(body, "ann@example.com") {
+		t.Fatalf("approved comment:\n%s", body)
+	}
+	if _, body = getBody(t, ts.URL, "/article/talk?reply="+cs[0].ID, ""); !strings.Contains(body, "Reply to Ann") || !strings.Contains(body, `name="parent" value="`+cs[0].ID+`"`) {
+		t.Fatalf("reply form:\n%s", body)
+	}
+
+	// two replies, one bulk approval
+	for _, name := range []string{"Bob", "Cy"} {
+		if code, _, body := postComment(t, ts.URL, "talk", url.Values{"name": {name}, "body": {"agreed"}, "parent": {cs[0].ID}}); code != http.StatusFound {
+			t.Fatalf("reply: %d\n%s", code, body)
+		}
+	}
+	cs, _ = loadComments("talk")
+	moderate(t, ts.URL, cookie, url.Values{"action": {"approve"}, "id": {"talk/" + cs[1].ID, "talk/" + cs[2].ID}})
+	_, body = getBody(t, ts.URL, "/article/talk", "")
+	if !strings.Contains(body, "Comments (3)") || strings.Count(body, `class="comment reply"`) != 2 {
+		t.Fatalf("thread:\n%s", body)
+	}
+	if entries, _ := readAudit(auditFilter{Action: "comment.approve"}); len(entries) != 3 {
+		t.Fatalf("%d approvals audited, want 3", len(entries))
+	}
+
+	// comments follow a renamed article
+	a, _ := loadArticle("talk")
+	renamed := a
+	renamed.Title, renamed.Slug = "Talk Two", "talk-two"
+	if err := updateArticle(a, renamed); err != nil {
+		t.Fatal(err)
+	}
+	if cs, _ := loadComments("talk-two"); len(cs) != 3 {
+		t.Fatalf("%d comments after rename, want 3", len(cs))
+	}
+}
+
+func TestComments_ImagesWithUnsafeURLsAreNotLinked(t *testing.T) {
+	resetStorage(t)
+	if err := saveArticle(Article{Title: "Pics", Slug: "pics", Content: "x", Published: time.Now().Add(-time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(buildMux())
+	defer ts.Close()
+	for _, body := range []string{"![x](javascript:alert(1))", "![](data:text/html,<script>alert(1)</script>)"} {
+		if code, _, page := postComment(t, ts.URL, "pics", url.Values{"name": {"Eve"}, "body": {body}}); code != http.StatusFound {
+			t.Fatalf("post %q: %d\n%s", body, code, page)
+		}
+	}
+	cs, _ := loadComments("pics")
+	cookie := login(t, ts.URL, cfg.AdminUser, cfg.AdminPass)
+	moderate(t, ts.URL, cookie, url.Values{"action": {"approve"}, "id": {"pics/" + cs[0].ID, "pics/" + cs[1].ID}})
+
+	for _, c := range cs {
+		if out := commentHTML(c.Body); strings.Contains(string(out), "href") {
+			t.Fatalf("%q rendered as %s", c.Body, out)
+		}
+	}
+	_, page := getBody(t, ts.URL, "/article/pics", "")
+	if !strings.Contains(page, "Comments (2)") || strings.Contains(page, "javascript:") || strings.Contains(page, "data:text") {
+		t.Fatalf("article page:\n%s", page)
+	}
+}
+
+func TestComments_RejectsBotsAndClosedArticles(t *testing.T) {
+	resetStorage(t)
+	if err := saveArticle(Article{Title: "Open", Slug: "open", Content: "x", Published: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveArticle(Article{Title: "Shut", Slug: "shut", Content: "x", Published: time.Now(), CommentsClosed: true}); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(buildMux())
+	defer ts.Close()
+	form := func() url.Values { return url.Values{"name": {"Bot"}, "body": {"hello"}} }
+
+	f := form()
+	f.Set("website", "http://spam.example")
+	if code, _, _ := postComment(t, ts.URL, "open", f); code != http.StatusFound {
+		t.Fatalf("honeypot answer: %d", code)
+	}
+	f = form()
+	f.Set("token", commentToken("open", time.Now()))
+	if _, _, body := postComment(t, ts.URL, "open", f); !strings.Contains(body, "That was quick") || !strings.Contains(body, "hello</textarea>") {
+		t.Fatalf("instant submit:\n%s", body)
+	}
+	for _, tok := range []string{"123.forged", commentToken("open", time.Now().Add(-2*commentTokenTTL)), commentToken("shut", time.Now().Add(-time.Minute))} {
+		f = form()
+		f.Set("token", tok)
+		if _, _, body := postComment(t, ts.URL, "open", f); !strings.Contains(body, "expired") {
+			t.Fatalf("token %q accepted:\n%s", tok, body)
+		}
+	}
+	f = form()
+	f.Set("parent", "nope")
+	if _, _, body := postComment(t, ts.URL, "open", f); !strings.Contains(body, "no longer available") {
+		t.Fatalf("reply to unknown comment:\n%s", body)
+	}
+	f = form()
+	f.Set("email", "not an email")
+	if _, _, body := postComment(t, ts.URL, "open", f); !strings.Contains(body, "email address") {
+		t.Fatalf("bad email:\n%s", body)
+	}
+	if cs, _ := loadComments("open"); len(cs) != 0 {
+		t.Fatalf("stored %d comments from rejected posts", len(cs))
+	}
+
+	if code, _, _ := postComment(t, ts.URL, "shut", form()); code != http.StatusForbidden {
+		t.Fatalf("closed article: %d", code)
+	}
+	if _, body := getBody(t, ts.URL, "/article/shut", ""); !strings.Contains(body, "Comments are closed.") || strings.Contains(body, "comment-form") {
+		t.Fatalf("closed article page:\n%s", body)
+	}
+}
+
+func TestComments_FormPagesExpireFromPageCache(t *testing.T) {
+	resetStorage(t)
+	if err := saveArticle(Article{Title: "Cached", Slug: "cached", Content: "x", Published: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(buildMux())
+	defer ts.Close()
+	getBody(t, ts.URL, "/article/cached", "")
+	pages.mu.Lock()
+	el, ok := pages.items["/article/cached"]
+	pages.mu.Unlock()
+	if !ok {
+		t.Fatal("article page not cached")
+	}
+	p := el.Value.(*cachedPage)
+	if p.expires.IsZero() || p.expires.After(time.Now().Add(commentFormTTL)) {
+		t.Fatalf("expires %v, want within %v", p.expires, commentFormTTL)
+	}
+	p.expires = time.Now().Add(-time.Second)
+	if _, ok := pages.get("/article/cached"); ok {
+		t.Fatal("expired page served from cache")
+	}
+}
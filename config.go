@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/netip"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --------------------------- Runtime config --------------------
+
+// Config holds every setting that can change without a rebuild. Values are
+// layered: defaults, then the JSON file, then BLOG_* environment variables,
+// then command-line flags.
+type Config struct {
+	ListenAddr     string   `json:"listen_addr"`
+	StorageDir     string   `json:"storage_dir"`
+	AdminUser      string   `json:"admin_user"`
+	AdminPass      string   `json:"admin_pass"`
+	SessionCookie  string   `json:"session_cookie"`
+	SessionMaxAge  int      `json:"session_max_age"` // seconds
+	TrustedProxies []string `json:"trusted_proxies"`
+
+	// server timeouts, in seconds
+	ReadHeaderTimeout int `json:"read_header_timeout"`
+	ReadTimeout       int `json:"read_timeout"`
+	WriteTimeout      int `json:"write_timeout"`
+	IdleTimeout       int `json:"idle_timeout"`
+	ShutdownTimeout   int `json:"shutdown_timeout"`
+
+	// /metrics is served on MetricsAddr when set, otherwise on the main
+	// listener but only with a MetricsToken; with neither it is disabled.
+	MetricsAddr  string `json:"metrics_addr"`
+	MetricsToken string `json:"metrics_token"`
+
+	LogFormat string `json:"log_format"` // text or json
+	LogLevel  string `json:"log_level"`  // debug, info, warn or error
+
+	SiteTitle string `json:"site_title"`
+	Author    string `json:"author"`
+	BaseURL   string `json:"base_url"`
+	PageSize  int    `json:"page_size"`
+	Timezone  string `json:"timezone"`
+
+	// Cache-Control max-age, in seconds, for public pages and static assets
+	CacheMaxAge  int `json:"cache_max_age"`
+	StaticMaxAge int `json:"static_max_age"`
+
+	PageCacheBytes int `json:"page_cache_bytes"` // rendered-page LRU size; 0 disables
+
+	// security headers; CSP may contain {nonce}, and an empty string
+	// disables ReferrerPolicy, PermissionsPolicy or FrameAncestors
+	CSP               string `json:"csp"`
+	CSPReportOnly     bool   `json:"csp_report_only"`
+	FrameAncestors    string `json:"frame_ancestors"`
+	ReferrerPolicy    string `json:"referrer_policy"`
+	PermissionsPolicy string `json:"permissions_policy"`
+	HSTSMaxAge        int    `json:"hsts_max_age"` // seconds; 0 disables, sent over TLS only
+
+	// HTTPS on ListenAddr from TLSCert/TLSKey (reloaded when they change) or
+	// a throwaway self-signed certificate; TLSRedirectAddr optionally
+	// listens for plain HTTP and redirects it to HTTPS.
+	TLSCert         string `json:"tls_cert"`
+	TLSKey          string `json:"tls_key"`
+	TLSSelfSigned   bool   `json:"tls_self_signed"`
+	TLSRedirectAddr string `json:"tls_redirect_addr"`
+
+	// Newsletter is off, immediate (one email per published article) or
+	// weekly (a digest on DigestDay). Mail goes through SMTPAddr, with PLAIN
+	// auth when SMTPUser is set.
+	Newsletter string `json:"newsletter"`
+	DigestDay  string `json:"digest_day"`
+	SMTPAddr   string `json:"smtp_addr"`
+	SMTPUser   string `json:"smtp_user"`
+	SMTPPass   string `json:"smtp_pass"`
+	SMTPFrom   string `json:"smtp_from"`
+
+	// FediverseUser is the account name the blog is followed as
+	// (@user@host); empty turns ActivityPub off. It needs BaseURL.
+	FediverseUser string `json:"fediverse_user"`
+
+	// resolved by validate
+	location  *time.Location
+	proxies   []netip.Prefix
+	digestDay time.Weekday
+}
+
+func defaultConfig() Config {
+	return Config{
+		ListenAddr:    ":8080",
+		StorageDir:    "data",
+		AdminUser:     "admin",
+		AdminPass:     "changeme", // change this
+		SessionCookie: "session",
+		SessionMaxAge: 24 * 3600, // 1 day
+
+		ReadHeaderTimeout: 5,
+		ReadTimeout:       15,
+		WriteTimeout:      30,
+		IdleTimeout:       120,
+		ShutdownTimeout:   20,
+
+		LogFormat: "text",
+		LogLevel:  "info",
+
+		SiteTitle: "Personal Blog",
+		PageSize:  10,
+		Timezone:  "UTC",
+		location:  time.UTC,
+
+		CacheMaxAge:  60,
+		StaticMaxAge: 24 * 3600, // 1 day
+
+		PageCacheBytes: 8 << 20, // 8 MiB
+
+		FrameAncestors:    "'none'",
+		ReferrerPolicy:    "strict-origin-when-cross-origin",
+		PermissionsPolicy: "camera=(), microphone=(), geolocation=(), payment=(), usb=()",
+		HSTSMaxAge:        365 * 24 * 3600, // 1 year
+
+		Newsletter: "off",
+		DigestDay:  "monday",
+		digestDay:  time.Monday,
+	}
+}
+
+// UsingDefaultPassword reports whether the admin password was never changed.
+func (c Config) UsingDefaultPassword() bool { return c.AdminPass == defaultConfig().AdminPass }
+
+// TLSEnabled reports whether ListenAddr serves HTTPS.
+func (c Config) TLSEnabled() bool { return c.TLSSelfSigned || c.TLSCert != "" }
+
+// Federating reports whether the blog can be followed over ActivityPub.
+func (c Config) Federating() bool { return c.FediverseUser != "" && c.BaseURL != "" }
+
+// NewsletterEnabled reports whether readers can subscribe by email.
+func (c Config) NewsletterEnabled() bool {
+	return c.Newsletter == "immediate" || c.Newsletter == "weekly"
+}
+
+// Location is the time zone used to read and display publication dates.
+func (c Config) Location() *time.Location {
+	if c.location == nil {
+		return time.UTC
+	}
+	return c.location
+}
+
+// validate checks every field and resolves the derived ones.
+func (c *Config) validate() error {
+	var errs []error
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		errs = append(errs, fmt.Errorf("listen_addr %q: %v", c.ListenAddr, err))
+	}
+	if strings.TrimSpace(c.StorageDir) == "" {
+		errs = append(errs, errors.New("storage_dir must not be empty"))
+	}
+	if strings.TrimSpace(c.AdminUser) == "" {
+		errs = append(errs, errors.New("admin_user must not be empty"))
+	}
+	if c.AdminPass == "" {
+		errs = append(errs, errors.New("admin_pass must not be empty"))
+	}
+	if c.SessionCookie == "" || strings.ContainsAny(c.SessionCookie, " \t;,=\"") {
+		errs = append(errs, fmt.Errorf("session_cookie %q is not a valid cookie name", c.SessionCookie))
+	}
+	if c.SessionMaxAge <= 0 {
+		errs = append(errs, fmt.Errorf("session_max_age must be positive, got %d", c.SessionMaxAge))
+	}
+	for _, t := range []struct {
+		name string
+		v    int
+	}{
+		{"read_header_timeout", c.ReadHeaderTimeout},
+		{"read_timeout", c.ReadTimeout},
+		{"write_timeout", c.WriteTimeout},
+		{"idle_timeout", c.IdleTimeout},
+		{"shutdown_timeout", c.ShutdownTimeout},
+	} {
+		if t.v <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be positive, got %d", t.name, t.v))
+		}
+	}
+	if c.LogFormat != "text" && c.LogFormat != "json" {
+		errs = append(errs, fmt.Errorf("log_format must be text or json, got %q", c.LogFormat))
+	}
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		errs = append(errs, fmt.Errorf("log_level %q: want debug, info, warn or error", c.LogLevel))
+	}
+	if c.MetricsAddr != "" {
+		if _, _, err := net.SplitHostPort(c.MetricsAddr); err != nil {
+			errs = append(errs, fmt.Errorf("metrics_addr %q: %v", c.MetricsAddr, err))
+		}
+	}
+	if c.PageSize < 1 || c.PageSize > 1000 {
+		errs = append(errs, fmt.Errorf("page_size must be between 1 and 1000, got %d", c.PageSize))
+	}
+	if c.CacheMaxAge < 0 || c.StaticMaxAge < 0 {
+		errs = append(errs, fmt.Errorf("cache_max_age and static_max_age must not be negative, got %d and %d", c.CacheMaxAge, c.StaticMaxAge))
+	}
+	if c.PageCacheBytes < 0 {
+		errs = append(errs, fmt.Errorf("page_cache_bytes must not be negative, got %d", c.PageCacheBytes))
+	}
+	if c.BaseURL != "" {
+		u, err := url.Parse(c.BaseURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("base_url %q must be an absolute http(s) URL", c.BaseURL))
+		}
+		c.BaseURL = strings.TrimSuffix(c.BaseURL, "/")
+	}
+	if loc, err := time.LoadLocation(c.Timezone); err != nil {
+		errs = append(errs, fmt.Errorf("timezone %q: %v", c.Timezone, err))
+	} else {
+		c.location = loc
+	}
+	if strings.ContainsAny(c.CSP+c.FrameAncestors+c.ReferrerPolicy+c.PermissionsPolicy, "\r\n") {
+		errs = append(errs, errors.New("security header settings must not contain line breaks"))
+	}
+	if c.HSTSMaxAge < 0 {
+		errs = append(errs, fmt.Errorf("hsts_max_age must not be negative, got %d", c.HSTSMaxAge))
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		errs = append(errs, errors.New("tls_cert and tls_key must be set together"))
+	}
+	if c.TLSSelfSigned && c.TLSCert != "" {
+		errs = append(errs, errors.New("tls_self_signed cannot be combined with tls_cert"))
+	}
+	if c.TLSRedirectAddr != "" {
+		if !c.TLSEnabled() {
+			errs = append(errs, errors.New("tls_redirect_addr needs TLS to be enabled"))
+		} else if _, _, err := net.SplitHostPort(c.TLSRedirectAddr); err != nil {
+			errs = append(errs, fmt.Errorf("tls_redirect_addr %q: %v", c.TLSRedirectAddr, err))
+		}
+	}
+	if c.Newsletter != "off" && !c.NewsletterEnabled() {
+		errs = append(errs, fmt.Errorf("newsletter must be off, immediate or weekly, got %q", c.Newsletter))
+	}
+	if d, ok := parseWeekday(c.DigestDay); ok {
+		c.digestDay = d
+	} else {
+		errs = append(errs, fmt.Errorf("digest_day %q is not a day of the week", c.DigestDay))
+	}
+	if c.NewsletterEnabled() {
+		if _, _, err := net.SplitHostPort(c.SMTPAddr); err != nil {
+			errs = append(errs, fmt.Errorf("smtp_addr %q: %v", c.SMTPAddr, err))
+		}
+		if _, err := mail.ParseAddress(c.SMTPFrom); err != nil {
+			errs = append(errs, fmt.Errorf("smtp_from %q: %v", c.SMTPFrom, err))
+		}
+		if c.BaseURL == "" {
+			errs = append(errs, errors.New("the newsletter needs base_url for the links in its emails"))
+		}
+	}
+	if c.FediverseUser != "" && !fediverseUserRe.MatchString(c.FediverseUser) {
+		errs = append(errs, fmt.Errorf("fediverse_user %q may only hold letters, digits and underscores", c.FediverseUser))
+	}
+	if nets, err := parseTrustedProxies(c.TrustedProxies); err != nil {
+		errs = append(errs, fmt.Errorf("trusted_proxies: %v", err))
+	} else {
+		c.proxies = nets
+	}
+	return errors.Join(errs...)
+}
+
+// String renders the config as indented JSON with the password masked.
+func (c Config) String() string {
+	if c.AdminPass != "" {
+		c.AdminPass = "********"
+	}
+	if c.MetricsToken != "" {
+		c.MetricsToken = "********"
+	}
+	if c.SMTPPass != "" {
+		c.SMTPPass = "********"
+	}
+	b, _ := json.MarshalIndent(c, "", "  ")
+	return string(b)
+}
+
+// configVar binds one setting to a flag name and a BLOG_* variable.
+type configVar struct {
+	flag  string
+	usage string
+	set   func(c *Config, v string) error
+}
+
+// env returns the environment variable name for v, e.g. BLOG_ADMIN_USER.
+func (v configVar) env() string {
+	return "BLOG_" + strings.ToUpper(strings.ReplaceAll(v.flag, "-", "_"))
+}
+
+var fediverseUserRe = regexp.MustCompile(`^[A-Za-z0-9_]{1,30}$`)
+
+// parseWeekday reads a day name such as "monday", in any case.
+func parseWeekday(s string) (time.Weekday, bool) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(s, d.String()) {
+			return d, true
+		}
+	}
+	return 0, false
+}
+
+func parseInt(v string, dst *int) error {
+	n, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil {
+		return err
+	}
+	*dst = n
+	return nil
+}
+
+var configVars = []configVar{
+	{"addr", "listen address, e.g. :8080", func(c *Config, v string) error { c.ListenAddr = v; return nil }},
+	{"storage", "directory holding article JSON files", func(c *Config, v string) error { c.StorageDir = v; return nil }},
+	{"admin-user", "admin username", func(c *Config, v string) error { c.AdminUser = v; return nil }},
+	{"admin-pass", "admin password", func(c *Config, v string) error { c.AdminPass = v; return nil }},
+	{"session-cookie", "session cookie name", func(c *Config, v string) error { c.SessionCookie = v; return nil }},
+	{"session-max-age", "session lifetime in seconds", func(c *Config, v string) error { return parseInt(v, &c.SessionMaxAge) }},
+	{"trusted-proxies", "comma-separated proxy IPs/CIDRs whose forwarding headers are trusted", func(c *Config, v string) error {
+		c.TrustedProxies = nil
+		for _, p := range strings.Split(v, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				c.TrustedProxies = append(c.TrustedProxies, p)
+			}
+		}
+		return nil
+	}},
+	{"read-header-timeout", "seconds allowed to read request headers", func(c *Config, v string) error { return parseInt(v, &c.ReadHeaderTimeout) }},
+	{"read-timeout", "seconds allowed to read a whole request", func(c *Config, v string) error { return parseInt(v, &c.ReadTimeout) }},
+	{"write-timeout", "seconds allowed to write a response", func(c *Config, v string) error { return parseInt(v, &c.WriteTimeout) }},
+	{"idle-timeout", "seconds an idle keep-alive connection stays open", func(c *Config, v string) error { return parseInt(v, &c.IdleTimeout) }},
+	{"shutdown-timeout", "seconds to drain in-flight requests on SIGTERM", func(c *Config, v string) error { return parseInt(v, &c.ShutdownTimeout) }},
+	{"metrics-addr", "separate listen address for /metrics, e.g. 127.0.0.1:9090", func(c *Config, v string) error { c.MetricsAddr = v; return nil }},
+	{"metrics-token", "bearer token required to scrape /metrics", func(c *Config, v string) error { c.MetricsToken = v; return nil }},
+	{"log-format", "log output format: text or json", func(c *Config, v string) error { c.LogFormat = v; return nil }},
+	{"log-level", "minimum log level: debug, info, warn or error", func(c *Config, v string) error { c.LogLevel = v; return nil }},
+	{"site-title", "site title shown in the header and <title>", func(c *Config, v string) error { c.SiteTitle = v; return nil }},
+	{"author", "site author", func(c *Config, v string) error { c.Author = v; return nil }},
+	{"base-url", "public URL of the site, e.g. https://blog.example.com", func(c *Config, v string) error { c.BaseURL = v; return nil }},
+	{"page-size", "articles per page on Home", func(c *Config, v string) error { return parseInt(v, &c.PageSize) }},
+	{"timezone", "IANA time zone for publication dates, e.g. Europe/Berlin", func(c *Config, v string) error { c.Timezone = v; return nil }},
+	{"cache-max-age", "Cache-Control max-age in seconds for public pages", func(c *Config, v string) error { return parseInt(v, &c.CacheMaxAge) }},
+	{"static-max-age", "Cache-Control max-age in seconds for static assets", func(c *Config, v string) error { return parseInt(v, &c.StaticMaxAge) }},
+	{"page-cache-bytes", "memory for cached rendered pages in bytes; 0 disables", func(c *Config, v string) error { return parseInt(v, &c.PageCacheBytes) }},
+	{"csp", "Content-Security-Policy; {nonce} is replaced per request", func(c *Config, v string) error { c.CSP = v; return nil }},
+	{"csp-report-only", "send the CSP as Content-Security-Policy-Report-Only", func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		c.CSPReportOnly = b
+		return err
+	}},
+	{"frame-ancestors", "CSP frame-ancestors sources, e.g. 'self'; empty allows framing", func(c *Config, v string) error { c.FrameAncestors = v; return nil }},
+	{"referrer-policy", "Referrer-Policy header value", func(c *Config, v string) error { c.ReferrerPolicy = v; return nil }},
+	{"permissions-policy", "Permissions-Policy header value", func(c *Config, v string) error { c.PermissionsPolicy = v; return nil }},
+	{"tls-cert", "TLS certificate file (PEM); reloaded when it changes", func(c *Config, v string) error { c.TLSCert = v; return nil }},
+	{"tls-key", "TLS private key file (PEM)", func(c *Config, v string) error { c.TLSKey = v; return nil }},
+	{"tls-self-signed", "serve HTTPS with an in-memory self-signed certificate (development)", func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		c.TLSSelfSigned = b
+		return err
+	}},
+	{"tls-redirect-addr", "plain-HTTP listen address that redirects to HTTPS, e.g. :80", func(c *Config, v string) error { c.TLSRedirectAddr = v; return nil }},
+	{"hsts-max-age", "Strict-Transport-Security max-age in seconds over TLS; 0 disables", func(c *Config, v string) error { return parseInt(v, &c.HSTSMaxAge) }},
+	{"newsletter", "email new articles to subscribers: off, immediate or weekly", func(c *Config, v string) error { c.Newsletter = v; return nil }},
+	{"digest-day", "day of the week the weekly digest is sent", func(c *Config, v string) error { c.DigestDay = v; return nil }},
+	{"smtp-addr", "SMTP server for newsletter mail, e.g. smtp.example.com:587", func(c *Config, v string) error { c.SMTPAddr = v; return nil }},
+	{"smtp-user", "SMTP username; empty sends without authentication", func(c *Config, v string) error { c.SMTPUser = v; return nil }},
+	{"smtp-pass", "SMTP password", func(c *Config, v string) error { c.SMTPPass = v; return nil }},
+	{"smtp-from", "From address of newsletter mail, e.g. Blog <blog@example.com>", func(c *Config, v string) error { c.SMTPFrom = v; return nil }},
+	{"fediverse-user", "ActivityPub account name the blog is followed as; empty disables", func(c *Config, v string) error { c.FediverseUser = v; return nil }},
+}
+
+// configFlags collects config flags during parsing; they are applied last
+// by load so they override the file and environment.
+type configFlags struct {
+	path string
+	set  map[string]string
+}
+
+// addConfigFlags registers -config and one flag per configVar on fs.
+func addConfigFlags(fs *flag.FlagSet) *configFlags {
+	cf := &configFlags{set: map[string]string{}}
+	fs.StringVar(&cf.path, "config", "", "path to a JSON config file (or $BLOG_CONFIG)")
+	for _, v := range configVars {
+		name := v.flag
+		fs.Func(name, v.usage+" ($"+v.env()+")", func(s string) error {
+			cf.set[name] = s
+			return nil
+		})
+	}
+	return cf
+}
+
+// load builds the effective Config from defaults, file, environment and flags.
+func (cf *configFlags) load() (Config, error) {
+	c := defaultConfig()
+	path := cf.path
+	if path == "" {
+		path = os.Getenv("BLOG_CONFIG")
+	}
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return c, err
+		}
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&c); err != nil {
+			return c, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	for _, v := range configVars {
+		if s, ok := os.LookupEnv(v.env()); ok {
+			if err := v.set(&c, s); err != nil {
+				return c, fmt.Errorf("$%s: %v", v.env(), err)
+			}
+		}
+	}
+	for _, v := range configVars {
+		if s, ok := cf.set[v.flag]; ok {
+			if err := v.set(&c, s); err != nil {
+				return c, fmt.Errorf("-%s: %v", v.flag, err)
+			}
+		}
+	}
+	if err := c.validate(); err != nil {
+		return c, err
+	}
+	return c, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfig_Precedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blog.json")
+	file := `{"listen_addr": ":9000", "site_title": "From File", "page_size": 5, "author": "File Author"}`
+	if err := os.WriteFile(path, []byte(file), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("BLOG_SITE_TITLE", "From Env")
+	t.Setenv("BLOG_PAGE_SIZE", "7")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cf := addConfigFlags(fs)
+	if err := fs.Parse([]string{"-config", path, "-page-size", "3", "-timezone", "Europe/Berlin"}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := cf.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ListenAddr != ":9000" || c.Author != "File Author" {
+		t.Fatalf("file values not applied: %+v", c)
+	}
+	if c.SiteTitle != "From Env" {
+		t.Fatalf("env should override file: site_title=%q", c.SiteTitle)
+	}
+	if c.PageSize != 3 {
+		t.Fatalf("flag should override env: page_size=%d", c.PageSize)
+	}
+	if c.Location().String() != "Europe/Berlin" {
+		t.Fatalf("timezone not resolved: %v", c.Location())
+	}
+	if c.AdminUser != "admin" || c.StorageDir != "data" {
+		t.Fatalf("defaults lost: %+v", c)
+	}
+	if c.BaseURL = "https://blog.example"; c.Federating() {
+		t.Fatal("federation is on without fediverse_user")
+	}
+	if s := c.String(); strings.Contains(s, c.AdminPass) {
+		t.Fatalf("printed config leaks the password: %s", s)
+	}
+}
+
+func TestConfig_Validation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blog.json")
+	if err := os.WriteFile(path, []byte(`{"page_sise": 5}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cf := addConfigFlags(fs)
+	_ = fs.Parse([]string{"-config", path})
+	if _, err := cf.load(); err == nil || !strings.Contains(err.Error(), "page_sise") {
+		t.Fatalf("unknown field should be rejected, got %v", err)
+	}
+
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	cf = addConfigFlags(fs)
+	_ = fs.Parse([]string{"-addr", "8080", "-page-size", "0", "-timezone", "Mars/Olympus", "-base-url", "blog.example.com", "-trusted-proxies", "10.0.0.0/33",
+		"-newsletter", "weekly", "-digest-day", "Funday", "-smtp-addr", "smtp.example.com", "-smtp-from", "not an address"})
+	_, err := cf.load()
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, want := range []string{"listen_addr", "page_size", "timezone", "base_url", "trusted_proxies", "digest_day", "smtp_addr", "smtp_from"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error should mention %s: %v", want, err)
+		}
+	}
+}
+
+func TestHome_Pagination(t *testing.T) {
+	resetStorage(t)
+	saved := cfg
+	defer func() { cfg = saved }()
+	cfg.PageSize = 2
+	cfg.SiteTitle = "Paged Blog"
+
+	for i := 1; i <= 5; i++ {
+		a := Article{Title: fmt.Sprintf("Post %d", i), Slug: fmt.Sprintf("post-%d", i), Content: "x", Published: time.Date(2024, 1, i, 0, 0, 0, 0, time.UTC)}
+		if err := saveArticle(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ts := httptest.NewServer(buildMux())
+	defer ts.Close()
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	status, body := get("/")
+	if status != http.StatusOK || !strings.Contains(body, "Post 5") || strings.Contains(body, "Post 3") {
+		t.Fatalf("page 1 should hold the two newest posts: %d %s", status, body)
+	}
+	if !strings.Contains(body, "Paged Blog") || !strings.Contains(body, `href="/page/2"`) {
+		t.Fatalf("page 1 missing site title or next link: %s", body)
+	}
+	status, body = get("/page/3")
+	if status != http.StatusOK || !strings.Contains(body, "Post 1") || !strings.Contains(body, "Page 3 of 3") {
+		t.Fatalf("page 3: %d %s", status, body)
+	}
+	if status, _ = get("/page/4"); status != http.StatusNotFound {
+		t.Fatalf("page past the end status=%d, want 404", status)
+	}
+}
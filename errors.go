@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+)
+
+// --------------------------- Error pages -----------------------
+
+// errorPages holds the guest-facing wording per status. Anything else falls
+// back to the 500 copy.
+var errorPages = map[int]struct{ Heading, Message string }{
+	http.StatusBadRequest:          {"Bad request", "The request couldn't be understood."},
+	http.StatusNotFound:            {"Page not found", "The page you're looking for doesn't exist."},
+	http.StatusGone:                {"Gone", "This article has been removed."},
+	http.StatusForbidden:           {"Forbidden", "You don't have permission to do that."},
+	http.StatusInternalServerError: {"Something went wrong", "An unexpected error occurred. It has been logged; please try again later."},
+}
+
+// renderError writes a branded error page. err is logged for 5xx responses
+// and only shown on the page to logged-in admins, so guests never see file
+// paths or other internals.
+func renderError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	if status >= 500 && err != nil {
+		slog.ErrorContext(r.Context(), "handler error", "method", r.Method, "path", r.URL.Path, "status", status, "err", err)
+	}
+	page, ok := errorPages[status]
+	if !ok {
+		page = errorPages[http.StatusInternalServerError]
+	}
+	data := map[string]any{
+		"Active":    "error",
+		"Title":     page.Heading,
+		"Status":    status,
+		"Heading":   page.Heading,
+		"Message":   page.Message,
+		"RequestID": requestID(r.Context()),
+		"Nonce":     cspNonce(r.Context()),
+		"Static":    isStaticBuild(r.Context()),
+	}
+	if err != nil && isAuthed(r) {
+		data["Detail"] = err.Error()
+	}
+	var buf bytes.Buffer
+	if terr := tmpl.ExecuteTemplate(&buf, "base", data); terr != nil {
+		slog.ErrorContext(r.Context(), "render error page", "err", terr)
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_, _ = buf.WriteTo(w)
+}
+
+func notFound(w http.ResponseWriter, r *http.Request) {
+	renderError(w, r, http.StatusNotFound, nil)
+}
+
+// serverError logs err with the request ID and answers with the 500 page.
+func serverError(w http.ResponseWriter, r *http.Request, err error) {
+	renderError(w, r, http.StatusInternalServerError, err)
+}
+
+// --------------------------- Middleware ------------------------
+
+// headerRecorder notes whether the response has started, so recovery knows
+// whether an error page can still be sent.
+type headerRecorder struct {
+	http.ResponseWriter
+	wrote bool
+}
+
+func (h *headerRecorder) WriteHeader(code int) {
+	h.wrote = true
+	h.ResponseWriter.WriteHeader(code)
+}
+
+func (h *headerRecorder) Write(b []byte) (int, error) {
+	h.wrote = true
+	return h.ResponseWriter.Write(b)
+}
+
+func (h *headerRecorder) Unwrap() http.ResponseWriter { return h.ResponseWriter }
+
+// recoverPanic turns a handler panic into a logged stack trace and a 500
+// page instead of a reset connection.
+func recoverPanic(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hw := &headerRecorder{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler { // deliberate abort; let net/http handle it
+				panic(v)
+			}
+			err, ok := v.(error)
+			if !ok {
+				err = fmt.Errorf("%v", v)
+			}
+			slog.ErrorContext(r.Context(), "panic", "method", r.Method, "path", r.URL.Path, "err", err, "stack", string(debug.Stack()))
+			if hw.wrote {
+				return // too late for an error page; the client gets a truncated response
+			}
+			renderError(hw, r, http.StatusInternalServerError, errors.Join(errors.New("panic"), err))
+		}()
+		next.ServeHTTP(hw, r)
+	})
+}
+
+// --------------------------- Templates (Errors) ----------------
+
+const errorHTML = `{{define "error"}}
+  <div class="card">
+    <div class="muted">Error {{.Status}}</div>
+    <h1 class="m-0 mt-4 mb-8">{{.Heading}}</h1>
+    <p>{{.Message}}</p>
+    {{with .Detail}}<pre class="card danger pre mt-12">{{.}}</pre>{{end}}
+    {{with .RequestID}}<div class="muted mt-12">Reference: <code>{{.}}</code></div>{{end}}
+    <div class="mt-12"><a href="/">← Back to Home</a></div>
+  </div>
+{{end}}`
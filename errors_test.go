@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecoverPanic_BrandedPageAndStack(t *testing.T) {
+	resetStorage(t)
+	buf := captureLogs(t)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/boom", func(w http.ResponseWriter, r *http.Request) {
+		panic("open /srv/blog/data/secret.json: permission denied")
+	})
+	mux.HandleFunc("/admin/login", adminLoginPost)
+	ts := httptest.NewServer(logRequest(instrument(recoverPanic(mux))))
+	defer ts.Close()
+
+	status, body := getBody(t, ts.URL, "/boom", "")
+	if status != http.StatusInternalServerError {
+		t.Fatalf("panic status=%d, want 500", status)
+	}
+	if !strings.Contains(body, "Something went wrong") || strings.Contains(body, "/srv/blog") {
+		t.Fatalf("guest error page should be branded and hide details: %s", body)
+	}
+
+	lines := logLines(t, buf)
+	var panicLine map[string]any
+	for _, l := range lines {
+		if l["msg"] == "panic" {
+			panicLine = l
+		}
+	}
+	if panicLine == nil || panicLine["request_id"] == "" || !strings.Contains(panicLine["stack"].(string), "errors_test.go") {
+		t.Fatalf("panic not logged with request ID and stack: %v", lines)
+	}
+	if !strings.Contains(body, panicLine["request_id"].(string)) {
+		t.Fatalf("error page should show the request ID as a reference: %s", body)
+	}
+
+	cookie := login(t, ts.URL, cfg.AdminUser, cfg.AdminPass)
+	if _, body = getBody(t, ts.URL, "/boom", cookie); !strings.Contains(body, "/srv/blog/data/secret.json") {
+		t.Fatalf("admins should see the error detail: %s", body)
+	}
+}
+
+func TestErrorPages_NotFoundGoneForbidden(t *testing.T) {
+	resetStorage(t)
+	ts := httptest.NewServer(buildMux())
+	defer ts.Close()
+
+	status, body := getBody(t, ts.URL, "/article/nope", "")
+	if status != http.StatusNotFound || !strings.Contains(body, "Page not found") || !strings.Contains(body, "<html") {
+		t.Fatalf("404 page: %d %s", status, body)
+	}
+	if status, body = getBody(t, ts.URL, "/no/such/page", ""); status != http.StatusNotFound || !strings.Contains(body, "Page not found") {
+		t.Fatalf("unknown path: %d %s", status, body)
+	}
+
+	a := Article{Title: "Short Lived", Slug: "short-lived", Content: "x", Published: time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)}
+	if err := saveArticle(a); err != nil {
+		t.Fatal(err)
+	}
+	if err := deleteArticle(a.Slug); err != nil {
+		t.Fatal(err)
+	}
+	if status, body = getBody(t, ts.URL, "/article/short-lived", ""); status != http.StatusGone || !strings.Contains(body, "has been removed") {
+		t.Fatalf("deleted article: %d %s", status, body)
+	}
+	if err := saveArticle(a); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ = getBody(t, ts.URL, "/article/short-lived", ""); status != http.StatusOK {
+		t.Fatalf("re-created article status=%d, want 200", status)
+	}
+
+	resp := postForm(t, ts.URL, "/admin/delete/short-lived", "", nil)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("anonymous delete status=%d, want 403", resp.StatusCode)
+	}
+	if _, err := loadArticle("short-lived"); err != nil {
+		t.Fatalf("anonymous delete must not remove the article: %v", err)
+	}
+}
@@ -0,0 +1,587 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --------------------------- Export ----------------------------
+// Markdown export writes one <slug>.md per article with YAML front matter
+// that the Markdown importer reads back; EPUB export bundles published
+// articles, oldest first, into an EPUB 3 book.
+
+// exportFilter selects the articles to export; zero fields match all.
+type exportFilter struct {
+	Tag   string
+	Since time.Time // inclusive
+	Until time.Time // exclusive
+}
+
+// parseExportFilter reads a tag and YYYY-MM-DD bounds; to includes the
+// whole day.
+func parseExportFilter(tag, from, to string) (exportFilter, error) {
+	f := exportFilter{Tag: strings.ToLower(strings.TrimSpace(tag))}
+	if from != "" {
+		t, err := time.ParseInLocation("2006-01-02", from, cfg.Location())
+		if err != nil {
+			return f, fmt.Errorf("invalid from date %q (use YYYY-MM-DD)", from)
+		}
+		f.Since = t
+	}
+	if to != "" {
+		t, err := time.ParseInLocation("2006-01-02", to, cfg.Location())
+		if err != nil {
+			return f, fmt.Errorf("invalid to date %q (use YYYY-MM-DD)", to)
+		}
+		f.Until = t.AddDate(0, 0, 1)
+	}
+	return f, nil
+}
+
+func (f exportFilter) match(a Article) bool {
+	if f.Tag != "" && !containsString(a.Tags, f.Tag) {
+		return false
+	}
+	if !f.Since.IsZero() && a.Published.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !a.Published.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// selectArticles returns the matching articles, oldest first.
+func selectArticles(f exportFilter, drafts bool) ([]Article, error) {
+	arts, err := allArticles()
+	if err != nil {
+		return nil, err
+	}
+	var out []Article
+	for _, a := range arts {
+		if f.match(a) && (drafts || !a.Draft) {
+			out = append(out, a)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Published.Before(out[j].Published) })
+	return out, nil
+}
+
+// --------------------------- Markdown export -------------------
+
+// yamlList renders a flow list of quoted strings.
+func yamlList(items []string) string {
+	q := make([]string, len(items))
+	for i, s := range items {
+		q[i] = strconv.Quote(s)
+	}
+	return "[" + strings.Join(q, ", ") + "]"
+}
+
+// articleMarkdown renders a with front matter in the shape markdownEntry
+// reads, so an export can be imported again unchanged.
+func articleMarkdown(a Article) []byte {
+	var b bytes.Buffer
+	b.WriteString("---\n")
+	fmt.Fprintf(&b, "title: %s\n", strconv.Quote(a.Title))
+	fmt.Fprintf(&b, "slug: %s\n", a.Slug)
+	fmt.Fprintf(&b, "date: %s\n", a.Published.Format(time.RFC3339))
+	if !a.UpdatedAt.IsZero() {
+		fmt.Fprintf(&b, "lastmod: %s\n", a.UpdatedAt.Format(time.RFC3339))
+	}
+	if a.Author != "" {
+		fmt.Fprintf(&b, "author: %s\n", strconv.Quote(a.Author))
+	}
+	if a.Draft {
+		b.WriteString("draft: true\n")
+	}
+	if len(a.Tags) > 0 {
+		fmt.Fprintf(&b, "tags: %s\n", yamlList(a.Tags))
+	}
+	if len(a.Aliases) > 0 {
+		fmt.Fprintf(&b, "aliases: %s\n", yamlList(a.Aliases))
+	}
+	b.WriteString("---\n\n")
+	b.WriteString(a.Content)
+	b.WriteString("\n")
+	return b.Bytes()
+}
+
+// writeMarkdownZip writes every article as <slug>.md into a zip.
+func writeMarkdownZip(w io.Writer, arts []Article) error {
+	zw := zip.NewWriter(w)
+	for _, a := range arts {
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: a.Slug + ".md", Method: zip.Deflate, Modified: a.Modified()})
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(articleMarkdown(a)); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// writeMarkdownDir writes every article as dir/<slug>.md.
+func writeMarkdownDir(dir string, arts []Article) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	for _, a := range arts {
+		if err := os.WriteFile(filepath.Join(dir, a.Slug+".md"), articleMarkdown(a), 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// --------------------------- EPUB export -----------------------
+
+const epubCSS = `body{font-family:serif;line-height:1.5}
+h1{font-size:1.6em;margin-bottom:.2em}
+.meta{color:#666;font-size:.9em;margin-bottom:1.5em}
+pre{white-space:pre-wrap;font-size:.9em}
+blockquote{margin-left:1em;padding-left:1em;border-left:3px solid #ccc}
+img{max-width:100%}
+`
+
+var imageTypes = map[string]string{".png": "image/png", ".jpg": "image/jpeg", ".jpeg": "image/jpeg", ".gif": "image/gif", ".svg": "image/svg+xml", ".webp": "image/webp"}
+
+// epubImage is an image embedded in the book.
+type epubImage struct {
+	href, mediaType string
+	body            []byte
+}
+
+// epubImages embeds local images. Root-relative or relative sources are
+// looked up below root; remote ones cannot be embedded (there is no
+// network access during export) and stay as links.
+type epubImages struct {
+	root   string
+	byPath map[string]*epubImage
+	list   []*epubImage
+}
+
+// embed returns the book-relative href for src, or "" if it is not local.
+func (e *epubImages) embed(src string) string {
+	if e.root == "" || strings.Contains(src, "://") || strings.HasPrefix(src, "data:") || strings.HasPrefix(src, "//") {
+		return ""
+	}
+	if i := strings.IndexAny(src, "?#"); i >= 0 {
+		src = src[:i]
+	}
+	rel := strings.TrimPrefix(path.Clean("/"+src), "/")
+	mt := imageTypes[strings.ToLower(path.Ext(rel))]
+	if mt == "" || rel == "" {
+		return ""
+	}
+	if img, ok := e.byPath[rel]; ok {
+		return img.href
+	}
+	b, err := os.ReadFile(filepath.Join(e.root, filepath.FromSlash(rel)))
+	if err != nil {
+		return ""
+	}
+	img := &epubImage{href: fmt.Sprintf("images/%d%s", len(e.list)+1, strings.ToLower(path.Ext(rel))), mediaType: mt, body: b}
+	e.byPath[rel] = img
+	e.list = append(e.list, img)
+	return img.href
+}
+
+func xmlEscape(s string) string { return html.EscapeString(s) }
+
+// bookID derives a stable urn:uuid from the selection, so re-exporting the
+// same articles yields the same book identity.
+func bookID(arts []Article) string {
+	var key strings.Builder
+	for _, a := range arts {
+		key.WriteString(a.Slug + "\n")
+	}
+	h := contentHash([]byte(key.String()))
+	return fmt.Sprintf("urn:uuid:%s-%s-5%s-8%s-%s", h[0:8], h[8:12], h[13:16], h[17:20], h[20:32])
+}
+
+// writeEPUB writes an EPUB 3 book of arts in the given order. imageRoot is
+// where local image paths are resolved ("" embeds none).
+func writeEPUB(w io.Writer, title string, arts []Article, imageRoot string) error {
+	zw := zip.NewWriter(w)
+	add := func(name string, method uint16, body string) error {
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: method})
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(f, body)
+		return err
+	}
+	// the mimetype entry must come first and be stored uncompressed
+	if err := add("mimetype", zip.Store, "application/epub+zip"); err != nil {
+		return err
+	}
+	if err := add("META-INF/container.xml", zip.Deflate, `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles><rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/></rootfiles>
+</container>
+`); err != nil {
+		return err
+	}
+
+	images := &epubImages{root: imageRoot, byPath: map[string]*epubImage{}}
+	var manifest, spine, toc strings.Builder
+	var modified time.Time
+	for i, a := range arts {
+		name := fmt.Sprintf("chapter-%03d.xhtml", i+1)
+		if t := a.Modified(); t.After(modified) {
+			modified = t
+		}
+		meta := "Published " + a.Published.In(cfg.Location()).Format("Jan 02, 2006")
+		if a.Author != "" {
+			meta += " by " + a.Author
+		}
+		body := markdownToXHTML(a.Content, images.embed)
+		page := xhtmlPage(a.Title, fmt.Sprintf("<h1>%s</h1>\n<div class=\"meta\">%s</div>\n%s", xmlEscape(a.Title), xmlEscape(meta), body))
+		if err := add("OEBPS/"+name, zip.Deflate, page); err != nil {
+			return err
+		}
+		fmt.Fprintf(&manifest, "    <item id=\"c%d\" href=\"%s\" media-type=\"application/xhtml+xml\"/>\n", i+1, name)
+		fmt.Fprintf(&spine, "    <itemref idref=\"c%d\"/>\n", i+1)
+		fmt.Fprintf(&toc, "      <li><a href=\"%s\">%s</a></li>\n", name, xmlEscape(a.Title))
+	}
+	for i, img := range images.list {
+		f, err := zw.Create("OEBPS/" + img.href)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(img.body); err != nil {
+			return err
+		}
+		fmt.Fprintf(&manifest, "    <item id=\"img%d\" href=\"%s\" media-type=\"%s\"/>\n", i+1, img.href, img.mediaType)
+	}
+	if modified.IsZero() {
+		modified = time.Now()
+	}
+
+	nav := xhtmlPage("Contents", fmt.Sprintf("<nav epub:type=\"toc\" id=\"toc\">\n    <h1>Contents</h1>\n    <ol>\n%s    </ol>\n  </nav>", toc.String()))
+	if err := add("OEBPS/nav.xhtml", zip.Deflate, nav); err != nil {
+		return err
+	}
+	if err := add("OEBPS/style.css", zip.Deflate, epubCSS); err != nil {
+		return err
+	}
+	creator := ""
+	if cfg.Author != "" {
+		creator = "\n    <dc:creator>" + xmlEscape(cfg.Author) + "</dc:creator>"
+	}
+	opf := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="bookid">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="bookid">%s</dc:identifier>
+    <dc:title>%s</dc:title>
+    <dc:language>en</dc:language>%s
+    <meta property="dcterms:modified">%s</meta>
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="css" href="style.css" media-type="text/css"/>
+%s  </manifest>
+  <spine>
+    <itemref idref="nav"/>
+%s  </spine>
+</package>
+`, bookID(arts), xmlEscape(title), creator, modified.UTC().Format("2006-01-02T15:04:05Z"), manifest.String(), spine.String())
+	if err := add("OEBPS/content.opf", zip.Deflate, opf); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func xhtmlPage(title, body string) string {
+	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" lang="en" xml:lang="en">
+<head>
+  <title>%s</title>
+  <link rel="stylesheet" type="text/css" href="style.css"/>
+</head>
+<body>
+  %s
+</body>
+</html>
+`, xmlEscape(title), body)
+}
+
+// --------------------------- Markdown to XHTML -----------------
+
+var (
+	mdHeading  = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*$`)
+	mdListItem = regexp.MustCompile(`^\s*(?:[-*+]|(\d+)[.)])\s+(.*)$`)
+	mdRule     = regexp.MustCompile(`^\s*(?:-\s*){3,}$|^\s*(?:\*\s*){3,}$`)
+	mdImage    = regexp.MustCompile(`!\[([^\]]*)\]\(([^)\s]+)\)`)
+	mdLink     = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+	mdStrong   = regexp.MustCompile(`\*\*(.+?)\*\*|__(.+?)__`)
+	mdEm       = regexp.MustCompile(`\*([^*\s][^*]*?)\*|(^|[^\w])_([^_\s][^_]*?)_([^\w]|$)`)
+)
+
+// markdownToXHTML renders the Markdown the importers produce (paragraphs,
+// headings, lists, quotes, code, emphasis, links and images) as
+// well-formed XHTML. Headings are shifted down one level below the
+// chapter title. image maps a source to an embedded href, "" to keep it
+// as a link.
+func markdownToXHTML(md string, image func(src string) string) string {
+	var out strings.Builder
+	lines := strings.Split(strings.ReplaceAll(md, "\r\n", "\n"), "\n")
+	var para []string
+	flush := func() {
+		if len(para) == 0 {
+			return
+		}
+		var p []string
+		for i, l := range para {
+			s := mdInline(strings.TrimSpace(l), image)
+			if i < len(para)-1 && strings.HasSuffix(l, "  ") {
+				s += "<br/>"
+			}
+			p = append(p, s)
+		}
+		out.WriteString("<p>" + strings.Join(p, "\n") + "</p>\n")
+		para = nil
+	}
+	for i := 0; i < len(lines); i++ {
+		l := lines[i]
+		trimmed := strings.TrimSpace(l)
+		switch {
+		case trimmed == "":
+			flush()
+		case strings.HasPrefix(trimmed, "```"):
+			flush()
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), "```"); i++ {
+				code = append(code, lines[i])
+			}
+			out.WriteString("<pre><code>" + xmlEscape(strings.Join(code, "\n")) + "</code></pre>\n")
+		case mdHeading.MatchString(trimmed):
+			flush()
+			m := mdHeading.FindStringSubmatch(trimmed)
+			lvl := min(len(m[1])+1, 6)
+			fmt.Fprintf(&out, "<h%d>%s</h%d>\n", lvl, mdInline(m[2], image), lvl)
+		case mdRule.MatchString(l):
+			flush()
+			out.WriteString("<hr/>\n")
+		case strings.HasPrefix(trimmed, ">"):
+			flush()
+			var quote []string
+			for ; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), ">"); i++ {
+				q := strings.TrimPrefix(strings.TrimSpace(lines[i]), ">")
+				quote = append(quote, strings.TrimPrefix(q, " "))
+			}
+			i--
+			out.WriteString("<blockquote>\n" + markdownToXHTML(strings.Join(quote, "\n"), image) + "</blockquote>\n")
+		case mdListItem.MatchString(l):
+			flush()
+			tag := "ul"
+			if mdListItem.FindStringSubmatch(l)[1] != "" {
+				tag = "ol"
+			}
+			out.WriteString("<" + tag + ">\n")
+			for ; i < len(lines) && mdListItem.MatchString(lines[i]); i++ {
+				out.WriteString("<li>" + mdInline(mdListItem.FindStringSubmatch(lines[i])[2], image) + "</li>\n")
+			}
+			i--
+			out.WriteString("</" + tag + ">\n")
+		default:
+			para = append(para, l)
+		}
+	}
+	flush()
+	return out.String()
+}
+
+// mdInline renders code spans, images, links and emphasis in one line.
+func mdInline(s string, image func(string) string) string {
+	parts := strings.Split(s, "`")
+	for i, p := range parts {
+		if i%2 == 1 && i < len(parts)-1 {
+			parts[i] = "<code>" + xmlEscape(p) + "</code>"
+			continue
+		}
+		if i%2 == 1 { // unmatched backtick
+			p = "`" + p
+		}
+		p = xmlEscape(p)
+		p = mdImage.ReplaceAllStringFunc(p, func(m string) string {
+			sub := mdImage.FindStringSubmatch(m)
+			alt, src := sub[1], html.UnescapeString(sub[2])
+			if href := image(src); href != "" {
+				return fmt.Sprintf(`<img src="%s" alt="%s"/>`, href, alt)
+			}
+			if !safeHref(src) {
+				return alt
+			}
+			if alt == "" {
+				alt = "image"
+			}
+			return fmt.Sprintf(`<a href="%s">%s</a>`, xmlEscape(src), alt)
+		})
+		p = mdLink.ReplaceAllStringFunc(p, func(m string) string {
+			sub := mdLink.FindStringSubmatch(m)
+			if !safeHref(html.UnescapeString(sub[2])) {
+				return sub[1]
+			}
+			return fmt.Sprintf(`<a href="%s">%s</a>`, sub[2], sub[1])
+		})
+		p = mdStrong.ReplaceAllString(p, "<strong>$1$2</strong>")
+		p = mdEm.ReplaceAllStringFunc(p, func(m string) string {
+			sub := mdEm.FindStringSubmatch(m)
+			if sub[1] != "" {
+				return "<em>" + sub[1] + "</em>"
+			}
+			return sub[2] + "<em>" + sub[3] + "</em>" + sub[4]
+		})
+		parts[i] = p
+	}
+	return strings.Join(parts, "")
+}
+
+// safeHref allows relative links and http, https and mailto ones.
+func safeHref(h string) bool {
+	scheme, _, ok := strings.Cut(h, ":")
+	if !ok || strings.ContainsAny(scheme, "/?#") {
+		return true
+	}
+	switch strings.ToLower(scheme) {
+	case "http", "https", "mailto":
+		return true
+	}
+	return false
+}
+
+// --------------------------- Handlers (Export) -----------------
+
+func adminExportGet(w http.ResponseWriter, r *http.Request) {
+	tags := map[string]bool{}
+	arts, err := allArticles()
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	for _, a := range arts {
+		for _, t := range a.Tags {
+			tags[t] = true
+		}
+	}
+	list := make([]string, 0, len(tags))
+	for t := range tags {
+		list = append(list, t)
+	}
+	sort.Strings(list)
+	render(w, r, map[string]any{"Active": "admin_export", "Title": "Export", "Tags": list, "BookTitle": cfg.SiteTitle})
+}
+
+// adminExportDownload sends the selected articles as a zip of Markdown
+// files or an EPUB.
+func adminExportDownload(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f, err := parseExportFilter(q.Get("tag"), q.Get("from"), q.Get("to"))
+	if err != nil {
+		renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	format := q.Get("format")
+	arts, err := selectArticles(f, format == "markdown" && q.Get("drafts") != "")
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	var buf bytes.Buffer
+	var name, ctype string
+	switch format {
+	case "markdown":
+		err = writeMarkdownZip(&buf, arts)
+		name, ctype = "articles.zip", "application/zip"
+	case "epub":
+		title := strings.TrimSpace(q.Get("title"))
+		if title == "" {
+			title = cfg.SiteTitle
+		}
+		err = writeEPUB(&buf, title, arts, cfg.StorageDir)
+		name, ctype = makeSlug(title)+".epub", "application/epub+zip"
+	default:
+		renderError(w, r, http.StatusBadRequest, fmt.Errorf("unknown format %q", format))
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	audit(r, "article.export", "", "", fmt.Sprintf("%s: %d articles", format, len(arts)))
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = buf.WriteTo(w)
+}
+
+// --------------------------- Templates (Export) ----------------
+
+const adminExportHTML = `{{define "admin_export"}}
+  <div class="card bar">
+    <div><h2 class="m-0">Export</h2></div>
+    <div><a href="/admin">Back</a></div>
+  </div>
+  <div class="card">
+    <form method="get" action="/admin/export/download">
+      <div class="row">
+        <div>
+          <label>Format</label>
+          <select name="format">
+            <option value="markdown">Markdown files with front matter (.zip)</option>
+            <option value="epub">EPUB ebook</option>
+          </select>
+        </div>
+        <div>
+          <label>Tag</label>
+          <select name="tag">
+            <option value="">Any</option>
+            {{range .Tags}}<option value="{{.}}">{{.}}</option>{{end}}
+          </select>
+        </div>
+        <div>
+          <label>Published from</label>
+          <input name="from" type="date" />
+        </div>
+        <div>
+          <label>Published to</label>
+          <input name="to" type="date" />
+        </div>
+      </div>
+      <div class="mt-12">
+        <label>Book title (EPUB)</label>
+        <input name="title" value="{{.BookTitle}}" />
+      </div>
+      <div class="mt-12">
+        <label class="inline"><input name="drafts" type="checkbox" /> Include drafts (Markdown only)</label>
+      </div>
+      <div class="mt-12"><button type="submit">Download</button></div>
+    </form>
+    <p class="muted mt-12">The EPUB contains published articles, oldest first, with a table of contents. Images stored under the data directory are embedded; remote images stay as links.</p>
+  </div>
+{{end}}`
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExport_MarkdownRoundTripsThroughImport(t *testing.T) {
+	resetStorage(t)
+	want := []Article{
+		{Title: `Say "hi": a post`, Slug: "say-hi", Content: "Body with **bold**.", Published: time.Date(2023, 3, 1, 9, 30, 0, 0, time.UTC),
+			UpdatedAt: time.Date(2023, 3, 2, 10, 0, 0, 0, time.UTC), Author: "Jo Doe", Tags: []string{"go", "web dev"}, Aliases: []string{"/2023/03/hi"}},
+		{Title: "Unfinished", Slug: "unfinished", Content: "Later.", Published: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), Draft: true, Tags: []string{"go"}},
+		{Title: "Other", Slug: "other", Content: "Not tagged.", Published: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, a := range want {
+		if err := saveArticle(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dir := filepath.Join(t.TempDir(), "md")
+	out, err := runCLI(t, "", "export", "-format", "markdown", "-tag", "go", "-out", dir)
+	if err != nil || !strings.Contains(out, "exported 2 articles") {
+		t.Fatalf("export: %v\n%s", err, out)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "other.md")); err == nil {
+		t.Fatal("tag filter ignored")
+	}
+
+	resetStorage(t)
+	if out, err := runCLI(t, "", "import", dir); err != nil || !strings.Contains(out, "2 created") {
+		t.Fatalf("import: %v\n%s", err, out)
+	}
+	for _, w := range want[:2] {
+		got, err := loadArticle(w.Slug)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := articleChanges(w, got); d != "no changes" || got.Author != w.Author || got.Draft != w.Draft || !got.Modified().Equal(w.Modified()) {
+			t.Fatalf("%s changed in round trip: %s\n%+v", w.Slug, d, got)
+		}
+	}
+}
+
+func TestExport_FilterDates(t *testing.T) {
+	f, err := parseExportFilter("", "2024-01-01", "2024-01-31")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		pub  time.Time
+		want bool
+	}{
+		{time.Date(2023, 12, 31, 12, 0, 0, 0, cfg.Location()), false},
+		{time.Date(2024, 1, 1, 0, 0, 0, 0, cfg.Location()), true},
+		{time.Date(2024, 1, 31, 23, 59, 0, 0, cfg.Location()), true},
+		{time.Date(2024, 2, 1, 0, 0, 0, 0, cfg.Location()), false},
+	} {
+		if got := f.match(Article{Published: c.pub}); got != c.want {
+			t.Fatalf("match(%v) = %v, want %v", c.pub, got, c.want)
+		}
+	}
+	if _, err := parseExportFilter("", "01/02/2024", ""); err == nil {
+		t.Fatal("bad date accepted")
+	}
+}
+
+// readZip returns the entry names in order and their contents.
+func readZip(t *testing.T, b []byte) ([]*zip.File, map[string]string) {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = string(body)
+	}
+	return zr.File, files
+}
+
+func TestExport_EPUBStructure(t *testing.T) {
+	resetStorage(t)
+	img := filepath.Join(t.TempDir(), "media")
+	if err := os.MkdirAll(img, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(img, "pic.png"), []byte("\x89PNG fake"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	arts := []Article{
+		{Title: "First & Foremost", Slug: "first", Published: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+			Content: "# Intro\n\nHello <world> with `a < b`, *this* and _that_, and [link](https://go.dev).\n\n![a picture](/pic.png)\n\n![remote](https://example.com/x.png)\n\n- one\n- two\n\n> quoted\n\n```\nif a < b {}\n```\n\n[bad](javascript:alert(1))"},
+		{Title: "Second", Slug: "second", Published: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC), Content: "Again ![same](pic.png)"},
+	}
+	var buf bytes.Buffer
+	if err := writeEPUB(&buf, "My Book", arts, img); err != nil {
+		t.Fatal(err)
+	}
+	entries, files := readZip(t, buf.Bytes())
+	if entries[0].Name != "mimetype" || entries[0].Method != zip.Store || files["mimetype"] != "application/epub+zip" {
+		t.Fatalf("first entry must be the stored mimetype, got %q", entries[0].Name)
+	}
+	for name, body := range files {
+		if !strings.HasSuffix(name, ".xhtml") && !strings.HasSuffix(name, ".opf") && !strings.HasSuffix(name, ".xml") {
+			continue
+		}
+		dec := xml.NewDecoder(strings.NewReader(body))
+		for {
+			if _, err := dec.Token(); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("%s is not well-formed: %v\n%s", name, err, body)
+			}
+		}
+	}
+	opf := files["OEBPS/content.opf"]
+	for _, want := range []string{"<dc:title>My Book</dc:title>", `href="images/1.png" media-type="image/png"`, `properties="nav"`} {
+		if !strings.Contains(opf, want) {
+			t.Fatalf("content.opf missing %q:\n%s", want, opf)
+		}
+	}
+	if strings.Contains(opf, "images/2") || files["OEBPS/images/1.png"] != "\x89PNG fake" {
+		t.Fatal("image should be embedded once")
+	}
+	if strings.Index(opf, `idref="c1"`) > strings.Index(opf, `idref="c2"`) {
+		t.Fatal("chapters out of order")
+	}
+	if nav := files["OEBPS/nav.xhtml"]; !strings.Contains(nav, `<a href="chapter-001.xhtml">First &amp; Foremost</a>`) {
+		t.Fatalf("toc:\n%s", nav)
+	}
+	ch := files["OEBPS/chapter-001.xhtml"]
+	for _, want := range []string{"<h2>Intro</h2>", "Hello &lt;world&gt;", "<code>a &lt; b</code>", "<em>this</em> and <em>that</em>,", `<a href="https://go.dev">link</a>`,
+		`<img src="images/1.png" alt="a picture"/>`, `<a href="https://example.com/x.png">remote</a>`, "<li>two</li>", "<blockquote>", "<pre><code>if a &lt; b {}"} {
+		if !strings.Contains(ch, want) {
+			t.Fatalf("chapter missing %q:\n%s", want, ch)
+		}
+	}
+	if strings.Contains(ch, "javascript:") {
+		t.Fatal("javascript link kept")
+	}
+}
+
+func TestExport_AdminDownload(t *testing.T) {
+	resetStorage(t)
+	for _, a := range []Article{
+		{Title: "Live", Slug: "live", Content: "x", Published: time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), Tags: []string{"go"}},
+		{Title: "Hidden", Slug: "hidden", Content: "y", Published: time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC), Draft: true, Tags: []string{"go"}},
+	} {
+		if err := saveArticle(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ts := httptest.NewServer(buildMux())
+	defer ts.Close()
+	if _, body := getBody(t, ts.URL, "/admin/export/download?format=epub", ""); !strings.Contains(body, "Admin Login") {
+		t.Fatal("export must require auth")
+	}
+	cookie := login(t, ts.URL, cfg.AdminUser, cfg.AdminPass)
+	if code, body := getBody(t, ts.URL, "/admin/export", cookie); code != http.StatusOK || !strings.Contains(body, `<option value="go">`) {
+		t.Fatalf("export page: %d\n%s", code, body)
+	}
+
+	get := func(query string) (*http.Response, []byte) {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/admin/export/download?"+query, nil)
+		req.Header.Set("Cookie", cookie)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp, b
+	}
+	resp, b := get("format=epub&tag=go&title=Go+Notes")
+	if resp.Header.Get("Content-Type") != "application/epub+zip" || !strings.Contains(resp.Header.Get("Content-Disposition"), "go-notes.epub") {
+		t.Fatalf("epub headers: %v", resp.Header)
+	}
+	if _, files := readZip(t, b); files["OEBPS/chapter-001.xhtml"] == "" || files["OEBPS/chapter-002.xhtml"] != "" {
+		t.Fatal("epub should hold only the published article")
+	}
+	resp, b = get("format=markdown&drafts=on")
+	if resp.Header.Get("Content-Type") != "application/zip" {
+		t.Fatalf("markdown headers: %v", resp.Header)
+	}
+	if _, files := readZip(t, b); !strings.Contains(files["hidden.md"], "draft: true") || files["live.md"] == "" {
+		t.Fatalf("markdown zip: %v", files)
+	}
+	if resp, _ := get("format=pdf"); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unknown format: %d", resp.StatusCode)
+	}
+	if entries, _ := readAudit(auditFilter{Action: "article.export"}); len(entries) != 2 {
+		t.Fatalf("exports audited %d times, want 2", len(entries))
+	}
+}
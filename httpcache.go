@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --------------------------- HTTP caching ----------------------
+
+// etagFor returns a strong ETag for a response body.
+func etagFor(b []byte) string {
+	sum := sha256.Sum256(b)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// servePage sends a rendered public page with an ETag, Last-Modified (when
+// known) and the guest Cache-Control policy; http.ServeContent answers
+// If-None-Match / If-Modified-Since with 304. Guest pages must render the
+// same bytes for the same content, so they must not print per-request data
+// such as the CSP nonce.
+func servePage(w http.ResponseWriter, r *http.Request, body []byte, modified time.Time) {
+	w.Header().Set("ETag", etagFor(body))
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(cfg.CacheMaxAge))
+	http.ServeContent(w, r, "", modified, bytes.NewReader(body))
+}
+
+// --------------------------- Compression -----------------------
+
+// compressMinSize skips compressing bodies too small to benefit.
+const compressMinSize = 256
+
+var compressibleTypes = []string{"text/", "application/json", "application/xml", "application/rss+xml", "application/atom+xml", "application/activity+json", "application/javascript", "image/svg+xml"}
+
+var gzipPool = sync.Pool{New: func() any { return gzip.NewWriter(io.Discard) }}
+
+// negotiateEncoding picks gzip or deflate from Accept-Encoding, honouring
+// q-values; "" means send the body as is.
+func negotiateEncoding(header string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "gzip" && name != "deflate" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		// gzip wins ties; it is listed first by every browser anyway
+		if q > 0 && (q > bestQ || (q == bestQ && name == "gzip")) {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
+
+// compressWriter holds back the status and the first compressMinSize bytes
+// until it can tell whether compressing is worthwhile, then commits.
+type compressWriter struct {
+	http.ResponseWriter
+	enc     string
+	status  int    // pending status; 0 until the handler sets one
+	buf     []byte // body held back while undecided
+	zw      io.WriteCloser
+	decided bool
+}
+
+func (c *compressWriter) WriteHeader(code int) {
+	if code < 200 {
+		c.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if c.status != 0 {
+		return // superfluous, as net/http would treat it
+	}
+	c.status = code
+	if !c.compressible() {
+		c.decide(false)
+	} else if n, err := strconv.Atoi(c.Header().Get("Content-Length")); err == nil {
+		c.decide(n >= compressMinSize)
+	}
+}
+
+// compressible reports whether the pending response may be encoded at all.
+func (c *compressWriter) compressible() bool {
+	h := c.Header()
+	if c.status == http.StatusNoContent || c.status == http.StatusNotModified || c.status == http.StatusPartialContent || h.Get("Content-Encoding") != "" {
+		return false
+	}
+	ct := h.Get("Content-Type")
+	for _, p := range compressibleTypes {
+		if strings.HasPrefix(ct, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// decide commits the headers and releases any held-back body.
+func (c *compressWriter) decide(compressing bool) {
+	c.decided = true
+	h := c.Header()
+	// the compressed bytes differ, so they get their own strong tag; a 304
+	// stands in for the compressed 200 and repeats it
+	if tag := h.Get("ETag"); (compressing || c.status == http.StatusNotModified) && strings.HasPrefix(tag, `"`) {
+		h.Set("ETag", strings.TrimSuffix(tag, `"`)+"-"+c.enc+`"`)
+	}
+	if compressing {
+		h.Set("Content-Encoding", c.enc)
+		h.Del("Content-Length")
+		if c.enc == "gzip" {
+			gz := gzipPool.Get().(*gzip.Writer)
+			gz.Reset(c.ResponseWriter)
+			c.zw = gz
+		} else {
+			c.zw = zlib.NewWriter(c.ResponseWriter)
+		}
+	}
+	c.ResponseWriter.WriteHeader(c.status)
+	if len(c.buf) > 0 {
+		_, _ = c.write(c.buf)
+		c.buf = nil
+	}
+}
+
+func (c *compressWriter) write(b []byte) (int, error) {
+	if c.zw != nil {
+		return c.zw.Write(b)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+func (c *compressWriter) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		if c.Header().Get("Content-Type") == "" {
+			c.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		c.WriteHeader(http.StatusOK)
+	}
+	if c.decided {
+		return c.write(b)
+	}
+	c.buf = append(c.buf, b...)
+	if len(c.buf) >= compressMinSize {
+		c.decide(true)
+	}
+	return len(b), nil
+}
+
+// Flush commits to compressing, since a flushing handler is streaming.
+func (c *compressWriter) Flush() {
+	if !c.decided && c.status != 0 {
+		c.decide(true)
+	}
+	if f, ok := c.zw.(interface{ Flush() error }); ok {
+		_ = f.Flush()
+	}
+	http.NewResponseController(c.ResponseWriter).Flush()
+}
+
+func (c *compressWriter) Unwrap() http.ResponseWriter { return c.ResponseWriter }
+
+func (c *compressWriter) close() {
+	if !c.decided && c.status != 0 {
+		c.decide(false) // the whole body fit under compressMinSize
+	}
+	if c.zw == nil {
+		return
+	}
+	_ = c.zw.Close()
+	if gz, ok := c.zw.(*gzip.Writer); ok {
+		gzipPool.Put(gz)
+	}
+}
+
+// compress gzip- or deflate-encodes compressible responses the client
+// accepts. Range requests are passed through untouched so byte offsets
+// keep referring to the identity body.
+func compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		enc := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if enc == "" || r.Header.Get("Range") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// validators come back with our encoding suffix; strip it so
+		// handlers compare against the identity ETag
+		if inm := r.Header.Get("If-None-Match"); inm != "" {
+			r.Header.Set("If-None-Match", strings.ReplaceAll(inm, "-"+enc+`"`, `"`))
+		}
+		cw := &compressWriter{ResponseWriter: w, enc: enc}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
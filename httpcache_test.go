@@ -0,0 +1,133 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rawGet issues a GET without the transport's transparent gzip handling.
+func rawGet(t *testing.T, url string, header map[string]string) (*http.Response, string) {
+	t.Helper()
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var r io.Reader = resp.Body
+	switch resp.Header.Get("Content-Encoding") {
+	case "gzip":
+		if r, err = gzip.NewReader(resp.Body); err != nil {
+			t.Fatal(err)
+		}
+	case "deflate":
+		if r, err = zlib.NewReader(resp.Body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(b)
+}
+
+func TestCompression_Negotiated(t *testing.T) {
+	resetStorage(t)
+	ts := httptest.NewServer(buildMux())
+	defer ts.Close()
+
+	for _, tc := range []struct{ accept, want string }{
+		{"gzip, deflate, br", "gzip"},
+		{"deflate", "deflate"},
+		{"gzip;q=0.2, deflate;q=0.8", "deflate"},
+		{"gzip;q=0", ""},
+		{"", ""},
+	} {
+		resp, body := rawGet(t, ts.URL+"/", map[string]string{"Accept-Encoding": tc.accept})
+		if got := resp.Header.Get("Content-Encoding"); got != tc.want {
+			t.Fatalf("Accept-Encoding %q: Content-Encoding=%q, want %q", tc.accept, got, tc.want)
+		}
+		if !strings.Contains(body, "<html") || !strings.Contains(resp.Header.Get("Vary"), "Accept-Encoding") {
+			t.Fatalf("Accept-Encoding %q: bad body or Vary: %v", tc.accept, resp.Header)
+		}
+	}
+	if resp, _ := rawGet(t, ts.URL+"/healthz", map[string]string{"Accept-Encoding": "gzip"}); resp.Header.Get("Content-Encoding") != "" {
+		t.Fatal("tiny bodies should not be compressed")
+	}
+}
+
+func TestHTTPCaching_ValidatorsAndPolicies(t *testing.T) {
+	resetStorage(t)
+	ts := httptest.NewServer(buildMux())
+	defer ts.Close()
+
+	updated := time.Date(2024, 3, 4, 5, 6, 7, 0, time.UTC)
+	a := Article{Title: "Cached", Slug: "cached", Content: "v1", Published: time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), UpdatedAt: updated}
+	if err := saveArticle(a); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, _ := rawGet(t, ts.URL+"/article/cached", nil)
+	etag := resp.Header.Get("ETag")
+	if !strings.HasPrefix(etag, `"`) || resp.Header.Get("Last-Modified") != updated.Format(http.TimeFormat) {
+		t.Fatalf("validators: ETag=%q Last-Modified=%q", etag, resp.Header.Get("Last-Modified"))
+	}
+	if got := resp.Header.Get("Cache-Control"); got != "public, max-age=60" {
+		t.Fatalf("guest Cache-Control=%q", got)
+	}
+	if resp, _ = rawGet(t, ts.URL+"/article/cached", map[string]string{"If-None-Match": etag}); resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("If-None-Match status=%d, want 304", resp.StatusCode)
+	}
+	if resp, _ = rawGet(t, ts.URL+"/article/cached", map[string]string{"If-Modified-Since": updated.Format(http.TimeFormat)}); resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("If-Modified-Since status=%d, want 304", resp.StatusCode)
+	}
+
+	// the gzip representation has its own tag, which revalidates too
+	resp, _ = rawGet(t, ts.URL+"/article/cached", map[string]string{"Accept-Encoding": "gzip"})
+	gzTag := resp.Header.Get("ETag")
+	if gzTag == etag || !strings.HasSuffix(gzTag, `-gzip"`) {
+		t.Fatalf("gzip ETag=%q, identity %q", gzTag, etag)
+	}
+	resp, _ = rawGet(t, ts.URL+"/article/cached", map[string]string{"Accept-Encoding": "gzip", "If-None-Match": gzTag})
+	if resp.StatusCode != http.StatusNotModified || resp.Header.Get("ETag") != gzTag {
+		t.Fatalf("gzip revalidation=%d ETag=%q", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+
+	a.Content, a.UpdatedAt = "v2", updated.Add(time.Hour)
+	if err := saveArticle(a); err != nil {
+		t.Fatal(err)
+	}
+	resp, body := rawGet(t, ts.URL+"/article/cached", map[string]string{"If-None-Match": etag})
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, "v2") || resp.Header.Get("ETag") == etag {
+		t.Fatalf("edited article should miss the old tag: %d %q", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+	if resp, _ = rawGet(t, ts.URL+"/", nil); resp.Header.Get("Last-Modified") != a.UpdatedAt.Format(http.TimeFormat) {
+		t.Fatalf("home Last-Modified=%q", resp.Header.Get("Last-Modified"))
+	}
+
+	cookie := login(t, ts.URL, cfg.AdminUser, cfg.AdminPass)
+	if resp, _ = rawGet(t, ts.URL+"/admin", map[string]string{"Cookie": cookie}); resp.Header.Get("Cache-Control") != "no-store" || resp.Header.Get("ETag") != "" {
+		t.Fatalf("admin caching headers: %v", resp.Header)
+	}
+	if resp, _ = rawGet(t, ts.URL+"/article/missing", nil); resp.Header.Get("Cache-Control") != "no-store" {
+		t.Fatalf("error page Cache-Control=%q", resp.Header.Get("Cache-Control"))
+	}
+	resp, _ = rawGet(t, ts.URL+"/static/style.css", nil)
+	if resp.Header.Get("Cache-Control") != "public, max-age=86400" || resp.Header.Get("ETag") != styleETag {
+		t.Fatalf("static caching headers: %v", resp.Header)
+	}
+	if resp, _ = rawGet(t, ts.URL+"/static/style.css", map[string]string{"If-None-Match": styleETag}); resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("stylesheet revalidation=%d, want 304", resp.StatusCode)
+	}
+}
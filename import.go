@@ -0,0 +1,564 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --------------------------- Import ----------------------------
+// Imports go in two steps: the source is parsed into importEntries, then
+// planImport decides per entry what would happen. The CLI and the admin
+// upload print the plan; unless it is a dry run, applyImport carries it out.
+
+const (
+	importMaxUpload = 32 << 20 // admin zip upload
+	importMaxFile   = 4 << 20  // one file inside a directory or zip
+)
+
+type importEntry struct {
+	Source   string // file the article came from
+	Article  Article
+	Comments []Comment // only from WordPress exports
+	Note     string    // e.g. how the slug was derived
+	Err      error     // the source could not be mapped onto an Article
+}
+
+type importStep struct {
+	importEntry
+	Action string // create, replace, skip or error
+}
+
+// planImport checks every entry against the store. Existing slugs are
+// conflicts: skipped, or replaced when overwrite is set.
+func planImport(entries []importEntry, overwrite bool) []importStep {
+	steps := make([]importStep, 0, len(entries))
+	seen := map[string]string{}
+	for _, e := range entries {
+		s := importStep{importEntry: e}
+		switch {
+		case e.Err != nil:
+			s.Action = "error"
+		case validateArticle(e.Article) != nil:
+			s.Action, s.Err = "error", validateArticle(e.Article)
+		case seen[e.Article.Slug] != "":
+			s.Action, s.Note = "skip", "slug also used by "+seen[e.Article.Slug]
+		case articleExists(e.Article.Slug) && !overwrite:
+			s.Action, s.Note = "skip", "slug exists"
+		case articleExists(e.Article.Slug):
+			s.Action = "replace"
+		default:
+			s.Action = "create"
+		}
+		if s.Err == nil {
+			seen[e.Article.Slug] = e.Source
+		}
+		steps = append(steps, s)
+	}
+	return steps
+}
+
+// applyImport saves every create and replace step, calling done after each.
+// Imported comments are added to those the article already has.
+func applyImport(steps []importStep, done func(importStep)) error {
+	for _, s := range steps {
+		if s.Action != "create" && s.Action != "replace" {
+			continue
+		}
+		if err := saveArticle(s.Article); err != nil {
+			return fmt.Errorf("%s: %v", s.Source, err)
+		}
+		if _, err := mergeComments(s.Article.Slug, s.Comments); err != nil {
+			return fmt.Errorf("%s: comments: %v", s.Source, err)
+		}
+		done(s)
+	}
+	return nil
+}
+
+// importSummary counts the steps by action.
+func importSummary(steps []importStep) string {
+	n := map[string]int{}
+	for _, s := range steps {
+		n[s.Action]++
+	}
+	return fmt.Sprintf("%d created, %d replaced, %d skipped, %d failed", n["create"], n["replace"], n["skip"], n["error"])
+}
+
+// jsonEntries reads a JSON array of articles, as written by `blog export`.
+func jsonEntries(r io.Reader, name string) ([]importEntry, error) {
+	var arts []Article
+	if err := json.NewDecoder(r).Decode(&arts); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	entries := make([]importEntry, len(arts))
+	for i, a := range arts {
+		entries[i] = importEntry{Source: fmt.Sprintf("%s[%d]", name, i), Article: a}
+	}
+	return entries, nil
+}
+
+// --------------------------- Markdown import -------------------
+
+// markdownEntries reads every Markdown file below fsys, which is a
+// directory (os.DirFS) or an uploaded zip. Hugo section pages (_index.md)
+// and hidden directories are skipped.
+func markdownEntries(fsys fs.FS) ([]importEntry, error) {
+	var entries []importEntry
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := d.Name()
+		if d.IsDir() {
+			if p != "." && (strings.HasPrefix(name, ".") || name == "__MACOSX") {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if ext := path.Ext(name); (ext != ".md" && ext != ".markdown") || name == "_index.md" {
+			return nil
+		}
+		f, err := fsys.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		b, err := io.ReadAll(io.LimitReader(f, importMaxFile+1))
+		if err != nil {
+			return err
+		}
+		if len(b) > importMaxFile {
+			entries = append(entries, importEntry{Source: p, Err: fmt.Errorf("larger than %d bytes", importMaxFile)})
+			return nil
+		}
+		entries = append(entries, markdownEntry(p, b))
+		return nil
+	})
+	return entries, err
+}
+
+// jekyllName matches _posts/2024-01-02-my-post.md.
+var jekyllName = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2})-(.+)$`)
+
+// markdownEntry maps one file onto an Article. The slug comes from the
+// front matter, else the file name (the directory name for a Hugo page
+// bundle's index.md, without the date prefix for Jekyll posts).
+func markdownEntry(p string, b []byte) importEntry {
+	e := importEntry{Source: p}
+	fm, body, err := splitFrontMatter(b)
+	if err != nil {
+		e.Err = err
+		return e
+	}
+	a := Article{Title: fm.str("title"), Author: fm.str("author"), Content: strings.TrimSpace(body)}
+
+	base := strings.TrimSuffix(path.Base(p), path.Ext(p))
+	if base == "index" && path.Dir(p) != "." {
+		base = path.Base(path.Dir(p))
+	}
+	var fileDate string
+	if m := jekyllName.FindStringSubmatch(base); m != nil {
+		fileDate, base = m[1], m[2]
+	}
+
+	if s := fm.str("slug"); s != "" {
+		a.Slug = s
+	} else {
+		a.Slug = base
+	}
+	if norm := makeSlug(a.Slug); norm != a.Slug {
+		e.Note = fmt.Sprintf("slug %q normalised", a.Slug)
+		a.Slug = norm
+	}
+
+	date := fm.str("date")
+	if date == "" {
+		date = fileDate
+	}
+	if date == "" {
+		e.Err = errors.New("no date in front matter or file name")
+		return e
+	}
+	if a.Published, err = parseFrontMatterTime(date); err != nil {
+		e.Err = err
+		return e
+	}
+	for _, k := range []string{"lastmod", "last_modified_at"} {
+		if t, err := parseFrontMatterTime(fm.str(k)); err == nil {
+			a.UpdatedAt = t.UTC()
+			break
+		}
+	}
+	a.Draft = fm.str("draft") == "true"
+	a.Tags = normaliseTags(fm.list("tags"))
+	for _, al := range append(fm.list("aliases"), fm.list("redirect_from")...) {
+		if al = normaliseAlias(al); al != "" {
+			a.Aliases = append(a.Aliases, al)
+		}
+	}
+	e.Article = a
+	return e
+}
+
+// timeLayouts are the date forms Hugo, Jekyll and TOML front matter use.
+var timeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05 -07:00",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// parseFrontMatterTime parses a front matter date; ones without a zone are
+// in the site's time zone.
+func parseFrontMatterTime(s string) (time.Time, error) {
+	for _, l := range timeLayouts {
+		if t, err := time.ParseInLocation(l, s, cfg.Location()); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognised date %q", s)
+}
+
+// --------------------------- Front matter ----------------------
+
+// frontMatter holds the top-level keys of a YAML or TOML header. Scalars
+// are strings (with quotes removed); lists are []string. Nested tables and
+// maps are ignored: none of the fields the importer reads use them.
+type frontMatter map[string]any
+
+func (fm frontMatter) str(k string) string {
+	s, _ := fm[k].(string)
+	return s
+}
+
+// list returns a list value; a scalar is split on spaces, as Jekyll does
+// for `tags: go web`.
+func (fm frontMatter) list(k string) []string {
+	switch v := fm[k].(type) {
+	case []string:
+		return v
+	case string:
+		return strings.Fields(v)
+	}
+	return nil
+}
+
+// splitFrontMatter separates a --- YAML or +++ TOML header from the body.
+// A file without one has empty front matter.
+func splitFrontMatter(b []byte) (frontMatter, string, error) {
+	s := strings.TrimPrefix(strings.ReplaceAll(string(b), "\r\n", "\n"), "\ufeff")
+	for _, delim := range []string{"---", "+++"} {
+		if !strings.HasPrefix(s, delim+"\n") {
+			continue
+		}
+		rest := s[len(delim)+1:]
+		end := strings.Index(rest, "\n"+delim+"\n")
+		head, body := "", ""
+		switch {
+		case strings.HasPrefix(rest, delim+"\n"):
+			body = rest[len(delim)+1:]
+		case end >= 0:
+			head, body = rest[:end], rest[end+len(delim)+2:]
+		case strings.HasSuffix(rest, "\n"+delim):
+			head = strings.TrimSuffix(rest, "\n"+delim)
+		default:
+			return nil, "", fmt.Errorf("front matter opened with %s is never closed", delim)
+		}
+		if delim == "---" {
+			fm, err := parseYAMLFrontMatter(head)
+			return fm, body, err
+		}
+		fm, err := parseTOMLFrontMatter(head)
+		return fm, body, err
+	}
+	return frontMatter{}, s, nil
+}
+
+// parseYAMLFrontMatter understands `key: value`, flow lists `[a, b]` and
+// block lists of `- item` lines.
+func parseYAMLFrontMatter(head string) (frontMatter, error) {
+	fm := frontMatter{}
+	var listKey string
+	sc := bufio.NewScanner(strings.NewReader(head))
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' || line[0] == '-' {
+			if item, ok := strings.CutPrefix(trimmed, "-"); ok && listKey != "" {
+				l, _ := fm[listKey].([]string)
+				fm[listKey] = append(l, unquote(strings.TrimSpace(item)))
+			}
+			continue // nested map or stray item
+		}
+		key, val, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("front matter line %d: want key: value", n)
+		}
+		key, val, listKey = strings.TrimSpace(key), stripComment(strings.TrimSpace(val)), ""
+		switch {
+		case val == "":
+			listKey = key
+			fm[key] = []string(nil)
+		case strings.HasPrefix(val, "["):
+			fm[key] = flowList(val)
+		default:
+			fm[key] = unquote(val)
+		}
+	}
+	return fm, nil
+}
+
+// parseTOMLFrontMatter understands top-level `key = value` pairs with
+// strings, booleans, dates and arrays; keys after the first [table] header
+// belong to that table and are ignored.
+func parseTOMLFrontMatter(head string) (frontMatter, error) {
+	fm := frontMatter{}
+	lines := strings.Split(head, "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			break
+		}
+		key, val, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("front matter line %d: want key = value", i+1)
+		}
+		key, val = unquote(strings.TrimSpace(key)), stripComment(strings.TrimSpace(val))
+		if strings.HasPrefix(val, "[") {
+			// arrays may span lines
+			for !strings.HasSuffix(val, "]") && i+1 < len(lines) {
+				i++
+				val += " " + stripComment(strings.TrimSpace(lines[i]))
+			}
+			fm[key] = flowList(val)
+			continue
+		}
+		fm[key] = unquote(val)
+	}
+	return fm, nil
+}
+
+// flowList splits "[a, 'b', "c"]" into its items.
+func flowList(s string) []string {
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = unquote(strings.TrimSpace(item)); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// unquote removes matching single or double quotes.
+func unquote(s string) string {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		if u, err := strconv.Unquote(s); err == nil {
+			return u
+		}
+		return s[1 : len(s)-1]
+	}
+	if len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'' {
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'")
+	}
+	return s
+}
+
+// stripComment drops a trailing " # comment" outside quotes.
+func stripComment(s string) string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || s[i-1] == ' ' || s[i-1] == '\t'):
+			return strings.TrimSpace(s[:i])
+		}
+	}
+	return s
+}
+
+// --------------------------- Tags & aliases --------------------
+
+// normaliseTags lower-cases, trims and de-duplicates tags, keeping order.
+func normaliseTags(tags []string) []string {
+	var out []string
+	seen := map[string]bool{}
+	for _, t := range tags {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t != "" && !seen[t] {
+			seen[t] = true
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// parseTags reads the comma-separated tags field of the article form.
+func parseTags(s string) []string {
+	return normaliseTags(strings.Split(s, ","))
+}
+
+// normaliseAlias turns an old URL (absolute, relative or with a trailing
+// slash) into the path form aliasTarget compares against.
+func normaliseAlias(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.Index(s, "://"); i >= 0 {
+		s = s[i+3:]
+		if j := strings.IndexByte(s, '/'); j >= 0 {
+			s = s[j:]
+		} else {
+			s = "/"
+		}
+	}
+	s = path.Clean("/" + s)
+	if s == "/" {
+		return ""
+	}
+	return s
+}
+
+// aliasTarget finds the public article that lists p as a former URL.
+func aliasTarget(p string) (string, bool) {
+	p = normaliseAlias(p)
+	if p == "" {
+		return "", false
+	}
+	arts, err := publicArticles()
+	if err != nil {
+		return "", false
+	}
+	for _, a := range arts {
+		for _, al := range a.Aliases {
+			if al == p {
+				return "/article/" + a.Slug, true
+			}
+		}
+	}
+	return "", false
+}
+
+// --------------------------- Handlers (Import) -----------------
+
+func adminImportGet(w http.ResponseWriter, r *http.Request) {
+	render(w, r, map[string]any{"Active": "admin_import", "Title": "Import", "DryRun": true})
+}
+
+// adminImportPost imports the Markdown files in an uploaded zip, or an
+// uploaded WordPress export.
+func adminImportPost(w http.ResponseWriter, r *http.Request) {
+	data := map[string]any{"Active": "admin_import", "Title": "Import"}
+	fail := func(msg string) {
+		data["Error"] = msg
+		w.WriteHeader(http.StatusBadRequest)
+		render(w, r, data)
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, importMaxUpload)
+	if err := r.ParseMultipartForm(importMaxUpload); err != nil {
+		fail(fmt.Sprintf("Upload failed (limit %d MB): %v", importMaxUpload>>20, err))
+		return
+	}
+	dryRun, overwrite := r.FormValue("dry_run") != "", r.FormValue("overwrite") != ""
+	data["DryRun"], data["Overwrite"] = dryRun, overwrite
+	f, hdr, err := r.FormFile("archive")
+	if err != nil {
+		fail("Choose a .zip of Markdown posts or a WordPress .xml export")
+		return
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	var entries []importEntry
+	if strings.EqualFold(path.Ext(hdr.Filename), ".xml") {
+		entries, err = wxrEntries(bytes.NewReader(b), hdr.Filename)
+	} else if zr, zerr := zip.NewReader(bytes.NewReader(b), int64(len(b))); zerr == nil {
+		entries, err = markdownEntries(zr)
+	} else {
+		err = fmt.Errorf("%s is not a zip file", hdr.Filename)
+	}
+	if err != nil {
+		fail(err.Error())
+		return
+	}
+	steps := planImport(entries, overwrite)
+	if !dryRun {
+		err := applyImport(steps, func(s importStep) {
+			audit(r, "article.import", "", s.Article.Slug, fmt.Sprintf("%s from %s: title %q", s.Action, s.Source, s.Article.Title))
+		})
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+	}
+	data["Steps"], data["Summary"], data["Applied"] = steps, importSummary(steps), !dryRun
+	render(w, r, data)
+}
+
+// --------------------------- Templates (Import) ----------------
+
+const adminImportHTML = `{{define "admin_import"}}
+  <div class="card bar">
+    <div><h2 class="m-0">Import</h2></div>
+    <div><a href="/admin">Back</a></div>
+  </div>
+  <div class="card">
+    {{if .Error}}<div class="card danger mb-12">{{.Error}}</div>{{end}}
+    <p class="muted mt-0">Upload a .zip of Markdown files with YAML (<code>---</code>) or TOML (<code>+++</code>) front matter, e.g. a Hugo <code>content/</code> or Jekyll <code>_posts/</code> folder. Title, date, slug, tags, draft and aliases are kept.</p>
+    <p class="muted">Or upload a WordPress export (.xml from Tools → Export): posts and pages are converted to Markdown, categories and tags become tags, and old permalinks redirect to the new articles.</p>
+    <form method="post" action="/admin/import" enctype="multipart/form-data">
+      <input name="archive" type="file" accept=".zip,.xml,application/zip,text/xml" />
+      <div class="mt-12">
+        <label class="inline"><input name="dry_run" type="checkbox" {{if .DryRun}}checked{{end}} /> Dry run (only show what would change)</label>
+        <label class="inline ml-8"><input name="overwrite" type="checkbox" {{if .Overwrite}}checked{{end}} /> Replace articles whose slug exists</label>
+      </div>
+      <div class="mt-12"><button type="submit">Import</button></div>
+    </form>
+  </div>
+  {{if .Steps}}
+  <div class="card">
+    <div class="muted mb-8">{{if .Applied}}Imported{{else}}Dry run{{end}}: {{.Summary}}</div>
+    <table>
+      <thead><tr><th>File</th><th>Action</th><th>Slug</th><th>Title</th><th>Notes</th></tr></thead>
+      <tbody>
+        {{range .Steps}}
+        <tr>
+          <td>{{.Source}}</td>
+          <td>{{.Action}}</td>
+          <td>{{.Article.Slug}}</td>
+          <td>{{.Article.Title}}</td>
+          <td>{{if .Err}}{{.Err}}{{else}}{{.Note}}{{end}}</td>
+        </tr>
+        {{end}}
+      </tbody>
+    </table>
+  </div>
+  {{end}}
+{{end}}`
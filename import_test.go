@@ -0,0 +1,215 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+const hugoYAML = `---
+title: "Hello, Hugo"
+date: 2023-05-06T10:00:00Z
+slug: hello-hugo
+draft: false
+tags:
+  - Go
+  - web
+aliases: ["/posts/old-hello/", "https://old.example.com/2023/hello.html"]
+params:
+  nested: ignored
+---
+Body **in Markdown**.
+`
+
+const hugoTOML = `+++
+title = 'Bundle Post' # page bundle
+date = 2022-01-02
+draft = true
+tags = [
+  "notes",
+]
+[params]
+slug = "not-top-level"
++++
+
+Bundled.
+`
+
+const jekyllPost = `---
+title: Jekyll Post
+tags: ruby static
+redirect_from: /blog/jekyll-post/
+---
+From Jekyll.
+`
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, body := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMarkdownEntry_FrontMatterFormats(t *testing.T) {
+	e := markdownEntry("posts/hello.md", []byte(hugoYAML))
+	a := e.Article
+	if e.Err != nil || a.Title != "Hello, Hugo" || a.Slug != "hello-hugo" || a.Draft || a.Content != "Body **in Markdown**." {
+		t.Fatalf("yaml: %+v, %v", a, e.Err)
+	}
+	if !a.Published.Equal(time.Date(2023, 5, 6, 10, 0, 0, 0, time.UTC)) {
+		t.Fatalf("yaml date: %v", a.Published)
+	}
+	if !slices.Equal(a.Tags, []string{"go", "web"}) || !slices.Equal(a.Aliases, []string{"/posts/old-hello", "/2023/hello.html"}) {
+		t.Fatalf("yaml lists: %v %v", a.Tags, a.Aliases)
+	}
+
+	e = markdownEntry("posts/bundle-post/index.md", []byte(hugoTOML))
+	a = e.Article
+	if e.Err != nil || a.Title != "Bundle Post" || a.Slug != "bundle-post" || !a.Draft || !slices.Equal(a.Tags, []string{"notes"}) || a.Content != "Bundled." {
+		t.Fatalf("toml: %+v, %v", a, e.Err)
+	}
+
+	e = markdownEntry("_posts/2021-03-04-Jekyll_Post.md", []byte(jekyllPost))
+	a = e.Article
+	if e.Err != nil || a.Slug != "jekyll-post" || e.Note == "" || a.Published.Format("2006-01-02") != "2021-03-04" {
+		t.Fatalf("jekyll: %+v, %v", a, e.Err)
+	}
+	if !slices.Equal(a.Tags, []string{"ruby", "static"}) || !slices.Equal(a.Aliases, []string{"/blog/jekyll-post"}) {
+		t.Fatalf("jekyll lists: %v %v", a.Tags, a.Aliases)
+	}
+
+	if e = markdownEntry("undated.md", []byte("---\ntitle: x\n---\nbody")); e.Err == nil {
+		t.Fatal("a post without a date should fail")
+	}
+	if e = markdownEntry("open.md", []byte("+++\ntitle = 'x'\n")); e.Err == nil {
+		t.Fatal("unterminated front matter should fail")
+	}
+}
+
+func TestImport_CLIDirectoryConflictsAndAliases(t *testing.T) {
+	resetStorage(t)
+	if err := saveArticle(Article{Title: "Mine", Slug: "hello-hugo", Content: "keep me", Published: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"posts/hello.md":              hugoYAML,
+		"posts/bundle-post/index.md":  hugoTOML,
+		"posts/_index.md":             "---\ntitle: Posts\n---\n",
+		"_posts/2021-03-04-jekyll.md": jekyllPost,
+		"broken.md":                   "---\ntitle: no date\n---\nx",
+	})
+
+	out, err := runCLI(t, "", "import", "-dry-run", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"skip     hello-hugo (slug exists)", "create   bundle-post", "create   jekyll", "error    broken.md: no date"} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("dry run missing %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "_index") {
+		t.Fatalf("section page imported:\n%s", out)
+	}
+	if articleExists("jekyll") {
+		t.Fatal("dry run wrote an article")
+	}
+
+	out, err = runCLI(t, "", "import", "-overwrite", dir)
+	if err == nil || !strings.Contains(out, "2 created, 1 replaced, 0 skipped, 1 failed") {
+		t.Fatalf("import: %v\n%s", err, out)
+	}
+	if a, _ := loadArticle("hello-hugo"); a.Title != "Hello, Hugo" {
+		t.Fatalf("-overwrite kept %+v", a)
+	}
+
+	ts := httptest.NewServer(buildMux())
+	defer ts.Close()
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse }}
+	for path, want := range map[string]string{"/posts/old-hello/": "/article/hello-hugo", "/2023/hello.html": "/article/hello-hugo", "/blog/jekyll-post": "/article/jekyll"} {
+		resp, err := client.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != want {
+			t.Fatalf("%s: %d -> %q, want 301 -> %s", path, resp.StatusCode, resp.Header.Get("Location"), want)
+		}
+	}
+	if _, body := getBody(t, ts.URL, "/article/hello-hugo", ""); !strings.Contains(body, "go, web") {
+		t.Fatal("tags not shown on the article page")
+	}
+}
+
+func TestImport_AdminZipUpload(t *testing.T) {
+	resetStorage(t)
+	ts := httptest.NewServer(buildMux())
+	defer ts.Close()
+	cookie := login(t, ts.URL, cfg.AdminUser, cfg.AdminPass)
+
+	var zbuf bytes.Buffer
+	zw := zip.NewWriter(&zbuf)
+	for name, body := range map[string]string{"site/content/hello.md": hugoYAML, "site/content/bundle-post/index.md": hugoTOML} {
+		w, _ := zw.Create(name)
+		w.Write([]byte(body))
+	}
+	zw.Close()
+
+	upload := func(dryRun bool) (int, string) {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, _ := mw.CreateFormFile("archive", "hugo.zip")
+		fw.Write(zbuf.Bytes())
+		if dryRun {
+			mw.WriteField("dry_run", "on")
+		}
+		mw.Close()
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/admin/import", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		req.Header.Set("Cookie", cookie)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var b bytes.Buffer
+		b.ReadFrom(resp.Body)
+		return resp.StatusCode, b.String()
+	}
+
+	code, page := upload(true)
+	if code != http.StatusOK || !strings.Contains(page, "Dry run: 2 created") {
+		t.Fatalf("dry run: %d\n%s", code, page)
+	}
+	if articleExists("hello-hugo") {
+		t.Fatal("dry run wrote an article")
+	}
+	if code, page = upload(false); code != http.StatusOK || !strings.Contains(page, "Imported: 2 created") {
+		t.Fatalf("import: %d\n%s", code, page)
+	}
+	if a, err := loadArticle("bundle-post"); err != nil || !a.Draft {
+		t.Fatalf("bundle-post: %+v, %v", a, err)
+	}
+	if entries, _ := readAudit(auditFilter{Action: "article.import"}); len(entries) != 2 {
+		t.Fatalf("audited %d imports", len(entries))
+	}
+
+	if _, body := getBody(t, ts.URL, "/admin/import", ""); !strings.Contains(body, "Admin Login") {
+		t.Fatal("import page must require auth")
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// captureLogs routes slog to an in-memory JSON handler for the test.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	saved := slog.Default()
+	slog.SetDefault(newLogger(&buf, "json"))
+	t.Cleanup(func() { slog.SetDefault(saved) })
+	return &buf
+}
+
+// logLines decodes every JSON log record in buf.
+func logLines(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var out []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var m map[string]any
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Fatalf("bad log line %q: %v", line, err)
+		}
+		out = append(out, m)
+	}
+	return out
+}
+
+func TestLogRequest_StructuredWithRequestID(t *testing.T) {
+	resetStorage(t)
+	buf := captureLogs(t)
+	ts := httptest.NewServer(buildMux())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/article/missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	id := resp.Header.Get("X-Request-ID")
+	if id == "" {
+		t.Fatal("missing X-Request-ID response header")
+	}
+
+	lines := logLines(t, buf)
+	if len(lines) != 1 {
+		t.Fatalf("want one request log line, got %v", lines)
+	}
+	l := lines[0]
+	if l["msg"] != "request" || l["request_id"] != id || l["path"] != "/article/missing" || l["status"] != float64(http.StatusNotFound) || l["ip"] != "127.0.0.1" {
+		t.Fatalf("unexpected log record: %v", l)
+	}
+	if _, ok := l["bytes"]; !ok {
+		t.Fatalf("log record missing bytes: %v", l)
+	}
+
+	// A well-formed upstream ID is propagated; junk is replaced.
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/healthz", nil)
+	req.Header.Set("X-Request-ID", "lb-1234.abc")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get("X-Request-ID"); got != "lb-1234.abc" {
+		t.Fatalf("upstream request ID not reused: %q", got)
+	}
+	req.Header.Set("X-Request-ID", "bad id <with> junk")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get("X-Request-ID"); got == "" || strings.Contains(got, " ") {
+		t.Fatalf("invalid upstream request ID should be replaced, got %q", got)
+	}
+}
+
+func TestServerError_LogsRequestID(t *testing.T) {
+	buf := captureLogs(t)
+	h := logRequest(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serverError(w, r, errors.New("disk on fire"))
+	}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/boom", nil))
+
+	id := rec.Header().Get("X-Request-ID")
+	lines := logLines(t, buf)
+	if len(lines) != 2 {
+		t.Fatalf("want error and request lines, got %v", lines)
+	}
+	if lines[0]["msg"] != "handler error" || lines[0]["err"] != "disk on fire" || lines[0]["request_id"] != id {
+		t.Fatalf("error not logged with request ID: %v", lines[0])
+	}
+	if lines[1]["level"] != "ERROR" || lines[1]["status"] != float64(500) {
+		t.Fatalf("5xx request line should log at ERROR: %v", lines[1])
+	}
+}
+
+func TestLogLevel_FiltersProbes(t *testing.T) {
+	buf := captureLogs(t)
+	defer logLevel.Set(logLevel.Level())
+	logLevel.Set(slog.LevelInfo)
+
+	h := logRequest(http.HandlerFunc(healthzHandler))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if buf.Len() != 0 {
+		t.Fatalf("probe should log at debug only, got %s", buf.String())
+	}
+	logLevel.Set(slog.LevelDebug)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if !strings.Contains(buf.String(), `"path":"/healthz"`) {
+		t.Fatalf("probe should log at debug level, got %q", buf.String())
+	}
+}
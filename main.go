@@ -1,29 +1,43 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"html/template"
 	"io/fs"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
 // --------------------------- Config ---------------------------
+// Runtime settings live in Config (config.go); these are fixed policy.
 const (
-	listenAddr    = ":8080"
-	storageDir    = "data"
-	adminUser     = "admin"
-	adminPass     = "changeme" // change this
-	sessionCookie = "session"
-	sessionMaxAge = 24 * 3600 // 1 day
+	// login throttling: a few free failures, then exponential backoff, then
+	// a temporary lockout. Failure history is forgotten after an idle hour,
+	// or sooner for the least recent unblocked keys once loginMaxKeys are
+	// tracked; with every slot blocked, new keys wait.
+	loginFreeAttempts = 3
+	loginBackoffBase  = time.Second
+	loginBackoffMax   = 5 * time.Minute
+	loginLockoutAfter = 10
+	loginLockoutFor   = 15 * time.Minute
+	loginFailureTTL   = time.Hour
+	loginMaxKeys      = 10_000
 )
 
 // --------------------------- Types ----------------------------
@@ -33,22 +47,48 @@ type Article struct {
 	Slug      string    `json:"slug"`
 	Content   string    `json:"content"`
 	Published time.Time `json:"published"`
+	UpdatedAt time.Time `json:"updated_at,omitzero"`
+	Draft     bool      `json:"draft,omitempty"`  // hidden from guests until published
+	Author    string    `json:"author,omitempty"` // set by imports; shown as the byline
+	Tags      []string  `json:"tags,omitempty"`
+	Aliases   []string  `json:"aliases,omitempty"` // former URL paths that redirect here
+
+	CommentsClosed bool `json:"comments_closed,omitempty"` // no new comments; existing ones stay visible
+}
+
+// Modified is when the article last changed; files written before
+// UpdatedAt existed fall back to the publication date.
+func (a Article) Modified() time.Time {
+	if a.UpdatedAt.IsZero() {
+		return a.Published
+	}
+	return a.UpdatedAt
 }
 
 // --------------------------- Globals --------------------------
 
 var (
 	tmpl = template.Must(template.New("base").Funcs(template.FuncMap{
-		"date": func(t time.Time) string { return t.Format("Jan 02, 2006") },
+		"date": func(t time.Time) string { return t.In(cfg.Location()).Format("Jan 02, 2006") },
 		"dateInput": func(t time.Time) string {
 			if t.IsZero() {
 				return ""
 			}
-			return t.Format("2006-01-02")
+			return t.In(cfg.Location()).Format("2006-01-02")
 		},
+		"site": func() Config { return cfg },
 	}).Parse(baseHTML))
 
-	sessions = map[string]bool{} // token -> isAdmin
+	cfg = defaultConfig() // replaced in main once flags are parsed
+
+	sessions   = map[string]string{} // token -> username
+	sessionsMu sync.RWMutex
+
+	limiter = newLoginLimiter()
+
+	// storeMu lets backups take a consistent snapshot: every write to the
+	// storage dir holds the read side, snapshotStorage the write side.
+	storeMu sync.RWMutex
 )
 
 func init() {
@@ -58,31 +98,60 @@ func init() {
 	template.Must(tmpl.New("admin_login").Parse(adminLoginHTML))
 	template.Must(tmpl.New("admin_dashboard").Parse(adminDashboardHTML))
 	template.Must(tmpl.New("admin_form").Parse(adminFormHTML))
-
-	// Ensure storage dir exists on startup (handles missing ./data gracefully).
-	if err := ensureStorage(); err != nil {
-		log.Fatalf("storage init: %v", err)
-	}
+	template.Must(tmpl.New("admin_audit").Parse(adminAuditHTML))
+	template.Must(tmpl.New("admin_import").Parse(adminImportHTML))
+	template.Must(tmpl.New("admin_export").Parse(adminExportHTML))
+	template.Must(tmpl.New("comments").Parse(commentsHTML))
+	template.Must(tmpl.New("webmentions").Parse(webmentionsHTML))
+	template.Must(tmpl.New("admin_webhooks").Parse(adminWebhooksHTML))
+	template.Must(tmpl.New("newsletter_form").Parse(newsletterFormHTML))
+	template.Must(tmpl.New("newsletter").Parse(newsletterHTML))
+	template.Must(tmpl.New("admin_newsletter").Parse(adminNewsletterHTML))
+	template.Must(tmpl.New("admin_tokens").Parse(adminTokensHTML))
+	template.Must(tmpl.New("admin_comments").Parse(adminCommentsHTML))
+	template.Must(tmpl.New("error").Parse(errorHTML))
 }
 
 // --------------------------- Storage --------------------------
 
 // ensureStorage creates the storage directory if it doesn't exist.
 func ensureStorage() error {
-	return os.MkdirAll(storageDir, 0o755)
+	return os.MkdirAll(cfg.StorageDir, 0o755)
 }
 
-func allArticles() ([]Article, error) {
+func allArticles() (_ []Article, err error) {
+	defer observeStore("list", time.Now(), &err)
+	var list []Article
+	err = walkArticles(func(path string, b []byte) error {
+		a, err := decodeArticle(b)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		list = append(list, a)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// newest first
+	sort.Slice(list, func(i, j int) bool { return list[i].Published.After(list[j].Published) })
+	return list, nil
+}
+
+// walkArticles calls fn with the path and contents of every article file.
+func walkArticles(fn func(path string, b []byte) error) error {
 	// If the data folder is missing, create it and return empty list.
 	if err := ensureStorage(); err != nil { // handles missing ./data
-		return nil, err
+		return err
 	}
-	var list []Article
-	err := filepath.WalkDir(storageDir, func(path string, d fs.DirEntry, err error) error {
+	return filepath.WalkDir(cfg.StorageDir, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
 		if d.IsDir() {
+			if path != cfg.StorageDir && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir // internal stores, see metaDir
+			}
 			return nil
 		}
 		if !strings.HasSuffix(d.Name(), ".json") {
@@ -92,64 +161,173 @@ func allArticles() ([]Article, error) {
 		if err != nil {
 			return err
 		}
-		var a Article
-		if err := json.Unmarshal(b, &a); err != nil {
-			return err
-		}
-		list = append(list, a)
-		return nil
+		return fn(path, b)
 	})
+}
+
+// publicArticles is allArticles without drafts, for everything guests see.
+func publicArticles() ([]Article, error) {
+	arts, err := allArticles()
 	if err != nil {
 		return nil, err
 	}
-	// newest first
-	sort.Slice(list, func(i, j int) bool { return list[i].Published.After(list[j].Published) })
-	return list, nil
+	out := arts[:0]
+	for _, a := range arts {
+		if !a.Draft {
+			out = append(out, a)
+		}
+	}
+	return out, nil
 }
 
-func loadArticle(slug string) (Article, error) {
+func loadArticle(slug string) (_ Article, err error) {
+	defer observeStore("load", time.Now(), &err)
 	if err := ensureStorage(); err != nil {
 		return Article{}, err
 	}
-	p := filepath.Join(storageDir, slug+".json")
+	p := filepath.Join(cfg.StorageDir, slug+".json")
 	b, err := os.ReadFile(p)
 	if err != nil {
 		return Article{}, err
 	}
-	var a Article
-	if err := json.Unmarshal(b, &a); err != nil {
-		return Article{}, err
-	}
-	return a, nil
+	return decodeArticle(b)
 }
 
-func saveArticle(a Article) error {
+func saveArticle(a Article) (err error) {
+	defer observeStore("save", time.Now(), &err)
 	if a.Slug == "" {
 		return errors.New("missing slug")
 	}
 	if err := ensureStorage(); err != nil {
 		return err
 	}
-	p := filepath.Join(storageDir, a.Slug+".json")
-	b, err := json.MarshalIndent(a, "", "  ")
+	p := filepath.Join(cfg.StorageDir, a.Slug+".json")
+	b, err := encodeArticle(a)
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(p, b, 0o644)
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	if err := writeFileAtomic(p, b, 0o644); err != nil {
+		return err
+	}
+	articleChanged(a.Slug)
+	// a re-created slug is no longer gone
+	if err := os.Remove(tombstonePath(a.Slug)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
 }
 
+// deleteArticle removes an article and leaves a tombstone (a copy of the
+// deleted JSON) so its URL answers 410 Gone instead of 404.
 func deleteArticle(slug string) error {
+	return retireArticle(slug, "")
+}
+
+// retireArticle is deleteArticle for an article that may have moved to a
+// new slug; the tombstone then records movedTo, so the old slug can't be
+// undeleted into a stale copy.
+func retireArticle(slug, movedTo string) (err error) {
+	defer observeStore("delete", time.Now(), &err)
 	if err := ensureStorage(); err != nil {
 		return err
 	}
-	p := filepath.Join(storageDir, slug+".json")
-	err := os.Remove(p)
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	p := filepath.Join(cfg.StorageDir, slug+".json")
+	b, err := os.ReadFile(p)
 	if os.IsNotExist(err) {
 		return nil
 	}
+	if err != nil {
+		return err
+	}
+	if movedTo != "" {
+		s, err := decodeStored(b)
+		if err != nil {
+			return err
+		}
+		s.MovedTo = movedTo
+		if b, err = json.MarshalIndent(s, "", "  "); err != nil {
+			return err
+		}
+	}
+	if err := writeFileAtomic(tombstonePath(slug), b, 0o644); err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	articleChanged(slug)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// updateArticle replaces orig with updated, moving the file when the slug
+// changed. The web editor and the CLI both go through here.
+func updateArticle(orig, updated Article) error {
+	if err := saveArticle(updated); err != nil {
+		return err
+	}
+	if updated.Slug != orig.Slug {
+		if err := moveComments(orig.Slug, updated.Slug); err != nil {
+			return err
+		}
+		return retireArticle(orig.Slug, updated.Slug)
+	}
+	return nil
+}
+
+// articleWritten tells the outside world about a create (before is the
+// zero Article), an edit, or a delete (after is zero) made from the admin
+// or the CLI. Imports and maintenance commands don't go through here.
+func articleWritten(before, after Article) {
+	queueWebmentions(before, after)
+	queueWebhooks(before, after)
+	queueNewsletter(before, after)
+	queueActivityPub(before, after)
+}
+
+// metaDir holds the app's own stores (users and the like) inside the
+// storage dir; allArticles skips dot-directories.
+func metaDir() string {
+	return filepath.Join(cfg.StorageDir, ".blog")
+}
+
+// writeFileAtomic writes through a temp file and a rename, so readers and
+// backups never see a half-written file.
+func writeFileAtomic(path string, b []byte, perm fs.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
 	return err
 }
 
+func tombstonePath(slug string) string {
+	return filepath.Join(cfg.StorageDir, slug+".gone")
+}
+
+// articleGone reports whether slug belonged to a deleted article.
+func articleGone(slug string) bool {
+	_, err := os.Stat(tombstonePath(slug))
+	return err == nil
+}
+
 // --------------------------- Util -----------------------------
 
 func makeSlug(title string) string {
@@ -184,16 +362,58 @@ func newToken(n int) string {
 }
 
 func isAuthed(r *http.Request) bool {
-	c, err := r.Cookie(sessionCookie)
+	return sessionUser(r) != ""
+}
+
+// sessionUser returns the username of the logged-in admin, or "" when
+// there is none or the account has been removed since.
+func sessionUser(r *http.Request) string {
+	c, err := r.Cookie(cfg.SessionCookie)
 	if err != nil {
-		return false
+		return ""
+	}
+	sessionsMu.RLock()
+	u := sessions[c.Value]
+	sessionsMu.RUnlock()
+	if u == "" || !accountExists(u) {
+		return ""
 	}
-	return sessions[c.Value]
+	return u
 }
 
+// startSession creates a session for user and returns its token.
+func startSession(user string) string {
+	tok := newToken(32)
+	sessionsMu.Lock()
+	sessions[tok] = user
+	sessionsMu.Unlock()
+	return tok
+}
+
+// endSession forgets tok and returns the user it belonged to.
+func endSession(tok string) string {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	u := sessions[tok]
+	delete(sessions, tok)
+	return u
+}
+
+func sessionCount() int {
+	sessionsMu.RLock()
+	defer sessionsMu.RUnlock()
+	return len(sessions)
+}
+
+// requireAuth sends anonymous page views to the login form; anonymous
+// writes are refused outright since there is nothing sensible to redirect.
 func requireAuth(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if !isAuthed(r) {
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				renderError(w, r, http.StatusForbidden, nil)
+				return
+			}
 			http.Redirect(w, r, "/admin/login", http.StatusFound)
 			return
 		}
@@ -201,97 +421,237 @@ func requireAuth(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// render executes the base template into a buffer first, so a template
+// error becomes a clean 500 page instead of half a page. Templates get the
+// request's CSP nonce as .Nonce for any inline <script> or <style>. Admin
+// pages are never cached; public ones get validators from servePage, with
+// data["Modified"] as Last-Modified.
+func render(w http.ResponseWriter, r *http.Request, data map[string]any) {
+	data["Nonce"] = cspNonce(r.Context())
+	data["Static"] = isStaticBuild(r.Context())
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, "base", data); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if strings.HasPrefix(r.URL.Path, "/admin") || strings.HasPrefix(r.URL.Path, "/newsletter/") {
+		w.Header().Set("Cache-Control", "no-store")
+		_, _ = buf.WriteTo(w)
+		return
+	}
+	modified, _ := data["Modified"].(time.Time)
+	servePage(w, r, buf.Bytes(), modified)
+}
+
 // --------------------------- Handlers (Guest) -----------------
 
 func homeHandler(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path != "/" {
-		http.NotFound(w, r)
+		if target, ok := aliasTarget(r.URL.Path); ok {
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return
+		}
+		notFound(w, r)
 		return
 	}
-	arts, err := allArticles()
+	renderHome(w, r, 1)
+}
+
+// homePageHandler serves /page/{n}, the older pages of the Home listing.
+func homePageHandler(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/page/"))
+	if err != nil || n < 1 {
+		notFound(w, r)
+		return
+	}
+	if n == 1 {
+		http.Redirect(w, r, "/", http.StatusMovedPermanently)
+		return
+	}
+	renderHome(w, r, n)
+}
+
+// pageURL is the path of page n of the Home listing.
+func pageURL(n int) string {
+	if n <= 1 {
+		return "/"
+	}
+	return fmt.Sprintf("/page/%d", n)
+}
+
+func renderHome(w http.ResponseWriter, r *http.Request, page int) {
+	arts, err := publicArticles()
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		serverError(w, r, err)
+		return
+	}
+	pages := (len(arts) + cfg.PageSize - 1) / cfg.PageSize
+	if pages == 0 {
+		pages = 1
+	}
+	if page > pages {
+		notFound(w, r)
 		return
 	}
+	start := (page - 1) * cfg.PageSize
+	end := min(start+cfg.PageSize, len(arts))
 	data := map[string]any{
-		"Active":   "home",
-		"Articles": arts,
-		"Title":    "Home",
+		"Active":    "home",
+		"Articles":  arts[start:end],
+		"Title":     "Home",
+		"Canonical": pageURL(page),
+		"Page":      page,
+		"Pages":     pages,
+	}
+	var newest time.Time
+	for _, a := range arts {
+		if t := a.Modified(); t.After(newest) {
+			newest = t
+		}
 	}
-	if err := tmpl.ExecuteTemplate(w, "base", data); err != nil {
-		http.Error(w, err.Error(), 500)
+	data["Modified"] = newest
+	if page > 1 {
+		data["PrevURL"] = pageURL(page - 1)
 	}
+	if page < pages {
+		data["NextURL"] = pageURL(page + 1)
+	}
+	render(w, r, data)
 }
 
 func articleHandler(w http.ResponseWriter, r *http.Request) {
 	slug := strings.TrimPrefix(r.URL.Path, "/article/")
 	if slug == "" {
-		http.NotFound(w, r)
+		notFound(w, r)
 		return
 	}
 	a, err := loadArticle(slug)
+	if errors.Is(err, fs.ErrNotExist) {
+		if articleGone(slug) {
+			renderError(w, r, http.StatusGone, nil)
+			return
+		}
+		notFound(w, r)
+		return
+	}
 	if err != nil {
-		http.NotFound(w, r)
+		serverError(w, r, err)
+		return
+	}
+	if a.Draft && !isAuthed(r) {
+		notFound(w, r)
 		return
 	}
+	if r.Method == http.MethodPost {
+		commentPost(w, r, a)
+		return
+	}
+	renderArticle(w, r, a, commentForm{Parent: r.URL.Query().Get("reply")})
+}
+
+// renderArticle shows a with its comments; form refills the comment form
+// after a rejected post.
+func renderArticle(w http.ResponseWriter, r *http.Request, a Article, form commentForm) {
 	data := map[string]any{
-		"Active":  "article",
-		"Title":   a.Title,
-		"Article": a,
+		"Active":    "article",
+		"Title":     a.Title,
+		"Article":   a,
+		"Canonical": "/article/" + a.Slug,
 	}
-	if err := tmpl.ExecuteTemplate(w, "base", data); err != nil {
-		http.Error(w, err.Error(), 500)
+	if err := addCommentData(w, r, a, form, data); err != nil {
+		serverError(w, r, err)
+		return
 	}
+	if err := addMentionData(a, data); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	render(w, r, data)
+}
+
+// styleETag is computed once; the stylesheet only changes with a rebuild.
+var styleETag = etagFor([]byte(styleCSS))
+
+// styleHandler serves the site stylesheet.
+func styleHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/css; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(cfg.StaticMaxAge))
+	w.Header().Set("ETag", styleETag)
+	http.ServeContent(w, r, "", time.Time{}, strings.NewReader(styleCSS))
 }
 
 // --------------------------- Handlers (Admin) -----------------
 
 func adminLoginGet(w http.ResponseWriter, r *http.Request, errMsg string) {
 	data := map[string]any{"Active": "admin_login", "Title": "Admin Login", "Error": errMsg}
-	if err := tmpl.ExecuteTemplate(w, "base", data); err != nil {
-		http.Error(w, err.Error(), 500)
-	}
+	render(w, r, data)
 }
 
 func adminLoginPost(w http.ResponseWriter, r *http.Request) {
 	_ = r.ParseForm()
 	u := strings.TrimSpace(r.FormValue("username"))
 	p := strings.TrimSpace(r.FormValue("password"))
-	if u == adminUser && p == adminPass {
-		tok := newToken(32)
-		sessions[tok] = true
-		http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: tok, Path: "/", MaxAge: sessionMaxAge, HttpOnly: true})
+	ip := clientIP(r)
+	keys := loginKeys(ip, u)
+	if wait := limiter.check(keys...); wait > 0 {
+		wait = wait.Truncate(time.Second) + time.Second
+		audit(r, "login.throttled", u, "", fmt.Sprintf("retry in %s", wait))
+		loginFailures.add(1, "throttled")
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())))
+		w.WriteHeader(http.StatusTooManyRequests)
+		adminLoginGet(w, r, fmt.Sprintf("Too many failed attempts. Try again in %s.", wait))
+		return
+	}
+	if authenticate(u, p) {
+		limiter.succeed(keys...)
+		tok := startSession(u)
+		audit(r, "login", u, "", "")
+		http.SetCookie(w, &http.Cookie{Name: cfg.SessionCookie, Value: tok, Path: "/", MaxAge: cfg.SessionMaxAge, HttpOnly: true, Secure: requestIsTLS(r)})
 		http.Redirect(w, r, "/admin", http.StatusFound)
 		return
 	}
+	loginFailures.add(1, "invalid_credentials")
+	if limiter.fail(keys...) {
+		audit(r, "login.failed", u, "", fmt.Sprintf("locked out for %s", loginLockoutFor))
+	} else {
+		audit(r, "login.failed", u, "", "")
+	}
 	adminLoginGet(w, r, "Invalid credentials")
 }
 
 func adminLogout(w http.ResponseWriter, r *http.Request) {
-	if c, err := r.Cookie(sessionCookie); err == nil {
-		delete(sessions, c.Value)
+	if c, err := r.Cookie(cfg.SessionCookie); err == nil {
+		if u := endSession(c.Value); u != "" {
+			audit(r, "logout", u, "", "")
+		}
 	}
-	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+	http.SetCookie(w, &http.Cookie{Name: cfg.SessionCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true, Secure: requestIsTLS(r)})
 	http.Redirect(w, r, "/admin/login", http.StatusFound)
 }
 
 func adminDashboard(w http.ResponseWriter, r *http.Request) {
 	arts, err := allArticles()
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		serverError(w, r, err)
 		return
 	}
-	data := map[string]any{"Active": "admin_dashboard", "Title": "Dashboard", "Articles": arts}
-	if err := tmpl.ExecuteTemplate(w, "base", data); err != nil {
-		http.Error(w, err.Error(), 500)
+	data := map[string]any{"Active": "admin_dashboard", "Title": "Dashboard", "Articles": arts, "Lockouts": limiter.blocked(), "Cache": pages.snapshot(), "PendingComments": pendingComments()}
+	render(w, r, data)
+}
+
+func adminClearLockoutPost(w http.ResponseWriter, r *http.Request) {
+	_ = r.ParseForm()
+	key := r.FormValue("key")
+	if limiter.clear(key) {
+		audit(r, "lockout.clear", "", "", key)
 	}
+	http.Redirect(w, r, "/admin", http.StatusFound)
 }
 
 func adminNewGet(w http.ResponseWriter, r *http.Request, a *Article, errMsg string) {
 	data := map[string]any{"Active": "admin_form", "Title": "Add Article", "Article": a, "Error": errMsg, "Mode": "add"}
-	if err := tmpl.ExecuteTemplate(w, "base", data); err != nil {
-		http.Error(w, err.Error(), 500)
-	}
+	render(w, r, data)
 }
 
 func adminNewPost(w http.ResponseWriter, r *http.Request) {
@@ -303,16 +663,18 @@ func adminNewPost(w http.ResponseWriter, r *http.Request) {
 		adminNewGet(w, r, nil, "All fields are required")
 		return
 	}
-	pub, err := time.Parse("2006-01-02", dateStr)
+	pub, err := time.ParseInLocation("2006-01-02", dateStr, cfg.Location())
 	if err != nil {
 		adminNewGet(w, r, nil, "Invalid date (use YYYY-MM-DD)")
 		return
 	}
-	a := Article{Title: title, Slug: makeSlug(title), Content: content, Published: pub}
+	a := Article{Title: title, Slug: makeSlug(title), Content: content, Published: pub, UpdatedAt: time.Now().UTC(), Draft: r.FormValue("draft") != "", Tags: parseTags(r.FormValue("tags")), CommentsClosed: r.FormValue("comments_closed") != ""}
 	if err := saveArticle(a); err != nil {
 		adminNewGet(w, r, &a, err.Error())
 		return
 	}
+	audit(r, "article.create", "", a.Slug, fmt.Sprintf("title %q; content %d chars; published %s", a.Title, len(a.Content), a.Published.Format("2006-01-02")))
+	articleWritten(Article{}, a)
 	http.Redirect(w, r, "/admin", http.StatusFound)
 }
 
@@ -325,14 +687,12 @@ func adminEditGet(w http.ResponseWriter, r *http.Request, a *Article, errMsg str
 	} else {
 		art, err = loadArticle(slug)
 		if err != nil {
-			http.NotFound(w, r)
+			notFound(w, r)
 			return
 		}
 	}
 	data := map[string]any{"Active": "admin_form", "Title": "Edit Article", "Article": &art, "Error": errMsg, "Mode": "edit"}
-	if err := tmpl.ExecuteTemplate(w, "base", data); err != nil {
-		http.Error(w, err.Error(), 500)
-	}
+	render(w, r, data)
 }
 
 func adminEditPost(w http.ResponseWriter, r *http.Request) {
@@ -340,7 +700,7 @@ func adminEditPost(w http.ResponseWriter, r *http.Request) {
 	slug := strings.TrimPrefix(r.URL.Path, "/admin/edit/")
 	orig, err := loadArticle(slug)
 	if err != nil {
-		http.NotFound(w, r)
+		notFound(w, r)
 		return
 	}
 	title := strings.TrimSpace(r.FormValue("title"))
@@ -350,51 +710,237 @@ func adminEditPost(w http.ResponseWriter, r *http.Request) {
 		adminEditGet(w, r, &orig, "All fields are required")
 		return
 	}
-	pub, err := time.Parse("2006-01-02", dateStr)
+	pub, err := time.ParseInLocation("2006-01-02", dateStr, cfg.Location())
 	if err != nil {
 		adminEditGet(w, r, &orig, "Invalid date (use YYYY-MM-DD)")
 		return
 	}
 
 	newSlug := makeSlug(title)
-	updated := Article{Title: title, Slug: newSlug, Content: content, Published: pub}
-	if newSlug != orig.Slug {
-		// rename file: save new then delete old
-		if err := saveArticle(updated); err != nil {
-			adminEditGet(w, r, &updated, err.Error())
-			return
-		}
-		_ = deleteArticle(orig.Slug)
-	} else {
-		if err := saveArticle(updated); err != nil {
-			adminEditGet(w, r, &updated, err.Error())
-			return
-		}
+	updated := Article{Title: title, Slug: newSlug, Content: content, Published: pub, UpdatedAt: time.Now().UTC(), Draft: r.FormValue("draft") != "", Author: orig.Author, Tags: parseTags(r.FormValue("tags")), Aliases: orig.Aliases, CommentsClosed: r.FormValue("comments_closed") != ""}
+	if err := updateArticle(orig, updated); err != nil {
+		adminEditGet(w, r, &updated, err.Error())
+		return
 	}
+	audit(r, "article.update", "", updated.Slug, articleChanges(orig, updated))
+	articleWritten(orig, updated)
 	http.Redirect(w, r, "/admin", http.StatusFound)
 }
 
 func adminDeletePost(w http.ResponseWriter, r *http.Request) {
 	slug := strings.TrimPrefix(r.URL.Path, "/admin/delete/")
 	if slug == "" {
-		http.NotFound(w, r)
+		notFound(w, r)
 		return
 	}
+	a, _ := loadArticle(slug)
 	if err := deleteArticle(slug); err != nil {
-		http.Error(w, err.Error(), 500)
+		serverError(w, r, err)
 		return
 	}
+	audit(r, "article.delete", "", slug, fmt.Sprintf("title %q", a.Title))
+	articleWritten(a, Article{})
 	http.Redirect(w, r, "/admin", http.StatusFound)
 }
 
 // --------------------------- main -----------------------------
 
 func main() {
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		printUsage(os.Stdout)
+		return
+	}
+	cmd, ok := findCommand(name)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		printUsage(os.Stderr)
+		os.Exit(2)
+	}
+	if err := cmd.run(args); err != nil {
+		fatal(name+" failed", "err", err)
+	}
+}
+
+// runServe implements `blog serve`, the default command.
+func runServe(args []string) error {
+	configure(flag.NewFlagSet("serve", flag.ExitOnError), args)
+	slog.Info("effective config:\n" + cfg.String())
+	if cfg.UsingDefaultPassword() {
+		slog.Warn("admin password is the default; set admin_pass or $BLOG_ADMIN_PASS")
+	}
+
+	// Ensure storage dir exists on startup (handles missing ./data gracefully).
+	if err := ensureStorage(); err != nil {
+		fatal("storage init", "err", err)
+	}
+	if err := logSchema(); err != nil {
+		fatal("storage schema", "err", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var bg background
+	bg.run(func() { webmentions.run(ctx, processWebmentions) })
+	bg.run(func() { webhookDeliveries.run(ctx, processWebhooks) })
+	bg.run(func() { newsletters.run(ctx, processNewsletter) })
+	bg.run(func() { federation.run(ctx, processFederation) })
+	ln, err := net.Listen("tcp", cfg.ListenAddr)
+	if err != nil {
+		fatal("listen", "addr", cfg.ListenAddr, "err", err)
+	}
+	if cfg.MetricsAddr != "" {
+		mln, err := net.Listen("tcp", cfg.MetricsAddr)
+		if err != nil {
+			fatal("listen", "addr", cfg.MetricsAddr, "err", err)
+		}
+		slog.Info("metrics listening", "url", "http://"+mln.Addr().String()+"/metrics")
+		bg.run(func() {
+			if err := serve(ctx, newServer(metricsMux()), mln); err != nil {
+				slog.Error("metrics server", "err", err)
+			}
+		})
+	}
+	srv := newServer(handler())
+	scheme := "http"
+	if cfg.TLSEnabled() {
+		if srv.TLSConfig, err = tlsConfig(); err != nil {
+			fatal("tls", "err", err)
+		}
+		scheme = "https"
+	}
+	if cfg.TLSRedirectAddr != "" {
+		rln, err := net.Listen("tcp", cfg.TLSRedirectAddr)
+		if err != nil {
+			fatal("listen", "addr", cfg.TLSRedirectAddr, "err", err)
+		}
+		slog.Info("redirecting plain HTTP to HTTPS", "addr", rln.Addr().String())
+		bg.run(func() {
+			if err := serve(ctx, newServer(http.HandlerFunc(httpsRedirect)), rln); err != nil {
+				slog.Error("redirect server", "err", err)
+			}
+		})
+	}
+	slog.Info(cfg.SiteTitle+" running", "url", scheme+"://localhost"+cfg.ListenAddr)
+	err = serve(ctx, srv, ln)
+	stop() // the other listeners and the workers stop with the main server
+	if !bg.wait(seconds(cfg.ShutdownTimeout)) {
+		slog.Warn("background work still running after the shutdown timeout")
+	}
+	if err != nil {
+		return err
+	}
+	slog.Info("server stopped")
+	return nil
+}
+
+// configure registers the config flags on fs (next to any the caller
+// added), parses args, installs the resulting Config and sets up logging.
+func configure(fs *flag.FlagSet, args []string) {
+	cf := addConfigFlags(fs)
+	_ = fs.Parse(args)
+	c, err := cf.load()
+	if err != nil {
+		fatal("invalid config", "err", err)
+	}
+	cfg = c
+	lvl, _ := parseLogLevel(cfg.LogLevel) // validated by load
+	logLevel.Set(lvl)
+	slog.SetDefault(newLogger(os.Stderr, cfg.LogFormat))
+}
+
+// handler wraps the routes in the middleware chain, outermost first.
+func handler() http.Handler {
+	return logRequest(securityHeaders(compress(instrument(recoverPanic(routes())))))
+}
+
+// routes registers every guest and admin handler on a fresh mux.
+func routes() *http.ServeMux {
 	mux := http.NewServeMux()
 
+	// probes
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+	if cfg.MetricsAddr == "" && cfg.MetricsToken != "" {
+		mux.HandleFunc("/metrics", requireMetricsToken(metricsHandler))
+	}
+
 	// guest
-	mux.HandleFunc("/", homeHandler)
-	mux.HandleFunc("/article/", articleHandler)
+	mux.HandleFunc("/", cached(homeHandler))
+	mux.HandleFunc("/static/style.css", styleHandler)
+	mux.HandleFunc("/csp-report", cspReportHandler)
+	mux.HandleFunc("/page/", cached(homePageHandler))
+	mux.HandleFunc("/article/", cached(articleHandler))
+	mux.HandleFunc("/webmention", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			webmentionPost(w, r)
+			return
+		}
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	})
+	mux.HandleFunc("/.well-known/webfinger", webfingerHandler)
+	mux.HandleFunc("/ap/actor", apActorHandler)
+	mux.HandleFunc("/ap/outbox", apOutboxHandler)
+	mux.HandleFunc("/ap/followers", apFollowersHandler)
+	mux.HandleFunc("/ap/articles/", apArticleHandler)
+	mux.HandleFunc("/ap/inbox", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			apInboxPost(w, r)
+			return
+		}
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	})
+	mux.HandleFunc("/micropub", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			micropubGet(w, r)
+			return
+		}
+		if r.Method == http.MethodPost {
+			micropubPost(w, r)
+			return
+		}
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	})
+	mux.HandleFunc("/micropub/media", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			micropubMediaPost(w, r)
+			return
+		}
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	})
+	mux.HandleFunc("/media/", mediaHandler)
+	mux.HandleFunc("/xmlrpc", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			xmlrpcHandler(w, r)
+			return
+		}
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	})
+	mux.HandleFunc("/rsd.xml", rsdHandler)
+	mux.HandleFunc("/newsletter/subscribe", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			newsletterSubscribePost(w, r)
+			return
+		}
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	})
+	mux.HandleFunc("/newsletter/confirm", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodPost {
+			newsletterConfirm(w, r)
+			return
+		}
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	})
+	mux.HandleFunc("/newsletter/unsubscribe", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodPost {
+			newsletterUnsubscribe(w, r)
+			return
+		}
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	})
 
 	// admin auth
 	mux.HandleFunc("/admin/login", func(w http.ResponseWriter, r *http.Request) {
@@ -441,55 +987,145 @@ func main() {
 		}
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 	}))
-
-	log.Printf("Personal Blog running on http://localhost%s\n", listenAddr)
-	log.Fatal(http.ListenAndServe(listenAddr, logRequest(mux)))
-}
-
-// basic request logger
-func logRequest(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		next.ServeHTTP(w, r)
-		log.Printf("%s %s %s", r.Method, r.URL.Path, time.Since(start))
-	})
+	mux.HandleFunc("/admin/import", requireAuth(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			adminImportGet(w, r)
+			return
+		}
+		if r.Method == http.MethodPost {
+			adminImportPost(w, r)
+			return
+		}
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}))
+	mux.HandleFunc("/admin/comments", requireAuth(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			adminCommentsGet(w, r)
+			return
+		}
+		if r.Method == http.MethodPost {
+			adminCommentsPost(w, r)
+			return
+		}
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}))
+	mux.HandleFunc("/admin/webhooks", requireAuth(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			adminWebhooksGet(w, r, "")
+			return
+		}
+		if r.Method == http.MethodPost {
+			adminWebhooksPost(w, r)
+			return
+		}
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}))
+	mux.HandleFunc("/admin/newsletter", requireAuth(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			adminNewsletterGet(w, r)
+			return
+		}
+		if r.Method == http.MethodPost {
+			adminNewsletterPost(w, r)
+			return
+		}
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}))
+	mux.HandleFunc("/admin/newsletter/subscribers.csv", requireAuth(adminNewsletterCSV))
+	mux.HandleFunc("/admin/tokens", requireAuth(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			adminTokensGet(w, r, "", nil, "")
+			return
+		}
+		if r.Method == http.MethodPost {
+			adminTokensPost(w, r)
+			return
+		}
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}))
+	mux.HandleFunc("/admin/export", requireAuth(adminExportGet))
+	mux.HandleFunc("/admin/export/download", requireAuth(adminExportDownload))
+	mux.HandleFunc("/admin/backup", requireAuth(adminBackup))
+	mux.HandleFunc("/admin/audit", requireAuth(adminAuditGet))
+	mux.HandleFunc("/admin/audit.csv", requireAuth(adminAuditCSV))
+	mux.HandleFunc("/admin/lockouts/clear", requireAuth(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			adminClearLockoutPost(w, r)
+			return
+		}
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}))
+	return mux
 }
 
 // --------------------------- Templates ------------------------
 
+// styleCSS is served from /static/style.css rather than inlined, so the CSP
+// needs no 'unsafe-inline' for styles. Templates use the utility classes at
+// the bottom instead of style attributes.
+const styleCSS = `:root{--bg:#0b0c10;--card:#15171c;--text:#e8eef2;--muted:#aab4bf;--accent:#60a5fa;--bad:#ef4444}
+*{box-sizing:border-box}
+body{margin:0;font-family:system-ui,-apple-system,Segoe UI,Roboto,Inter,Arial,sans-serif;background:var(--bg);color:var(--text)}
+header{padding:18px 20px;border-bottom:1px solid #23262d;background:#0f1116;position:sticky;top:0}
+a{color:var(--accent);text-decoration:none}
+nav a{color:var(--muted);margin-right:14px;padding:8px 10px;border-radius:10px}
+nav a.active{background:#15171c;color:#fff;border:1px solid #262a33}
+main{max-width:860px;margin:28px auto;padding:0 16px}
+.card{background:#15171c;border:1px solid #23262d;border-radius:16px;padding:20px;margin-bottom:16px}
+.row{display:grid;grid-template-columns:1fr 1fr;gap:12px}
+input, textarea, select{width:100%;background:#0f1116;border:1px solid #23262d;color:#e8eef2;padding:12px;border-radius:12px}
+textarea{min-height:260px}
+input[type=checkbox]{width:auto}
+label{font-size:14px;color:var(--muted)}
+button{background:var(--accent);border:none;color:#04121f;padding:10px 14px;border-radius:12px;font-weight:600;cursor:pointer}
+table{width:100%;border-collapse:collapse}
+th,td{padding:10px;border-bottom:1px solid #23262d}
+.danger{background:#2a1111;border:1px solid #3a1a1a;color:#ffb4b4}
+.muted{color:var(--muted)}
+.m-0{margin:0}
+.mt-0{margin-top:0}
+.mt-4{margin-top:4px}
+.mt-8{margin-top:8px}
+.mt-10{margin-top:10px}
+.mt-12{margin-top:12px}
+.mb-8{margin-bottom:8px}
+.mb-12{margin-bottom:12px}
+.mb-16{margin-bottom:16px}
+.ml-8{margin-left:8px}
+.my-24{margin:24px 0}
+.w-120{width:120px}
+.w-220{width:220px}
+.inline{display:inline}
+.bar{display:flex;justify-content:space-between;align-items:center}
+.pre{white-space:pre-wrap}
+.prose{white-space:pre-wrap;line-height:1.6}
+.short{min-height:120px}
+.comment{margin-top:16px}
+.comment-body{line-height:1.6}
+.reply{margin-left:20px;padding-left:12px;border-left:2px solid #23262d}
+.hp{position:absolute;left:-10000px;width:1px;height:1px;overflow:hidden}
+`
+
 const baseHTML = `{{define "base"}}
 <!doctype html>
 <html lang="en">
 <head>
   <meta charset="utf-8">
   <meta name="viewport" content="width=device-width, initial-scale=1"/>
-  <title>{{.Title}} · Personal Blog</title>
-  <style>
-    :root{--bg:#0b0c10;--card:#15171c;--text:#e8eef2;--muted:#aab4bf;--accent:#60a5fa;--bad:#ef4444}
-    *{box-sizing:border-box}
-    body{margin:0;font-family:system-ui,-apple-system,Segoe UI,Roboto,Inter,Arial,sans-serif;background:var(--bg);color:var(--text)}
-    header{padding:18px 20px;border-bottom:1px solid #23262d;background:#0f1116;position:sticky;top:0}
-    a{color:var(--accent);text-decoration:none}
-    nav a{color:var(--muted);margin-right:14px;padding:8px 10px;border-radius:10px}
-    nav a.active{background:#15171c;color:#fff;border:1px solid #262a33}
-    main{max-width:860px;margin:28px auto;padding:0 16px}
-    .card{background:#15171c;border:1px solid #23262d;border-radius:16px;padding:20px;margin-bottom:16px}
-    .row{display:grid;grid-template-columns:1fr 1fr;gap:12px}
-    input, textarea{width:100%;background:#0f1116;border:1px solid #23262d;color:#e8eef2;padding:12px;border-radius:12px}
-    textarea{min-height:260px}
-    label{font-size:14px;color:var(--muted)}
-    button{background:var(--accent);border:none;color:#04121f;padding:10px 14px;border-radius:12px;font-weight:600;cursor:pointer}
-    table{width:100%;border-collapse:collapse}
-    th,td{padding:10px;border-bottom:1px solid #23262d}
-    .danger{background:#2a1111;border:1px solid #3a1a1a;color:#ffb4b4}
-    .muted{color:var(--muted)}
-  </style>
+  <title>{{.Title}} · {{site.SiteTitle}}</title>
+  {{with site.Author}}<meta name="author" content="{{.}}">{{end}}
+  {{if and site.BaseURL .Canonical}}<link rel="canonical" href="{{site.BaseURL}}{{.Canonical}}">{{end}}
+  <link rel="stylesheet" href="/static/style.css">
+  {{if not .Static}}<link rel="webmention" href="/webmention">
+  <link rel="micropub" href="/micropub">
+  <link rel="EditURI" type="application/rsd+xml" href="/rsd.xml">{{end}}
+  {{if and site.Federating (eq .Active "article") (not .Static)}}<link rel="alternate" type="application/activity+json" href="{{site.BaseURL}}/ap/articles/{{.Article.Slug}}">{{end}}
 </head>
 <body>
   <header>
     <nav>
       <a href="/" class="{{if eq .Active "home"}}active{{end}}">Home</a>
-      <a href="/admin" class="{{if eq .Active "admin_dashboard"}}active{{end}}">Admin</a>
+      {{if not .Static}}<a href="/admin" class="{{if eq .Active "admin_dashboard"}}active{{end}}">Admin</a>{{end}}
       {{if eq .Active "admin_login"}}<span class="muted">Login</span>{{end}}
     </nav>
   </header>
@@ -505,66 +1141,104 @@ const baseHTML = `{{define "base"}}
       {{template "admin_dashboard" .}}
     {{else if eq .Active "admin_form"}}
       {{template "admin_form" .}}
+    {{else if eq .Active "admin_import"}}
+      {{template "admin_import" .}}
+    {{else if eq .Active "admin_export"}}
+      {{template "admin_export" .}}
+    {{else if eq .Active "admin_comments"}}
+      {{template "admin_comments" .}}
+    {{else if eq .Active "admin_webhooks"}}
+      {{template "admin_webhooks" .}}
+    {{else if eq .Active "admin_newsletter"}}
+      {{template "admin_newsletter" .}}
+    {{else if eq .Active "admin_tokens"}}
+      {{template "admin_tokens" .}}
+    {{else if eq .Active "newsletter"}}
+      {{template "newsletter" .}}
+    {{else if eq .Active "admin_audit"}}
+      {{template "admin_audit" .}}
+    {{else if eq .Active "error"}}
+      {{template "error" .}}
     {{end}}
+    {{with site.Author}}<footer class="muted my-24">© {{.}}</footer>{{end}}
   </main>
 </body>
 </html>
 {{end}}`
 
 const homeHTML = `{{define "home"}}
-  <h1 style="margin:0 0 12px 0">Personal Blog</h1>
+  <h1 class="m-0 mb-12">{{site.SiteTitle}}</h1>
   {{if not .Articles}}
     <div class="card">No articles yet.</div>
   {{end}}
   {{range .Articles}}
     <article class="card">
-      <h2 style="margin:0 0 8px 0"><a href="/article/{{.Slug}}">{{.Title}}</a></h2>
+      <h2 class="m-0 mb-8"><a href="/article/{{.Slug}}">{{.Title}}</a></h2>
       <div class="muted">Published {{date .Published}}</div>
     </article>
   {{end}}
+  {{if gt .Pages 1}}
+    <nav class="card bar">
+      <span>{{with .PrevURL}}<a href="{{.}}">← Newer</a>{{end}}</span>
+      <span class="muted">Page {{.Page}} of {{.Pages}}</span>
+      <span>{{with .NextURL}}<a href="{{.}}">Older →</a>{{end}}</span>
+    </nav>
+  {{end}}
+  {{template "newsletter_form" .}}
 {{end}}`
 
 const articleHTML = `{{define "article"}}
   <article class="card">
-    <h1 style="margin:0 0 8px 0">{{.Article.Title}}</h1>
-    <div class="muted" style="margin-bottom:16px">Published {{date .Article.Published}}</div>
-    <div style="white-space:pre-wrap;line-height:1.6">{{.Article.Content}}</div>
+    <h1 class="m-0 mb-8">{{.Article.Title}}</h1>
+    <div class="muted mb-16">Published {{date .Article.Published}}{{with .Article.Author}} by {{.}}{{end}}{{with .Article.Tags}} · {{range $i, $t := .}}{{if $i}}, {{end}}{{$t}}{{end}}{{end}}</div>
+    <div class="prose">{{.Article.Content}}</div>
   </article>
+  {{template "newsletter_form" .}}
+  {{template "webmentions" .}}
+  {{template "comments" .}}
 {{end}}`
 
 const adminLoginHTML = `{{define "admin_login"}}
   <div class="card">
     <h2>Admin Login</h2>
-    {{if .Error}}<div class="card danger" style="margin-top:8px">{{.Error}}</div>{{end}}
+    {{if .Error}}<div class="card danger mt-8">{{.Error}}</div>{{end}}
     <form method="post" action="/admin/login" target="_self" autocomplete="off">
       <div class="row">
         <div>
           <label>Username</label>
-          <input name="username" placeholder="admin" />
+          <input name="username" placeholder="{{site.AdminUser}}" />
         </div>
         <div>
           <label>Password</label>
-          <input name="password" type="password" placeholder="changeme" />
+          <input name="password" type="password" />
         </div>
       </div>
-      <div style="margin-top:12px"><button type="submit">Sign in</button></div>
+      <div class="mt-12"><button type="submit">Sign in</button></div>
     </form>
-    <div class="muted" style="margin-top:10px">Default credentials: admin / changeme</div>
+    {{if site.UsingDefaultPassword}}<div class="muted mt-10">Default credentials: {{site.AdminUser}} / changeme</div>{{end}}
   </div>
 {{end}}`
 
 const adminDashboardHTML = `{{define "admin_dashboard"}}
-  <div class="card" style="display:flex;justify-content:space-between;align-items:center">
-    <div><h2 style="margin:0">Dashboard</h2></div>
+  <div class="card bar">
+    <div><h2 class="m-0">Dashboard</h2></div>
     <div>
       <a href="/admin/new"><button>Add Article</button></a>
-      <a href="/admin/logout" style="margin-left:8px"><button class="danger">Logout</button></a>
+      <a class="ml-8" href="/admin/comments"><button>Comments{{with .PendingComments}} ({{.}}){{end}}</button></a>
+      <a class="ml-8" href="/admin/import"><button>Import</button></a>
+      <a class="ml-8" href="/admin/export"><button>Export</button></a>
+      <a class="ml-8" href="/admin/backup"><button>Backup</button></a>
+      <a class="ml-8" href="/admin/webhooks"><button>Webhooks</button></a>
+      <a class="ml-8" href="/admin/newsletter"><button>Newsletter</button></a>
+      <a class="ml-8" href="/admin/tokens"><button>Tokens</button></a>
+      <a class="ml-8" href="/admin/audit"><button>Audit Log</button></a>
+      <a class="ml-8" href="/admin/logout"><button class="danger">Logout</button></a>
     </div>
   </div>
   <div class="card">
     <table>
       <thead>
-        <tr><th>Title</th><th>Published</th><th style="width:220px">Actions</th></tr>
+        <tr><th>Title</th><th>Published</th><th class="w-220">Actions</th></tr>
       </thead>
       <tbody>
         {{if not .Articles}}
@@ -572,11 +1246,11 @@ const adminDashboardHTML = `{{define "admin_dashboard"}}
         {{end}}
         {{range .Articles}}
         <tr>
-          <td><a href="/article/{{.Slug}}">{{.Title}}</a></td>
+          <td><a href="/article/{{.Slug}}">{{.Title}}</a>{{if .Draft}} <span class="muted">(draft)</span>{{end}}</td>
           <td>{{date .Published}}</td>
           <td>
             <a href="/admin/edit/{{.Slug}}"><button>Edit</button></a>
-            <form method="post" action="/admin/delete/{{.Slug}}" style="display:inline">
+            <form class="inline" method="post" action="/admin/delete/{{.Slug}}">
               <button type="submit" class="danger">Delete</button>
             </form>
           </td>
@@ -585,12 +1259,44 @@ const adminDashboardHTML = `{{define "admin_dashboard"}}
       </tbody>
     </table>
   </div>
+  {{with .Cache}}{{if .MaxBytes}}
+  <div class="card muted">
+    Page cache: {{.Entries}} pages, {{.Bytes}} / {{.MaxBytes}} bytes ·
+    {{.Hits}} hits, {{.Misses}} misses ({{printf "%.1f" .HitRatio}}%) ·
+    {{.Evictions}} evicted, {{.Invalidations}} invalidated
+  </div>
+  {{end}}{{end}}
+  {{if .Lockouts}}
+  <div class="card">
+    <h3 class="mt-0">Login lockouts</h3>
+    <table>
+      <thead>
+        <tr><th>Key</th><th>Failures</th><th>Blocked until</th><th class="w-120"></th></tr>
+      </thead>
+      <tbody>
+        {{range .Lockouts}}
+        <tr>
+          <td>{{.Key}}{{if .Locked}} <span class="muted">(locked)</span>{{end}}</td>
+          <td>{{.Failures}}</td>
+          <td>{{.BlockedUntil.Format "Jan 02 15:04:05"}}</td>
+          <td>
+            <form class="inline" method="post" action="/admin/lockouts/clear">
+              <input type="hidden" name="key" value="{{.Key}}" />
+              <button type="submit">Clear</button>
+            </form>
+          </td>
+        </tr>
+        {{end}}
+      </tbody>
+    </table>
+  </div>
+  {{end}}
 {{end}}`
 
 const adminFormHTML = `{{define "admin_form"}}
   <div class="card">
     <h2>{{if eq .Mode "add"}}Add Article{{else}}Edit Article{{end}}</h2>
-    {{if .Error}}<div class="card danger" style="margin-top:8px">{{.Error}}</div>{{end}}
+    {{if .Error}}<div class="card danger mt-8">{{.Error}}</div>{{end}}
     <form method="post" action="{{if eq .Mode "add"}}/admin/new{{else}}/admin/edit/{{.Article.Slug}}{{end}}" target="_self" autocomplete="off">
       <div class="row">
         <div>
@@ -602,17 +1308,25 @@ const adminFormHTML = `{{define "admin_form"}}
           <input name="date" type="date" value="{{if .Article}}{{dateInput .Article.Published}}{{end}}" placeholder="YYYY-MM-DD" />
         </div>
       </div>
-      <div style="margin-top:12px">
+      <div class="mt-12">
+        <label>Tags (comma-separated)</label>
+        <input name="tags" value="{{if .Article}}{{range $i, $t := .Article.Tags}}{{if $i}}, {{end}}{{$t}}{{end}}{{end}}" />
+      </div>
+      <div class="mt-12">
         <label>Content</label>
         <textarea name="content" placeholder="Write your article...">{{if .Article}}{{.Article.Content}}{{end}}</textarea>
       </div>
-      <div style="margin-top:12px">
+      <div class="mt-12">
+        <label><input name="draft" type="checkbox" {{if and .Article .Article.Draft}}checked{{end}} /> Draft (hidden from guests)</label>
+        <label class="ml-8"><input name="comments_closed" type="checkbox" {{if and .Article .Article.CommentsClosed}}checked{{end}} /> Close comments</label>
+      </div>
+      <div class="mt-12">
         <button type="submit">{{if eq .Mode "add"}}Publish{{else}}Save Changes{{end}}</button>
-        <a href="/admin" style="margin-left:8px">Cancel</a>
+        <a class="ml-8" href="/admin">Cancel</a>
       </div>
     </form>
     {{if and .Article (ne .Mode "add")}}
-      <div class="muted" style="margin-top:8px">Slug: {{.Article.Slug}}</div>
+      <div class="muted mt-8">Slug: {{.Article.Slug}}</div>
     {{end}}
   </div>
 {{end}}`
@@ -6,7 +6,6 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
-	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -18,8 +17,7 @@ var (
 )
 
 // TestMain runs before tests; set an isolated working directory so the
-// app writes its ./data storage there. main.go's init() will already
-// have created a ./data in the original WD; we remove it after tests.
+// app writes its ./data storage there.
 func TestMain(m *testing.M) {
 	// remember original working dir and create a temp root
 	wd, _ := os.Getwd()
@@ -34,73 +32,28 @@ func TestMain(m *testing.M) {
 	if err := os.Chdir(tmpRoot); err != nil {
 		panic(err)
 	}
-	_ = os.MkdirAll(storageDir, 0o755)
+	_ = os.MkdirAll(cfg.StorageDir, 0o755)
 
 	code := m.Run()
 
-	// cleanup: remove temp root and any ./data created in original WD by init()
+	// cleanup: remove temp root
 	_ = os.Chdir(origWD)
 	_ = os.RemoveAll(tmpRoot)
-	_ = os.RemoveAll(filepath.Join(origWD, storageDir))
 	os.Exit(code)
 }
 
 // buildMux mirrors main() so tests can exercise real routes.
 func buildMux() http.Handler {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", homeHandler)
-	mux.HandleFunc("/article/", articleHandler)
-	mux.HandleFunc("/admin/login", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == http.MethodGet {
-			adminLoginGet(w, r, "")
-			return
-		}
-		if r.Method == http.MethodPost {
-			adminLoginPost(w, r)
-			return
-		}
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-	})
-	mux.HandleFunc("/admin/logout", adminLogout)
-	mux.HandleFunc("/admin", requireAuth(adminDashboard))
-	mux.HandleFunc("/admin/new", requireAuth(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == http.MethodGet {
-			adminNewGet(w, r, nil, "")
-			return
-		}
-		if r.Method == http.MethodPost {
-			adminNewPost(w, r)
-			return
-		}
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-	}))
-	mux.HandleFunc("/admin/edit/", requireAuth(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == http.MethodGet {
-			adminEditGet(w, r, nil, "")
-			return
-		}
-		if r.Method == http.MethodPost {
-			adminEditPost(w, r)
-			return
-		}
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-	}))
-	mux.HandleFunc("/admin/delete/", requireAuth(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == http.MethodPost {
-			adminDeletePost(w, r)
-			return
-		}
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-	}))
-	return logRequest(mux)
+	return handler()
 }
 
 // resetStorage ensures a clean ./data for each test.
 func resetStorage(t *testing.T) {
 	t.Helper()
-	_ = os.RemoveAll(storageDir)
-	if err := os.MkdirAll(storageDir, 0o755); err != nil {
-		t.Fatalf("mkdir %s: %v", storageDir, err)
+	pages.reset()
+	_ = os.RemoveAll(cfg.StorageDir)
+	if err := os.MkdirAll(cfg.StorageDir, 0o755); err != nil {
+		t.Fatalf("mkdir %s: %v", cfg.StorageDir, err)
 	}
 }
 
@@ -177,7 +130,7 @@ func TestAdmin_Login_And_Dashboard(t *testing.T) {
 	ts := httptest.NewServer(buildMux())
 	defer ts.Close()
 
-	cookie := login(t, ts.URL, adminUser, adminPass)
+	cookie := login(t, ts.URL, cfg.AdminUser, cfg.AdminPass)
 	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/admin", nil)
 	req.Header.Set("Cookie", cookie)
 	resp, err := http.DefaultClient.Do(req)
@@ -199,7 +152,7 @@ func TestArticle_Create_View_Delete_Flow(t *testing.T) {
 	ts := httptest.NewServer(buildMux())
 	defer ts.Close()
 
-	cookie := login(t, ts.URL, adminUser, adminPass)
+	cookie := login(t, ts.URL, cfg.AdminUser, cfg.AdminPass)
 
 	// Create a new article via /admin/new
 	form := url.Values{}
@@ -264,11 +217,14 @@ func TestArticle_Create_View_Delete_Flow(t *testing.T) {
 		t.Fatalf("delete status=%d, want 302", delResp.StatusCode)
 	}
 
-	// Article should now be 404
-	check, _ := http.Get(ts.URL + "/article/" + slug)
+	// Article should now be 410 Gone (deleted, not unknown)
+	check, err := http.Get(ts.URL + "/article/" + slug)
+	if err != nil {
+		t.Fatal(err)
+	}
 	defer check.Body.Close()
-	if check.StatusCode != http.StatusNotFound {
+	if check.StatusCode != http.StatusGone {
 		b, _ := io.ReadAll(check.Body)
-		t.Fatalf("expected 404 after delete, got %d body=%s", check.StatusCode, string(b))
+		t.Fatalf("expected 410 after delete, got %d body=%s", check.StatusCode, string(b))
 	}
 }
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --------------------------- Metrics ---------------------------
+// A tiny Prometheus text-format registry; enough for counters and
+// histograms without pulling in client_golang.
+
+var (
+	latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	storeBuckets   = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, 1}
+
+	httpRequests  = newCounter("blog_http_requests_total", "HTTP requests by route, method and status.", "route", "method", "status")
+	httpDuration  = newHistogram("blog_http_request_duration_seconds", "HTTP request latency by route and status.", latencyBuckets, "route", "status")
+	storeDuration = newHistogram("blog_store_operation_duration_seconds", "Article store operation latency.", storeBuckets, "op")
+	storeErrors   = newCounter("blog_store_errors_total", "Article store operations that returned an error.", "op")
+	loginFailures = newCounter("blog_login_failures_total", "Rejected admin logins by reason.", "reason")
+	allMetrics    = []*metricVec{httpRequests, httpDuration, storeDuration, storeErrors, loginFailures}
+)
+
+type series struct {
+	labels []string
+	value  float64  // counters
+	counts []uint64 // histograms: per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+type metricVec struct {
+	mu      sync.Mutex
+	name    string
+	help    string
+	kind    string // "counter" or "histogram"
+	labels  []string
+	buckets []float64
+	series  map[string]*series
+}
+
+func newCounter(name, help string, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, kind: "counter", labels: labels, series: map[string]*series{}}
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, kind: "histogram", labels: labels, buckets: buckets, series: map[string]*series{}}
+}
+
+// get returns the series for labelValues; callers must hold m.mu.
+func (m *metricVec) get(labelValues []string) *series {
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labels: append([]string(nil), labelValues...)}
+		if m.kind == "histogram" {
+			s.counts = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+func (m *metricVec) add(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labelValues).value += v
+}
+
+func (m *metricVec) observe(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.get(labelValues)
+	for i, b := range m.buckets {
+		if v <= b {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (m *metricVec) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := m.series[k]
+		if m.kind == "counter" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, labelSet(m.labels, s.labels), formatFloat(s.value))
+			continue
+		}
+		names := append(append([]string(nil), m.labels...), "le")
+		values := append(append([]string(nil), s.labels...), "")
+		var cum uint64
+		for i, b := range m.buckets {
+			cum += s.counts[i]
+			values[len(values)-1] = formatFloat(b)
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, labelSet(names, values), cum)
+		}
+		values[len(values)-1] = "+Inf"
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, labelSet(names, values), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, labelSet(m.labels, s.labels), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, labelSet(m.labels, s.labels), s.count)
+	}
+}
+
+// writeGauge emits a gauge computed at scrape time, one sample per label value.
+func writeGauge(w io.Writer, name, help, label string, values map[string]float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		ls := ""
+		if label != "" {
+			ls = labelSet([]string{label}, []string{k})
+		}
+		fmt.Fprintf(w, "%s%s %s\n", name, ls, formatFloat(values[k]))
+	}
+}
+
+func labelSet(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, n := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(n)
+		b.WriteString(`="`)
+		b.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(values[i]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatFloat(v float64) string { return strconv.FormatFloat(v, 'g', -1, 64) }
+
+// observeStore records the latency and outcome of a store operation; use as
+// defer observeStore("load", time.Now(), &err).
+func observeStore(op string, start time.Time, err *error) {
+	storeDuration.observe(time.Since(start).Seconds(), op)
+	if err != nil && *err != nil {
+		storeErrors.add(1, op)
+	}
+}
+
+// --------------------------- Middleware ------------------------
+
+// knownMethods bounds the method label; anything else is reported as OTHER.
+var knownMethods = map[string]bool{"GET": true, "HEAD": true, "POST": true, "PUT": true, "DELETE": true, "PATCH": true, "OPTIONS": true}
+
+// instrument counts requests and their latency by route. It must hand the
+// mux the same *http.Request it holds (no WithContext in between): the mux
+// records the matched pattern on that request, which is how the route label
+// stays low-cardinality.
+func instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		method := r.Method
+		if !knownMethods[method] {
+			method = "OTHER"
+		}
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		status := strconv.Itoa(rec.status)
+		httpRequests.add(1, route, method, status)
+		httpDuration.observe(time.Since(start).Seconds(), route, status)
+	})
+}
+
+// --------------------------- Handlers (Metrics) ----------------
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	for _, m := range allMetrics {
+		m.write(w)
+	}
+
+	byStatus := map[string]float64{"published": 0, "scheduled": 0, "draft": 0}
+	if arts, err := allArticles(); err == nil {
+		now := time.Now()
+		for _, a := range arts {
+			if a.Draft {
+				byStatus["draft"]++
+			} else if a.Published.After(now) {
+				byStatus["scheduled"]++
+			} else {
+				byStatus["published"]++
+			}
+		}
+	}
+	writeGauge(w, "blog_articles", "Stored articles by status; scheduled ones have a future publication date.", "status", byStatus)
+	writeGauge(w, "blog_sessions_active", "Admin sessions currently held in memory.", "", map[string]float64{"": float64(sessionCount())})
+}
+
+// requireMetricsToken guards /metrics with a bearer token when one is configured.
+func requireMetricsToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cfg.MetricsToken == "" {
+			next(w, r)
+			return
+		}
+		tok, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(tok), []byte(cfg.MetricsToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// metricsMux serves /metrics on its own listener (metrics_addr).
+func metricsMux() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", requireMetricsToken(metricsHandler))
+	return mux
+}
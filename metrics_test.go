@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// metricValue returns the value of the sample whose name and labels equal
+// series, or 0 when it is absent.
+func metricValue(t *testing.T, body, series string) float64 {
+	t.Helper()
+	for _, line := range strings.Split(body, "\n") {
+		if v, ok := strings.CutPrefix(line, series+" "); ok {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				t.Fatalf("bad sample %q: %v", line, err)
+			}
+			return f
+		}
+	}
+	return 0
+}
+
+func scrape(t *testing.T, base, token string) (int, string) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, base+"/metrics", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(b)
+}
+
+func TestMetrics_TokenProtectedOnMainListener(t *testing.T) {
+	resetStorage(t)
+	saved := cfg
+	defer func() { cfg = saved }()
+	cfg.MetricsToken = "s3cret"
+
+	future := Article{Title: "Later", Slug: "later", Content: "x", Published: time.Now().AddDate(1, 0, 0)}
+	past := Article{Title: "Earlier", Slug: "earlier", Content: "x", Published: time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)}
+	for _, a := range []Article{future, past} {
+		if err := saveArticle(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ts := httptest.NewServer(buildMux())
+	defer ts.Close()
+
+	if status, _ := scrape(t, ts.URL, ""); status != http.StatusUnauthorized {
+		t.Fatalf("scrape without token=%d, want 401", status)
+	}
+	if status, _ := scrape(t, ts.URL, "wrong"); status != http.StatusUnauthorized {
+		t.Fatalf("scrape with wrong token=%d, want 401", status)
+	}
+
+	_, before := scrape(t, ts.URL, "s3cret")
+	getBody(t, ts.URL, "/article/earlier", "")
+	getBody(t, ts.URL, "/article/earlier", "")
+	postForm(t, ts.URL, "/admin/login", "", url.Values{"username": {"metrics-test"}, "password": {"nope"}})
+	login(t, ts.URL, cfg.AdminUser, cfg.AdminPass)
+
+	status, after := scrape(t, ts.URL, "s3cret")
+	if status != http.StatusOK {
+		t.Fatalf("scrape status=%d", status)
+	}
+	reqs := `blog_http_requests_total{route="/article/",method="GET",status="200"}`
+	if d := metricValue(t, after, reqs) - metricValue(t, before, reqs); d != 2 {
+		t.Fatalf("%s grew by %v, want 2", reqs, d)
+	}
+	count := `blog_http_request_duration_seconds_count{route="/article/",status="200"}`
+	inf := `blog_http_request_duration_seconds_bucket{route="/article/",status="200",le="+Inf"}`
+	if metricValue(t, after, count) == 0 || metricValue(t, after, count) != metricValue(t, after, inf) {
+		t.Fatalf("histogram count and +Inf bucket disagree:\n%s", after)
+	}
+	fails := `blog_login_failures_total{reason="invalid_credentials"}`
+	if d := metricValue(t, after, fails) - metricValue(t, before, fails); d != 1 {
+		t.Fatalf("%s grew by %v, want 1", fails, d)
+	}
+	if metricValue(t, after, `blog_store_operation_duration_seconds_count{op="load"}`) == 0 {
+		t.Fatalf("store load latency not recorded:\n%s", after)
+	}
+	if metricValue(t, after, `blog_articles{status="published"}`) != 1 || metricValue(t, after, `blog_articles{status="scheduled"}`) != 1 {
+		t.Fatalf("article gauges wrong:\n%s", after)
+	}
+	if metricValue(t, after, "blog_sessions_active") < 1 {
+		t.Fatalf("active sessions gauge missing:\n%s", after)
+	}
+	for _, want := range []string{"# TYPE blog_http_requests_total counter", "# TYPE blog_http_request_duration_seconds histogram", "# TYPE blog_articles gauge"} {
+		if !strings.Contains(after, want) {
+			t.Fatalf("missing %q in exposition", want)
+		}
+	}
+}
+
+func TestMetrics_DisabledOrSeparateListener(t *testing.T) {
+	saved := cfg
+	defer func() { cfg = saved }()
+
+	cfg.MetricsToken = ""
+	ts := httptest.NewServer(buildMux())
+	status, _ := scrape(t, ts.URL, "")
+	ts.Close()
+	if status != http.StatusNotFound {
+		t.Fatalf("/metrics without token or addr=%d, want 404", status)
+	}
+
+	cfg.MetricsAddr = "127.0.0.1:0"
+	cfg.MetricsToken = "s3cret"
+	ts = httptest.NewServer(buildMux())
+	status, _ = scrape(t, ts.URL, "s3cret")
+	ts.Close()
+	if status != http.StatusNotFound {
+		t.Fatalf("/metrics on main listener with metrics_addr set=%d, want 404", status)
+	}
+
+	ms := httptest.NewServer(metricsMux())
+	defer ms.Close()
+	if status, body := scrape(t, ms.URL, "s3cret"); status != http.StatusOK || !strings.Contains(body, "blog_http_requests_total") {
+		t.Fatalf("metrics listener=%d %s", status, body)
+	}
+}
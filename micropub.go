@@ -0,0 +1,683 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// --------------------------- Micropub --------------------------
+// /micropub implements the W3C Micropub API so posting apps can create,
+// update, delete and undelete articles with an API token (see tokens.go).
+// Requests are form-encoded, multipart (with photos) or JSON; h-entry
+// properties map onto Article fields:
+//
+//	name → Title (derived from the content when missing, as for notes)
+//	content → Content (HTML content is converted to Markdown)
+//	photo → images appended to Content
+//	category → Tags, published → Published,
+//	post-status draft → Draft, mp-slug → Slug
+//
+// Other properties are ignored. Saves go through the same path as the admin
+// editor, so they are audited and announced like any other change. Uploads
+// from /micropub/media and photo fields are stored in StorageDir/media and
+// served from /media/.
+
+const (
+	micropubMaxBody  = 1 << 20
+	mediaDir         = "media"
+	mediaMaxBytes    = 10 << 20
+	micropubTitleMax = 60 // runes of content used as a note's title
+)
+
+var mediaExts = map[string]string{"image/jpeg": ".jpg", "image/png": ".png", "image/gif": ".gif", "image/webp": ".webp"}
+
+var mediaNameRe = regexp.MustCompile(`^[A-Za-z0-9]+\.(jpg|png|gif|webp)$`)
+
+// micropubProps are h-entry properties: every value is a list.
+type micropubProps map[string][]any
+
+// micropubRequest is a JSON request body.
+type micropubRequest struct {
+	Type       []string        `json:"type"`
+	Properties micropubProps   `json:"properties"`
+	Action     string          `json:"action"`
+	URL        string          `json:"url"`
+	Replace    micropubProps   `json:"replace"`
+	Add        micropubProps   `json:"add"`
+	Delete     json.RawMessage `json:"delete"` // property names, or values per property
+}
+
+type micropubError struct {
+	status int
+	code   string
+	desc   string
+}
+
+func (e *micropubError) Error() string { return e.desc }
+
+func badMicropub(format string, args ...any) error {
+	return &micropubError{http.StatusBadRequest, "invalid_request", fmt.Sprintf(format, args...)}
+}
+
+func writeMicropubError(w http.ResponseWriter, r *http.Request, err error) {
+	var me *micropubError
+	if !errors.As(err, &me) {
+		// storage errors carry file paths; they go to the log only
+		slog.ErrorContext(r.Context(), "handler error", "method", r.Method, "path", r.URL.Path, "status", http.StatusInternalServerError, "err", err)
+		me = &micropubError{http.StatusInternalServerError, "server_error", "an unexpected error occurred; it has been logged"}
+	}
+	body := map[string]string{"error": me.code, "error_description": me.desc}
+	if me.code == "insufficient_scope" {
+		body["scope"] = strings.TrimPrefix(me.desc, "token lacks the scope ")
+	}
+	if me.status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="micropub"`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(me.status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// micropubAuth checks the request's token, from the Authorization header
+// or an access_token form field, against scope ("" for any token).
+func micropubAuth(r *http.Request, scope string) (apiToken, error) {
+	secret := bearerToken(r)
+	if secret == "" && r.Method == http.MethodPost {
+		secret = r.PostFormValue("access_token")
+	}
+	return checkMicropubToken(secret, scope)
+}
+
+// checkMicropubToken is micropubAuth for a secret already read.
+func checkMicropubToken(secret, scope string) (apiToken, error) {
+	if secret == "" {
+		return apiToken{}, &micropubError{http.StatusUnauthorized, "unauthorized", "no access token"}
+	}
+	t, ok := checkToken(secret)
+	if !ok {
+		return apiToken{}, &micropubError{http.StatusForbidden, "forbidden", "invalid access token"}
+	}
+	if scope != "" && !t.can(scope) {
+		return t, &micropubError{http.StatusUnauthorized, "insufficient_scope", "token lacks the scope " + scope}
+	}
+	return t, nil
+}
+
+// tokenActor names who acted in the audit log.
+func tokenActor(t apiToken) string { return fmt.Sprintf("%s (token %s)", t.User, t.ID) }
+
+// siteURL is the absolute root of the site for Location headers.
+func siteURL(r *http.Request) string {
+	if cfg.BaseURL != "" {
+		return cfg.BaseURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// micropubSlug maps a post URL to its slug.
+func micropubSlug(u string) (string, error) {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return "", badMicropub("invalid url %q", u)
+	}
+	slug, ok := strings.CutPrefix(pu.Path, "/article/")
+	slug = strings.TrimSuffix(slug, "/")
+	if !ok || slug == "" || slug != makeSlug(slug) {
+		return "", badMicropub("%q is not a post on this site", u)
+	}
+	return slug, nil
+}
+
+// --------------------------- Properties ------------------------
+
+// first returns the first value of a property as a string.
+func (p micropubProps) first(name string) string {
+	for _, v := range p[name] {
+		if s, ok := v.(string); ok {
+			return strings.TrimSpace(s)
+		}
+	}
+	return ""
+}
+
+func (p micropubProps) strings(name string) []string {
+	var out []string
+	for _, v := range p[name] {
+		if s, ok := v.(string); ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// articleProperties is the h-entry form of a, for q=source and updates.
+func articleProperties(a Article) micropubProps {
+	status := "published"
+	if a.Draft {
+		status = "draft"
+	}
+	p := micropubProps{
+		"name":        {a.Title},
+		"content":     {a.Content},
+		"published":   {a.Published.Format(time.RFC3339)},
+		"post-status": {status},
+		"mp-slug":     {a.Slug},
+	}
+	if len(a.Tags) > 0 {
+		p["category"] = []any{}
+		for _, t := range a.Tags {
+			p["category"] = append(p["category"], t)
+		}
+	}
+	if !a.UpdatedAt.IsZero() {
+		p["updated"] = []any{a.UpdatedAt.Format(time.RFC3339)}
+	}
+	return p
+}
+
+// articleFromProperties builds the article an h-entry describes.
+func articleFromProperties(p micropubProps, now time.Time) (Article, error) {
+	var content string
+	for _, v := range p["content"] {
+		switch c := v.(type) {
+		case string:
+			content = c
+		case map[string]any:
+			if html, _ := c["html"].(string); html != "" {
+				content = htmlToMarkdown(html)
+			} else {
+				content, _ = c["value"].(string)
+			}
+		}
+		break
+	}
+	content = strings.TrimSpace(content)
+	for _, v := range p["photo"] {
+		var src, alt string
+		switch ph := v.(type) {
+		case string:
+			src = ph
+		case map[string]any:
+			src, _ = ph["value"].(string)
+			alt, _ = ph["alt"].(string)
+		}
+		if u, err := url.Parse(src); err != nil || (u.Scheme != "http" && u.Scheme != "https" && !strings.HasPrefix(src, "/media/")) {
+			return Article{}, badMicropub("invalid photo %q", src)
+		}
+		if img := fmt.Sprintf("![%s](%s)", strings.ReplaceAll(alt, "]", ""), src); !strings.Contains(content, "("+src+")") {
+			content = strings.TrimSpace(content + "\n\n" + img)
+		}
+	}
+	if content == "" {
+		return Article{}, badMicropub("content or photo is required")
+	}
+
+	a := Article{Title: p.first("name"), Content: content, Published: now, UpdatedAt: now.UTC(), Tags: normaliseTags(p.strings("category"))}
+	if a.Title == "" {
+		line, _, _ := strings.Cut(content, "\n")
+		a.Title = excerpt(strings.TrimSpace(strings.TrimLeft(line, "#>*- ")), micropubTitleMax)
+		if strings.HasPrefix(line, "![") {
+			a.Title = "Photo, " + now.In(cfg.Location()).Format("Jan 2, 2006")
+		}
+	}
+	if s := p.first("published"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t, err = time.ParseInLocation("2006-01-02", s, cfg.Location())
+		}
+		if err != nil {
+			return Article{}, badMicropub("invalid published %q", s)
+		}
+		a.Published = t
+	}
+	switch p.first("post-status") {
+	case "", "published":
+	case "draft":
+		a.Draft = true
+	default:
+		return Article{}, badMicropub("post-status must be published or draft")
+	}
+	a.Slug = makeSlug(a.Title)
+	if s := p.first("mp-slug"); s != "" {
+		a.Slug = makeSlug(s)
+	}
+	return a, validateArticle(a)
+}
+
+// freeSlug appends -2, -3… to slug until no article or tombstone has it.
+func freeSlug(slug string) string {
+	taken := func(s string) bool {
+		_, err := os.Stat(filepath.Join(cfg.StorageDir, s+".json"))
+		return err == nil || articleGone(s)
+	}
+	for i, s := 2, slug; ; i++ {
+		if !taken(s) {
+			return s
+		}
+		s = fmt.Sprintf("%s-%d", slug, i)
+	}
+}
+
+// --------------------------- Media -----------------------------
+
+// storeMedia saves an uploaded image and returns its path on the site.
+func storeMedia(f io.Reader) (string, error) {
+	b, err := io.ReadAll(io.LimitReader(f, mediaMaxBytes+1))
+	if err != nil {
+		return "", badMicropub("reading the upload: %v", err)
+	}
+	return saveMedia(b)
+}
+
+// saveMedia stores an image under a random name and returns its path.
+func saveMedia(b []byte) (string, error) {
+	if len(b) > mediaMaxBytes {
+		return "", &micropubError{http.StatusRequestEntityTooLarge, "invalid_request", fmt.Sprintf("file is over %d MB", mediaMaxBytes>>20)}
+	}
+	ext, ok := mediaExts[http.DetectContentType(b)]
+	if !ok {
+		return "", &micropubError{http.StatusUnsupportedMediaType, "invalid_request", "only JPEG, PNG, GIF and WebP images are accepted"}
+	}
+	dir := filepath.Join(cfg.StorageDir, mediaDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	name := newToken(20) + ext
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	if err := writeFileAtomic(filepath.Join(dir, name), b, 0o644); err != nil {
+		return "", err
+	}
+	return "/" + mediaDir + "/" + name, nil
+}
+
+// mediaHandler serves uploaded files; their names never change.
+func mediaHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/media/")
+	if !mediaNameRe.MatchString(name) {
+		notFound(w, r)
+		return
+	}
+	f, err := os.Open(filepath.Join(cfg.StorageDir, mediaDir, name))
+	if err != nil {
+		notFound(w, r)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", mime.TypeByExtension(filepath.Ext(name)))
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	http.ServeContent(w, r, "", time.Time{}, f)
+}
+
+// micropubMediaPost is the media endpoint: one file in the "file" field.
+// The upload is streamed, not parsed up front, and the token (the Bearer
+// header, or an access_token field sent before the file) is checked before
+// any of the file is read, so anonymous clients can't make the server
+// buffer or spool anything.
+func micropubMediaPost(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, mediaMaxBytes+micropubMaxBody)
+	var t apiToken
+	header := bearerToken(r) != ""
+	if header {
+		var err error
+		if t, err = micropubAuth(r, "media"); err != nil {
+			w.Header().Set("Connection", "close") // rather than drain the upload
+			writeMicropubError(w, r, err)
+			return
+		}
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		writeMicropubError(w, r, badMicropub("want a multipart upload: %v", err))
+		return
+	}
+	var secret string
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			writeMicropubError(w, r, badMicropub("missing file"))
+			return
+		}
+		if err != nil {
+			writeMicropubError(w, r, badMicropub("invalid upload: %v", err))
+			return
+		}
+		switch part.FormName() {
+		case "access_token":
+			b, _ := io.ReadAll(io.LimitReader(part, 1<<10))
+			secret = strings.TrimSpace(string(b))
+		case "file":
+			if !header {
+				if t, err = checkMicropubToken(secret, "media"); err != nil {
+					w.Header().Set("Connection", "close")
+					writeMicropubError(w, r, err)
+					return
+				}
+			}
+			p, err := storeMedia(part)
+			if err != nil {
+				writeMicropubError(w, r, err)
+				return
+			}
+			audit(r, "media.upload", tokenActor(t), "", fmt.Sprintf("%s from %q", p, part.FileName()))
+			w.Header().Set("Location", siteURL(r)+p)
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+	}
+}
+
+// --------------------------- Handlers (Micropub) ---------------
+
+func micropubGet(w http.ResponseWriter, r *http.Request) {
+	if _, err := micropubAuth(r, ""); err != nil {
+		writeMicropubError(w, r, err)
+		return
+	}
+	var resp any
+	switch q := r.URL.Query(); q.Get("q") {
+	case "config":
+		resp = map[string]any{
+			"media-endpoint": siteURL(r) + "/micropub/media",
+			"syndicate-to":   []string{},
+			"q":              []string{"config", "source", "syndicate-to"},
+			"post-types":     []map[string]string{{"type": "article", "name": "Article"}, {"type": "note", "name": "Note"}, {"type": "photo", "name": "Photo"}},
+		}
+	case "syndicate-to":
+		resp = map[string]any{"syndicate-to": []string{}}
+	case "source":
+		slug, err := micropubSlug(q.Get("url"))
+		if err != nil {
+			writeMicropubError(w, r, err)
+			return
+		}
+		a, err := loadArticle(slug)
+		if err != nil {
+			writeMicropubError(w, r, badMicropub("no post at %q", q.Get("url")))
+			return
+		}
+		props := articleProperties(a)
+		if want := append(q["properties[]"], q["properties"]...); len(want) > 0 {
+			for k := range props {
+				if !slices.Contains(want, k) {
+					delete(props, k)
+				}
+			}
+			resp = map[string]any{"properties": props}
+		} else {
+			resp = map[string]any{"type": []string{"h-entry"}, "properties": props}
+		}
+	default:
+		writeMicropubError(w, r, badMicropub("unsupported query %q", q.Get("q")))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func micropubPost(w http.ResponseWriter, r *http.Request) {
+	// The action, and so the scope needed, is only known from the body.
+	// With a Bearer header the token is checked before reading it; without
+	// one, the body (and any photo in it) must fit in memory.
+	if bearerToken(r) != "" {
+		if _, err := micropubAuth(r, ""); err != nil {
+			writeMicropubError(w, r, err)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, mediaMaxBytes+micropubMaxBody)
+	} else {
+		r.Body = http.MaxBytesReader(w, r.Body, micropubMaxBody)
+	}
+	var req micropubRequest
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch ct {
+	case "application/json":
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeMicropubError(w, r, badMicropub("invalid JSON: %v", err))
+			return
+		}
+		if req.Action == "" && !slices.Equal(req.Type, []string{"h-entry"}) {
+			writeMicropubError(w, r, badMicropub("only h-entry posts are supported"))
+			return
+		}
+	case "application/x-www-form-urlencoded", "multipart/form-data":
+		var err error
+		if req, err = micropubForm(r); err != nil {
+			writeMicropubError(w, r, err)
+			return
+		}
+		if r.MultipartForm != nil {
+			defer r.MultipartForm.RemoveAll()
+		}
+	default:
+		writeMicropubError(w, r, &micropubError{http.StatusUnsupportedMediaType, "invalid_request", "send JSON, form-encoded or multipart data"})
+		return
+	}
+
+	scope := req.Action
+	if scope == "" {
+		scope = "create"
+	}
+	if !slices.Contains(tokenScopes, scope) || scope == "media" {
+		writeMicropubError(w, r, badMicropub("unknown action %q", req.Action))
+		return
+	}
+	t, err := micropubAuth(r, scope)
+	if err != nil {
+		writeMicropubError(w, r, err)
+		return
+	}
+	if r.MultipartForm != nil && scope == "create" {
+		if err := micropubPhotos(r, req.Properties); err != nil {
+			writeMicropubError(w, r, err)
+			return
+		}
+	}
+	var location string
+	switch scope {
+	case "create":
+		location, err = micropubCreate(r, t, req.Properties)
+	case "update":
+		location, err = micropubUpdate(r, t, req)
+	case "delete":
+		err = micropubDelete(r, t, req.URL)
+	case "undelete":
+		err = micropubUndelete(r, t, req.URL)
+	}
+	if err != nil {
+		writeMicropubError(w, r, err)
+		return
+	}
+	if location != "" {
+		w.Header().Set("Location", location)
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// micropubForm reads a form-encoded or multipart request: every field but
+// the reserved ones is a property, and "category[]" is "category".
+func micropubForm(r *http.Request) (micropubRequest, error) {
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		err = r.ParseMultipartForm(micropubMaxBody)
+	} else {
+		err = r.ParseForm()
+	}
+	if err != nil {
+		return micropubRequest{}, badMicropub("invalid form: %v", err)
+	}
+	req := micropubRequest{Action: r.PostFormValue("action"), URL: r.PostFormValue("url"), Properties: micropubProps{}}
+	if h := r.PostFormValue("h"); req.Action == "" && h != "entry" {
+		return req, badMicropub("only h=entry posts are supported")
+	}
+	if req.Action == "update" {
+		return req, badMicropub("updates must be sent as JSON")
+	}
+	for k, vs := range r.PostForm {
+		if k == "h" || k == "action" || k == "url" || k == "access_token" {
+			continue
+		}
+		k = strings.TrimSuffix(k, "[]")
+		for _, v := range vs {
+			req.Properties[k] = append(req.Properties[k], v)
+		}
+	}
+	return req, nil
+}
+
+// micropubPhotos stores the photo files of a multipart create and adds
+// them to the photo property.
+func micropubPhotos(r *http.Request, p micropubProps) error {
+	for _, field := range []string{"photo", "photo[]"} {
+		for _, fh := range r.MultipartForm.File[field] {
+			f, err := fh.Open()
+			if err != nil {
+				return err
+			}
+			path, err := storeMedia(f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+			p["photo"] = append(p["photo"], siteURL(r)+path)
+		}
+	}
+	return nil
+}
+
+func micropubCreate(r *http.Request, t apiToken, p micropubProps) (string, error) {
+	a, err := articleFromProperties(p, time.Now())
+	if err != nil {
+		return "", err
+	}
+	a.Slug = freeSlug(a.Slug)
+	if err := saveArticle(a); err != nil {
+		return "", err
+	}
+	audit(r, "article.create", tokenActor(t), a.Slug, fmt.Sprintf("via micropub; title %q; content %d chars; published %s", a.Title, len(a.Content), a.Published.Format("2006-01-02")))
+	articleWritten(Article{}, a)
+	return siteURL(r) + "/article/" + a.Slug, nil
+}
+
+// micropubUpdate applies replace, then add, then delete to the post's
+// properties. It answers with a Location only when the URL changed.
+func micropubUpdate(r *http.Request, t apiToken, req micropubRequest) (string, error) {
+	slug, err := micropubSlug(req.URL)
+	if err != nil {
+		return "", err
+	}
+	orig, err := loadArticle(slug)
+	if err != nil {
+		return "", badMicropub("no post at %q", req.URL)
+	}
+	p := articleProperties(orig)
+	for k, vs := range req.Replace {
+		p[k] = vs
+	}
+	for k, vs := range req.Add {
+		p[k] = append(p[k], vs...)
+	}
+	if len(req.Delete) > 0 {
+		var names []string
+		var values micropubProps
+		switch {
+		case json.Unmarshal(req.Delete, &names) == nil:
+			for _, k := range names {
+				delete(p, k)
+			}
+		case json.Unmarshal(req.Delete, &values) == nil:
+			for k, vs := range values {
+				p[k] = slices.DeleteFunc(p[k], func(v any) bool { return slices.Contains(vs, v) })
+			}
+		default:
+			return "", badMicropub("delete must be a list of properties or an object of values")
+		}
+	}
+	if _, ok := p["published"]; !ok {
+		p["published"] = []any{orig.Published.Format(time.RFC3339)}
+	}
+	updated, err := articleFromProperties(p, time.Now())
+	if err != nil {
+		return "", err
+	}
+	updated.Author, updated.Aliases, updated.CommentsClosed = orig.Author, orig.Aliases, orig.CommentsClosed
+	if updated.Slug != orig.Slug {
+		if free := freeSlug(updated.Slug); free != updated.Slug {
+			return "", badMicropub("slug %q is taken", updated.Slug)
+		}
+	}
+	if err := updateArticle(orig, updated); err != nil {
+		return "", err
+	}
+	audit(r, "article.update", tokenActor(t), updated.Slug, "via micropub; "+articleChanges(orig, updated))
+	articleWritten(orig, updated)
+	if updated.Slug != orig.Slug {
+		return siteURL(r) + "/article/" + updated.Slug, nil
+	}
+	return "", nil
+}
+
+func micropubDelete(r *http.Request, t apiToken, u string) error {
+	slug, err := micropubSlug(u)
+	if err != nil {
+		return err
+	}
+	a, err := loadArticle(slug)
+	if err != nil {
+		return badMicropub("no post at %q", u)
+	}
+	if err := deleteArticle(slug); err != nil {
+		return err
+	}
+	audit(r, "article.delete", tokenActor(t), slug, fmt.Sprintf("via micropub; title %q", a.Title))
+	articleWritten(a, Article{})
+	return nil
+}
+
+// micropubUndelete restores a deleted post from its tombstone, which holds
+// the article as it was.
+func micropubUndelete(r *http.Request, t apiToken, u string) error {
+	slug, err := micropubSlug(u)
+	if err != nil {
+		return err
+	}
+	b, err := os.ReadFile(tombstonePath(slug))
+	if errors.Is(err, os.ErrNotExist) {
+		return badMicropub("%q was not deleted", u)
+	}
+	if err != nil {
+		return err
+	}
+	s, err := decodeStored(b)
+	if err != nil {
+		return err
+	}
+	if s.MovedTo != "" {
+		return badMicropub("%q was renamed to %q, not deleted", u, s.MovedTo)
+	}
+	a := s.Article
+	if err := saveArticle(a); err != nil {
+		return err
+	}
+	audit(r, "article.undelete", tokenActor(t), slug, fmt.Sprintf("via micropub; title %q", a.Title))
+	articleWritten(Article{}, a)
+	return nil
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var pngBytes = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01\x00\x00\x00\x01\x08\x06\x00\x00\x00")
+
+// micropub sends a request with the token and returns the response.
+func micropub(t *testing.T, method, target, token, contentType string, body io.Reader) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func micropubJSON(t *testing.T, base, token string, v any) *http.Response {
+	t.Helper()
+	b, _ := json.Marshal(v)
+	return micropub(t, http.MethodPost, base+"/micropub", token, "application/json", bytes.NewReader(b))
+}
+
+func TestMicropub_CreateUpdateDeleteUndelete(t *testing.T) {
+	resetStorage(t)
+	ts := httptest.NewServer(buildMux())
+	defer ts.Close()
+	_, token, err := createToken("Phone", cfg.AdminUser, tokenScopes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a form-encoded note gets its title from the content
+	form := url.Values{"h": {"entry"}, "content": {"Walked to the harbour today.\n\nSunny."}, "category[]": {"Walks", "sea"}}
+	resp := micropub(t, http.MethodPost, ts.URL+"/micropub", token, "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("Location") != ts.URL+"/article/walked-to-the-harbour-today" {
+		t.Fatalf("form create: %d %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	a, err := loadArticle("walked-to-the-harbour-today")
+	if err != nil || a.Title != "Walked to the harbour today." || strings.Join(a.Tags, ",") != "walks,sea" {
+		t.Fatalf("note: %+v %v", a, err)
+	}
+
+	// JSON with HTML content, a photo, a slug and draft status
+	resp = micropubJSON(t, ts.URL, token, map[string]any{
+		"type": []string{"h-entry"},
+		"properties": map[string]any{
+			"name":        []string{"Boats"},
+			"content":     []any{map[string]string{"html": "<p>Some <strong>boats</strong>.</p>"}},
+			"photo":       []any{map[string]string{"value": "https://img.example/boat.jpg", "alt": "A boat"}},
+			"published":   []string{"2024-03-04T10:00:00Z"},
+			"post-status": []string{"draft"},
+			"mp-slug":     []string{"boats-at-dusk"},
+		},
+	})
+	if resp.StatusCode != http.StatusCreated || !strings.HasSuffix(resp.Header.Get("Location"), "/article/boats-at-dusk") {
+		t.Fatalf("json create: %d %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	a, err = loadArticle("boats-at-dusk")
+	if err != nil || !a.Draft || a.Published.Format("2006-01-02") != "2024-03-04" ||
+		!strings.Contains(a.Content, "**boats**") || !strings.Contains(a.Content, "![A boat](https://img.example/boat.jpg)") {
+		t.Fatalf("json article: %+v %v", a, err)
+	}
+
+	// q=source shows the post as an h-entry
+	resp = micropub(t, http.MethodGet, ts.URL+"/micropub?q=source&url="+url.QueryEscape(ts.URL+"/article/boats-at-dusk"), token, "", nil)
+	var src struct {
+		Type       []string            `json:"type"`
+		Properties map[string][]string `json:"properties"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&src); err != nil || src.Type[0] != "h-entry" || src.Properties["name"][0] != "Boats" || src.Properties["post-status"][0] != "draft" {
+		t.Fatalf("source: %+v %v", src, err)
+	}
+
+	// update: replace the title, add a tag, publish, keep the slug
+	resp = micropubJSON(t, ts.URL, token, map[string]any{
+		"action":  "update",
+		"url":     ts.URL + "/article/boats-at-dusk",
+		"replace": map[string][]string{"name": {"Boats at dusk"}, "post-status": {"published"}},
+		"add":     map[string][]string{"category": {"harbour"}},
+	})
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("update: %d", resp.StatusCode)
+	}
+	a, _ = loadArticle("boats-at-dusk")
+	if a.Title != "Boats at dusk" || a.Draft || strings.Join(a.Tags, ",") != "harbour" || a.Published.Format("2006-01-02") != "2024-03-04" {
+		t.Fatalf("updated: %+v", a)
+	}
+	resp = micropubJSON(t, ts.URL, token, map[string]any{"action": "update", "url": ts.URL + "/article/boats-at-dusk", "delete": []string{"category"}})
+	if a, _ = loadArticle("boats-at-dusk"); resp.StatusCode != http.StatusNoContent || len(a.Tags) != 0 {
+		t.Fatalf("delete property: %d %+v", resp.StatusCode, a)
+	}
+
+	// delete, then undelete
+	resp = micropubJSON(t, ts.URL, token, map[string]any{"action": "delete", "url": ts.URL + "/article/boats-at-dusk"})
+	if code, _ := getBody(t, ts.URL, "/article/boats-at-dusk", ""); resp.StatusCode != http.StatusNoContent || code != http.StatusGone {
+		t.Fatalf("delete: %d, then %d", resp.StatusCode, code)
+	}
+	form = url.Values{"action": {"undelete"}, "url": {ts.URL + "/article/boats-at-dusk"}}
+	resp = micropub(t, http.MethodPost, ts.URL+"/micropub", token, "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	if code, body := getBody(t, ts.URL, "/article/boats-at-dusk", ""); resp.StatusCode != http.StatusNoContent || code != http.StatusOK || !strings.Contains(body, "Boats at dusk") {
+		t.Fatalf("undelete: %d, then %d", resp.StatusCode, code)
+	}
+
+	entries, _ := readAudit(auditFilter{Slug: "boats-at-dusk"})
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Action)
+	}
+	if strings.Join(got, ",") != "article.undelete,article.delete,article.update,article.update,article.create" || !strings.Contains(entries[0].Actor, "(token ") {
+		t.Fatalf("audit: %v %+v", got, entries[0])
+	}
+
+	// a renamed post's old URL is gone too, but can't be undeleted
+	resp = micropubJSON(t, ts.URL, token, map[string]any{"action": "update", "url": ts.URL + "/article/boats-at-dusk", "replace": map[string][]string{"mp-slug": {"dusk"}}})
+	if resp.StatusCode != http.StatusCreated || !strings.HasSuffix(resp.Header.Get("Location"), "/article/dusk") {
+		t.Fatalf("rename: %d %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	resp = micropubJSON(t, ts.URL, token, map[string]any{"action": "undelete", "url": ts.URL + "/article/boats-at-dusk"})
+	if resp.StatusCode != http.StatusBadRequest || articleExists("boats-at-dusk") {
+		t.Fatalf("undelete after rename: %d", resp.StatusCode)
+	}
+}
+
+func TestMicropub_AuthAndScopes(t *testing.T) {
+	resetStorage(t)
+	ts := httptest.NewServer(buildMux())
+	defer ts.Close()
+	_, token, err := createToken("Create only", cfg.AdminUser, []string{"create"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errCode := func(resp *http.Response) string {
+		var e struct{ Error string }
+		_ = json.NewDecoder(resp.Body).Decode(&e)
+		return e.Error
+	}
+
+	if resp := micropub(t, http.MethodGet, ts.URL+"/micropub?q=config", "", "", nil); resp.StatusCode != http.StatusUnauthorized || errCode(resp) != "unauthorized" {
+		t.Fatalf("no token: %d", resp.StatusCode)
+	}
+	if resp := micropub(t, http.MethodGet, ts.URL+"/micropub?q=config", "wrong", "", nil); resp.StatusCode != http.StatusForbidden || errCode(resp) != "forbidden" {
+		t.Fatalf("bad token: %d", resp.StatusCode)
+	}
+	resp := micropub(t, http.MethodGet, ts.URL+"/micropub?q=config", token, "", nil)
+	var conf map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&conf); err != nil || conf["media-endpoint"] != ts.URL+"/micropub/media" {
+		t.Fatalf("config: %v %v", conf, err)
+	}
+
+	// access_token in the body works too
+	form := url.Values{"h": {"entry"}, "name": {"Hello"}, "content": {"Hi"}, "access_token": {token}}
+	if resp := micropub(t, http.MethodPost, ts.URL+"/micropub", "", "application/x-www-form-urlencoded", strings.NewReader(form.Encode())); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("form token: %d", resp.StatusCode)
+	}
+	// the second post with the same title gets a fresh slug
+	form.Del("access_token")
+	resp = micropub(t, http.MethodPost, ts.URL+"/micropub", token, "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	if !strings.HasSuffix(resp.Header.Get("Location"), "/article/hello-2") {
+		t.Fatalf("second slug: %q", resp.Header.Get("Location"))
+	}
+
+	resp = micropubJSON(t, ts.URL, token, map[string]any{"action": "delete", "url": ts.URL + "/article/hello"})
+	if resp.StatusCode != http.StatusUnauthorized || errCode(resp) != "insufficient_scope" {
+		t.Fatalf("delete without scope: %d", resp.StatusCode)
+	}
+	if _, err := loadArticle("hello"); err != nil {
+		t.Fatalf("article deleted without scope: %v", err)
+	}
+	if resp := micropubJSON(t, ts.URL, token, map[string]any{"type": []string{"h-entry"}, "properties": map[string]any{"name": []string{"Empty"}}}); resp.StatusCode != http.StatusBadRequest || errCode(resp) != "invalid_request" {
+		t.Fatalf("no content: %d", resp.StatusCode)
+	}
+
+	// a revoked token stops working
+	ts2, _ := loadTokens()
+	if _, err := revokeToken(ts2[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if resp := micropub(t, http.MethodGet, ts.URL+"/micropub?q=config", token, "", nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("revoked: %d", resp.StatusCode)
+	}
+}
+
+func TestMicropub_TokensEndWithTheirOwner(t *testing.T) {
+	resetStorage(t)
+	ts := httptest.NewServer(buildMux())
+	defer ts.Close()
+	if _, err := runCLI(t, "b0bs-password\n", "user", "add", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	_, token, err := createToken("Bob's phone", "bob", tokenScopes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := micropub(t, http.MethodGet, ts.URL+"/micropub?q=config", token, "", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("before removal: %d", resp.StatusCode)
+	}
+	if _, err := runCLI(t, "", "user", "del", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	form := url.Values{"h": {"entry"}, "content": {"still here"}}
+	if resp := micropub(t, http.MethodPost, ts.URL+"/micropub", token, "application/x-www-form-urlencoded", strings.NewReader(form.Encode())); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("after removal: %d", resp.StatusCode)
+	}
+	if arts, _ := allArticles(); len(arts) != 0 {
+		t.Fatalf("removed user posted: %+v", arts)
+	}
+}
+
+func TestMicropub_MediaAndPhotos(t *testing.T) {
+	resetStorage(t)
+	ts := httptest.NewServer(buildMux())
+	defer ts.Close()
+	_, token, err := createToken("Camera", cfg.AdminUser, []string{"create", "media"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload := func(target string, fields map[string]string, fileField string, file []byte) *http.Response {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		for k, v := range fields {
+			_ = mw.WriteField(k, v)
+		}
+		fw, _ := mw.CreateFormFile(fileField, "pic.png")
+		_, _ = fw.Write(file)
+		_ = mw.Close()
+		return micropub(t, http.MethodPost, ts.URL+target, token, mw.FormDataContentType(), &buf)
+	}
+
+	resp := upload("/micropub/media", nil, "file", pngBytes)
+	loc := resp.Header.Get("Location")
+	if resp.StatusCode != http.StatusCreated || !strings.HasPrefix(loc, ts.URL+"/media/") || !strings.HasSuffix(loc, ".png") {
+		t.Fatalf("upload: %d %q", resp.StatusCode, loc)
+	}
+	got := micropub(t, http.MethodGet, loc, "", "", nil)
+	if b, _ := io.ReadAll(got.Body); got.StatusCode != http.StatusOK || got.Header.Get("Content-Type") != "image/png" || !bytes.Equal(b, pngBytes) {
+		t.Fatalf("serve: %d %q", got.StatusCode, got.Header.Get("Content-Type"))
+	}
+	if resp := upload("/micropub/media", nil, "file", []byte("#!/bin/sh\necho hi\n")); resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("script upload: %d", resp.StatusCode)
+	}
+	if code, _ := getBody(t, ts.URL, "/media/..%2f.blog%2ftokens.json", ""); code != http.StatusNotFound {
+		t.Fatalf("traversal: %d", code)
+	}
+
+	// a photo post sent as multipart stores the file and links it
+	resp = upload("/micropub", map[string]string{"h": "entry", "content": "Sunset"}, "photo", pngBytes)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("photo post: %d", resp.StatusCode)
+	}
+	a, err := loadArticle("sunset")
+	if err != nil || !strings.Contains(a.Content, "](") || !strings.Contains(a.Content, "/media/") {
+		t.Fatalf("photo article: %+v %v", a, err)
+	}
+	if entries, _ := readAudit(auditFilter{Action: "media.upload"}); len(entries) != 1 {
+		t.Fatalf("media audit entries: %d", len(entries))
+	}
+
+	// without a header the token must come before the file, and an
+	// anonymous upload is refused before any of the file is read
+	pr, pw := io.Pipe()
+	stall := time.AfterFunc(2*time.Second, func() { pw.CloseWithError(errors.New("body never finished")) })
+	defer stall.Stop()
+	defer pw.Close()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		fw, _ := mw.CreateFormFile("file", "pic.png")
+		_, _ = fw.Write(pngBytes) // and never finish
+	}()
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/micropub/media", pr)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("anonymous upload waited for the body: %v", err)
+	}
+	resp.Body.Close()
+	if !stall.Stop() || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("anonymous upload: %d", resp.StatusCode)
+	}
+	var buf bytes.Buffer
+	mw = multipart.NewWriter(&buf)
+	_ = mw.WriteField("access_token", token)
+	fw, _ := mw.CreateFormFile("file", "pic.png")
+	_, _ = fw.Write(pngBytes)
+	_ = mw.Close()
+	if resp := micropub(t, http.MethodPost, ts.URL+"/micropub/media", "", mw.FormDataContentType(), &buf); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("access_token field: %d", resp.StatusCode)
+	}
+
+	// storage errors are logged, not sent to the client
+	if err := os.RemoveAll(filepath.Join(cfg.StorageDir, mediaDir)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(cfg.StorageDir, mediaDir), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	resp = upload("/micropub/media", nil, "file", pngBytes)
+	var e struct {
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&e)
+	if resp.StatusCode != http.StatusInternalServerError || e.Error != "server_error" || strings.Contains(e.Description, mediaDir) {
+		t.Fatalf("storage error: %d %+v", resp.StatusCode, e)
+	}
+}
+
+func TestTokens_AdminAndCLI(t *testing.T) {
+	resetStorage(t)
+	ts := httptest.NewServer(buildMux())
+	defer ts.Close()
+	cookie := login(t, ts.URL, cfg.AdminUser, cfg.AdminPass)
+
+	resp := postForm(t, ts.URL, "/admin/tokens", cookie, url.Values{"action": {"create"}, "name": {"Quill"}, "scope": {"create", "update"}})
+	b, _ := io.ReadAll(resp.Body)
+	toks, _ := loadTokens()
+	if resp.StatusCode != http.StatusOK || len(toks) != 1 || toks[0].User != cfg.AdminUser || strings.Join(toks[0].Scopes, ",") != "create,update" {
+		t.Fatalf("admin create: %d %+v", resp.StatusCode, toks)
+	}
+	if strings.Contains(string(b), toks[0].Hash) {
+		t.Fatal("page shows the token hash")
+	}
+	if code, body := getBody(t, ts.URL, "/admin/tokens", cookie); code != http.StatusOK || !strings.Contains(body, "Quill") {
+		t.Fatalf("list page: %d", code)
+	}
+	if resp := postForm(t, ts.URL, "/admin/tokens", cookie, url.Values{"action": {"create"}, "name": {"Bad"}, "scope": {"admin"}}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("bad scope: %d", resp.StatusCode)
+	}
+	if toks, _ = loadTokens(); len(toks) != 1 {
+		t.Fatalf("bad scope stored a token: %+v", toks)
+	}
+
+	secret, err := runCLI(t, "", "token", "add", "-name", "Script", "-scope", "create,media")
+	if err != nil || len(strings.TrimSpace(secret)) != tokenChars {
+		t.Fatalf("cli add: %q %v", secret, err)
+	}
+	if tok, ok := checkToken(strings.TrimSpace(secret)); !ok || !tok.can("media") || tok.can("delete") {
+		t.Fatalf("cli token: %+v %v", tok, ok)
+	}
+	out, err := runCLI(t, "", "token", "list")
+	if err != nil || !strings.Contains(out, "Quill") || !strings.Contains(out, "Script") {
+		t.Fatalf("cli list: %q %v", out, err)
+	}
+	if _, err := runCLI(t, "", "token", "revoke", toks[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runCLI(t, "", "token", "revoke", toks[0].ID); err == nil {
+		t.Fatal("revoking twice succeeded")
+	}
+	if toks, _ = loadTokens(); len(toks) != 1 || toks[0].Name != "Script" {
+		t.Fatalf("after revoke: %+v", toks)
+	}
+}
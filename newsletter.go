@@ -0,0 +1,676 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --------------------------- Newsletter ------------------------
+// Readers subscribe with their email address and confirm through a link
+// (double opt-in). Publishing an article queues it; a worker mails the queue
+// to every confirmed subscriber, at once or as a weekly digest depending on
+// the newsletter setting. Every email carries a personal unsubscribe link.
+// Subscribers live in .blog/subscribers.json, the queue and send history in
+// .blog/newsletter.json.
+
+const (
+	subscribersFile       = "subscribers.json"
+	newsletterFile        = "newsletter.json"
+	newsletterConfirmTTL  = 48 * time.Hour
+	newsletterResendAfter = 10 * time.Minute // between confirmation emails
+	newsletterSweep       = 10 * time.Minute
+	newsletterHistory     = 100 // issues kept
+	newsletterExcerpt     = 300 // runes of each article in the email
+)
+
+// Subscriber states.
+const (
+	subscriberPending      = "pending"
+	subscriberActive       = "active"
+	subscriberUnsubscribed = "unsubscribed"
+)
+
+type subscriber struct {
+	Email        string    `json:"email"`
+	Token        string    `json:"token"` // in the confirmation and unsubscribe links
+	Status       string    `json:"status"`
+	Created      time.Time `json:"created"`
+	ConfirmSent  time.Time `json:"confirm_sent,omitzero"`
+	Confirmed    time.Time `json:"confirmed,omitzero"`
+	Unsubscribed time.Time `json:"unsubscribed,omitzero"`
+	IP           string    `json:"ip,omitempty"`
+}
+
+// newsletterIssue records one send, for the history in the admin.
+type newsletterIssue struct {
+	Sent       time.Time `json:"sent"`
+	Subject    string    `json:"subject"`
+	Slugs      []string  `json:"slugs"`
+	Recipients int       `json:"recipients"`
+	Failed     int       `json:"failed,omitempty"`
+	Error      string    `json:"error,omitempty"` // the first failure
+}
+
+type newsletterState struct {
+	Queue      []string          `json:"queue"` // slugs published since they were last mailed
+	LastDigest time.Time         `json:"last_digest,omitzero"`
+	History    []newsletterIssue `json:"history"` // oldest first
+}
+
+var newsletterMu sync.Mutex
+
+// newsletterSendMu lets one send run at a time, so the worker and "send
+// now" never both mail the same queue.
+var newsletterSendMu sync.Mutex
+
+// newsletters mails queued articles when they are due; it is woken when an
+// article is published.
+var newsletters = newWorker(newsletterSweep)
+
+// --------------------------- Newsletter storage ----------------
+
+func loadSubscribers() ([]subscriber, error) {
+	b, err := os.ReadFile(filepath.Join(metaDir(), subscribersFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ss []subscriber
+	return ss, json.Unmarshal(b, &ss)
+}
+
+func saveSubscribers(ss []subscriber) error {
+	if err := os.MkdirAll(metaDir(), 0o700); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(ss, "", "  ")
+	if err != nil {
+		return err
+	}
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	return writeFileAtomic(filepath.Join(metaDir(), subscribersFile), b, 0o600)
+}
+
+func loadNewsletter() (newsletterState, error) {
+	var st newsletterState
+	b, err := os.ReadFile(filepath.Join(metaDir(), newsletterFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return st, err
+	}
+	return st, json.Unmarshal(b, &st)
+}
+
+func saveNewsletter(st newsletterState) error {
+	if err := os.MkdirAll(metaDir(), 0o700); err != nil {
+		return err
+	}
+	if n := len(st.History); n > newsletterHistory {
+		st.History = st.History[n-newsletterHistory:]
+	}
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	return writeFileAtomic(filepath.Join(metaDir(), newsletterFile), b, 0o600)
+}
+
+// subscribe records a request to subscribe email and reports whether a
+// confirmation email should go out: not to confirmed subscribers, and not
+// twice within newsletterResendAfter.
+func subscribe(email, ip string, now time.Time) (subscriber, bool, error) {
+	newsletterMu.Lock()
+	defer newsletterMu.Unlock()
+	ss, err := loadSubscribers()
+	if err != nil {
+		return subscriber{}, false, err
+	}
+	i := slices.IndexFunc(ss, func(s subscriber) bool { return strings.EqualFold(s.Email, email) })
+	if i < 0 {
+		ss = append(ss, subscriber{Email: email, Status: subscriberUnsubscribed})
+		i = len(ss) - 1
+	}
+	s := &ss[i]
+	switch {
+	case s.Status == subscriberActive:
+		return *s, false, nil
+	case s.Status == subscriberPending && now.Sub(s.ConfirmSent) < newsletterResendAfter:
+		return *s, false, nil
+	case s.Status == subscriberUnsubscribed:
+		*s = subscriber{Email: email, Token: newToken(32), Status: subscriberPending, Created: now.UTC()}
+	}
+	s.ConfirmSent, s.IP = now.UTC(), ip
+	return *s, true, saveSubscribers(ss)
+}
+
+// confirmationFailed lets the subscriber ask again at once after the
+// confirmation email could not be sent.
+func confirmationFailed(token string) {
+	newsletterMu.Lock()
+	defer newsletterMu.Unlock()
+	ss, err := loadSubscribers()
+	if i := slices.IndexFunc(ss, func(s subscriber) bool { return s.Token == token }); err == nil && i >= 0 {
+		ss[i].ConfirmSent = time.Time{}
+		err = saveSubscribers(ss)
+	}
+	if err != nil {
+		slog.Error("reset confirmation", "err", err)
+	}
+}
+
+var errLinkExpired = errors.New("this confirmation link has expired; please subscribe again")
+
+// setSubscription confirms (active) or cancels (unsubscribed) the
+// subscription with token. It returns the email address.
+func setSubscription(token, status string, now time.Time) (string, error) {
+	newsletterMu.Lock()
+	defer newsletterMu.Unlock()
+	ss, err := loadSubscribers()
+	if err != nil {
+		return "", err
+	}
+	i := slices.IndexFunc(ss, func(s subscriber) bool { return token != "" && s.Token == token })
+	if i < 0 {
+		return "", os.ErrNotExist
+	}
+	s := &ss[i]
+	switch {
+	case s.Status == status:
+		return s.Email, nil
+	case status == subscriberActive && s.Status != subscriberPending:
+		return "", os.ErrNotExist // unsubscribed links don't resubscribe
+	case status == subscriberActive && now.Sub(s.ConfirmSent) > newsletterConfirmTTL:
+		return "", errLinkExpired
+	case status == subscriberActive:
+		s.Confirmed = now.UTC()
+	default:
+		s.Unsubscribed = now.UTC()
+	}
+	s.Status = status
+	return s.Email, saveSubscribers(ss)
+}
+
+// queueNewsletter queues an article that was just made public. Like the
+// other notifications it logs failures rather than failing the save.
+func queueNewsletter(before, after Article) {
+	if !cfg.NewsletterEnabled() || !slices.Contains(articleEvents(before, after), "article.published") {
+		return
+	}
+	newsletterMu.Lock()
+	defer newsletterMu.Unlock()
+	st, err := loadNewsletter()
+	if err == nil && !slices.Contains(st.Queue, after.Slug) {
+		st.Queue = append(st.Queue, after.Slug)
+		err = saveNewsletter(st)
+	}
+	if err != nil {
+		slog.Error("queue newsletter", "err", err)
+		return
+	}
+	if cfg.Newsletter == "immediate" {
+		newsletters.wake()
+	}
+}
+
+// --------------------------- Newsletter sending ----------------
+
+func processNewsletter(ctx context.Context) {
+	if _, err := sendNewsletter(time.Now(), false); err != nil {
+		slog.Error("send newsletter", "err", err)
+	}
+}
+
+// sendNewsletter mails the queued articles if they are due: at once in
+// immediate mode (one email per article), on the digest day in weekly mode
+// (one email for all), or whenever force is set. Articles deleted or
+// unpublished since are dropped. When every recipient fails, as with the
+// SMTP server down, the queue is kept for the next try.
+func sendNewsletter(now time.Time, force bool) ([]newsletterIssue, error) {
+	if !cfg.NewsletterEnabled() {
+		return nil, nil
+	}
+	newsletterSendMu.Lock()
+	defer newsletterSendMu.Unlock()
+	newsletterMu.Lock()
+	st, err := loadNewsletter()
+	if err != nil {
+		newsletterMu.Unlock()
+		return nil, err
+	}
+	today := now.In(cfg.Location())
+	lastDigest := st.LastDigest.In(cfg.Location())
+	digestDue := today.Weekday() == cfg.digestDay && (st.LastDigest.IsZero() || lastDigest.YearDay() != today.YearDay() || lastDigest.Year() != today.Year())
+	if len(st.Queue) == 0 || (!force && cfg.Newsletter == "weekly" && !digestDue) {
+		newsletterMu.Unlock()
+		return nil, nil
+	}
+	queue := st.Queue
+	subs, err := loadSubscribers()
+	newsletterMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	var arts []Article
+	for _, slug := range queue {
+		if a, err := loadArticle(slug); err == nil && !a.Draft {
+			arts = append(arts, a)
+		}
+	}
+	active := subs[:0]
+	for _, s := range subs {
+		if s.Status == subscriberActive {
+			active = append(active, s)
+		}
+	}
+
+	var batches [][]Article
+	if cfg.Newsletter == "immediate" {
+		for _, a := range arts {
+			batches = append(batches, []Article{a})
+		}
+	} else if len(arts) > 0 {
+		batches = append(batches, arts)
+	}
+	// done holds the slugs to take off the queue: those dropped above and
+	// those of every issue that reached at least one subscriber
+	done := slices.DeleteFunc(slices.Clone(queue), func(slug string) bool {
+		return slices.ContainsFunc(arts, func(a Article) bool { return a.Slug == slug })
+	})
+	var issues []newsletterIssue
+	for _, batch := range batches {
+		issue := mailIssue(batch, active, now)
+		issues = append(issues, issue)
+		if issue.Failed == 0 || issue.Failed < issue.Recipients {
+			done = append(done, issue.Slugs...)
+		}
+	}
+
+	newsletterMu.Lock()
+	defer newsletterMu.Unlock()
+	if st, err = loadNewsletter(); err != nil {
+		return issues, err
+	}
+	st.History = append(st.History, issues...)
+	st.Queue = slices.DeleteFunc(st.Queue, func(slug string) bool { return slices.Contains(done, slug) })
+	if cfg.Newsletter == "weekly" && len(done) == len(queue) {
+		st.LastDigest = now.UTC()
+	}
+	return issues, saveNewsletter(st)
+}
+
+// mailIssue sends one email about arts to each subscriber.
+func mailIssue(arts []Article, to []subscriber, now time.Time) newsletterIssue {
+	subject := arts[0].Title
+	if len(arts) > 1 {
+		subject = fmt.Sprintf("%s: %d new posts", cfg.SiteTitle, len(arts))
+	}
+	issue := newsletterIssue{Sent: now.UTC(), Subject: subject, Recipients: len(to)}
+	for _, a := range arts {
+		issue.Slugs = append(issue.Slugs, a.Slug)
+	}
+	for _, s := range to {
+		if err := sendMail(s.Email, newsletterMessage(s, subject, arts, now)); err != nil {
+			if issue.Failed++; issue.Error == "" {
+				issue.Error = fmt.Sprintf("%s: %v", s.Email, err)
+			}
+		}
+	}
+	slog.Info("newsletter sent", "subject", subject, "recipients", issue.Recipients, "failed", issue.Failed)
+	return issue
+}
+
+// sendMail delivers one message through the configured SMTP server;
+// net/smtp upgrades to TLS when the server offers STARTTLS.
+func sendMail(to string, msg []byte) error {
+	from, err := mail.ParseAddress(cfg.SMTPFrom)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if cfg.SMTPUser != "" {
+		host, _, _ := net.SplitHostPort(cfg.SMTPAddr)
+		auth = smtp.PlainAuth("", cfg.SMTPUser, cfg.SMTPPass, host)
+	}
+	return smtp.SendMail(cfg.SMTPAddr, auth, from.Address, []string{to}, msg)
+}
+
+func newsletterURL(action, token string) string {
+	return cfg.BaseURL + "/newsletter/" + action + "?token=" + url.QueryEscape(token)
+}
+
+// mailHeader writes the headers shared by every email. Values are
+// collapsed to one line so titles can't inject headers.
+func mailHeader(b *bytes.Buffer, to, subject string, now time.Time) {
+	subject = strings.Join(strings.Fields(subject), " ")
+	fmt.Fprintf(b, "From: %s\r\n", cfg.SMTPFrom)
+	fmt.Fprintf(b, "To: %s\r\n", to)
+	fmt.Fprintf(b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(b, "Message-ID: <%s@%s>\r\n", newToken(24), mailDomain())
+	b.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n")
+}
+
+func mailDomain() string {
+	if u, err := url.Parse(cfg.BaseURL); err == nil && u.Hostname() != "" {
+		return u.Hostname()
+	}
+	return "localhost"
+}
+
+func mailBody(b *bytes.Buffer, text string) {
+	qp := quotedprintable.NewWriter(b)
+	_, _ = qp.Write([]byte(strings.ReplaceAll(text, "\n", "\r\n")))
+	_ = qp.Close()
+}
+
+// newsletterMessage is the email about arts for s, in plain text.
+func newsletterMessage(s subscriber, subject string, arts []Article, now time.Time) []byte {
+	var b bytes.Buffer
+	unsub := newsletterURL("unsubscribe", s.Token)
+	mailHeader(&b, s.Email, subject, now)
+	fmt.Fprintf(&b, "List-Unsubscribe: <%s>\r\nList-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n\r\n", unsub)
+	var text strings.Builder
+	for _, a := range arts {
+		fmt.Fprintf(&text, "%s\n%s\n\n", strings.Join(strings.Fields(a.Title), " "), cfg.BaseURL+"/article/"+a.Slug)
+		plain := parseHTML(markdownToXHTML(a.Content, func(string) string { return "" })).text()
+		fmt.Fprintf(&text, "%s\n\n\n", excerpt(plain, newsletterExcerpt))
+	}
+	fmt.Fprintf(&text, "--\nYou get this email because you subscribed to %s.\nUnsubscribe: %s\n", cfg.SiteTitle, unsub)
+	mailBody(&b, text.String())
+	return b.Bytes()
+}
+
+// confirmationMessage asks s to confirm the subscription.
+func confirmationMessage(s subscriber, now time.Time) []byte {
+	var b bytes.Buffer
+	mailHeader(&b, s.Email, "Confirm your subscription to "+cfg.SiteTitle, now)
+	b.WriteString("\r\n")
+	mailBody(&b, fmt.Sprintf("Someone, hopefully you, asked to get new posts from %s by email.\n\nTo confirm, open this link within %d hours:\n%s\n\nIf it wasn't you, ignore this email and nothing will be sent.\n",
+		cfg.SiteTitle, int(newsletterConfirmTTL.Hours()), newsletterURL("confirm", s.Token)))
+	return b.Bytes()
+}
+
+// --------------------------- Handlers (newsletter) -------------
+
+// renderNewsletter shows a message page, optionally with a button that
+// posts token to action.
+func renderNewsletter(w http.ResponseWriter, r *http.Request, heading, msg, action, button string) {
+	data := map[string]any{"Active": "newsletter", "Title": heading, "Heading": heading, "Message": msg, "Action": action, "Button": button, "Token": r.FormValue("token")}
+	render(w, r, data)
+}
+
+func newsletterSubscribePost(w http.ResponseWriter, r *http.Request) {
+	if !cfg.NewsletterEnabled() {
+		notFound(w, r)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 8<<10)
+	if err := r.ParseForm(); err != nil {
+		renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	email := strings.TrimSpace(r.PostFormValue("email"))
+	sent := "We've sent a confirmation link to " + email + ". Your subscription starts once you open it."
+	if r.PostFormValue("website") != "" {
+		renderNewsletter(w, r, "Check your inbox", sent, "", "") // honeypot: look the same, do nothing
+		return
+	}
+	if addr, err := mail.ParseAddress(email); err != nil || addr.Address != email || len(email) > commentMaxEmail {
+		renderNewsletter(w, r, "Subscribe", "Please enter a valid email address.", "", "")
+		return
+	}
+	s, send, err := subscribe(email, clientIP(r), time.Now())
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if send {
+		if err := sendMail(s.Email, confirmationMessage(s, time.Now())); err != nil {
+			slog.ErrorContext(r.Context(), "send confirmation email", "err", err)
+			confirmationFailed(s.Token)
+			renderNewsletter(w, r, "Subscribe", "We couldn't send the confirmation email just now. Please try again later.", "", "")
+			return
+		}
+	}
+	renderNewsletter(w, r, "Check your inbox", sent, "", "")
+}
+
+// newsletterConfirm and newsletterUnsubscribe show a button on GET, so
+// link scanners in mail clients don't act on the links; the POST does it.
+// Unsubscribing also accepts RFC 8058 one-click POSTs from mail clients.
+func newsletterConfirm(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		renderNewsletter(w, r, "Confirm subscription", "Get new posts from "+cfg.SiteTitle+" by email.", "/newsletter/confirm", "Confirm")
+		return
+	}
+	_ = r.ParseForm()
+	email, err := setSubscription(r.FormValue("token"), subscriberActive, time.Now())
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		renderNewsletter(w, r, "Confirm subscription", "This link is no longer valid.", "", "")
+	case errors.Is(err, errLinkExpired):
+		renderNewsletter(w, r, "Confirm subscription", "This link has expired. Please subscribe again.", "", "")
+	case err != nil:
+		serverError(w, r, err)
+	default:
+		renderNewsletter(w, r, "You're subscribed", "New posts will be sent to "+email+".", "", "")
+	}
+}
+
+func newsletterUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		renderNewsletter(w, r, "Unsubscribe", "Stop getting new posts from "+cfg.SiteTitle+" by email.", "/newsletter/unsubscribe", "Unsubscribe")
+		return
+	}
+	_ = r.ParseForm()
+	email, err := setSubscription(r.FormValue("token"), subscriberUnsubscribed, time.Now())
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		renderNewsletter(w, r, "Unsubscribe", "This link is no longer valid.", "", "")
+	case err != nil:
+		serverError(w, r, err)
+	default:
+		renderNewsletter(w, r, "Unsubscribed", email+" won't get any more emails from "+cfg.SiteTitle+".", "", "")
+	}
+}
+
+// --------------------------- Handlers (admin newsletter) -------
+
+func adminNewsletterGet(w http.ResponseWriter, r *http.Request) {
+	newsletterMu.Lock()
+	subs, err := loadSubscribers()
+	var st newsletterState
+	if err == nil {
+		st, err = loadNewsletter()
+	}
+	newsletterMu.Unlock()
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	sort.SliceStable(subs, func(i, j int) bool { return subs[i].Created.After(subs[j].Created) })
+	counts := map[string]int{}
+	for _, s := range subs {
+		counts[s.Status]++
+	}
+	var queued []Article
+	for _, slug := range st.Queue {
+		if a, err := loadArticle(slug); err == nil {
+			queued = append(queued, a)
+		}
+	}
+	slices.Reverse(st.History)
+	data := map[string]any{"Active": "admin_newsletter", "Title": "Newsletter", "Subscribers": subs, "Counts": counts, "Queue": queued, "History": st.History, "Enabled": cfg.NewsletterEnabled()}
+	render(w, r, data)
+}
+
+func adminNewsletterPost(w http.ResponseWriter, r *http.Request) {
+	_ = r.ParseForm()
+	switch r.FormValue("action") {
+	case "send":
+		issues, err := sendNewsletter(time.Now(), true)
+		for _, is := range issues {
+			audit(r, "newsletter.send", "", strings.Join(is.Slugs, ","), fmt.Sprintf("%q to %d subscribers, %d failed", is.Subject, is.Recipients, is.Failed))
+		}
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+	case "delete":
+		email := r.FormValue("email")
+		newsletterMu.Lock()
+		ss, err := loadSubscribers()
+		n := len(ss)
+		if err == nil {
+			ss = slices.DeleteFunc(ss, func(s subscriber) bool { return s.Email == email })
+			err = saveSubscribers(ss)
+		}
+		newsletterMu.Unlock()
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		if len(ss) < n {
+			audit(r, "subscriber.delete", "", "", email)
+		}
+	default:
+		renderError(w, r, http.StatusBadRequest, nil)
+		return
+	}
+	http.Redirect(w, r, "/admin/newsletter", http.StatusFound)
+}
+
+func adminNewsletterCSV(w http.ResponseWriter, r *http.Request) {
+	newsletterMu.Lock()
+	subs, err := loadSubscribers()
+	newsletterMu.Unlock()
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	audit(r, "newsletter.export", "", "", fmt.Sprintf("%d subscribers", len(subs)))
+	stamp := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format(time.RFC3339)
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="subscribers.csv"`)
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"email", "status", "created", "confirmed", "unsubscribed"})
+	for _, s := range subs {
+		_ = cw.Write([]string{csvCell(s.Email), s.Status, stamp(s.Created), stamp(s.Confirmed), stamp(s.Unsubscribed)})
+	}
+	cw.Flush()
+}
+
+// --------------------------- Templates (newsletter) ------------
+
+const newsletterFormHTML = `{{define "newsletter_form"}}{{if and site.NewsletterEnabled (not .Static)}}
+  <form method="post" action="/newsletter/subscribe" class="card bar">
+    <label for="nl-email">Get new posts by email</label>
+    <div class="hp" aria-hidden="true"><label>Leave this empty <input name="website" tabindex="-1" autocomplete="off" /></label></div>
+    <span><input id="nl-email" name="email" type="email" placeholder="you@example.com" required /> <button type="submit">Subscribe</button></span>
+  </form>
+{{end}}{{end}}`
+
+const newsletterHTML = `{{define "newsletter"}}
+  <div class="card">
+    <h1 class="m-0 mb-8">{{.Heading}}</h1>
+    <p>{{.Message}}</p>
+    {{if and .Action .Token}}
+    <form method="post" action="{{.Action}}">
+      <input type="hidden" name="token" value="{{.Token}}" />
+      <button type="submit">{{.Button}}</button>
+    </form>
+    {{end}}
+  </div>
+{{end}}`
+
+const adminNewsletterHTML = `{{define "admin_newsletter"}}
+  <div class="card bar">
+    <div><h2 class="m-0">Newsletter</h2></div>
+    <div>
+      <a href="/admin/newsletter/subscribers.csv"><button>Export CSV</button></a>
+      <a class="ml-8" href="/admin">Back</a>
+    </div>
+  </div>
+  {{if not .Enabled}}<div class="card danger">The newsletter is off; set <code>newsletter</code> and the SMTP settings to let readers subscribe.</div>{{end}}
+  <div class="card">
+    <div class="bar">
+      <div>
+        <strong>{{index .Counts "active"}}</strong> subscribed · {{index .Counts "pending"}} awaiting confirmation · {{index .Counts "unsubscribed"}} unsubscribed
+        <div class="muted">{{if .Queue}}Queued: {{range $i, $a := .Queue}}{{if $i}}, {{end}}{{$a.Title}}{{end}}{{else}}Nothing queued.{{end}}</div>
+      </div>
+      {{if .Queue}}<form method="post" action="/admin/newsletter"><button name="action" value="send">Send queued now</button></form>{{end}}
+    </div>
+  </div>
+  <div class="card">
+    <h3 class="mt-0">Send history</h3>
+    {{if not .History}}<p class="muted m-0">Nothing sent yet.</p>{{else}}
+    <table>
+      <thead><tr><th>Sent</th><th>Subject</th><th>Recipients</th><th>Failed</th></tr></thead>
+      <tbody>
+        {{range .History}}
+        <tr>
+          <td>{{.Sent.Format "Jan 02 15:04"}}</td>
+          <td>{{.Subject}}</td>
+          <td>{{.Recipients}}</td>
+          <td>{{.Failed}}{{with .Error}}<div class="muted">{{.}}</div>{{end}}</td>
+        </tr>
+        {{end}}
+      </tbody>
+    </table>
+    {{end}}
+  </div>
+  <div class="card">
+    <h3 class="mt-0">Subscribers</h3>
+    {{if not .Subscribers}}<p class="muted m-0">No subscribers yet.</p>{{else}}
+    <table>
+      <thead><tr><th>Email</th><th>Status</th><th>Since</th><th class="w-220"></th></tr></thead>
+      <tbody>
+        {{range .Subscribers}}
+        <tr>
+          <td>{{.Email}}</td>
+          <td>{{.Status}}</td>
+          <td>{{.Created.Format "Jan 02, 2006"}}</td>
+          <td>
+            <form method="post" action="/admin/newsletter">
+              <input type="hidden" name="email" value="{{.Email}}" />
+              <button class="danger" name="action" value="delete">Remove</button>
+            </form>
+          </td>
+        </tr>
+        {{end}}
+      </tbody>
+    </table>
+    {{end}}
+  </div>
+{{end}}`
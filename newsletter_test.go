@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type sentMail struct {
+	to   string
+	msg  *mail.Message
+	body string // decoded
+}
+
+// fakeSMTP runs a minimal SMTP server, points the config at it and returns
+// the mail it received. Recipients in reject are refused with a 550.
+func fakeSMTP(t *testing.T, reject ...string) func() []sentMail {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var mu sync.Mutex
+	var got []sentMail
+	serve := func(c net.Conn) {
+		defer c.Close()
+		r := bufio.NewReader(c)
+		reply := func(s string) { _, _ = io.WriteString(c, s+"\r\n") }
+		reply("220 fake ESMTP")
+		var to string
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			cmd := strings.ToUpper(strings.TrimSpace(line))
+			switch {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				reply("250 fake")
+			case strings.HasPrefix(cmd, "RCPT TO:"):
+				to = strings.Trim(strings.TrimSpace(line)[len("RCPT TO:"):], "<>")
+				for _, bad := range reject {
+					if to == bad {
+						reply("550 no such user")
+						to = ""
+					}
+				}
+				if to != "" {
+					reply("250 ok")
+				}
+			case cmd == "DATA":
+				reply("354 go ahead")
+				var data strings.Builder
+				for {
+					l, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if l == ".\r\n" {
+						break
+					}
+					data.WriteString(strings.TrimPrefix(l, "."))
+				}
+				msg, err := mail.ReadMessage(strings.NewReader(data.String()))
+				if err != nil {
+					t.Errorf("bad message: %v\n%s", err, data.String())
+				} else {
+					b, _ := io.ReadAll(quotedprintable.NewReader(msg.Body))
+					mu.Lock()
+					got = append(got, sentMail{to, msg, strings.ReplaceAll(string(b), "\r\n", "\n")})
+					mu.Unlock()
+				}
+				reply("250 queued")
+			case cmd == "QUIT":
+				reply("221 bye")
+				return
+			default: // MAIL, RSET, NOOP
+				reply("250 ok")
+			}
+		}
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(c)
+		}
+	}()
+
+	saved := cfg
+	t.Cleanup(func() { cfg = saved })
+	cfg.Newsletter = "immediate"
+	cfg.SMTPAddr = ln.Addr().String()
+	cfg.SMTPFrom = "Blog <blog@blog.example>"
+	cfg.BaseURL = "https://blog.example"
+	return func() []sentMail {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]sentMail(nil), got...)
+	}
+}
+
+var tokenRe = regexp.MustCompile(`token=([A-Za-z0-9]+)`)
+
+func TestNewsletter_DoubleOptInAndUnsubscribe(t *testing.T) {
+	resetStorage(t)
+	received := fakeSMTP(t)
+	ts := httptest.NewServer(buildMux())
+	defer ts.Close()
+	cookie := login(t, ts.URL, cfg.AdminUser, cfg.AdminPass)
+
+	if _, body := getBody(t, ts.URL, "/", ""); !strings.Contains(body, `action="/newsletter/subscribe"`) {
+		t.Fatalf("no subscribe form:\n%s", body)
+	}
+	for _, form := range []url.Values{
+		{"email": {"not-an-address"}},
+		{"email": {"bot@example.com"}, "website": {"spam"}},
+	} {
+		if resp := postForm(t, ts.URL, "/newsletter/subscribe", "", form); resp.StatusCode != http.StatusOK || resp.Header.Get("Cache-Control") != "no-store" {
+			t.Fatalf("%v: %d %v", form, resp.StatusCode, resp.Header)
+		}
+	}
+	postForm(t, ts.URL, "/newsletter/subscribe", "", url.Values{"email": {"reader@example.com"}})
+	postForm(t, ts.URL, "/newsletter/subscribe", "", url.Values{"email": {"reader@example.com"}}) // not sent twice
+	got := received()
+	if len(got) != 1 || got[0].to != "reader@example.com" || !strings.HasPrefix(got[0].msg.Header.Get("Subject"), "Confirm") {
+		t.Fatalf("confirmation mails: %+v", got)
+	}
+	m := tokenRe.FindStringSubmatch(got[0].body)
+	if m == nil || !strings.Contains(got[0].body, "https://blog.example/newsletter/confirm?token=") {
+		t.Fatalf("no confirmation link:\n%s", got[0].body)
+	}
+	token := m[1]
+
+	// unconfirmed subscribers get nothing
+	postForm(t, ts.URL, "/admin/new", cookie, url.Values{"title": {"Early"}, "content": {"x"}, "date": {"2024-05-06"}})
+	processNewsletter(context.Background())
+	if n := len(received()); n != 1 {
+		t.Fatalf("%d mails before confirming", n)
+	}
+
+	// the link shows a button; only the POST confirms
+	if _, body := getBody(t, ts.URL, "/newsletter/confirm?token="+token, ""); !strings.Contains(body, `value="`+token+`"`) {
+		t.Fatalf("confirm page:\n%s", body)
+	}
+	if subs, _ := loadSubscribers(); subs[0].Status != subscriberPending {
+		t.Fatal("confirmed by GET")
+	}
+	if resp := postForm(t, ts.URL, "/newsletter/confirm", "", url.Values{"token": {token}}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("confirm: %d", resp.StatusCode)
+	}
+	if subs, _ := loadSubscribers(); subs[0].Status != subscriberActive {
+		t.Fatalf("not confirmed: %+v", subs)
+	}
+
+	content := "Hello **readers**, " + strings.Repeat("word ", 200)
+	postForm(t, ts.URL, "/admin/new", cookie, url.Values{"title": {"Big\r\nBcc: news"}, "content": {content}, "date": {"2024-05-07"}})
+	processNewsletter(context.Background())
+	got = received()
+	if len(got) != 2 {
+		t.Fatalf("%d mails, want the confirmation and one issue", len(got))
+	}
+	issue := got[1]
+	if issue.msg.Header.Get("Subject") != "Big Bcc: news" || issue.msg.Header.Get("Bcc") != "" {
+		t.Fatalf("issue headers: %v", issue.msg.Header)
+	}
+	unsub := "https://blog.example/newsletter/unsubscribe?token=" + token
+	if issue.msg.Header.Get("List-Unsubscribe") != "<"+unsub+">" || issue.msg.Header.Get("List-Unsubscribe-Post") != "List-Unsubscribe=One-Click" {
+		t.Fatalf("unsubscribe headers: %v", issue.msg.Header)
+	}
+	st, _ := loadNewsletter()
+	if len(st.Queue) != 0 || len(st.History) != 2 || st.History[1].Recipients != 1 {
+		t.Fatalf("state: %+v", st)
+	}
+	if !strings.HasPrefix(issue.body, "Big Bcc: news\nhttps://blog.example/article/"+st.History[1].Slugs[0]+"\n") || !strings.Contains(issue.body, "Hello readers, word") || !strings.Contains(issue.body, unsub) || strings.Count(issue.body, "word") > 100 {
+		t.Fatalf("issue body:\n%s", issue.body)
+	}
+
+	// mail clients unsubscribe with a one-click POST
+	resp := postForm(t, ts.URL, "/newsletter/unsubscribe?token="+token, "", url.Values{"List-Unsubscribe": {"One-Click"}})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unsubscribe: %d", resp.StatusCode)
+	}
+	if subs, _ := loadSubscribers(); subs[0].Status != subscriberUnsubscribed {
+		t.Fatalf("still subscribed: %+v", subs)
+	}
+	if resp := postForm(t, ts.URL, "/newsletter/confirm", "", url.Values{"token": {token}}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("confirm after unsubscribe: %d", resp.StatusCode)
+	}
+	if subs, _ := loadSubscribers(); subs[0].Status != subscriberUnsubscribed {
+		t.Fatal("old confirmation link resubscribed")
+	}
+	postForm(t, ts.URL, "/admin/new", cookie, url.Values{"title": {"Late"}, "content": {"x"}, "date": {"2024-05-08"}})
+	processNewsletter(context.Background())
+	if n := len(received()); n != 2 {
+		t.Fatalf("%d mails after unsubscribing", n)
+	}
+}
+
+func TestNewsletter_WeeklyDigestAndAdmin(t *testing.T) {
+	resetStorage(t)
+	received := fakeSMTP(t, "bounce@example.com")
+	cfg.Newsletter = "weekly"
+	cfg.digestDay = time.Wednesday
+	ts := httptest.NewServer(buildMux())
+	defer ts.Close()
+	cookie := login(t, ts.URL, cfg.AdminUser, cfg.AdminPass)
+
+	now := time.Now()
+	if err := saveSubscribers([]subscriber{
+		{Email: "a@example.com", Token: "tokena", Status: subscriberActive, Created: now},
+		{Email: "bounce@example.com", Token: "tokenb", Status: subscriberActive, Created: now},
+		{Email: "p@example.com", Token: "tokenp", Status: subscriberPending, Created: now},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	site := []string{"-base-url=https://blog.example", "-newsletter=weekly", "-digest-day=wednesday", "-smtp-addr=" + cfg.SMTPAddr, "-smtp-from=blog@blog.example"}
+	for _, title := range []string{"One", "Two"} {
+		if _, err := runCLI(t, "body of "+title, "new", append(site, "-title", title)...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := runCLI(t, "wip", "new", append(site, "-title", "Draft", "-draft")...); err != nil {
+		t.Fatal(err)
+	}
+	if st, _ := loadNewsletter(); strings.Join(st.Queue, ",") != "one,two" {
+		t.Fatalf("queue: %+v", st.Queue)
+	}
+
+	tuesday := time.Date(2024, 5, 7, 9, 0, 0, 0, cfg.Location())
+	if issues, _ := sendNewsletter(tuesday, false); len(issues) != 0 || len(received()) != 0 {
+		t.Fatal("digest sent before its day")
+	}
+	// the worker and "send now" racing send the digest once
+	wednesday := tuesday.AddDate(0, 0, 1)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var issues []newsletterIssue
+	var err error
+	for _, force := range []bool{false, true} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, e := sendNewsletter(wednesday, force)
+			mu.Lock()
+			defer mu.Unlock()
+			issues = append(issues, got...)
+			err = errors.Join(err, e)
+		}()
+	}
+	wg.Wait()
+	if err != nil || len(issues) != 1 || issues[0].Recipients != 2 || issues[0].Failed != 1 || !strings.Contains(issues[0].Error, "bounce@example.com") {
+		t.Fatalf("digest: %+v %v", issues, err)
+	}
+	got := received()
+	if len(got) != 1 || got[0].to != "a@example.com" || !strings.Contains(got[0].msg.Header.Get("Subject"), "2 new posts") ||
+		!strings.Contains(got[0].body, "body of One") || !strings.Contains(got[0].body, "body of Two") {
+		t.Fatalf("digest mail: %+v", got)
+	}
+	if issues, _ := sendNewsletter(wednesday.Add(time.Hour), false); len(issues) != 0 {
+		t.Fatal("digest sent twice")
+	}
+
+	_, body := getBody(t, ts.URL, "/admin/newsletter", cookie)
+	for _, want := range []string{"<strong>2</strong> subscribed", "1 awaiting confirmation", "Nothing queued.", "2 new posts", "bounce@example.com: "} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("admin page lacks %q:\n%s", want, body)
+		}
+	}
+	if resp := postForm(t, ts.URL, "/admin/newsletter", cookie, url.Values{"action": {"delete"}, "email": {"p@example.com"}}); resp.StatusCode != http.StatusFound {
+		t.Fatalf("delete: %d", resp.StatusCode)
+	}
+	code, csv := getBody(t, ts.URL, "/admin/newsletter/subscribers.csv", cookie)
+	if code != http.StatusOK || !strings.HasPrefix(csv, "email,status,created,confirmed,unsubscribed\n") || strings.Count(csv, "\n") != 3 || strings.Contains(csv, "p@example.com") {
+		t.Fatalf("csv %d:\n%s", code, csv)
+	}
+
+	// sending by hand doesn't wait for the digest day
+	if _, err := runCLI(t, "three", "new", append(site, "-title", "Three")...); err != nil {
+		t.Fatal(err)
+	}
+	if resp := postForm(t, ts.URL, "/admin/newsletter", cookie, url.Values{"action": {"send"}}); resp.StatusCode != http.StatusFound {
+		t.Fatalf("send: %d", resp.StatusCode)
+	}
+	if got := received(); len(got) != 2 || got[1].msg.Header.Get("Subject") != "Three" {
+		t.Fatalf("manual send: %+v", got)
+	}
+	if entries, _ := readAudit(auditFilter{Action: "newsletter.send"}); len(entries) != 1 {
+		t.Fatal("send not audited")
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --------------------------- Page cache ------------------------
+// Rendered guest pages, kept in an LRU bounded by body bytes. Entries are
+// tagged with the content they were built from and dropped when
+// saveArticle or deleteArticle touch that content. Every invalidation also
+// rewrites a stamp file in metaDir, and a lookup that finds the stamp
+// changed by someone else (a CLI command against the same storage dir)
+// empties the cache.
+
+// Dependency tags. Every page that lists articles (Home and its pages, and
+// any future tag, archive or feed page) depends on depList; an article page
+// depends on its own slug only.
+const depList = "list"
+
+// pageCacheMaxAge bounds every entry, so a change the stamp file misses (a
+// hand edit under the storage dir) shows up within minutes all the same.
+const pageCacheMaxAge = 10 * time.Minute
+
+func articleDep(slug string) string { return "article:" + slug }
+
+// pageDeps maps a cached path to the content it was built from.
+func pageDeps(path string) []string {
+	if slug, ok := strings.CutPrefix(path, "/article/"); ok {
+		return []string{articleDep(slug)}
+	}
+	return []string{depList}
+}
+
+type cachedPage struct {
+	key          string
+	deps         []string
+	contentType  string
+	etag         string
+	cacheControl string
+	modified     time.Time
+	expires      time.Time
+	body         []byte
+}
+
+// PageCacheStats is shown on the admin dashboard.
+type PageCacheStats struct {
+	Hits, Misses, Evictions, Invalidations uint64
+	Entries, Bytes, MaxBytes               int
+}
+
+// HitRatio is the share of lookups served from the cache, in percent.
+func (s PageCacheStats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return 100 * float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+type pageCache struct {
+	mu    sync.Mutex
+	lru   *list.List // front is most recently used
+	items map[string]*list.Element
+	byDep map[string]map[string]bool // dep -> keys
+	bytes int
+	// gen changes on every invalidation, so a page rendered before one is
+	// not stored after it
+	gen   uint64
+	stamp time.Time // mtime of the stamp file as this process last saw it
+	stats PageCacheStats
+}
+
+func pageStampPath() string { return filepath.Join(metaDir(), "pagecache.stamp") }
+
+// stampTime is the stamp file's mtime, or zero if there is none yet.
+func stampTime() time.Time {
+	fi, err := os.Stat(pageStampPath())
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+var pages = newPageCache()
+
+func newPageCache() *pageCache {
+	return &pageCache{lru: list.New(), items: map[string]*list.Element{}, byDep: map[string]map[string]bool{}}
+}
+
+func (c *pageCache) get(key string) (*cachedPage, bool) {
+	stamp := stampTime()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !stamp.Equal(c.stamp) {
+		c.stats.Invalidations += uint64(len(c.items))
+		c.clear()
+		c.stamp = stamp
+	}
+	el, ok := c.items[key]
+	if ok {
+		if p := el.Value.(*cachedPage); time.Now().After(p.expires) {
+			c.remove(el)
+			ok = false
+		}
+	}
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	c.stats.Hits++
+	c.lru.MoveToFront(el)
+	return el.Value.(*cachedPage), true
+}
+
+// generation returns the value to pass to put for a page about to render.
+func (c *pageCache) generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// put stores p unless content changed since gen or it can never fit.
+func (c *pageCache) put(p *cachedPage, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	limit := cfg.PageCacheBytes
+	if gen != c.gen || len(p.body) > limit {
+		return
+	}
+	if el, ok := c.items[p.key]; ok {
+		c.remove(el)
+	}
+	c.items[p.key] = c.lru.PushFront(p)
+	c.bytes += len(p.body)
+	for _, d := range p.deps {
+		if c.byDep[d] == nil {
+			c.byDep[d] = map[string]bool{}
+		}
+		c.byDep[d][p.key] = true
+	}
+	for c.bytes > limit {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+// remove drops one entry; callers hold c.mu.
+func (c *pageCache) remove(el *list.Element) {
+	p := c.lru.Remove(el).(*cachedPage)
+	delete(c.items, p.key)
+	c.bytes -= len(p.body)
+	for _, d := range p.deps {
+		delete(c.byDep[d], p.key)
+		if len(c.byDep[d]) == 0 {
+			delete(c.byDep, d)
+		}
+	}
+}
+
+// invalidate drops every page built from any of deps, here and in any
+// other process serving the same storage dir.
+func (c *pageCache) invalidate(deps ...string) {
+	c.mu.Lock()
+	c.gen++
+	for _, d := range deps {
+		for key := range c.byDep[d] {
+			if el, ok := c.items[key]; ok {
+				c.remove(el)
+				c.stats.Invalidations++
+			}
+		}
+	}
+	c.mu.Unlock()
+	c.touch()
+}
+
+// reset empties the cache, e.g. when the storage directory is swapped.
+func (c *pageCache) reset() {
+	c.mu.Lock()
+	c.clear()
+	c.mu.Unlock()
+	c.touch()
+}
+
+// clear drops every entry; callers hold c.mu.
+func (c *pageCache) clear() {
+	c.gen++
+	c.lru.Init()
+	c.items = map[string]*list.Element{}
+	c.byDep = map[string]map[string]bool{}
+	c.bytes = 0
+}
+
+// touch rewrites the stamp file so other processes drop their pages, and
+// remembers its mtime so this one keeps its own. If another process wrote
+// the stamp in between, the token read back differs and the next lookup
+// empties this cache too.
+func (c *pageCache) touch() {
+	token := strconv.Itoa(os.Getpid()) + "-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	if err := os.MkdirAll(metaDir(), 0o700); err != nil {
+		return
+	}
+	if err := writeFileAtomic(pageStampPath(), []byte(token), 0o600); err != nil {
+		return
+	}
+	stamp := stampTime()
+	b, err := os.ReadFile(pageStampPath())
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil && string(b) == token {
+		c.stamp = stamp
+	} else {
+		c.stamp = time.Time{}
+	}
+}
+
+func (c *pageCache) snapshot() PageCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stats
+	s.Entries, s.Bytes, s.MaxBytes = len(c.items), c.bytes, cfg.PageCacheBytes
+	return s
+}
+
+// articleChanged invalidates the pages affected by a write to slug.
+func articleChanged(slug string) {
+	pages.invalidate(articleDep(slug), depList)
+}
+
+// --------------------------- Middleware ------------------------
+
+// pageRecorder passes the response through while keeping a copy of it.
+// Headers are copied as the handler set them, before outer middleware such
+// as compress rewrites them.
+type pageRecorder struct {
+	http.ResponseWriter
+	status int
+	header http.Header
+	body   bytes.Buffer
+	ttl    time.Duration
+}
+
+func (p *pageRecorder) WriteHeader(code int) {
+	if p.status == 0 {
+		p.status = code
+		p.header = p.Header().Clone()
+	}
+	p.ResponseWriter.WriteHeader(code)
+}
+
+func (p *pageRecorder) Write(b []byte) (int, error) {
+	if p.status == 0 {
+		p.WriteHeader(http.StatusOK)
+	}
+	p.body.Write(b)
+	return p.ResponseWriter.Write(b)
+}
+
+func (p *pageRecorder) Unwrap() http.ResponseWriter { return p.ResponseWriter }
+
+// limitCache keeps the page being rendered to w in the page cache for at
+// most d rather than pageCacheMaxAge, for pages that embed something
+// short-lived.
+func limitCache(w http.ResponseWriter, d time.Duration) {
+	for {
+		if p, ok := w.(*pageRecorder); ok {
+			p.ttl = d
+			return
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return
+		}
+		w = u.Unwrap()
+	}
+}
+
+// cached serves a guest route from the page cache. Logged-in admins bypass
+// it in both directions, and only complete public 200 GET responses are
+// stored; conditional requests on a hit are answered by ServeContent.
+func cached(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cfg.PageCacheBytes <= 0 || (r.Method != http.MethodGet && r.Method != http.MethodHead) || isAuthed(r) || isStaticBuild(r.Context()) {
+			next(w, r)
+			return
+		}
+		key := r.URL.Path
+		if r.URL.RawQuery != "" {
+			key += "?" + r.URL.RawQuery
+		}
+		if p, ok := pages.get(key); ok {
+			h := w.Header()
+			h.Set("Content-Type", p.contentType)
+			h.Set("Cache-Control", p.cacheControl)
+			h.Set("ETag", p.etag)
+			h.Set("X-Cache", "HIT")
+			http.ServeContent(w, r, "", p.modified, bytes.NewReader(p.body))
+			return
+		}
+		w.Header().Set("X-Cache", "MISS")
+		gen := pages.generation()
+		rec := &pageRecorder{ResponseWriter: w}
+		next(rec, r)
+		h := rec.header
+		if rec.status != http.StatusOK || r.Method != http.MethodGet || r.Header.Get("Range") != "" || !strings.HasPrefix(h.Get("Cache-Control"), "public") {
+			return
+		}
+		modified, _ := http.ParseTime(h.Get("Last-Modified"))
+		ttl := pageCacheMaxAge
+		if rec.ttl > 0 && rec.ttl < ttl {
+			ttl = rec.ttl
+		}
+		pages.put(&cachedPage{
+			key:          key,
+			deps:         pageDeps(r.URL.Path),
+			contentType:  h.Get("Content-Type"),
+			etag:         h.Get("ETag"),
+			cacheControl: h.Get("Cache-Control"),
+			modified:     modified,
+			expires:      time.Now().Add(ttl),
+			body:         rec.body.Bytes(),
+		}, gen)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func xCache(t *testing.T, base, path string, header map[string]string) (string, string) {
+	t.Helper()
+	resp, body := rawGet(t, base+path, header)
+	return resp.Header.Get("X-Cache"), body
+}
+
+func TestPageCache_HitsAndPreciseInvalidation(t *testing.T) {
+	resetStorage(t)
+	ts := httptest.NewServer(buildMux())
+	defer ts.Close()
+
+	pub := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	a := Article{Title: "Alpha", Slug: "alpha", Content: "a", Published: pub}
+	b := Article{Title: "Beta", Slug: "beta", Content: "b", Published: pub}
+	for _, x := range []Article{a, b} {
+		if err := saveArticle(x); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := pages.snapshot()
+	for _, p := range []string{"/", "/article/alpha", "/article/beta"} {
+		if got, _ := xCache(t, ts.URL, p, nil); got != "MISS" {
+			t.Fatalf("first %s: X-Cache=%q", p, got)
+		}
+		if got, _ := xCache(t, ts.URL, p, nil); got != "HIT" {
+			t.Fatalf("second %s: X-Cache=%q", p, got)
+		}
+	}
+	if s := pages.snapshot(); s.Hits-before.Hits != 3 || s.Misses-before.Misses != 3 || s.Entries != 3 {
+		t.Fatalf("stats after warm-up: %+v", s)
+	}
+
+	// editing beta drops beta and the listing, but alpha stays cached
+	b.Title = "Beta Revised"
+	if err := saveArticle(b); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := xCache(t, ts.URL, "/article/alpha", nil); got != "HIT" {
+		t.Fatalf("unrelated article was invalidated: %q", got)
+	}
+	if got, body := xCache(t, ts.URL, "/", nil); got != "MISS" || !strings.Contains(body, "Beta Revised") {
+		t.Fatalf("home after edit: %q", got)
+	}
+	if got, body := xCache(t, ts.URL, "/article/beta", nil); got != "MISS" || !strings.Contains(body, "Beta Revised") {
+		t.Fatalf("article after edit: %q", got)
+	}
+
+	if err := deleteArticle("alpha"); err != nil {
+		t.Fatal(err)
+	}
+	if resp, _ := rawGet(t, ts.URL+"/article/alpha", nil); resp.StatusCode != http.StatusGone {
+		t.Fatalf("deleted article served from cache: %d", resp.StatusCode)
+	}
+
+	// compressed hits carry the same single-suffixed tag as the miss did
+	_, _ = xCache(t, ts.URL, "/article/beta", nil)
+	r1, _ := rawGet(t, ts.URL+"/article/beta", map[string]string{"Accept-Encoding": "gzip"})
+	if r1.Header.Get("X-Cache") != "HIT" || strings.Count(r1.Header.Get("ETag"), "-gzip") != 1 {
+		t.Fatalf("gzip hit headers: %v", r1.Header)
+	}
+	if r2, _ := rawGet(t, ts.URL+"/article/beta", map[string]string{"Accept-Encoding": "gzip", "If-None-Match": r1.Header.Get("ETag")}); r2.StatusCode != http.StatusNotModified {
+		t.Fatalf("revalidating a cached page=%d, want 304", r2.StatusCode)
+	}
+}
+
+func TestPageCache_AdminBypassAndByteBound(t *testing.T) {
+	resetStorage(t)
+	saved := cfg
+	defer func() { cfg = saved }()
+	ts := httptest.NewServer(buildMux())
+	defer ts.Close()
+
+	pub := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	for _, slug := range []string{"one", "two"} {
+		if err := saveArticle(Article{Title: slug, Slug: slug, Content: strings.Repeat("x", 2000), Published: pub}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cookie := login(t, ts.URL, cfg.AdminUser, cfg.AdminPass)
+	if got, _ := xCache(t, ts.URL, "/article/one", map[string]string{"Cookie": cookie}); got != "" {
+		t.Fatalf("admin request used the cache: %q", got)
+	}
+	if pages.snapshot().Entries != 0 {
+		t.Fatal("admin request was stored")
+	}
+
+	// room for one article page only
+	_, body := xCache(t, ts.URL, "/article/one", nil)
+	cfg.PageCacheBytes = len(body) + len(body)/2
+	evicted := pages.snapshot().Evictions
+	xCache(t, ts.URL, "/article/two", nil)
+	if s := pages.snapshot(); s.Entries != 1 || s.Bytes > cfg.PageCacheBytes || s.Evictions != evicted+1 {
+		t.Fatalf("byte bound not enforced: %+v", s)
+	}
+	if got, _ := xCache(t, ts.URL, "/article/one", nil); got != "MISS" {
+		t.Fatalf("least recently used page should be evicted, got %q", got)
+	}
+
+	_, dash := getBody(t, ts.URL, "/admin", cookie)
+	if !strings.Contains(dash, "Page cache:") || !strings.Contains(dash, "misses") {
+		t.Fatalf("dashboard lacks cache stats: %s", dash)
+	}
+}
+
+func TestPageCache_WritesFromAnotherProcess(t *testing.T) {
+	resetStorage(t)
+	ts := httptest.NewServer(buildMux())
+	defer ts.Close()
+
+	pub := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	if err := saveArticle(Article{Title: "Old Post", Slug: "old-post", Content: "o", Published: pub}); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/", "/", "/article/old-post", "/article/old-post"} {
+		xCache(t, ts.URL, p, nil)
+	}
+	if got, _ := xCache(t, ts.URL, "/", nil); got != "HIT" {
+		t.Fatalf("warm-up: %q", got)
+	}
+
+	// the CLI runs as its own process with its own, empty cache
+	server := pages
+	cli := func(input string, args ...string) {
+		t.Helper()
+		pages = newPageCache()
+		defer func() { pages = server }()
+		if _, err := runCLI(t, input, args[0], args[1:]...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cli("hello", "new", "-title", "CLI Post")
+	if got, body := xCache(t, ts.URL, "/", nil); got != "MISS" || !strings.Contains(body, "CLI Post") {
+		t.Fatalf("home after a CLI write: %q", got)
+	}
+	if got, _ := xCache(t, ts.URL, "/", nil); got != "HIT" {
+		t.Fatalf("home is cached again: %q", got)
+	}
+
+	cli("", "delete", "old-post")
+	if resp, _ := rawGet(t, ts.URL+"/article/old-post", nil); resp.StatusCode != http.StatusGone || resp.Header.Get("X-Cache") != "MISS" {
+		t.Fatalf("article after a CLI delete: %d %q", resp.StatusCode, resp.Header.Get("X-Cache"))
+	}
+}
+
+func TestPageCache_EveryEntryExpires(t *testing.T) {
+	resetStorage(t)
+	ts := httptest.NewServer(buildMux())
+	defer ts.Close()
+	// a page without a comment form still gets the default bound
+	if err := saveArticle(Article{Title: "Plain", Slug: "plain", Content: "p", Published: time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), CommentsClosed: true}); err != nil {
+		t.Fatal(err)
+	}
+	xCache(t, ts.URL, "/", nil)
+	xCache(t, ts.URL, "/article/plain", nil)
+
+	pages.mu.Lock()
+	for _, key := range []string{"/", "/article/plain"} {
+		el, ok := pages.items[key]
+		if !ok {
+			pages.mu.Unlock()
+			t.Fatalf("%s not cached", key)
+		}
+		p := el.Value.(*cachedPage)
+		if p.expires.IsZero() || p.expires.After(time.Now().Add(pageCacheMaxAge)) {
+			pages.mu.Unlock()
+			t.Fatalf("%s expires %v, want within %v", key, p.expires, pageCacheMaxAge)
+		}
+		p.expires = time.Now().Add(-time.Second)
+	}
+	pages.mu.Unlock()
+
+	// a hand edit is picked up once the entry has expired
+	b, _ := os.ReadFile(filepath.Join(cfg.StorageDir, "plain.json"))
+	if err := os.WriteFile(filepath.Join(cfg.StorageDir, "plain.json"), []byte(strings.Replace(string(b), `"Plain"`, `"Edited By Hand"`, 1)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got, body := xCache(t, ts.URL, "/article/plain", nil); got != "MISS" || !strings.Contains(body, "Edited By Hand") {
+		t.Fatalf("expired entry: %q", got)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --------------------------- Login rate limiting ---------------
+
+// loginAttempts tracks failed logins for one key ("ip:..." or "user:...").
+type loginAttempts struct {
+	Key          string
+	Failures     int
+	LastFailure  time.Time
+	BlockedUntil time.Time
+}
+
+// Locked reports whether the key reached the lockout threshold rather than
+// just being in exponential backoff.
+func (a loginAttempts) Locked() bool { return a.Failures >= loginLockoutAfter }
+
+type loginLimiter struct {
+	mu        sync.Mutex
+	entries   map[string]*loginAttempts
+	now       func() time.Time
+	lastPrune time.Time
+}
+
+func newLoginLimiter() *loginLimiter {
+	return &loginLimiter{entries: map[string]*loginAttempts{}, now: time.Now}
+}
+
+// loginDelay returns how long a key must wait after its n-th consecutive failure.
+func loginDelay(n int) time.Duration {
+	if n >= loginLockoutAfter {
+		return loginLockoutFor
+	}
+	if n <= loginFreeAttempts {
+		return 0
+	}
+	d := loginBackoffBase << (n - loginFreeAttempts - 1)
+	if d <= 0 || d > loginBackoffMax { // <= 0 guards against shift overflow
+		d = loginBackoffMax
+	}
+	return d
+}
+
+// check returns how long the caller must wait before another attempt is
+// allowed for any of keys; zero means go ahead. A key that could not be
+// tracked because every slot holds a blocked key must wait too.
+func (l *loginLimiter) check(keys ...string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	var wait time.Duration
+	for _, k := range keys {
+		var d time.Duration
+		if a, ok := l.entries[k]; ok {
+			d = a.BlockedUntil.Sub(now)
+		} else {
+			d = l.roomLocked(now)
+		}
+		if d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// fail records a failed attempt for every key and reports whether any of
+// them just crossed into lockout.
+func (l *loginLimiter) fail(keys ...string) (locked bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if now.Sub(l.lastPrune) > time.Minute {
+		l.pruneLocked(now)
+	}
+	for _, k := range keys {
+		a, ok := l.entries[k]
+		if !ok {
+			if l.roomLocked(now) > 0 {
+				continue // check refuses the key until there is room
+			}
+			a = &loginAttempts{Key: k}
+			l.entries[k] = a
+		} else if now.After(a.BlockedUntil) && now.Sub(a.LastFailure) > loginFailureTTL {
+			a.Failures = 0 // idle long enough; not pruned yet
+		}
+		a.Failures++
+		a.LastFailure = now
+		a.BlockedUntil = now.Add(loginDelay(a.Failures))
+		if a.Failures == loginLockoutAfter {
+			locked = true
+		}
+	}
+	return locked
+}
+
+// succeed forgets the failure history of keys after a good login.
+func (l *loginLimiter) succeed(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, k := range keys {
+		delete(l.entries, k)
+	}
+}
+
+// clear removes a single key; it reports whether the key was known.
+func (l *loginLimiter) clear(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.entries[key]
+	delete(l.entries, key)
+	return ok
+}
+
+// blocked lists keys that currently may not attempt a login, longest wait first.
+func (l *loginLimiter) blocked() []loginAttempts {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	var out []loginAttempts
+	for _, a := range l.entries {
+		if a.BlockedUntil.After(now) {
+			out = append(out, *a)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].BlockedUntil.After(out[j].BlockedUntil) })
+	return out
+}
+
+// pruneLocked drops entries that are neither blocked nor recently failed.
+// Callers must hold l.mu.
+func (l *loginLimiter) pruneLocked(now time.Time) {
+	l.lastPrune = now
+	for k, a := range l.entries {
+		if now.After(a.BlockedUntil) && now.Sub(a.LastFailure) > loginFailureTTL {
+			delete(l.entries, k)
+		}
+	}
+}
+
+// roomLocked makes room for a new key once loginMaxKeys are tracked, so
+// floods of made-up usernames can't grow the map without bound. It prunes,
+// then drops the tenth of the unblocked entries that failed longest ago;
+// blocked keys are never dropped, since that would lift their lockout. If
+// every entry is blocked it returns how long until the first one frees up,
+// otherwise zero. Callers must hold l.mu.
+func (l *loginLimiter) roomLocked(now time.Time) time.Duration {
+	if len(l.entries) < loginMaxKeys {
+		return 0
+	}
+	l.pruneLocked(now)
+	if len(l.entries) < loginMaxKeys {
+		return 0
+	}
+	var free []*loginAttempts
+	next := loginLockoutFor
+	for _, a := range l.entries {
+		if d := a.BlockedUntil.Sub(now); d <= 0 {
+			free = append(free, a)
+		} else if d < next {
+			next = d
+		}
+	}
+	if len(free) == 0 {
+		return next
+	}
+	sort.Slice(free, func(i, j int) bool { return free[i].LastFailure.Before(free[j].LastFailure) })
+	for _, a := range free[:min(len(free), len(l.entries)/10+1)] {
+		delete(l.entries, a.Key)
+	}
+	return 0
+}
+
+// loginKeys returns the limiter keys for a login attempt.
+func loginKeys(ip, user string) []string {
+	return []string{"ip:" + ip, "user:" + strings.ToLower(user)}
+}
+
+// --------------------------- Client IP -------------------------
+
+// parseTrustedProxies turns addresses and CIDR ranges into prefixes.
+func parseTrustedProxies(list []string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if strings.Contains(s, "/") {
+			p, err := netip.ParsePrefix(s)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, p.Masked())
+			continue
+		}
+		a, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, err
+		}
+		a = a.Unmap()
+		out = append(out, netip.PrefixFrom(a, a.BitLen()))
+	}
+	return out, nil
+}
+
+func isTrustedProxy(host string) bool {
+	a, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	a = a.Unmap()
+	for _, p := range cfg.proxies {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client that made r. Forwarding headers
+// are only honoured when the direct peer is a trusted proxy, and the chain is
+// walked from the nearest hop outwards so a client cannot spoof its address by
+// sending its own X-Forwarded-For.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrustedProxy(host) {
+		return host
+	}
+	hops := forwardedHops(r)
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !isTrustedProxy(hops[i]) {
+			return hops[i]
+		}
+	}
+	if len(hops) > 0 {
+		return hops[0]
+	}
+	return host
+}
+
+// forwardedHops lists the client addresses recorded by proxies, client first.
+// The standard Forwarded header wins over X-Forwarded-For when both are set.
+func forwardedHops(r *http.Request) []string {
+	var hops []string
+	if vals := r.Header.Values("Forwarded"); len(vals) > 0 {
+		for _, elem := range strings.Split(strings.Join(vals, ","), ",") {
+			for _, pair := range strings.Split(elem, ";") {
+				k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(k, "for") {
+					hops = append(hops, stripHostPort(strings.Trim(v, `"`)))
+				}
+			}
+		}
+		return hops
+	}
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for _, h := range strings.Split(v, ",") {
+			if h = strings.TrimSpace(h); h != "" {
+				hops = append(hops, stripHostPort(h))
+			}
+		}
+	}
+	return hops
+}
+
+// stripHostPort removes an optional port and IPv6 brackets from a node name
+// such as "[2001:db8::1]:4711" or "192.0.2.1:80".
+func stripHostPort(s string) string {
+	if h, _, err := net.SplitHostPort(s); err == nil {
+		return h
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClock lets tests move the limiter through its backoff windows.
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func TestLoginLimiter_BackoffAndLockout(t *testing.T) {
+	clk := &fakeClock{t: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+	l := newLoginLimiter()
+	l.now = clk.now
+
+	for i := 0; i < loginFreeAttempts; i++ {
+		l.fail("user:admin")
+		if wait := l.check("user:admin"); wait != 0 {
+			t.Fatalf("failure %d: wait=%s, want 0 within free attempts", i+1, wait)
+		}
+	}
+	l.fail("user:admin")
+	if wait := l.check("user:admin"); wait != loginBackoffBase {
+		t.Fatalf("first backoff wait=%s, want %s", wait, loginBackoffBase)
+	}
+	l.fail("user:admin")
+	if wait := l.check("user:admin"); wait != 2*loginBackoffBase {
+		t.Fatalf("second backoff wait=%s, want %s", wait, 2*loginBackoffBase)
+	}
+
+	var locked bool
+	for i := loginFreeAttempts + 2; i < loginLockoutAfter; i++ {
+		locked = l.fail("user:admin")
+	}
+	if !locked {
+		t.Fatalf("expected lockout after %d failures", loginLockoutAfter)
+	}
+	if wait := l.check("ip:192.0.2.1", "user:admin"); wait != loginLockoutFor {
+		t.Fatalf("lockout wait=%s, want %s", wait, loginLockoutFor)
+	}
+	if b := l.blocked(); len(b) != 1 || !b[0].Locked() {
+		t.Fatalf("blocked()=%+v, want one locked entry", b)
+	}
+
+	clk.advance(loginLockoutFor + time.Second)
+	if wait := l.check("user:admin"); wait != 0 {
+		t.Fatalf("wait after lockout expired=%s, want 0", wait)
+	}
+	l.succeed("user:admin")
+	if b := l.blocked(); len(b) != 0 {
+		t.Fatalf("blocked() after success=%+v, want none", b)
+	}
+}
+
+func TestLoginLimiter_BoundedKeys(t *testing.T) {
+	clk := &fakeClock{t: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+	l := newLoginLimiter()
+	l.now = clk.now
+
+	for i := range 3 * loginMaxKeys {
+		clk.advance(time.Millisecond)
+		l.fail("ip:203.0.113.9", fmt.Sprintf("user:spoof%d", i))
+	}
+	if n := len(l.entries); n > loginMaxKeys {
+		t.Fatalf("%d entries, want at most %d", n, loginMaxKeys)
+	}
+	if wait := l.check("ip:203.0.113.9"); wait != loginLockoutFor {
+		t.Fatalf("the flooding IP lost its lockout: wait=%s", wait)
+	}
+	if _, ok := l.entries["user:spoof0"]; ok {
+		t.Fatal("the oldest key was kept")
+	}
+}
+
+func TestLoginLimiter_FullMapKeepsLockouts(t *testing.T) {
+	clk := &fakeClock{t: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+	l := newLoginLimiter()
+	l.now = clk.now
+
+	for range loginLockoutAfter {
+		l.fail("user:admin")
+	}
+	// the oldest failure of all, then a flood of made-up usernames
+	for i := range 2 * loginMaxKeys {
+		clk.advance(time.Millisecond)
+		l.fail(fmt.Sprintf("user:spoof%d", i))
+	}
+	if wait := l.check("user:admin"); wait <= 0 {
+		t.Fatal("the flood evicted a locked key")
+	}
+
+	// with every slot blocked, unknown keys are refused rather than tracked
+	l = newLoginLimiter()
+	l.now = clk.now
+	for i := range loginMaxKeys {
+		for range loginFreeAttempts + 1 {
+			l.fail(fmt.Sprintf("user:spoof%d", i))
+		}
+	}
+	if wait := l.check("ip:198.51.100.7", "user:new"); wait <= 0 || wait > loginBackoffBase {
+		t.Fatalf("full map: wait=%s", wait)
+	}
+	if l.fail("user:new"); len(l.entries) != loginMaxKeys || l.entries["user:new"] != nil {
+		t.Fatalf("a new key displaced a blocked one: %d entries", len(l.entries))
+	}
+	clk.advance(loginBackoffBase + time.Millisecond)
+	if wait := l.check("user:new"); wait != 0 {
+		t.Fatalf("after the backoff: wait=%s", wait)
+	}
+}
+
+func TestClientIP_TrustedProxies(t *testing.T) {
+	saved := cfg.proxies
+	defer func() { cfg.proxies = saved }()
+	nets, err := parseTrustedProxies([]string{"10.0.0.0/8", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.proxies = nets
+
+	cases := []struct {
+		remote string
+		header string
+		value  string
+		want   string
+	}{
+		{"203.0.113.9:5000", "X-Forwarded-For", "198.51.100.1", "203.0.113.9"},
+		{"10.0.0.2:5000", "X-Forwarded-For", "198.51.100.1, 203.0.113.7, 10.0.0.5", "203.0.113.7"},
+		{"10.0.0.2:5000", "Forwarded", `for=198.51.100.1, for="[2001:db8::1]:4711";proto=https`, "2001:db8::1"},
+		{"[::1]:5000", "X-Forwarded-For", "10.1.1.1", "10.1.1.1"},
+		{"10.0.0.2:5000", "", "", "10.0.0.2"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = c.remote
+		if c.header != "" {
+			r.Header.Set(c.header, c.value)
+		}
+		if got := clientIP(r); got != c.want {
+			t.Errorf("clientIP(%s, %s=%q)=%q, want %q", c.remote, c.header, c.value, got, c.want)
+		}
+	}
+}
+
+func TestAdmin_Login_Throttled_And_Cleared(t *testing.T) {
+	resetStorage(t)
+	saved := limiter
+	defer func() { limiter = saved }()
+	clk := &fakeClock{t: time.Now()}
+	limiter = newLoginLimiter()
+	limiter.now = clk.now
+
+	ts := httptest.NewServer(buildMux())
+	defer ts.Close()
+
+	post := func(pass string) *http.Response {
+		t.Helper()
+		client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse }}
+		resp, err := client.PostForm(ts.URL+"/admin/login", url.Values{"username": {cfg.AdminUser}, "password": {pass}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	for i := 0; i <= loginFreeAttempts; i++ {
+		resp := post("wrong")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("failed attempt %d status=%d, want 200", i+1, resp.StatusCode)
+		}
+	}
+	resp := post(cfg.AdminPass)
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("throttled status=%d, want 429", resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") == "" || !strings.Contains(string(b), "Too many failed attempts") {
+		t.Fatalf("throttled response missing Retry-After or message: %s", string(b))
+	}
+
+	// Let the backoff expire, log in, and clear the IP entry from the dashboard.
+	clk.advance(loginBackoffMax)
+	cookie := login(t, ts.URL, cfg.AdminUser, cfg.AdminPass)
+	limiter.fail("ip:198.51.100.1")
+	for i := 0; i < loginLockoutAfter; i++ {
+		limiter.fail("user:mallory")
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/admin", nil)
+	req.Header.Set("Cookie", cookie)
+	dash, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(dash.Body)
+	dash.Body.Close()
+	if !strings.Contains(string(body), "user:mallory") || !strings.Contains(string(body), "(locked)") {
+		t.Fatalf("dashboard should list the lockout: %s", string(body))
+	}
+
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse }}
+	clr, _ := http.NewRequest(http.MethodPost, ts.URL+"/admin/lockouts/clear", strings.NewReader(url.Values{"key": {"user:mallory"}}.Encode()))
+	clr.Header.Set("Cookie", cookie)
+	clr.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	cresp, err := client.Do(clr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cresp.Body.Close()
+	if cresp.StatusCode != http.StatusFound {
+		t.Fatalf("clear status=%d, want 302", cresp.StatusCode)
+	}
+	if wait := limiter.check("user:mallory"); wait != 0 {
+		t.Fatalf("user:mallory still blocked for %s after clear", wait)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// --------------------------- Schema & migrations ---------------
+// Article files carry a "schema" field. Files from an older schema are
+// upgraded in memory when loaded and rewritten by `blog migrate`; files
+// from a newer one are refused rather than read with missing fields.
+
+// schemaVersion is the storage layout this binary reads and writes. Bump it
+// together with a new entry in articleMigrations; backups and restores
+// record it too.
+const schemaVersion = 2
+
+// storedArticle is an Article as written to disk.
+type storedArticle struct {
+	Schema int `json:"schema"`
+	Article
+	MovedTo string `json:"moved_to,omitempty"` // tombstones only: the slug a renamed article lives on as
+}
+
+// articleMigration upgrades a decoded article document from version From
+// to From+1 in place.
+type articleMigration struct {
+	From int
+	Note string
+	Up   func(doc map[string]any) error
+}
+
+// articleMigrations are applied in order; entry i upgrades version i+1.
+var articleMigrations = []articleMigration{
+	{From: 1, Note: "record updated_at explicitly instead of falling back to published", Up: func(doc map[string]any) error {
+		if s, _ := doc["updated_at"].(string); s == "" || strings.HasPrefix(s, "0001-01-01") {
+			if pub, ok := doc["published"]; ok {
+				doc["updated_at"] = pub
+			}
+		}
+		return nil
+	}},
+}
+
+// errNewerSchema is returned for data written by a newer binary.
+var errNewerSchema = errors.New("written by a newer version of the blog; upgrade the binary")
+
+// docSchema reads the schema field; files from before it existed are 1.
+func docSchema(b []byte) (int, error) {
+	var v struct {
+		Schema int `json:"schema"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return 0, err
+	}
+	if v.Schema == 0 {
+		return 1, nil
+	}
+	return v.Schema, nil
+}
+
+// upgradeArticle returns b in the current schema, running every migration
+// from its version on, and the version b was at.
+func upgradeArticle(b []byte) ([]byte, int, error) {
+	from, err := docSchema(b)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch {
+	case from > schemaVersion:
+		return nil, from, fmt.Errorf("schema %d (this binary reads up to %d): %w", from, schemaVersion, errNewerSchema)
+	case from == schemaVersion:
+		return b, from, nil
+	}
+	var doc map[string]any
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, from, err
+	}
+	for v := from; v < schemaVersion; v++ {
+		m := articleMigrations[v-1]
+		if err := m.Up(doc); err != nil {
+			return nil, from, fmt.Errorf("migrating schema %d to %d: %v", v, v+1, err)
+		}
+	}
+	doc["schema"] = schemaVersion
+	out, err := json.Marshal(doc)
+	return out, from, err
+}
+
+// decodeArticle reads an article file of any supported schema.
+func decodeArticle(b []byte) (Article, error) {
+	s, err := decodeStored(b)
+	return s.Article, err
+}
+
+// decodeStored is decodeArticle keeping the envelope, for tombstones.
+func decodeStored(b []byte) (storedArticle, error) {
+	b, _, err := upgradeArticle(b)
+	if err != nil {
+		return storedArticle{}, err
+	}
+	var s storedArticle
+	err = json.Unmarshal(b, &s)
+	return s, err
+}
+
+// encodeArticle writes a in the current schema.
+func encodeArticle(a Article) ([]byte, error) {
+	if a.UpdatedAt.IsZero() {
+		a.UpdatedAt = a.Published
+	}
+	return json.MarshalIndent(storedArticle{Schema: schemaVersion, Article: a}, "", "  ")
+}
+
+// checkSchema refuses storage holding articles from a newer schema and
+// counts those from an older one.
+func checkSchema() (outdated int, err error) {
+	err = walkArticles(func(path string, b []byte) error {
+		v, err := docSchema(b)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if v > schemaVersion {
+			return fmt.Errorf("%s has schema %d (this binary reads up to %d): %w", path, v, schemaVersion, errNewerSchema)
+		}
+		if v < schemaVersion {
+			outdated++
+		}
+		return nil
+	})
+	return outdated, err
+}
+
+// --------------------------- Commands (migrate) ----------------
+
+// runMigrate rewrites every article file from an older schema, after
+// writing a backup of the storage dir.
+func runMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "only list the files that would be upgraded")
+	out := fs.String("backup", "", "backup to write before migrating (default blog-backup-<time>.tar.gz)")
+	configure(fs, args)
+
+	var pending []string
+	var n int
+	err := walkArticles(func(path string, b []byte) error {
+		n++
+		_, from, err := upgradeArticle(b)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if from < schemaVersion {
+			pending = append(pending, path)
+			fmt.Fprintf(stdout, "upgrade  %s (schema %d -> %d)\n", path, from, schemaVersion)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		fmt.Fprintf(stdout, "%d article files, all at schema %d\n", n, schemaVersion)
+		return nil
+	}
+	if *dryRun {
+		fmt.Fprintf(stdout, "dry run: %d of %d files would be upgraded\n", len(pending), n)
+		return nil
+	}
+
+	if *out == "" {
+		*out = backupName()
+	}
+	files, m, err := snapshotStorage()
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := writeBackup(&buf, files, m); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(*out, buf.Bytes(), 0o600); err != nil {
+		return fmt.Errorf("backup before migrating: %v", err)
+	}
+	fmt.Fprintf(stdout, "wrote backup %s\n", *out)
+
+	if err := rewriteArticles(pending); err != nil {
+		return err
+	}
+	auditCLI("storage.migrate", "", fmt.Sprintf("%d files to schema %d, backup %s", len(pending), schemaVersion, filepath.Base(*out)))
+	fmt.Fprintf(stdout, "%d of %d files upgraded to schema %d\n", len(pending), n, schemaVersion)
+	return nil
+}
+
+// rewriteArticles reads each file and writes it back in the current schema.
+func rewriteArticles(paths []string) error {
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	for _, p := range paths {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		a, err := decodeArticle(b)
+		if err != nil {
+			return fmt.Errorf("%s: %v", p, err)
+		}
+		nb, err := encodeArticle(a)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(p, nb, 0o644); err != nil {
+			return err
+		}
+		articleChanged(a.Slug)
+	}
+	return nil
+}
+
+// logSchema is run at startup: newer data stops the server, older data is
+// upgraded on load and only mentioned.
+func logSchema() error {
+	outdated, err := checkSchema()
+	if err != nil {
+		return err
+	}
+	if outdated > 0 {
+		slog.Info("article files use an older schema; they are upgraded when read, run `blog migrate` to rewrite them",
+			"files", outdated, "schema", schemaVersion)
+	}
+	return nil
+}
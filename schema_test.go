@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Every migration needs a case here; the test fails when one is added
+// without it.
+func TestArticleMigrations(t *testing.T) {
+	cases := []struct {
+		from    int
+		in, out string
+	}{
+		{1,
+			`{"title":"T","slug":"t","content":"c","published":"2020-01-02T03:04:05Z"}`,
+			`{"title":"T","slug":"t","content":"c","published":"2020-01-02T03:04:05Z","updated_at":"2020-01-02T03:04:05Z"}`},
+		{1,
+			`{"title":"T","published":"2020-01-02T03:04:05Z","updated_at":"2021-01-01T00:00:00Z"}`,
+			`{"title":"T","published":"2020-01-02T03:04:05Z","updated_at":"2021-01-01T00:00:00Z"}`},
+		{1, `{"title":"no date"}`, `{"title":"no date"}`},
+	}
+	covered := map[int]bool{}
+	for _, c := range cases {
+		covered[c.from] = true
+		var doc, want map[string]any
+		if err := json.Unmarshal([]byte(c.in), &doc); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal([]byte(c.out), &want); err != nil {
+			t.Fatal(err)
+		}
+		if err := articleMigrations[c.from-1].Up(doc); err != nil {
+			t.Fatalf("migration from %d on %s: %v", c.from, c.in, err)
+		}
+		if !reflect.DeepEqual(doc, want) {
+			t.Fatalf("migration from %d on %s:\ngot  %v\nwant %v", c.from, c.in, doc, want)
+		}
+	}
+	for i, m := range articleMigrations {
+		if m.From != i+1 || m.Note == "" {
+			t.Fatalf("migration %d: From=%d, want %d and a note", i, m.From, i+1)
+		}
+		if !covered[m.From] {
+			t.Fatalf("migration from schema %d has no test case", m.From)
+		}
+	}
+	if len(articleMigrations) != schemaVersion-1 {
+		t.Fatalf("%d migrations for schema %d", len(articleMigrations), schemaVersion)
+	}
+}
+
+const legacyArticle = `{
+  "title": "Old",
+  "slug": "old",
+  "content": "from before schemas",
+  "published": "2019-06-01T00:00:00Z"
+}`
+
+func TestSchema_OldFilesUpgradeOnLoad(t *testing.T) {
+	resetStorage(t)
+	p := filepath.Join(cfg.StorageDir, "old.json")
+	if err := os.WriteFile(p, []byte(legacyArticle), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	a, err := loadArticle("old")
+	if err != nil || a.Content != "from before schemas" || !a.UpdatedAt.Equal(time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("load: %+v, %v", a, err)
+	}
+	if b, _ := os.ReadFile(p); string(b) != legacyArticle {
+		t.Fatal("loading must not rewrite the file")
+	}
+	if n, err := checkSchema(); err != nil || n != 1 {
+		t.Fatalf("checkSchema: %d outdated, %v", n, err)
+	}
+
+	if err := saveArticle(a); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(p); !strings.Contains(string(b), `"schema": 2`) {
+		t.Fatalf("saved file has no schema:\n%s", b)
+	}
+}
+
+func TestSchema_MigrateCommandBacksUpFirst(t *testing.T) {
+	resetStorage(t)
+	if err := os.WriteFile(filepath.Join(cfg.StorageDir, "old.json"), []byte(legacyArticle), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveArticle(Article{Title: "New", Slug: "new", Content: "n", Published: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := runCLI(t, "", "migrate", "-dry-run")
+	if err != nil || !strings.Contains(out, "old.json (schema 1 -> 2)") || !strings.Contains(out, "1 of 2 files would be upgraded") {
+		t.Fatalf("dry run: %v\n%s", err, out)
+	}
+	if n, _ := checkSchema(); n != 1 {
+		t.Fatal("dry run rewrote files")
+	}
+
+	archive := filepath.Join(t.TempDir(), "pre-migrate.tar.gz")
+	out, err = runCLI(t, "", "migrate", "-backup", archive)
+	if err != nil || !strings.Contains(out, "1 of 2 files upgraded to schema 2") {
+		t.Fatalf("migrate: %v\n%s", err, out)
+	}
+	if n, _ := checkSchema(); n != 0 {
+		t.Fatalf("%d files still outdated", n)
+	}
+	f, err := os.Open(archive)
+	if err != nil {
+		t.Fatalf("no backup: %v", err)
+	}
+	defer f.Close()
+	_, files, err := readBackup(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kept bool
+	for _, sf := range files {
+		kept = kept || (sf.Path == "old.json" && string(sf.body) == legacyArticle)
+	}
+	if !kept {
+		t.Fatal("backup does not hold the pre-migration file")
+	}
+	if entries, _ := readAudit(auditFilter{Action: "storage.migrate"}); len(entries) != 1 {
+		t.Fatal("migration not audited")
+	}
+	if out, err := runCLI(t, "", "migrate"); err != nil || !strings.Contains(out, "all at schema 2") {
+		t.Fatalf("second run: %v\n%s", err, out)
+	}
+}
+
+func TestSchema_RefusesNewerData(t *testing.T) {
+	resetStorage(t)
+	newer := `{"schema": 99, "title": "Future", "slug": "future", "content": "x", "published": "2030-01-01T00:00:00Z"}`
+	if err := os.WriteFile(filepath.Join(cfg.StorageDir, "future.json"), []byte(newer), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checkSchema(); !errors.Is(err, errNewerSchema) {
+		t.Fatalf("checkSchema: %v", err)
+	}
+	if _, err := loadArticle("future"); !errors.Is(err, errNewerSchema) {
+		t.Fatalf("load: %v", err)
+	}
+	archive := filepath.Join(t.TempDir(), "b.tar.gz")
+	if _, err := runCLI(t, "", "migrate", "-backup", archive); !errors.Is(err, errNewerSchema) {
+		t.Fatalf("migrate: %v", err)
+	}
+	if _, err := os.Stat(archive); err == nil {
+		t.Fatal("migrate went ahead with newer data")
+	}
+}
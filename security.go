@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// --------------------------- Security headers ------------------
+
+// defaultCSP is the policy used when csp is not configured. {nonce} is
+// replaced per request; frame-ancestors and report-uri are appended by
+// contentSecurityPolicy so they follow their own settings.
+const defaultCSP = "default-src 'none'; script-src 'nonce-{nonce}'; style-src 'self' 'nonce-{nonce}'; img-src 'self' data:; font-src 'self'; connect-src 'self'; form-action 'self'; base-uri 'none'; object-src 'none'"
+
+// cspReportLimit caps the size of a violation report body.
+const cspReportLimit = 64 << 10
+
+type nonceKey struct{}
+
+// cspNonce returns the nonce of the current request, for templates that
+// need an inline <script> or <style>.
+func cspNonce(ctx context.Context) string {
+	n, _ := ctx.Value(nonceKey{}).(string)
+	return n
+}
+
+func newNonce() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// contentSecurityPolicy renders the configured policy for one nonce.
+func contentSecurityPolicy(nonce string) string {
+	policy := cfg.CSP
+	if policy == "" {
+		policy = defaultCSP
+	}
+	policy = strings.TrimRight(strings.TrimSpace(policy), ";")
+	policy = strings.ReplaceAll(policy, "{nonce}", nonce)
+	if cfg.FrameAncestors != "" {
+		policy += "; frame-ancestors " + cfg.FrameAncestors
+	}
+	return policy + "; report-uri /csp-report"
+}
+
+// requestIsTLS reports whether the client reached us over HTTPS, either
+// directly or through a trusted proxy that says so.
+func requestIsTLS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return isTrustedProxy(host) && strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+// securityHeaders sets the CSP (with a fresh nonce per request) and the other
+// hardening headers on every response. It sits outside instrument because it
+// replaces the request context.
+func securityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce := newNonce()
+		h := w.Header()
+		name := "Content-Security-Policy"
+		if cfg.CSPReportOnly {
+			name = "Content-Security-Policy-Report-Only"
+		}
+		h.Set(name, contentSecurityPolicy(nonce))
+		h.Set("X-Content-Type-Options", "nosniff")
+		// browsers ignore frame-ancestors in report-only mode, so keep the
+		// legacy header in step for the two common values
+		switch cfg.FrameAncestors {
+		case "'none'":
+			h.Set("X-Frame-Options", "DENY")
+		case "'self'":
+			h.Set("X-Frame-Options", "SAMEORIGIN")
+		}
+		if cfg.ReferrerPolicy != "" {
+			h.Set("Referrer-Policy", cfg.ReferrerPolicy)
+		}
+		if cfg.PermissionsPolicy != "" {
+			h.Set("Permissions-Policy", cfg.PermissionsPolicy)
+		}
+		if cfg.HSTSMaxAge > 0 && requestIsTLS(r) {
+			h.Set("Strict-Transport-Security", "max-age="+strconv.Itoa(cfg.HSTSMaxAge)+"; includeSubDomains")
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), nonceKey{}, nonce)))
+	})
+}
+
+// --------------------------- Handlers (Security) ---------------
+
+// cspReportHandler logs violation reports sent by browsers. Both the legacy
+// application/csp-report body and Reporting API arrays are accepted; the
+// body is logged as compact JSON, not interpreted.
+func cspReportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, cspReportLimit+1))
+	if err != nil || len(body) > cspReportLimit {
+		http.Error(w, "report too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, body); err != nil {
+		http.Error(w, "invalid report", http.StatusBadRequest)
+		return
+	}
+	slog.WarnContext(r.Context(), "csp violation", "report", buf.String(), "ip", clientIP(r), "user_agent", r.UserAgent())
+	w.WriteHeader(http.StatusNoContent)
+}
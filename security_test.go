@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSecurityHeaders_StrictCSPWithNonce(t *testing.T) {
+	resetStorage(t)
+	ts := httptest.NewServer(buildMux())
+	defer ts.Close()
+
+	nonces := map[string]bool{}
+	for range 2 {
+		resp, err := http.Get(ts.URL + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		csp := resp.Header.Get("Content-Security-Policy")
+		_, rest, ok := strings.Cut(csp, "'nonce-")
+		if !ok || !strings.Contains(csp, "default-src 'none'") || !strings.Contains(csp, "frame-ancestors 'none'") || !strings.Contains(csp, "report-uri /csp-report") {
+			t.Fatalf("unexpected CSP %q", csp)
+		}
+		nonces[rest[:strings.Index(rest, "'")]] = true
+		for h, want := range map[string]string{
+			"X-Content-Type-Options": "nosniff",
+			"X-Frame-Options":        "DENY",
+			"Referrer-Policy":        "strict-origin-when-cross-origin",
+		} {
+			if got := resp.Header.Get(h); got != want {
+				t.Fatalf("%s=%q, want %q", h, got, want)
+			}
+		}
+		if resp.Header.Get("Permissions-Policy") == "" {
+			t.Fatal("missing Permissions-Policy")
+		}
+		if resp.Header.Get("Strict-Transport-Security") != "" {
+			t.Fatal("HSTS must not be sent over plain HTTP")
+		}
+	}
+	if len(nonces) != 2 {
+		t.Fatalf("nonce should change per request: %v", nonces)
+	}
+
+	// the pages must work under the policy: no inline styles, stylesheet served
+	_, body := getBody(t, ts.URL, "/", "")
+	if strings.Contains(body, "style=") || strings.Contains(body, "<style") {
+		t.Fatalf("page has inline styles the CSP would block:\n%s", body)
+	}
+	resp, err := http.Get(ts.URL + "/static/style.css")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/css") {
+		t.Fatalf("stylesheet: %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+}
+
+func TestSecurityHeaders_ConfigurableReportOnlyAndHSTS(t *testing.T) {
+	saved := cfg
+	defer func() { cfg = saved }()
+	cfg.CSP = "default-src 'self'; script-src 'self' 'nonce-{nonce}'"
+	cfg.CSPReportOnly = true
+	cfg.FrameAncestors = "https://embed.example.com"
+	cfg.ReferrerPolicy = ""
+
+	ts := httptest.NewTLSServer(buildMux())
+	defer ts.Close()
+	resp, err := ts.Client().Get(ts.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.Header.Get("Content-Security-Policy") != "" {
+		t.Fatal("report-only mode must not enforce the policy")
+	}
+	csp := resp.Header.Get("Content-Security-Policy-Report-Only")
+	if !strings.HasPrefix(csp, "default-src 'self'; script-src 'self' 'nonce-") || !strings.Contains(csp, "frame-ancestors https://embed.example.com") {
+		t.Fatalf("custom CSP not applied: %q", csp)
+	}
+	if resp.Header.Get("X-Frame-Options") != "" || resp.Header.Get("Referrer-Policy") != "" {
+		t.Fatalf("disabled headers still sent: %v", resp.Header)
+	}
+	if got := resp.Header.Get("Strict-Transport-Security"); got != "max-age=31536000; includeSubDomains" {
+		t.Fatalf("HSTS over TLS=%q", got)
+	}
+
+	// behind a trusted proxy the forwarded scheme decides
+	cfg.HSTSMaxAge = 600
+	cfg.TrustedProxies = []string{"127.0.0.1"}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+	req.RemoteAddr = "127.0.0.1:4000"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	rec := httptest.NewRecorder()
+	buildMux().ServeHTTP(rec, req)
+	if got := rec.Header().Get("Strict-Transport-Security"); got != "max-age=600; includeSubDomains" {
+		t.Fatalf("HSTS behind proxy=%q", got)
+	}
+}
+
+func TestCSPReport_LogsViolations(t *testing.T) {
+	buf := captureLogs(t)
+	ts := httptest.NewServer(buildMux())
+	defer ts.Close()
+
+	report := `{"csp-report": {"document-uri": "https://blog.example.com/", "violated-directive": "script-src", "blocked-uri": "inline"}}`
+	resp, err := http.Post(ts.URL+"/csp-report", "application/csp-report", strings.NewReader(report))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("report status=%d, want 204", resp.StatusCode)
+	}
+	var found bool
+	for _, l := range logLines(t, buf) {
+		if l["msg"] == "csp violation" && strings.Contains(l["report"].(string), `"violated-directive":"script-src"`) {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("violation not logged: %s", buf.String())
+	}
+
+	resp, err = http.Post(ts.URL+"/csp-report", "application/csp-report", strings.NewReader("not json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("junk report status=%d, want 400", resp.StatusCode)
+	}
+	resp, err = http.Post(ts.URL+"/csp-report", "application/csp-report", strings.NewReader(strings.Repeat(" ", cspReportLimit+1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("oversized report status=%d, want 413", resp.StatusCode)
+	}
+}
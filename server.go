@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --------------------------- Server ----------------------------
+
+// draining is set once shutdown starts so /readyz takes the instance out of
+// rotation while in-flight requests finish.
+var draining atomic.Bool
+
+func seconds(n int) time.Duration { return time.Duration(n) * time.Second }
+
+// newServer wraps h in an http.Server with the configured timeouts, so slow
+// clients can't hold connections open indefinitely.
+func newServer(h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              cfg.ListenAddr,
+		Handler:           h,
+		ReadHeaderTimeout: seconds(cfg.ReadHeaderTimeout),
+		ReadTimeout:       seconds(cfg.ReadTimeout),
+		WriteTimeout:      seconds(cfg.WriteTimeout),
+		IdleTimeout:       seconds(cfg.IdleTimeout),
+	}
+}
+
+// serve runs srv on ln, over TLS when srv.TLSConfig is set, until ctx is
+// cancelled, then stops accepting new connections and waits up to the
+// shutdown timeout for in-flight requests.
+func serve(ctx context.Context, srv *http.Server, ln net.Listener) error {
+	errc := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			errc <- srv.ServeTLS(ln, "", "") // certificates come from TLSConfig
+			return
+		}
+		errc <- srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	draining.Store(true)
+	timeout := seconds(cfg.ShutdownTimeout)
+	slog.Info("shutting down; draining connections", "timeout", timeout)
+	sctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(sctx); err != nil {
+		return fmt.Errorf("shutdown: %w", err)
+	}
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// --------------------------- Background work --------------------
+
+// worker runs a job in the background of `blog serve`: at start, when woken
+// and every period, which picks up retries that fell due and queues written
+// by CLI commands.
+type worker struct {
+	period time.Duration
+	wakeup chan struct{}
+}
+
+func newWorker(period time.Duration) *worker {
+	return &worker{period: period, wakeup: make(chan struct{}, 1)}
+}
+
+// wake asks for a run soon; it never blocks.
+func (w *worker) wake() {
+	select {
+	case w.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// run calls job until ctx is cancelled.
+func (w *worker) run(ctx context.Context, job func(context.Context)) {
+	t := time.NewTicker(w.period)
+	defer t.Stop()
+	for {
+		job(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.wakeup:
+		case <-t.C:
+		}
+	}
+}
+
+// background tracks what `blog serve` runs next to the main server (the
+// metrics and redirect listeners and the workers), so shutdown can wait for
+// a delivery to finish saving its queue before the process exits.
+type background struct{ wg sync.WaitGroup }
+
+func (b *background) run(f func()) {
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		f()
+	}()
+}
+
+// wait blocks until everything returned or d passed, and reports which.
+func (b *background) wait(d time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+// --------------------------- Handlers (Health) -----------------
+
+// healthzHandler reports liveness: the process is up and serving HTTP.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintln(w, "ok")
+}
+
+// readyzHandler reports readiness: not draining, and the storage directory
+// exists and accepts writes.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if draining.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "shutting down")
+		return
+	}
+	if err := checkStorageWritable(); err != nil {
+		slog.WarnContext(r.Context(), "readyz: storage check failed", "err", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "storage unavailable")
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// checkStorageWritable creates and removes a probe file in the storage dir.
+func checkStorageWritable() error {
+	fi, err := os.Stat(cfg.StorageDir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", cfg.StorageDir)
+	}
+	f, err := os.CreateTemp(cfg.StorageDir, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	_, werr := f.WriteString("ok")
+	cerr := f.Close()
+	rerr := os.Remove(name)
+	return errors.Join(werr, cerr, rerr)
+}
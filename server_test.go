@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthAndReadiness(t *testing.T) {
+	resetStorage(t)
+	ts := httptest.NewServer(buildMux())
+	defer ts.Close()
+
+	for _, p := range []string{"/healthz", "/readyz"} {
+		if status, body := getBody(t, ts.URL, p, ""); status != http.StatusOK || body != "ok\n" {
+			t.Fatalf("%s=%d %q, want 200 ok", p, status, body)
+		}
+	}
+
+	// Storage that is not a directory makes the instance unready but still live.
+	if err := os.RemoveAll(cfg.StorageDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(cfg.StorageDir, []byte("not a dir"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	defer resetStorage(t)
+	if status, _ := getBody(t, ts.URL, "/readyz", ""); status != http.StatusServiceUnavailable {
+		t.Fatalf("/readyz with broken storage=%d, want 503", status)
+	}
+	if status, _ := getBody(t, ts.URL, "/healthz", ""); status != http.StatusOK {
+		t.Fatalf("/healthz with broken storage=%d, want 200", status)
+	}
+}
+
+func TestServe_DrainsInFlightRequests(t *testing.T) {
+	defer draining.Store(false)
+
+	started := make(chan struct{})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(w, "saved")
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- serve(ctx, newServer(h), ln) }()
+
+	type result struct {
+		body string
+		err  error
+	}
+	resc := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/")
+		if err != nil {
+			resc <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		resc <- result{string(b), err}
+	}()
+
+	<-started
+	cancel()
+	res := <-resc
+	if res.err != nil || res.body != "saved" {
+		t.Fatalf("in-flight request cut off: body=%q err=%v", res.body, res.err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("serve returned %v, want nil after graceful shutdown", err)
+	}
+	if !draining.Load() {
+		t.Fatal("draining flag not set during shutdown")
+	}
+}
+
+func TestBackground_WaitsForWorkers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var bg background
+	var saved atomic.Bool
+	started := make(chan struct{})
+	bg.run(func() {
+		newWorker(time.Hour).run(ctx, func(ctx context.Context) {
+			if saved.Load() || ctx.Err() != nil {
+				return
+			}
+			close(started)
+			<-ctx.Done()                       // a delivery cut short by shutdown...
+			time.Sleep(100 * time.Millisecond) // ...still saves its queue
+			saved.Store(true)
+		})
+	})
+	<-started
+	cancel()
+	if !bg.wait(5*time.Second) || !saved.Load() {
+		t.Fatal("shutdown did not wait for the worker to save its queue")
+	}
+
+	bg.run(func() { time.Sleep(time.Second) })
+	if bg.wait(10 * time.Millisecond) {
+		t.Fatal("wait ignored its timeout")
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// --------------------------- Spam filter -----------------------
+// A naive Bayes classifier over the words, link hosts and email domain of
+// a comment. It learns only from moderation: approving trains ham, marking
+// as spam trains spam. Counts live in .blog/spam.json.
+
+const (
+	spamFile = "spam.json"
+	// spamMinTrained is how many of each kind must be seen before scores
+	// are trusted; until then every comment scores 0.5.
+	spamMinTrained = 5
+	// spamThreshold sends a new comment straight to the spam folder.
+	spamThreshold = 0.9
+	// spamTokens is how many of the most telling tokens are combined.
+	spamTokens = 20
+)
+
+type spamModel struct {
+	SpamDocs int            `json:"spam_docs"`
+	HamDocs  int            `json:"ham_docs"`
+	Spam     map[string]int `json:"spam"`
+	Ham      map[string]int `json:"ham"`
+}
+
+var spamMu sync.Mutex
+
+var (
+	spamWordRe = regexp.MustCompile(`[\p{L}\p{N}$€£'-]{2,30}`)
+	spamLinkRe = regexp.MustCompile(`https?://[^\s)>"']+`)
+)
+
+// spamFeatures lists the distinct tokens of c.
+func spamFeatures(c Comment) []string {
+	seen := map[string]bool{}
+	add := func(t string) { seen[t] = true }
+	for _, w := range spamWordRe.FindAllString(strings.ToLower(c.Body), -1) {
+		add(strings.Trim(w, "'-"))
+	}
+	for _, w := range spamWordRe.FindAllString(strings.ToLower(c.Name), -1) {
+		add("name:" + w)
+	}
+	links := spamLinkRe.FindAllString(c.Body, -1)
+	for _, l := range links {
+		if u, err := url.Parse(l); err == nil && u.Host != "" {
+			add("host:" + strings.ToLower(u.Hostname()))
+		}
+	}
+	switch n := len(links); {
+	case n == 0:
+		add("links:0")
+	case n < 3:
+		add("links:few")
+	default:
+		add("links:many")
+	}
+	if _, domain, ok := strings.Cut(c.Email, "@"); ok {
+		add("email:" + strings.ToLower(domain))
+	}
+	delete(seen, "")
+	out := make([]string, 0, len(seen))
+	for t := range seen {
+		out = append(out, t)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func spamPath() string { return filepath.Join(metaDir(), spamFile) }
+
+func loadSpamModel() (*spamModel, error) {
+	m := &spamModel{Spam: map[string]int{}, Ham: map[string]int{}}
+	b, err := os.ReadFile(spamPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, err
+	}
+	if m.Spam == nil {
+		m.Spam = map[string]int{}
+	}
+	if m.Ham == nil {
+		m.Ham = map[string]int{}
+	}
+	return m, nil
+}
+
+func saveSpamModel(m *spamModel) error {
+	if err := os.MkdirAll(metaDir(), 0o700); err != nil {
+		return err
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	return writeFileAtomic(spamPath(), b, 0o600)
+}
+
+// score returns the probability that a comment with these tokens is spam,
+// combining the spamTokens tokens furthest from neutral.
+func (m *spamModel) score(tokens []string) float64 {
+	if m.SpamDocs < spamMinTrained || m.HamDocs < spamMinTrained {
+		return 0.5
+	}
+	var ps []float64
+	for _, t := range tokens {
+		s, h := m.Spam[t], m.Ham[t]
+		if s+h == 0 {
+			continue
+		}
+		fs := float64(s) / float64(m.SpamDocs)
+		fh := float64(h) / float64(m.HamDocs)
+		p := fs / (fs + fh)
+		// Robinson's correction: pull rarely seen tokens towards 0.5
+		n := float64(s + h)
+		p = (0.5 + n*p) / (1 + n)
+		ps = append(ps, min(max(p, 0.01), 0.99))
+	}
+	if len(ps) == 0 {
+		return 0.5
+	}
+	sort.Slice(ps, func(i, j int) bool { return math.Abs(ps[i]-0.5) > math.Abs(ps[j]-0.5) })
+	if len(ps) > spamTokens {
+		ps = ps[:spamTokens]
+	}
+	var logSpam, logHam float64
+	for _, p := range ps {
+		logSpam += math.Log(p)
+		logHam += math.Log(1 - p)
+	}
+	return 1 / (1 + math.Exp(logHam-logSpam))
+}
+
+// train adds (delta 1) or removes (delta -1) one document's tokens.
+func (m *spamModel) train(tokens []string, spam bool, delta int) {
+	docs, counts := &m.HamDocs, m.Ham
+	if spam {
+		docs, counts = &m.SpamDocs, m.Spam
+	}
+	*docs = max(*docs+delta, 0)
+	for _, t := range tokens {
+		if counts[t] += delta; counts[t] <= 0 {
+			delete(counts, t)
+		}
+	}
+}
+
+// spamScore classifies c with the stored model.
+func spamScore(c Comment) float64 {
+	spamMu.Lock()
+	defer spamMu.Unlock()
+	m, err := loadSpamModel()
+	if err != nil {
+		return 0.5
+	}
+	return m.score(spamFeatures(c))
+}
+
+// trainSpam records a moderation decision for each comment, undoing
+// earlier training when the verdict changed. It returns the comments with
+// Trained updated.
+func trainSpam(cs []Comment) ([]Comment, error) {
+	spamMu.Lock()
+	defer spamMu.Unlock()
+	m, err := loadSpamModel()
+	if err != nil {
+		return cs, err
+	}
+	changed := false
+	for i, c := range cs {
+		want := ""
+		switch c.Status {
+		case commentApproved:
+			want = "ham"
+		case commentSpam:
+			want = "spam"
+		}
+		if want == c.Trained {
+			continue
+		}
+		tokens := spamFeatures(c)
+		if c.Trained != "" {
+			m.train(tokens, c.Trained == "spam", -1)
+		}
+		if want != "" {
+			m.train(tokens, want == "spam", 1)
+		}
+		cs[i].Trained = want
+		changed = true
+	}
+	if !changed {
+		return cs, nil
+	}
+	return cs, saveSpamModel(m)
+}
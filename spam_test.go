@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSpamModel_LearnsFromModeration(t *testing.T) {
+	resetStorage(t)
+	probe := Comment{Name: "Deals", Body: "cheap pills, buy now at https://pills.example/buy"}
+	if s := spamScore(probe); s != 0.5 {
+		t.Fatalf("untrained score %v, want 0.5", s)
+	}
+
+	var cs []Comment
+	for i := range spamMinTrained + 1 {
+		cs = append(cs,
+			Comment{ID: fmt.Sprintf("s%d", i), Name: "Best Deals", Body: fmt.Sprintf("buy cheap pills now https://pills.example/%d casino bonus", i), Status: commentSpam},
+			Comment{ID: fmt.Sprintf("h%d", i), Name: "Reader", Body: fmt.Sprintf("Thanks for the article about goroutines, part %d was helpful.", i), Status: commentApproved},
+		)
+	}
+	cs, err := trainSpam(cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs[0].Trained != "spam" || cs[1].Trained != "ham" {
+		t.Fatalf("trained marks: %q %q", cs[0].Trained, cs[1].Trained)
+	}
+	if s := spamScore(probe); s < spamThreshold {
+		t.Fatalf("spam scored %v", s)
+	}
+	if s := spamScore(Comment{Name: "Sam", Body: "Helpful article about goroutines, thanks!"}); s > 0.1 {
+		t.Fatalf("ham scored %v", s)
+	}
+
+	// changing a verdict moves the comment from one side to the other
+	m, _ := loadSpamModel()
+	before := m.Ham["goroutines"]
+	cs[1].Status = commentSpam
+	if cs, err = trainSpam(cs); err != nil || cs[1].Trained != "spam" {
+		t.Fatalf("retrain: %v %q", err, cs[1].Trained)
+	}
+	m, _ = loadSpamModel()
+	if m.Ham["goroutines"] != before-1 || m.Spam["goroutines"] != 1 || m.HamDocs != spamMinTrained {
+		t.Fatalf("counts after retrain: ham %d spam %d docs %d", m.Ham["goroutines"], m.Spam["goroutines"], m.HamDocs)
+	}
+}
+
+func TestSpamModel_NewSpamSkipsQueue(t *testing.T) {
+	resetStorage(t)
+	if err := saveArticle(Article{Title: "A", Slug: "a", Content: "x", Published: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	var seed []Comment
+	for i := range spamMinTrained {
+		seed = append(seed,
+			Comment{ID: fmt.Sprintf("s%d", i), Name: "Casino", Body: "casino bonus https://casino.example free spins", Status: commentSpam, Created: time.Now()},
+			Comment{ID: fmt.Sprintf("h%d", i), Name: "Kim", Body: "Nice write-up, I learned something.", Status: commentApproved, Created: time.Now()},
+		)
+	}
+	if _, err := mergeComments("a", seed); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(buildMux())
+	defer ts.Close()
+	postComment(t, ts.URL, "a", url.Values{"name": {"Casino"}, "body": {"free spins casino bonus https://casino.example"}})
+	postComment(t, ts.URL, "a", url.Values{"name": {"Lee"}, "body": {"I learned something, nice write-up."}})
+	cs, _ := loadComments("a")
+	spam, ham := cs[len(cs)-2], cs[len(cs)-1]
+	if spam.Status != commentSpam || spam.Score < spamThreshold || ham.Status != commentPending {
+		t.Fatalf("spam %s (%.2f), ham %s (%.2f)", spam.Status, spam.Score, ham.Status, ham.Score)
+	}
+}
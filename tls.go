@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// --------------------------- TLS -------------------------------
+
+// certCheckInterval bounds how often handshakes stat the cert files.
+var certCheckInterval = 5 * time.Second
+
+// certReloader serves the key pair from disk and picks up a rotated pair
+// on the next handshake after the files change. A pair that fails to load
+// (e.g. the cert was written but not yet the key) is logged and the old
+// one kept until the next check.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	stamp     string // mod times and sizes of both files at the last load
+	lastCheck time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	stamp, err := cr.fileStamp()
+	if err != nil {
+		return nil, err
+	}
+	if err := cr.load(stamp); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// fileStamp summarises both files so a change to either is noticed.
+func (cr *certReloader) fileStamp() (string, error) {
+	var stamp string
+	for _, f := range []string{cr.certFile, cr.keyFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return "", err
+		}
+		stamp += fmt.Sprintf("%d/%d;", fi.ModTime().UnixNano(), fi.Size())
+	}
+	return stamp, nil
+}
+
+// load reads the pair; callers other than the constructor hold cr.mu.
+func (cr *certReloader) load(stamp string) error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cr.cert, cr.stamp = &cert, stamp
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if time.Since(cr.lastCheck) < certCheckInterval {
+		return cr.cert, nil
+	}
+	cr.lastCheck = time.Now()
+	stamp, err := cr.fileStamp()
+	if err != nil {
+		slog.Error("tls cert check", "err", err)
+		return cr.cert, nil
+	}
+	if stamp != cr.stamp {
+		if err := cr.load(stamp); err != nil {
+			slog.Error("tls cert reload; keeping previous certificate", "err", err)
+		} else {
+			slog.Info("tls certificate reloaded", "cert", cr.certFile)
+		}
+	}
+	return cr.cert, nil
+}
+
+// selfSignedCert creates an in-memory certificate for localhost, for the
+// tls_self_signed dev mode. Browsers will warn about it.
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmplCert := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "localhost", Organization: []string{cfg.SiteTitle + " (dev)"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmplCert, tmplCert, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// tlsConfig builds the listener config from the TLS settings, or returns
+// nil when TLS is off.
+func tlsConfig() (*tls.Config, error) {
+	conf := &tls.Config{MinVersion: tls.VersionTLS12}
+	switch {
+	case cfg.TLSSelfSigned:
+		cert, err := selfSignedCert()
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	case cfg.TLSCert != "":
+		cr, err := newCertReloader(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		conf.GetCertificate = cr.GetCertificate
+	default:
+		return nil, nil
+	}
+	return conf, nil
+}
+
+// --------------------------- Handlers (TLS) --------------------
+
+// httpsRedirect answers the plain-HTTP listener by sending clients to the
+// same path on the TLS listener: at base_url's host when one is set, so a
+// forged Host header can't pick the target, else at the requested host.
+func httpsRedirect(w http.ResponseWriter, r *http.Request) {
+	code := http.StatusMovedPermanently
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		code = http.StatusPermanentRedirect // keep the method and body
+	}
+	if u, err := url.Parse(cfg.BaseURL); cfg.BaseURL != "" && err == nil && u.Host != "" {
+		http.Redirect(w, r, "https://"+u.Host+r.URL.RequestURI(), code)
+		return
+	}
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	if host == "" {
+		http.Error(w, "missing Host header", http.StatusBadRequest)
+		return
+	}
+	if _, port, _ := net.SplitHostPort(cfg.ListenAddr); port != "" && port != "443" {
+		host = net.JoinHostPort(host, port)
+	} else if net.ParseIP(host) != nil && net.ParseIP(host).To4() == nil {
+		host = "[" + host + "]"
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), code)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeCertPair writes a fresh self-signed pair for org as PEM files.
+func writeCertPair(t *testing.T, certFile, keyFile, org string, mtime time.Time) {
+	t.Helper()
+	saved := cfg.SiteTitle
+	cfg.SiteTitle = org
+	cert, err := selfSignedCert()
+	cfg.SiteTitle = saved
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.Chtimes(f, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// servedOrg dials addr and returns the organization of the served certificate.
+func servedOrg(t *testing.T, addr string) string {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.Organization[0]
+}
+
+func TestTLS_ReloadsRotatedCertificate(t *testing.T) {
+	saved, savedInterval := cfg, certCheckInterval
+	defer func() { cfg, certCheckInterval = saved, savedInterval }()
+	certCheckInterval = 0
+
+	dir := t.TempDir()
+	cfg.TLSCert, cfg.TLSKey = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCertPair(t, cfg.TLSCert, cfg.TLSKey, "first", time.Now().Add(-time.Hour))
+
+	srv := newServer(buildMux())
+	var err error
+	if srv.TLSConfig, err = tlsConfig(); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- serve(ctx, srv, ln) }()
+	defer func() {
+		cancel()
+		<-done
+		draining.Store(false)
+	}()
+
+	if got := servedOrg(t, ln.Addr().String()); got != "first (dev)" {
+		t.Fatalf("served cert org=%q", got)
+	}
+
+	// a half-written rotation (unparsable key) keeps the old certificate
+	if err := os.WriteFile(cfg.TLSKey, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	captureLogs(t)
+	if got := servedOrg(t, ln.Addr().String()); got != "first (dev)" {
+		t.Fatalf("broken pair should keep the old cert, got %q", got)
+	}
+
+	writeCertPair(t, cfg.TLSCert, cfg.TLSKey, "second", time.Now())
+	if got := servedOrg(t, ln.Addr().String()); got != "second (dev)" {
+		t.Fatalf("rotated cert not picked up, got %q", got)
+	}
+}
+
+func TestTLS_RedirectAndSecureCookie(t *testing.T) {
+	saved := cfg
+	defer func() { cfg = saved }()
+	cfg.ListenAddr = ":8443"
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/article/hello?x=1", nil)
+	req.Host = "blog.example.com:8080"
+	httpsRedirect(rec, req)
+	if rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != "https://blog.example.com:8443/article/hello?x=1" {
+		t.Fatalf("redirect=%d %q", rec.Code, rec.Header().Get("Location"))
+	}
+	cfg.ListenAddr = ":443"
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/admin/login", nil)
+	req.Host = "blog.example.com"
+	httpsRedirect(rec, req)
+	if rec.Code != http.StatusPermanentRedirect || rec.Header().Get("Location") != "https://blog.example.com/admin/login" {
+		t.Fatalf("POST redirect=%d %q", rec.Code, rec.Header().Get("Location"))
+	}
+	cfg.BaseURL = "https://blog.example.com:8443"
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/article/hello", nil)
+	req.Host = "evil.example"
+	httpsRedirect(rec, req)
+	if rec.Header().Get("Location") != "https://blog.example.com:8443/article/hello" {
+		t.Fatalf("redirect with base_url=%q", rec.Header().Get("Location"))
+	}
+	cfg.BaseURL = ""
+
+	resetStorage(t)
+	ts := httptest.NewTLSServer(buildMux())
+	defer ts.Close()
+	client := ts.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := client.PostForm(ts.URL+"/admin/login", url.Values{"username": {cfg.AdminUser}, "password": {cfg.AdminPass}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if ck := resp.Header.Get("Set-Cookie"); !strings.Contains(ck, "; Secure") {
+		t.Fatalf("session cookie over TLS lacks Secure: %q", ck)
+	}
+
+	plain := httptest.NewServer(buildMux())
+	defer plain.Close()
+	if ck := login(t, plain.URL, cfg.AdminUser, cfg.AdminPass); strings.Contains(ck, "Secure") {
+		t.Fatalf("session cookie over plain HTTP should not be Secure: %q", ck)
+	}
+}
+
+func TestConfig_TLSValidation(t *testing.T) {
+	for name, mutate := range map[string]func(*Config){
+		"cert without key":     func(c *Config) { c.TLSCert = "cert.pem" },
+		"cert and self-signed": func(c *Config) { c.TLSCert, c.TLSKey, c.TLSSelfSigned = "c", "k", true },
+		"redirect without tls": func(c *Config) { c.TLSRedirectAddr = ":80" },
+	} {
+		c := defaultConfig()
+		mutate(&c)
+		if err := c.validate(); err == nil {
+			t.Fatalf("%s: want validation error", name)
+		}
+	}
+	c := defaultConfig()
+	c.TLSSelfSigned, c.TLSRedirectAddr = true, ":80"
+	if err := c.validate(); err != nil {
+		t.Fatalf("self-signed with redirect: %v", err)
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// --------------------------- API tokens ------------------------
+// Bearer tokens let programs such as Micropub clients act for an admin
+// without a session. Only a SHA-256 of each token is kept, in
+// .blog/tokens.json; the token itself is shown once, when it is created.
+// Each token carries the Micropub scopes it may use.
+
+const (
+	tokensFile    = "tokens.json"
+	tokenChars    = 40
+	tokenNameMax  = 64
+	tokenUseEvery = time.Minute // how often LastUsed is written
+)
+
+var tokenScopes = []string{"create", "update", "delete", "undelete", "media"}
+
+type apiToken struct {
+	ID       string    `json:"id"` // public handle, for listing and revoking
+	Name     string    `json:"name"`
+	User     string    `json:"user"` // who created it; requests made with it are theirs
+	Scopes   []string  `json:"scopes"`
+	Hash     string    `json:"hash"` // hex SHA-256 of the token
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"last_used,omitzero"`
+}
+
+func (t apiToken) can(scope string) bool { return slices.Contains(t.Scopes, scope) }
+
+var tokensMu sync.Mutex
+
+func tokenHash(tok string) string {
+	sum := sha256.Sum256([]byte(tok))
+	return hex.EncodeToString(sum[:])
+}
+
+func loadTokens() ([]apiToken, error) {
+	b, err := os.ReadFile(filepath.Join(metaDir(), tokensFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ts []apiToken
+	return ts, json.Unmarshal(b, &ts)
+}
+
+func saveTokens(ts []apiToken) error {
+	if err := os.MkdirAll(metaDir(), 0o700); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(ts, "", "  ")
+	if err != nil {
+		return err
+	}
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	return writeFileAtomic(filepath.Join(metaDir(), tokensFile), b, 0o600)
+}
+
+// createToken stores a new token and returns it with its secret value.
+func createToken(name, user string, scopes []string) (apiToken, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > tokenNameMax {
+		return apiToken{}, "", fmt.Errorf("token name must be 1 to %d characters", tokenNameMax)
+	}
+	if len(scopes) == 0 {
+		return apiToken{}, "", errors.New("choose at least one scope")
+	}
+	for _, s := range scopes {
+		if !slices.Contains(tokenScopes, s) {
+			return apiToken{}, "", fmt.Errorf("unknown scope %q (want %s)", s, strings.Join(tokenScopes, ", "))
+		}
+	}
+	secret := newToken(tokenChars)
+	t := apiToken{ID: newToken(8), Name: name, User: user, Scopes: slices.Compact(slices.Sorted(slices.Values(scopes))), Hash: tokenHash(secret), Created: time.Now().UTC()}
+	tokensMu.Lock()
+	defer tokensMu.Unlock()
+	ts, err := loadTokens()
+	if err != nil {
+		return apiToken{}, "", err
+	}
+	return t, secret, saveTokens(append(ts, t))
+}
+
+func revokeToken(id string) (apiToken, error) {
+	tokensMu.Lock()
+	defer tokensMu.Unlock()
+	ts, err := loadTokens()
+	if err != nil {
+		return apiToken{}, err
+	}
+	i := slices.IndexFunc(ts, func(t apiToken) bool { return t.ID == id })
+	if i < 0 {
+		return apiToken{}, os.ErrNotExist
+	}
+	t := ts[i]
+	return t, saveTokens(slices.Delete(ts, i, i+1))
+}
+
+// checkToken finds the token with value secret and notes its use. Tokens
+// made in the web admin die with their owner's account; those made from
+// the CLI (owner "cli:…") have no account to check.
+func checkToken(secret string) (apiToken, bool) {
+	if secret == "" {
+		return apiToken{}, false
+	}
+	h := tokenHash(secret)
+	tokensMu.Lock()
+	defer tokensMu.Unlock()
+	ts, err := loadTokens()
+	if err != nil {
+		return apiToken{}, false
+	}
+	for i, t := range ts {
+		if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(h)) == 1 {
+			if !strings.HasPrefix(t.User, "cli:") && !accountExists(t.User) {
+				return apiToken{}, false
+			}
+			if now := time.Now(); now.Sub(t.LastUsed) > tokenUseEvery {
+				ts[i].LastUsed = now.UTC()
+				_ = saveTokens(ts)
+			}
+			return ts[i], true
+		}
+	}
+	return apiToken{}, false
+}
+
+// bearerToken reads the token from the Authorization header.
+func bearerToken(r *http.Request) string {
+	tok, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return strings.TrimSpace(tok)
+}
+
+// --------------------------- Handlers (admin tokens) -----------
+
+func adminTokensGet(w http.ResponseWriter, r *http.Request, errMsg string, created *apiToken, secret string) {
+	tokensMu.Lock()
+	ts, err := loadTokens()
+	tokensMu.Unlock()
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	slices.Reverse(ts)
+	data := map[string]any{"Active": "admin_tokens", "Title": "API Tokens", "Tokens": ts, "Scopes": tokenScopes, "Error": errMsg, "Created": created, "Secret": secret}
+	render(w, r, data)
+}
+
+func adminTokensPost(w http.ResponseWriter, r *http.Request) {
+	_ = r.ParseForm()
+	switch r.FormValue("action") {
+	case "create":
+		t, secret, err := createToken(r.FormValue("name"), sessionUser(r), r.Form["scope"])
+		if err != nil {
+			adminTokensGet(w, r, err.Error(), nil, "")
+			return
+		}
+		audit(r, "token.create", "", "", fmt.Sprintf("%s %q, scopes %s", t.ID, t.Name, strings.Join(t.Scopes, " ")))
+		adminTokensGet(w, r, "", &t, secret) // the only time the secret is shown
+	case "revoke":
+		t, err := revokeToken(r.FormValue("id"))
+		if errors.Is(err, os.ErrNotExist) {
+			notFound(w, r)
+			return
+		}
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		audit(r, "token.revoke", "", "", fmt.Sprintf("%s %q", t.ID, t.Name))
+		http.Redirect(w, r, "/admin/tokens", http.StatusFound)
+	default:
+		renderError(w, r, http.StatusBadRequest, nil)
+	}
+}
+
+// --------------------------- CLI (tokens) ----------------------
+
+func runToken(args []string) error {
+	fs := flag.NewFlagSet("token", flag.ExitOnError)
+	name := fs.String("name", "", "what the token is for, e.g. the app's name")
+	scope := fs.String("scope", strings.Join(tokenScopes, ","), "comma-separated scopes")
+	configure(fs, args)
+	if fs.NArg() == 0 {
+		return errors.New("token: want add, list or revoke")
+	}
+	switch sub := fs.Arg(0); sub {
+	case "add":
+		_ = fs.Parse(fs.Args()[1:]) // flags may follow the subcommand
+		t, secret, err := createToken(*name, "cli:"+os.Getenv("USER"), strings.FieldsFunc(*scope, func(r rune) bool { return r == ',' || r == ' ' }))
+		if err != nil {
+			return err
+		}
+		auditCLI("token.create", "", fmt.Sprintf("%s %q, scopes %s", t.ID, t.Name, strings.Join(t.Scopes, " ")))
+		fmt.Fprintln(stdout, secret)
+	case "list":
+		ts, err := loadTokens()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(stdout, 2, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tSCOPES\tCREATED\tLAST USED")
+		for _, t := range ts {
+			used := "never"
+			if !t.LastUsed.IsZero() {
+				used = t.LastUsed.In(cfg.Location()).Format("2006-01-02 15:04")
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", t.ID, t.Name, strings.Join(t.Scopes, ","), t.Created.In(cfg.Location()).Format("2006-01-02 15:04"), used)
+		}
+		return tw.Flush()
+	case "revoke":
+		if fs.NArg() != 2 {
+			return errors.New("token revoke: want exactly one token ID")
+		}
+		t, err := revokeToken(fs.Arg(1))
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("no token %q", fs.Arg(1))
+		}
+		if err != nil {
+			return err
+		}
+		auditCLI("token.revoke", "", fmt.Sprintf("%s %q", t.ID, t.Name))
+	default:
+		return fmt.Errorf("token: unknown subcommand %q", sub)
+	}
+	return nil
+}
+
+// --------------------------- Templates (tokens) ----------------
+
+const adminTokensHTML = `{{define "admin_tokens"}}
+  <div class="card bar">
+    <div><h2 class="m-0">API Tokens</h2></div>
+    <div><a href="/admin">Back</a></div>
+  </div>
+  {{with .Created}}
+  <div class="card">
+    <strong>{{.Name}}</strong> was created. Copy the token now; it won't be shown again.
+    <div class="mt-12"><code>{{$.Secret}}</code></div>
+  </div>
+  {{end}}
+  <div class="card">
+    {{if not .Tokens}}<p class="muted m-0">No tokens yet.</p>{{else}}
+    <table>
+      <thead><tr><th>Name</th><th>Scopes</th><th>Created</th><th>Last used</th><th></th></tr></thead>
+      <tbody>
+        {{range .Tokens}}
+        <tr>
+          <td>{{.Name}}<div class="muted">{{.ID}} · {{.User}}</div></td>
+          <td>{{range $i, $s := .Scopes}}{{if $i}}, {{end}}{{$s}}{{end}}</td>
+          <td>{{.Created.Format "Jan 02, 2006"}}</td>
+          <td>{{if .LastUsed.IsZero}}never{{else}}{{.LastUsed.Format "Jan 02 15:04"}}{{end}}</td>
+          <td>
+            <form method="post" action="/admin/tokens">
+              <input type="hidden" name="id" value="{{.ID}}" />
+              <button class="danger" name="action" value="revoke">Revoke</button>
+            </form>
+          </td>
+        </tr>
+        {{end}}
+      </tbody>
+    </table>
+    {{end}}
+  </div>
+  <form method="post" action="/admin/tokens" class="card">
+    <h3 class="mt-0">New token</h3>
+    {{with .Error}}<div class="card danger mb-12">{{.}}</div>{{end}}
+    <label>Name</label>
+    <input name="name" placeholder="Phone app" required />
+    <div class="mt-12">
+      {{range .Scopes}}<label class="ml-8"><input type="checkbox" name="scope" value="{{.}}" checked /> {{.}}</label>{{end}}
+    </div>
+    <div class="mt-12"><button name="action" value="create">Create token</button></div>
+  </form>
+{{end}}`
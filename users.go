@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --------------------------- Users -----------------------------
+// Admin accounts besides the one in the config. Passwords are stored as
+// PBKDF2-SHA256 hashes in metaDir()/users.json.
+
+const (
+	usersFile        = "users.json"
+	passwordIters    = 600_000
+	passwordMinChars = 8
+)
+
+type User struct {
+	Username string    `json:"username"`
+	Hash     string    `json:"hash"` // pbkdf2-sha256$iterations$salt$key
+	Created  time.Time `json:"created"`
+}
+
+var (
+	usersMu     sync.Mutex
+	validUserRe = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,63}$`)
+)
+
+func hashPassword(pass string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, pass, salt, passwordIters, 32)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawStdEncoding
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordIters, enc.EncodeToString(salt), enc.EncodeToString(key)), nil
+}
+
+func checkPassword(hash, pass string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iters, err := strconv.Atoi(parts[1])
+	enc := base64.RawStdEncoding
+	salt, err1 := enc.DecodeString(parts[2])
+	want, err2 := enc.DecodeString(parts[3])
+	if err != nil || err1 != nil || err2 != nil || iters < 1 {
+		return false
+	}
+	got, err := pbkdf2.Key(sha256.New, pass, salt, iters, len(want))
+	return err == nil && subtle.ConstantTimeCompare(got, want) == 1
+}
+
+func usersPath() string { return filepath.Join(metaDir(), usersFile) }
+
+// loadUsers returns every stored user; a missing file means none.
+func loadUsers() (map[string]User, error) {
+	users := map[string]User{}
+	b, err := os.ReadFile(usersPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return users, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []User
+	if err := json.Unmarshal(b, &list); err != nil {
+		return nil, fmt.Errorf("%s: %v", usersPath(), err)
+	}
+	for _, u := range list {
+		users[u.Username] = u
+	}
+	return users, nil
+}
+
+func saveUsers(users map[string]User) error {
+	if err := os.MkdirAll(metaDir(), 0o700); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(sortedUsers(users), "", "  ")
+	if err != nil {
+		return err
+	}
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	return writeFileAtomic(usersPath(), b, 0o600)
+}
+
+// listUsers returns the stored users sorted by name.
+func listUsers() ([]User, error) {
+	users, err := loadUsers()
+	if err != nil {
+		return nil, err
+	}
+	return sortedUsers(users), nil
+}
+
+func sortedUsers(users map[string]User) []User {
+	list := make([]User, 0, len(users))
+	for _, u := range users {
+		list = append(list, u)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Username < list[j].Username })
+	return list
+}
+
+// setUser creates name or, when replace is set, changes its password.
+func setUser(name, pass string, replace bool) error {
+	if !validUserRe.MatchString(name) {
+		return fmt.Errorf("invalid username %q", name)
+	}
+	if len(pass) < passwordMinChars {
+		return fmt.Errorf("password must be at least %d characters", passwordMinChars)
+	}
+	hash, err := hashPassword(pass)
+	if err != nil {
+		return err
+	}
+	usersMu.Lock()
+	defer usersMu.Unlock()
+	users, err := loadUsers()
+	if err != nil {
+		return err
+	}
+	u, exists := users[name]
+	switch {
+	case exists && !replace:
+		return fmt.Errorf("user %q already exists", name)
+	case !exists && replace:
+		return fmt.Errorf("no user %q", name)
+	case !exists:
+		u = User{Username: name, Created: time.Now().UTC()}
+	}
+	u.Hash = hash
+	users[name] = u
+	return saveUsers(users)
+}
+
+func deleteUser(name string) error {
+	usersMu.Lock()
+	defer usersMu.Unlock()
+	users, err := loadUsers()
+	if err != nil {
+		return err
+	}
+	if _, ok := users[name]; !ok {
+		return fmt.Errorf("no user %q", name)
+	}
+	delete(users, name)
+	return saveUsers(users)
+}
+
+// accountExists reports whether name can still log in: the config admin
+// or a stored user.
+func accountExists(name string) bool {
+	if name == cfg.AdminUser {
+		return true
+	}
+	users, err := loadUsers()
+	_, ok := users[name]
+	return err == nil && ok
+}
+
+// dummyHash is checked for names that aren't stored users, so a login
+// takes as long whether or not the name exists.
+var dummyHash = sync.OnceValue(func() string {
+	h, _ := hashPassword(newToken(16))
+	return h
+})
+
+// authenticate checks a login against the stored users, then against the
+// admin account from the config (unless a stored user has taken its name).
+func authenticate(name, pass string) bool {
+	users, err := loadUsers()
+	if err == nil {
+		if u, ok := users[name]; ok {
+			return checkPassword(u.Hash, pass)
+		}
+	}
+	checkPassword(dummyHash(), pass)
+	userOK := subtle.ConstantTimeCompare([]byte(name), []byte(cfg.AdminUser)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(cfg.AdminPass)) == 1
+	return userOK && passOK
+}
@@ -0,0 +1,602 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --------------------------- Webhooks --------------------------
+// Admins register endpoints in /admin/webhooks, each with a secret and the
+// events it wants. Saving or deleting an article queues a delivery per
+// subscribed endpoint; a worker posts them, signed with HMAC-SHA256, and
+// retries failures with exponential backoff. Each endpoint's deliveries,
+// queued and finished, are kept in .blog/webhooks/<id>.json, which is both
+// the queue and the delivery log.
+
+const (
+	webhooksFile       = "webhooks.json"
+	webhooksDir        = "webhooks"
+	webhookAttempts    = 8
+	webhookRetryBase   = 30 * time.Second
+	webhookSweep       = 15 * time.Second
+	webhookLogSize     = 50 // finished deliveries kept per endpoint
+	webhookTimeout     = 10 * time.Second
+	webhookSigHeader   = "X-Blog-Signature"
+	webhookBodyExcerpt = 200 // bytes of a failed response kept in the log
+)
+
+// webhookEvents are the events an endpoint can subscribe to.
+var webhookEvents = []string{"article.created", "article.updated", "article.published", "article.deleted"}
+
+// Delivery states.
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+)
+
+type webhook struct {
+	ID      string    `json:"id"`
+	URL     string    `json:"url"`
+	Secret  string    `json:"secret"`
+	Events  []string  `json:"events"`
+	Created time.Time `json:"created"`
+}
+
+// webhookPayload is the JSON body of every delivery. Article is the state
+// after the change, or the deleted article for article.deleted.
+type webhookPayload struct {
+	Event        string    `json:"event"`
+	OccurredAt   time.Time `json:"occurred_at"`
+	URL          string    `json:"url,omitempty"` // absolute; needs base_url
+	PreviousSlug string    `json:"previous_slug,omitempty"`
+	Article      Article   `json:"article"`
+}
+
+type webhookDelivery struct {
+	ID         string          `json:"id"`
+	Event      string          `json:"event"`
+	Payload    json.RawMessage `json:"payload"`
+	Created    time.Time       `json:"created"`
+	Status     string          `json:"status"`
+	Attempts   int             `json:"attempts,omitempty"`
+	NextTry    time.Time       `json:"next_try,omitzero"`
+	Last       time.Time       `json:"last,omitzero"`
+	Code       int             `json:"code,omitempty"` // HTTP status of the last attempt
+	Error      string          `json:"error,omitempty"`
+	Redelivery string          `json:"redelivery,omitempty"` // ID of the delivery it repeats
+}
+
+var webhookMu sync.Mutex
+
+// webhookDeliveries posts queued deliveries; it is woken when an article is
+// saved or a delivery is repeated.
+var webhookDeliveries = newWorker(webhookSweep)
+
+// webhookClient posts deliveries. Unlike webClient it may reach private
+// addresses: endpoints are set by admins, and deploy hooks often run on the
+// same network.
+var webhookClient httpDoer = &http.Client{Timeout: webhookTimeout}
+
+// --------------------------- Webhook storage -------------------
+
+func loadWebhooks() ([]webhook, error) {
+	b, err := os.ReadFile(filepath.Join(metaDir(), webhooksFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var hs []webhook
+	return hs, json.Unmarshal(b, &hs)
+}
+
+func saveWebhooks(hs []webhook) error {
+	if err := os.MkdirAll(metaDir(), 0o700); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(hs, "", "  ")
+	if err != nil {
+		return err
+	}
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	return writeFileAtomic(filepath.Join(metaDir(), webhooksFile), b, 0o600)
+}
+
+func deliveriesPath(id string) string {
+	return filepath.Join(metaDir(), webhooksDir, id+".json")
+}
+
+func loadDeliveries(id string) ([]webhookDelivery, error) {
+	b, err := os.ReadFile(deliveriesPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ds []webhookDelivery
+	return ds, json.Unmarshal(b, &ds)
+}
+
+// saveDeliveries writes an endpoint's log, dropping the oldest finished
+// deliveries beyond webhookLogSize; queued ones are always kept.
+func saveDeliveries(id string, ds []webhookDelivery) error {
+	finished := 0
+	for _, d := range ds {
+		if d.Status != deliveryPending {
+			finished++
+		}
+	}
+	kept := ds[:0:0]
+	for _, d := range ds {
+		if d.Status != deliveryPending && finished > webhookLogSize {
+			finished--
+			continue
+		}
+		kept = append(kept, d)
+	}
+	p := deliveriesPath(id)
+	if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(kept, "", "  ")
+	if err != nil {
+		return err
+	}
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	return writeFileAtomic(p, b, 0o600)
+}
+
+// enqueueDelivery appends a pending delivery to hook's queue.
+func enqueueDelivery(hookID string, d webhookDelivery) error {
+	ds, err := loadDeliveries(hookID)
+	if err != nil {
+		return err
+	}
+	return saveDeliveries(hookID, append(ds, d))
+}
+
+// --------------------------- Webhook events --------------------
+
+// articleEvents names what happened between before and after: a creation
+// (also a publication unless it is a draft), a publication (a draft made
+// public), a deletion, or otherwise an update.
+func articleEvents(before, after Article) []string {
+	switch {
+	case before.Slug == "" && after.Draft:
+		return []string{"article.created"}
+	case before.Slug == "":
+		return []string{"article.created", "article.published"}
+	case after.Slug == "":
+		return []string{"article.deleted"}
+	case before.Draft && !after.Draft:
+		return []string{"article.published"}
+	}
+	return []string{"article.updated"}
+}
+
+// queueWebhooks queues a delivery of each event to the endpoints that
+// subscribe to it. Like queueWebmentions it logs failures: the article has
+// been saved by then.
+func queueWebhooks(before, after Article) {
+	if err := queueWebhookEvents(before, after); err != nil {
+		slog.Error("queue webhooks", "err", err)
+	}
+}
+
+func queueWebhookEvents(before, after Article) error {
+	webhookMu.Lock()
+	defer webhookMu.Unlock()
+	hooks, err := loadWebhooks()
+	if err != nil || len(hooks) == 0 {
+		return err
+	}
+	now := time.Now().UTC()
+	queued := false
+	for _, ev := range articleEvents(before, after) {
+		p := webhookPayload{Event: ev, OccurredAt: now, Article: after}
+		if ev == "article.deleted" {
+			p.Article = before
+		} else if before.Slug != "" && before.Slug != after.Slug {
+			p.PreviousSlug = before.Slug
+		}
+		if cfg.BaseURL != "" {
+			p.URL = cfg.BaseURL + "/article/" + p.Article.Slug
+		}
+		body, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		for _, h := range hooks {
+			if !slices.Contains(h.Events, ev) {
+				continue
+			}
+			d := webhookDelivery{ID: newToken(16), Event: ev, Payload: body, Created: now, Status: deliveryPending, NextTry: now}
+			if err := enqueueDelivery(h.ID, d); err != nil {
+				return err
+			}
+			queued = true
+		}
+	}
+	if queued {
+		webhookDeliveries.wake()
+	}
+	return nil
+}
+
+// --------------------------- Webhook delivery ------------------
+
+// signPayload is the signature header value for body: "sha256=" and the
+// hex HMAC-SHA256 of the body keyed with the endpoint's secret.
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliver posts one delivery and returns the response status, if any.
+func deliver(ctx context.Context, h webhook, d webhookDelivery) (int, error) {
+	var body bytes.Buffer
+	if err := json.Compact(&body, d.Payload); err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body.Bytes()))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "blog-webhook ("+cfg.SiteTitle+")")
+	req.Header.Set("X-Blog-Event", d.Event)
+	req.Header.Set("X-Blog-Delivery", d.ID)
+	req.Header.Set(webhookSigHeader, signPayload(h.Secret, body.Bytes()))
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, webhookBodyExcerpt))
+		if msg := strings.TrimSpace(string(b)); msg != "" {
+			return resp.StatusCode, fmt.Errorf("%s: %s", resp.Status, msg)
+		}
+		return resp.StatusCode, errors.New(resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// webhookRetryDelay doubles from webhookRetryBase with every attempt.
+func webhookRetryDelay(attempts int) time.Duration {
+	return webhookRetryBase << (attempts - 1)
+}
+
+// processWebhooks posts every delivery that is due, then records the
+// outcomes. Sending happens without the lock, so saves aren't held up by
+// slow endpoints.
+func processWebhooks(ctx context.Context) {
+	if err := deliverWebhooks(ctx); err != nil {
+		slog.Error("deliver webhooks", "err", err)
+	}
+}
+
+func deliverWebhooks(ctx context.Context) error {
+	type job struct {
+		hook webhook
+		d    webhookDelivery
+		code int
+		err  error
+		at   time.Time
+	}
+	var jobs []job
+	webhookMu.Lock()
+	hooks, err := loadWebhooks()
+	for _, h := range hooks {
+		if err != nil {
+			break
+		}
+		var ds []webhookDelivery
+		ds, err = loadDeliveries(h.ID)
+		for _, d := range ds {
+			if d.Status == deliveryPending && !d.NextTry.After(time.Now()) {
+				jobs = append(jobs, job{hook: h, d: d})
+			}
+		}
+	}
+	webhookMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for i := range jobs {
+		if ctx.Err() != nil {
+			jobs = jobs[:i]
+			break
+		}
+		jobs[i].at = time.Now().UTC()
+		jobs[i].code, jobs[i].err = deliver(ctx, jobs[i].hook, jobs[i].d)
+	}
+
+	webhookMu.Lock()
+	defer webhookMu.Unlock()
+	byHook := map[string][]job{}
+	for _, j := range jobs {
+		byHook[j.hook.ID] = append(byHook[j.hook.ID], j)
+	}
+	for id, js := range byHook {
+		if _, err := os.Stat(deliveriesPath(id)); errors.Is(err, os.ErrNotExist) {
+			continue // endpoint deleted meanwhile
+		}
+		ds, err := loadDeliveries(id)
+		if err != nil {
+			return err
+		}
+		for _, j := range js {
+			i := slices.IndexFunc(ds, func(d webhookDelivery) bool { return d.ID == j.d.ID })
+			if i < 0 {
+				continue
+			}
+			d := &ds[i]
+			d.Attempts++
+			d.Last, d.Code, d.Error, d.NextTry = j.at, j.code, "", time.Time{}
+			switch {
+			case j.err == nil:
+				d.Status = deliveryDelivered
+			case d.Attempts >= webhookAttempts:
+				d.Status, d.Error = deliveryFailed, j.err.Error()
+				slog.Warn("webhook delivery failed", "url", j.hook.URL, "event", d.Event, "delivery", d.ID, "attempts", d.Attempts, "err", j.err)
+			default:
+				d.Error = j.err.Error()
+				d.NextTry = j.at.Add(webhookRetryDelay(d.Attempts))
+			}
+			slog.Info("webhook delivery", "url", j.hook.URL, "event", d.Event, "delivery", d.ID, "status", d.Status, "code", d.Code)
+		}
+		if err := saveDeliveries(id, ds); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// --------------------------- Handlers (webhooks) ---------------
+
+type webhookView struct {
+	webhook
+	Deliveries []webhookDelivery // newest first
+	Failing    bool              // the latest finished delivery failed
+}
+
+func adminWebhooksGet(w http.ResponseWriter, r *http.Request, errMsg string) {
+	webhookMu.Lock()
+	hooks, err := loadWebhooks()
+	var views []webhookView
+	for _, h := range hooks {
+		if err != nil {
+			break
+		}
+		v := webhookView{webhook: h}
+		v.Deliveries, err = loadDeliveries(h.ID)
+		slices.Reverse(v.Deliveries)
+		for _, d := range v.Deliveries {
+			if d.Status != deliveryPending || d.Attempts > 0 {
+				v.Failing = d.Status != deliveryDelivered
+				break
+			}
+		}
+		views = append(views, v)
+	}
+	webhookMu.Unlock()
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	data := map[string]any{"Active": "admin_webhooks", "Title": "Webhooks", "Hooks": views, "Events": webhookEvents, "Error": errMsg, "Form": r.PostForm, "Attempts": webhookAttempts}
+	render(w, r, data)
+}
+
+func adminWebhooksPost(w http.ResponseWriter, r *http.Request) {
+	_ = r.ParseForm()
+	var err error
+	switch r.FormValue("action") {
+	case "add":
+		var h webhook
+		if h, err = addWebhook(r.FormValue("url"), r.FormValue("secret"), r.Form["event"]); err != nil {
+			adminWebhooksGet(w, r, err.Error())
+			return
+		}
+		audit(r, "webhook.add", "", "", fmt.Sprintf("%s for %s", h.URL, strings.Join(h.Events, ", ")))
+	case "delete":
+		var h webhook
+		if h, err = deleteWebhook(r.FormValue("hook")); err == nil {
+			audit(r, "webhook.delete", "", "", h.URL)
+		}
+	case "redeliver":
+		var d webhookDelivery
+		if d, err = redeliver(r.FormValue("hook"), r.FormValue("delivery")); err == nil {
+			audit(r, "webhook.redeliver", "", "", fmt.Sprintf("%s of delivery %s", d.Event, d.Redelivery))
+		}
+	default:
+		renderError(w, r, http.StatusBadRequest, nil)
+		return
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		notFound(w, r)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, "/admin/webhooks", http.StatusFound)
+}
+
+// addWebhook registers an endpoint; an empty secret gets a random one.
+func addWebhook(rawURL, secret string, events []string) (webhook, error) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return webhook{}, errors.New("URL must be an absolute http(s) URL")
+	}
+	var evs []string
+	for _, ev := range webhookEvents {
+		if slices.Contains(events, ev) {
+			evs = append(evs, ev)
+		}
+	}
+	if len(evs) == 0 {
+		return webhook{}, errors.New("pick at least one event")
+	}
+	if secret = strings.TrimSpace(secret); secret == "" {
+		secret = newToken(32)
+	}
+	h := webhook{ID: newToken(12), URL: u.String(), Secret: secret, Events: evs, Created: time.Now().UTC()}
+	webhookMu.Lock()
+	defer webhookMu.Unlock()
+	hs, err := loadWebhooks()
+	if err != nil {
+		return webhook{}, err
+	}
+	if err := saveDeliveries(h.ID, nil); err != nil {
+		return webhook{}, err
+	}
+	return h, saveWebhooks(append(hs, h))
+}
+
+// deleteWebhook removes an endpoint with its log and queue.
+func deleteWebhook(id string) (webhook, error) {
+	webhookMu.Lock()
+	defer webhookMu.Unlock()
+	hs, err := loadWebhooks()
+	if err != nil {
+		return webhook{}, err
+	}
+	i := slices.IndexFunc(hs, func(h webhook) bool { return h.ID == id })
+	if i < 0 {
+		return webhook{}, os.ErrNotExist
+	}
+	h := hs[i]
+	if err := saveWebhooks(slices.Delete(hs, i, i+1)); err != nil {
+		return webhook{}, err
+	}
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	if err := os.Remove(deliveriesPath(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return webhook{}, err
+	}
+	return h, nil
+}
+
+// redeliver queues the payload of an earlier delivery again, under a new
+// delivery ID, whatever became of the original.
+func redeliver(hookID, deliveryID string) (webhookDelivery, error) {
+	webhookMu.Lock()
+	defer webhookMu.Unlock()
+	hs, err := loadWebhooks()
+	if err != nil {
+		return webhookDelivery{}, err
+	}
+	if !slices.ContainsFunc(hs, func(h webhook) bool { return h.ID == hookID }) {
+		return webhookDelivery{}, os.ErrNotExist
+	}
+	ds, err := loadDeliveries(hookID)
+	if err != nil {
+		return webhookDelivery{}, err
+	}
+	i := slices.IndexFunc(ds, func(d webhookDelivery) bool { return d.ID == deliveryID })
+	if i < 0 {
+		return webhookDelivery{}, os.ErrNotExist
+	}
+	now := time.Now().UTC()
+	d := webhookDelivery{ID: newToken(16), Event: ds[i].Event, Payload: ds[i].Payload, Created: now, Status: deliveryPending, NextTry: now, Redelivery: ds[i].ID}
+	if err := saveDeliveries(hookID, append(ds, d)); err != nil {
+		return webhookDelivery{}, err
+	}
+	webhookDeliveries.wake()
+	return d, nil
+}
+
+// --------------------------- Templates (webhooks) --------------
+
+const adminWebhooksHTML = `{{define "admin_webhooks"}}
+  <div class="card bar">
+    <div><h2 class="m-0">Webhooks</h2></div>
+    <div><a href="/admin">Back</a></div>
+  </div>
+  {{range .Hooks}}
+  <div class="card">
+    <div class="bar">
+      <div>
+        <strong>{{.URL}}</strong>{{if .Failing}} <span class="danger ml-8">failing</span>{{end}}
+        <div class="muted">{{range $i, $e := .Events}}{{if $i}}, {{end}}{{$e}}{{end}} · secret <code>{{.Secret}}</code></div>
+      </div>
+      <form method="post" action="/admin/webhooks">
+        <input type="hidden" name="hook" value="{{.ID}}" />
+        <button class="danger" name="action" value="delete">Delete</button>
+      </form>
+    </div>
+    {{if not .Deliveries}}
+      <p class="muted">No deliveries yet.</p>
+    {{else}}
+    <table class="mt-12">
+      <thead>
+        <tr><th>Queued</th><th>Event</th><th>Status</th><th>Attempts</th><th>Response</th><th></th></tr>
+      </thead>
+      <tbody>
+        {{range $d := .Deliveries}}
+        <tr>
+          <td>{{$d.Created.Format "Jan 02 15:04:05"}}{{with $d.Redelivery}}<div class="muted">redelivery</div>{{end}}</td>
+          <td>{{$d.Event}}</td>
+          <td>{{$d.Status}}{{if eq $d.Status "pending"}}{{if $d.Attempts}}<div class="muted">next try {{$d.NextTry.Format "15:04:05"}}</div>{{end}}{{end}}</td>
+          <td>{{$d.Attempts}}</td>
+          <td>{{with $d.Code}}{{.}}{{end}}{{with $d.Error}}<div class="muted">{{.}}</div>{{end}}</td>
+          <td>
+            <form method="post" action="/admin/webhooks">
+              <input type="hidden" name="hook" value="{{$.ID}}" />
+              <input type="hidden" name="delivery" value="{{$d.ID}}" />
+              <button name="action" value="redeliver">Redeliver</button>
+            </form>
+          </td>
+        </tr>
+        {{end}}
+      </tbody>
+    </table>
+    {{end}}
+  </div>
+  {{end}}
+  <form method="post" action="/admin/webhooks" class="card">
+    <h3 class="mt-0">Add endpoint</h3>
+    {{with .Error}}<div class="card danger mb-12">{{.}}</div>{{end}}
+    <div class="row">
+      <div>
+        <label>Payload URL</label>
+        <input name="url" value="{{.Form.Get "url"}}" placeholder="https://ci.example.com/hooks/blog" required />
+      </div>
+      <div>
+        <label>Secret (blank to generate)</label>
+        <input name="secret" autocomplete="off" />
+      </div>
+    </div>
+    <div class="mt-12">
+      {{range .Events}}<label class="ml-8"><input type="checkbox" name="event" value="{{.}}" checked /> {{.}}</label>{{end}}
+    </div>
+    <div class="mt-12"><button name="action" value="add">Add webhook</button></div>
+  </form>
+  <p class="muted">Each delivery is a JSON POST signed with <code>X-Blog-Signature: sha256=&lt;HMAC-SHA256 of the body&gt;</code>. Failed deliveries are tried up to {{.Attempts}} times with exponential backoff.</p>
+{{end}}`
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type hookRequest struct {
+	header http.Header
+	body   []byte
+}
+
+// hookReceiver records deliveries and answers with the status from status.
+func hookReceiver(t *testing.T, status func() int) (*httptest.Server, func() []hookRequest) {
+	t.Helper()
+	var mu sync.Mutex
+	var got []hookRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		got = append(got, hookRequest{r.Header, b})
+		mu.Unlock()
+		w.WriteHeader(status())
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() []hookRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]hookRequest(nil), got...)
+	}
+}
+
+func TestWebhooks_SignedDeliveriesForSubscribedEvents(t *testing.T) {
+	resetStorage(t)
+	ts := httptest.NewServer(buildMux())
+	defer ts.Close()
+	cookie := login(t, ts.URL, cfg.AdminUser, cfg.AdminPass)
+	hook, received := hookReceiver(t, func() int { return http.StatusNoContent })
+
+	form := url.Values{"action": {"add"}, "url": {hook.URL + "/deploy"}, "secret": {"s3cret"}, "event": {"article.published", "article.deleted", "bogus"}}
+	if resp := postForm(t, ts.URL, "/admin/webhooks", cookie, form); resp.StatusCode != http.StatusFound {
+		t.Fatalf("add: %d", resp.StatusCode)
+	}
+	hooks, _ := loadWebhooks()
+	if len(hooks) != 1 || strings.Join(hooks[0].Events, ",") != "article.published,article.deleted" {
+		t.Fatalf("hooks: %+v", hooks)
+	}
+
+	// a draft is created (not subscribed), published, edited (not
+	// subscribed) and deleted
+	postForm(t, ts.URL, "/admin/new", cookie, url.Values{"title": {"Ship It"}, "content": {"v1"}, "date": {"2024-05-06"}, "draft": {"on"}})
+	postForm(t, ts.URL, "/admin/edit/ship-it", cookie, url.Values{"title": {"Ship It"}, "content": {"v2"}, "date": {"2024-05-06"}})
+	postForm(t, ts.URL, "/admin/edit/ship-it", cookie, url.Values{"title": {"Ship It"}, "content": {"v3"}, "date": {"2024-05-06"}})
+	postForm(t, ts.URL, "/admin/delete/ship-it", cookie, url.Values{})
+	processWebhooks(context.Background())
+
+	got := received()
+	if len(got) != 2 {
+		t.Fatalf("%d deliveries, want 2", len(got))
+	}
+	for i, want := range []struct{ event, content string }{{"article.published", "v2"}, {"article.deleted", "v3"}} {
+		h := got[i].header
+		if h.Get("X-Blog-Event") != want.event || h.Get("Content-Type") != "application/json" || h.Get("X-Blog-Delivery") == "" {
+			t.Fatalf("delivery %d headers: %v", i, h)
+		}
+		if sig := h.Get(webhookSigHeader); sig != signPayload("s3cret", got[i].body) || !strings.HasPrefix(sig, "sha256=") {
+			t.Fatalf("delivery %d signature %q", i, sig)
+		}
+		var p webhookPayload
+		if err := json.Unmarshal(got[i].body, &p); err != nil {
+			t.Fatal(err)
+		}
+		if p.Event != want.event || p.Article.Slug != "ship-it" || p.Article.Content != want.content || p.OccurredAt.IsZero() {
+			t.Fatalf("delivery %d payload: %s", i, got[i].body)
+		}
+	}
+
+	ds, _ := loadDeliveries(hooks[0].ID)
+	if len(ds) != 2 || ds[0].Status != deliveryDelivered || ds[0].Code != http.StatusNoContent || ds[0].Attempts != 1 {
+		t.Fatalf("log: %+v", ds)
+	}
+	_, body := getBody(t, ts.URL, "/admin/webhooks", cookie)
+	if !strings.Contains(body, hook.URL+"/deploy") || strings.Count(body, ">delivered<") != 2 {
+		t.Fatalf("admin page:\n%s", body)
+	}
+	if entries, _ := readAudit(auditFilter{Action: "webhook.add"}); len(entries) != 1 {
+		t.Fatal("webhook not audited")
+	}
+}
+
+func TestWebhooks_RetryBackoffAndRedelivery(t *testing.T) {
+	resetStorage(t)
+	ts := httptest.NewServer(buildMux())
+	defer ts.Close()
+	cookie := login(t, ts.URL, cfg.AdminUser, cfg.AdminPass)
+	var mu sync.Mutex
+	status := http.StatusBadGateway
+	hook, received := hookReceiver(t, func() int { mu.Lock(); defer mu.Unlock(); return status })
+	h, err := addWebhook(hook.URL, "", webhookEvents)
+	if err != nil || len(h.Secret) != 32 {
+		t.Fatalf("add: %+v %v", h, err)
+	}
+
+	if _, err := runCLI(t, "hello", "new", "-title", "Retry Me"); err != nil {
+		t.Fatal(err)
+	}
+	processWebhooks(context.Background())
+	ds, _ := loadDeliveries(h.ID)
+	if len(ds) != 2 || ds[0].Event != "article.created" || ds[1].Event != "article.published" {
+		t.Fatalf("queued: %+v", ds)
+	}
+	for _, d := range ds {
+		if d.Status != deliveryPending || d.Attempts != 1 || d.Code != http.StatusBadGateway || d.NextTry.Sub(d.Last) != webhookRetryBase {
+			t.Fatalf("after one failure: %+v", d)
+		}
+	}
+
+	// nothing is due yet, so nothing is sent
+	processWebhooks(context.Background())
+	if n := len(received()); n != 2 {
+		t.Fatalf("%d requests before the retry was due", n)
+	}
+
+	// the second attempt waits twice as long, and the last one gives up
+	for i := range ds {
+		ds[i].Attempts = webhookAttempts - 1
+		ds[i].NextTry = time.Now().Add(-time.Second)
+	}
+	ds[1].Attempts = 1
+	if err := saveDeliveries(h.ID, ds); err != nil {
+		t.Fatal(err)
+	}
+	processWebhooks(context.Background())
+	ds, _ = loadDeliveries(h.ID)
+	if ds[0].Status != deliveryFailed || !strings.Contains(ds[0].Error, "502") {
+		t.Fatalf("exhausted delivery: %+v", ds[0])
+	}
+	if ds[1].Status != deliveryPending || ds[1].NextTry.Sub(ds[1].Last) != 2*webhookRetryBase {
+		t.Fatalf("second retry: %+v", ds[1])
+	}
+
+	mu.Lock()
+	status = http.StatusOK
+	mu.Unlock()
+	form := url.Values{"action": {"redeliver"}, "hook": {h.ID}, "delivery": {ds[0].ID}}
+	if resp := postForm(t, ts.URL, "/admin/webhooks", cookie, form); resp.StatusCode != http.StatusFound {
+		t.Fatalf("redeliver: %d", resp.StatusCode)
+	}
+	processWebhooks(context.Background())
+	ds, _ = loadDeliveries(h.ID)
+	if len(ds) != 3 || ds[2].Redelivery != ds[0].ID || ds[2].Status != deliveryDelivered {
+		t.Fatalf("redelivery: %+v", ds)
+	}
+	got := received()
+	if last := got[len(got)-1]; string(last.body) != string(got[0].body) || last.header.Get("X-Blog-Delivery") == got[0].header.Get("X-Blog-Delivery") {
+		t.Fatal("redelivery should repeat the payload under a new delivery ID")
+	}
+	if resp := postForm(t, ts.URL, "/admin/webhooks", cookie, url.Values{"action": {"redeliver"}, "hook": {h.ID}, "delivery": {"nope"}}); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unknown delivery: %d", resp.StatusCode)
+	}
+
+	if resp := postForm(t, ts.URL, "/admin/webhooks", cookie, url.Values{"action": {"delete"}, "hook": {h.ID}}); resp.StatusCode != http.StatusFound {
+		t.Fatalf("delete: %d", resp.StatusCode)
+	}
+	if hooks, _ := loadWebhooks(); len(hooks) != 0 {
+		t.Fatal("webhook not deleted")
+	}
+	if ds, _ := loadDeliveries(h.ID); len(ds) != 0 {
+		t.Fatal("delivery log left behind")
+	}
+}
+
+func TestWebhooks_AddValidates(t *testing.T) {
+	resetStorage(t)
+	ts := httptest.NewServer(buildMux())
+	defer ts.Close()
+	cookie := login(t, ts.URL, cfg.AdminUser, cfg.AdminPass)
+	for _, form := range []url.Values{
+		{"action": {"add"}, "url": {"ftp://example.com"}, "event": {"article.created"}},
+		{"action": {"add"}, "url": {"https://example.com/hook"}},
+	} {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/admin/webhooks", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Cookie", cookie)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if !strings.Contains(string(b), "card danger") {
+			t.Fatalf("%v accepted:\n%s", form, b)
+		}
+	}
+	if hooks, _ := loadWebhooks(); len(hooks) != 0 {
+		t.Fatalf("stored %d webhooks", len(hooks))
+	}
+}
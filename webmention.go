@@ -0,0 +1,1031 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+// --------------------------- Webmention -----------------------
+// Receiving: POST /webmention stores the mention as pending and wakes a
+// background worker, which fetches the source, checks that it links to the
+// target and reads its microformats2 h-entry. Verified mentions are shown
+// under the article. Sending: saving a public article queues a mention to
+// every link in its content; the same worker discovers each target's
+// endpoint and posts to it, retrying with backoff.
+
+const (
+	webmentionsDir     = "webmentions"
+	webmentionOutbox   = "webmention-outbox.json"
+	webmentionMaxBody  = 1 << 20 // bytes read from a fetched page
+	webmentionPending  = 50      // per article, before the endpoint answers 429
+	webmentionAttempts = 5
+	webmentionSweep    = time.Minute
+	webmentionExcerpt  = 280 // runes of content shown under the article
+)
+
+// Webmention states.
+const (
+	mentionPending  = "pending"
+	mentionVerified = "verified"
+	mentionRejected = "rejected"
+)
+
+// Webmention is a received mention of an article. Source is its identity:
+// a repeated mention from the same page replaces the earlier one.
+type Webmention struct {
+	Source     string    `json:"source"`
+	Target     string    `json:"target"`
+	Status     string    `json:"status"`
+	Received   time.Time `json:"received"`
+	Verified   time.Time `json:"verified,omitzero"`
+	Attempts   int       `json:"attempts,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Type       string    `json:"type,omitempty"` // reply, like, repost, bookmark or mention
+	URL        string    `json:"url,omitempty"`
+	Name       string    `json:"name,omitempty"`
+	Content    string    `json:"content,omitempty"`
+	Published  time.Time `json:"published,omitzero"`
+	AuthorName string    `json:"author_name,omitempty"`
+	AuthorURL  string    `json:"author_url,omitempty"`
+}
+
+// Verb describes the mention after the author's name.
+func (m Webmention) Verb() string {
+	switch m.Type {
+	case "reply":
+		return "replied"
+	case "like":
+		return "liked this"
+	case "repost":
+		return "reposted this"
+	case "bookmark":
+		return "bookmarked this"
+	}
+	return "mentioned this"
+}
+
+// Link is the mentioning post's own URL, or the page it was found on.
+func (m Webmention) Link() string {
+	if m.URL != "" {
+		return m.URL
+	}
+	return m.Source
+}
+
+// When is the mention's publication date, or when it was verified.
+func (m Webmention) When() time.Time {
+	if !m.Published.IsZero() {
+		return m.Published
+	}
+	return m.Verified
+}
+
+// outboundMention is a queued notification to a site the blog linked to.
+type outboundMention struct {
+	Source   string    `json:"source"`
+	Target   string    `json:"target"`
+	Queued   time.Time `json:"queued"`
+	NextTry  time.Time `json:"next_try"`
+	Attempts int       `json:"attempts,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+var webmentionMu sync.Mutex
+
+// webmentions verifies received mentions and sends queued ones; it is
+// woken when a mention arrives or an article is saved.
+var webmentions = newWorker(webmentionSweep)
+
+type httpDoer interface {
+	Do(*http.Request) (*http.Response, error)
+}
+
+// webClient fetches sources and targets. The default refuses to connect to
+// loopback and private addresses, so a mention can't be used to probe the
+// local network; tests swap in a plain client for their stand-in servers.
+var webClient httpDoer = &http.Client{Timeout: 15 * time.Second, Transport: publicTransport()}
+
+func publicTransport() *http.Transport {
+	d := &net.Dialer{
+		Timeout: 5 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip, err := netip.ParseAddr(host)
+			if err != nil {
+				return err
+			}
+			if ip = ip.Unmap(); ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsMulticast() {
+				return fmt.Errorf("refusing to connect to non-public address %s", ip)
+			}
+			return nil
+		},
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil // a proxy would connect on our behalf, past the check above
+	t.DialContext = d.DialContext
+	return t
+}
+
+// --------------------------- Webmention storage ----------------
+
+func webmentionsPath(slug string) string {
+	return filepath.Join(metaDir(), webmentionsDir, slug+".json")
+}
+
+func loadWebmentions(slug string) ([]Webmention, error) {
+	b, err := os.ReadFile(webmentionsPath(slug))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ms []Webmention
+	return ms, json.Unmarshal(b, &ms)
+}
+
+func saveWebmentions(slug string, ms []Webmention) error {
+	p := webmentionsPath(slug)
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	if len(ms) == 0 {
+		if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(ms, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(p, b, 0o600)
+}
+
+// webmentionSlugs lists the articles with stored mentions.
+func webmentionSlugs() ([]string, error) {
+	ents, err := os.ReadDir(filepath.Join(metaDir(), webmentionsDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var slugs []string
+	for _, e := range ents {
+		if slug, ok := strings.CutSuffix(e.Name(), ".json"); ok && !e.IsDir() {
+			slugs = append(slugs, slug)
+		}
+	}
+	return slugs, nil
+}
+
+var errTooManyMentions = errors.New("too many mentions waiting for verification")
+
+// receiveWebmention stores a mention of slug as pending.
+func receiveWebmention(slug, source, target string) error {
+	webmentionMu.Lock()
+	defer webmentionMu.Unlock()
+	ms, err := loadWebmentions(slug)
+	if err != nil {
+		return err
+	}
+	m := Webmention{Source: source, Target: target, Status: mentionPending, Received: time.Now().UTC()}
+	pending := 0
+	for _, old := range ms {
+		if old.Status == mentionPending {
+			pending++
+		}
+	}
+	i := indexMention(ms, source)
+	if i < 0 {
+		if pending >= webmentionPending {
+			return errTooManyMentions
+		}
+		ms = append(ms, m)
+	} else {
+		ms[i] = m
+	}
+	return saveWebmentions(slug, ms)
+}
+
+func indexMention(ms []Webmention, source string) int {
+	for i, m := range ms {
+		if m.Source == source {
+			return i
+		}
+	}
+	return -1
+}
+
+func loadOutbox() ([]outboundMention, error) {
+	b, err := os.ReadFile(filepath.Join(metaDir(), webmentionOutbox))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var q []outboundMention
+	return q, json.Unmarshal(b, &q)
+}
+
+func saveOutbox(q []outboundMention) error {
+	if err := os.MkdirAll(metaDir(), 0o700); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(q, "", "  ")
+	if err != nil {
+		return err
+	}
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	return writeFileAtomic(filepath.Join(metaDir(), webmentionOutbox), b, 0o600)
+}
+
+// --------------------------- Webmention sending ----------------
+
+var contentLinkRe = regexp.MustCompile(`https?://[^\s<>"'()\[\]]+`)
+
+// contentLinks lists the distinct absolute links in Markdown content,
+// leaving out the blog's own pages.
+func contentLinks(content string) []string {
+	seen := map[string]bool{}
+	var out []string
+	for _, l := range contentLinkRe.FindAllString(content, -1) {
+		l = strings.TrimRight(l, ".,;:!?*_")
+		if seen[l] || (cfg.BaseURL != "" && strings.HasPrefix(l, cfg.BaseURL+"/")) {
+			continue
+		}
+		seen[l] = true
+		out = append(out, l)
+	}
+	return out
+}
+
+// queueWebmentions notifies every site linked from the public versions of
+// before and after, so targets hear about new links, edits and removed
+// links alike. Either may be the zero Article (created or deleted). Failures
+// are logged: the article itself has been saved by then.
+func queueWebmentions(before, after Article) {
+	var add []outboundMention
+	now := time.Now().UTC()
+	for _, a := range []Article{before, after} {
+		if a.Slug == "" || a.Draft {
+			continue
+		}
+		for _, target := range contentLinks(a.Content) {
+			add = append(add, outboundMention{Source: cfg.BaseURL + "/article/" + a.Slug, Target: target, Queued: now, NextTry: now})
+		}
+	}
+	if len(add) == 0 {
+		return
+	}
+	if cfg.BaseURL == "" {
+		slog.Warn("webmentions not sent: base_url is not set", "links", len(add))
+		return
+	}
+	webmentionMu.Lock()
+	defer webmentionMu.Unlock()
+	q, err := loadOutbox()
+	if err == nil {
+	next:
+		for _, m := range add {
+			for i, old := range q {
+				if old.Source == m.Source && old.Target == m.Target {
+					q[i] = m
+					continue next
+				}
+			}
+			q = append(q, m)
+		}
+		err = saveOutbox(q)
+	}
+	if err != nil {
+		slog.Error("queue webmentions", "err", err)
+		return
+	}
+	webmentions.wake()
+}
+
+// sendWebmentions delivers the queued mentions that are due.
+func sendWebmentions(ctx context.Context) error {
+	webmentionMu.Lock()
+	q, err := loadOutbox()
+	webmentionMu.Unlock()
+	if err != nil {
+		return err
+	}
+	type result struct {
+		m   outboundMention
+		err error
+	}
+	var done []result
+	now := time.Now()
+	for _, m := range q {
+		if m.NextTry.After(now) {
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		done = append(done, result{m, sendWebmention(ctx, m.Source, m.Target)})
+	}
+	if len(done) == 0 {
+		return nil
+	}
+
+	webmentionMu.Lock()
+	defer webmentionMu.Unlock()
+	if q, err = loadOutbox(); err != nil {
+		return err
+	}
+	for _, d := range done {
+		i := slices.IndexFunc(q, func(m outboundMention) bool {
+			return m.Source == d.m.Source && m.Target == d.m.Target && m.Queued.Equal(d.m.Queued)
+		})
+		if i < 0 {
+			continue // re-queued by a newer save while we were sending
+		}
+		var perm *permanentError
+		switch {
+		case d.err == nil:
+			slog.Info("webmention sent", "source", d.m.Source, "target", d.m.Target)
+		case errors.As(d.err, &perm) || q[i].Attempts+1 >= webmentionAttempts:
+			slog.Warn("webmention failed", "source", d.m.Source, "target", d.m.Target, "err", d.err)
+		default:
+			q[i].Attempts++
+			q[i].Error = d.err.Error()
+			q[i].NextTry = time.Now().Add(retryDelay(q[i].Attempts)).UTC()
+			continue
+		}
+		q = append(q[:i], q[i+1:]...)
+	}
+	return saveOutbox(q)
+}
+
+// retryDelay backs off from a minute, quadrupling per attempt.
+func retryDelay(attempts int) time.Duration {
+	return time.Minute << (2 * (attempts - 1))
+}
+
+// permanentError marks a failure that retrying won't fix.
+type permanentError struct{ err error }
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+func permanent(format string, args ...any) error {
+	return &permanentError{fmt.Errorf(format, args...)}
+}
+
+// fetch GETs u and returns up to webmentionMaxBody bytes of its body.
+// Client errors are permanent; server and network errors are not.
+func fetch(ctx context.Context, u string) (*http.Response, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, nil, permanent("%v", err)
+	}
+	req.Header.Set("Accept", "text/html, application/xhtml+xml;q=0.9, */*;q=0.1")
+	req.Header.Set("User-Agent", "blog-webmention ("+cfg.SiteTitle+")")
+	resp, err := webClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, webmentionMaxBody))
+	if err != nil {
+		return resp, nil, err
+	}
+	switch {
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return resp, b, fmt.Errorf("GET %s: %s", u, resp.Status)
+	case resp.StatusCode >= 400:
+		return resp, b, permanent("GET %s: %s", u, resp.Status)
+	}
+	return resp, b, nil
+}
+
+// sendWebmention discovers target's endpoint and posts the mention to it.
+// A target without an endpoint is not an error.
+func sendWebmention(ctx context.Context, source, target string) error {
+	resp, body, err := fetch(ctx, target)
+	if err != nil {
+		return err
+	}
+	endpoint := discoverEndpoint(resp, body)
+	if endpoint == "" {
+		slog.Debug("no webmention endpoint", "target", target)
+		return nil
+	}
+	form := url.Values{"source": {source}, "target": {target}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return permanent("%v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err = webClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return fmt.Errorf("POST %s: %s", endpoint, resp.Status)
+	case resp.StatusCode >= 300:
+		return permanent("POST %s: %s", endpoint, resp.Status)
+	}
+	return nil
+}
+
+var linkHeaderRe = regexp.MustCompile(`<([^>]*)>\s*((?:;\s*[^;,]+)*)`)
+
+// discoverEndpoint finds the webmention endpoint a page advertises, first
+// in its Link headers, then in <link> and <a> elements; it is resolved
+// against the final URL after redirects.
+func discoverEndpoint(resp *http.Response, body []byte) string {
+	base := resp.Request.URL
+	resolve := func(href string) string {
+		u, err := base.Parse(href)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return ""
+		}
+		return u.String()
+	}
+	for _, h := range resp.Header.Values("Link") {
+		for _, m := range linkHeaderRe.FindAllStringSubmatch(h, -1) {
+			for _, param := range strings.Split(m[2], ";") {
+				k, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if strings.EqualFold(k, "rel") && hasToken(strings.Trim(v, `"`), "webmention") {
+					return resolve(m[1])
+				}
+			}
+		}
+	}
+	if !isHTML(resp) {
+		return ""
+	}
+	ns := parseHTML(string(body)).findAll(func(n *htmlNode) bool {
+		return (n.Tag == "link" || n.Tag == "a") && hasToken(n.attr("rel"), "webmention") && n.hasAttr("href")
+	})
+	if len(ns) == 0 {
+		return ""
+	}
+	return resolve(ns[0].attr("href"))
+}
+
+func hasToken(list, tok string) bool {
+	for _, f := range strings.Fields(list) {
+		if strings.EqualFold(f, tok) {
+			return true
+		}
+	}
+	return false
+}
+
+func isHTML(resp *http.Response) bool {
+	ct := resp.Header.Get("Content-Type")
+	return ct == "" || strings.Contains(ct, "html")
+}
+
+// --------------------------- Webmention receiving --------------
+
+// webmentionTarget checks a received mention and returns the slug of the
+// article it targets, or an error fit to show the sender.
+func webmentionTarget(r *http.Request, source, target string) (string, error) {
+	su, err := url.Parse(source)
+	if err != nil || (su.Scheme != "http" && su.Scheme != "https") || su.Host == "" {
+		return "", errors.New("source must be an http(s) URL")
+	}
+	tu, err := url.Parse(target)
+	if err != nil || (tu.Scheme != "http" && tu.Scheme != "https") || tu.Host == "" {
+		return "", errors.New("target must be an http(s) URL")
+	}
+	if stripFragment(source) == stripFragment(target) {
+		return "", errors.New("source and target are the same")
+	}
+	host, prefix := r.Host, "/article/"
+	if cfg.BaseURL != "" {
+		bu, _ := url.Parse(cfg.BaseURL) // validated by config
+		host, prefix = bu.Host, bu.Path+prefix
+	}
+	slug, ok := strings.CutPrefix(tu.Path, prefix)
+	slug = strings.TrimSuffix(slug, "/")
+	if !strings.EqualFold(tu.Host, host) || !ok || slug == "" || slug != makeSlug(slug) {
+		return "", errors.New("target is not an article on this site")
+	}
+	if a, err := loadArticle(slug); err != nil || a.Draft {
+		return "", errors.New("target is not an article on this site")
+	}
+	return slug, nil
+}
+
+func stripFragment(u string) string {
+	u, _, _ = strings.Cut(u, "#")
+	return strings.TrimSuffix(u, "/")
+}
+
+// webmentionPost is the receiving endpoint. Verification happens later, so
+// a valid request is answered with 202 Accepted.
+func webmentionPost(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 16<<10)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid form", http.StatusBadRequest)
+		return
+	}
+	source, target := strings.TrimSpace(r.PostFormValue("source")), strings.TrimSpace(r.PostFormValue("target"))
+	slug, err := webmentionTarget(r, source, target)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch err := receiveWebmention(slug, source, target); {
+	case errors.Is(err, errTooManyMentions):
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	case err != nil:
+		slog.ErrorContext(r.Context(), "store webmention", "err", err)
+		http.Error(w, "could not store the mention", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "webmention received", "source", source, "slug", slug, "ip", clientIP(r))
+	webmentions.wake()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintln(w, "Accepted; the mention will be verified shortly.")
+}
+
+// verifyWebmentions checks every pending mention. Network errors leave a
+// mention pending for the next sweep, up to webmentionAttempts tries.
+func verifyWebmentions(ctx context.Context) error {
+	webmentionMu.Lock()
+	slugs, err := webmentionSlugs()
+	webmentionMu.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, slug := range slugs {
+		webmentionMu.Lock()
+		ms, err := loadWebmentions(slug)
+		webmentionMu.Unlock()
+		if err != nil {
+			return err
+		}
+		var checked []Webmention
+		for _, m := range ms {
+			if m.Status == mentionPending && ctx.Err() == nil {
+				checked = append(checked, verifyWebmention(ctx, m))
+			}
+		}
+		if len(checked) == 0 {
+			continue
+		}
+		if err := storeVerified(slug, checked); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storeVerified writes back checked mentions, unless the sender re-sent
+// one in the meantime.
+func storeVerified(slug string, checked []Webmention) error {
+	webmentionMu.Lock()
+	defer webmentionMu.Unlock()
+	ms, err := loadWebmentions(slug)
+	if err != nil {
+		return err
+	}
+	for _, c := range checked {
+		if i := indexMention(ms, c.Source); i >= 0 && ms[i].Received.Equal(c.Received) {
+			ms[i] = c
+			slog.Info("webmention checked", "source", c.Source, "slug", slug, "status", c.Status, "err", c.Error)
+		}
+	}
+	if err := saveWebmentions(slug, ms); err != nil {
+		return err
+	}
+	pages.invalidate(articleDep(slug))
+	return nil
+}
+
+// verifyWebmention fetches m's source and fills in what it says about the
+// article; a source that is gone or no longer links to the target rejects
+// the mention, which also hides one verified earlier.
+func verifyWebmention(ctx context.Context, m Webmention) Webmention {
+	resp, body, err := fetch(ctx, m.Source)
+	var perm *permanentError
+	if err != nil && !errors.As(err, &perm) {
+		if m.Attempts++; m.Attempts < webmentionAttempts {
+			m.Error = err.Error()
+			return m
+		}
+	}
+	out := Webmention{Source: m.Source, Target: m.Target, Received: m.Received, Status: mentionRejected, Verified: time.Now().UTC()}
+	if err != nil {
+		out.Error = err.Error()
+		return out
+	}
+	base := resp.Request.URL
+	if !isHTML(resp) {
+		if strings.Contains(string(body), m.Target) {
+			out.Status, out.Type = mentionVerified, "mention"
+		} else {
+			out.Error = "source does not link to target"
+		}
+		return out
+	}
+	doc := parseHTML(string(body))
+	links := func(n *htmlNode) bool {
+		return len(n.findAll(func(n *htmlNode) bool { return linksTo(n, base, m.Target) })) > 0
+	}
+	if !links(doc) {
+		out.Error = "source does not link to target"
+		return out
+	}
+	out.Status, out.Type = mentionVerified, "mention"
+	entries := doc.findAll(func(n *htmlNode) bool { return n.hasClass("h-entry") })
+	if len(entries) == 0 {
+		if t := doc.findAll(func(n *htmlNode) bool { return n.Tag == "title" }); len(t) > 0 {
+			out.Name = t[0].text()
+		}
+		out.AuthorName = base.Hostname()
+		return out
+	}
+	entry := entries[0]
+	for _, e := range entries {
+		if links(e) {
+			entry = e
+			break
+		}
+	}
+	h := parseHEntry(entry, base)
+	out.Name, out.URL, out.Published = h.Name, h.URL, h.Published
+	out.AuthorName, out.AuthorURL = h.AuthorName, h.AuthorURL
+	if out.AuthorName == "" {
+		out.AuthorName = base.Hostname()
+	}
+	out.Content = excerpt(h.Content, webmentionExcerpt)
+	switch target := stripFragment(m.Target); {
+	case containsURL(h.InReplyTo, target):
+		out.Type = "reply"
+	case containsURL(h.LikeOf, target):
+		out.Type = "like"
+	case containsURL(h.RepostOf, target):
+		out.Type = "repost"
+	case containsURL(h.BookmarkOf, target):
+		out.Type = "bookmark"
+	}
+	return out
+}
+
+// linksTo reports whether element n links to target.
+func linksTo(n *htmlNode, base *url.URL, target string) bool {
+	for _, name := range []string{"href", "src"} {
+		if v := n.attr(name); v != "" {
+			if u, err := base.Parse(v); err == nil && stripFragment(u.String()) == stripFragment(target) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func containsURL(list []string, target string) bool {
+	for _, u := range list {
+		if stripFragment(u) == target {
+			return true
+		}
+	}
+	return false
+}
+
+func excerpt(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	r := []rune(s)
+	return strings.TrimSpace(string(r[:n])) + "…"
+}
+
+// addMentionData lists the verified mentions of a under the article.
+func addMentionData(a Article, data map[string]any) error {
+	webmentionMu.Lock()
+	ms, err := loadWebmentions(a.Slug)
+	webmentionMu.Unlock()
+	if err != nil {
+		return err
+	}
+	var shown []Webmention
+	modified, _ := data["Modified"].(time.Time)
+	for _, m := range ms {
+		if m.Status == mentionVerified {
+			shown = append(shown, m)
+			if m.Verified.After(modified) {
+				modified = m.Verified
+			}
+		}
+	}
+	sort.Slice(shown, func(i, j int) bool { return shown[i].When().Before(shown[j].When()) })
+	data["Mentions"], data["Modified"] = shown, modified
+	return nil
+}
+
+// --------------------------- Webmention worker -----------------
+
+func processWebmentions(ctx context.Context) {
+	if err := verifyWebmentions(ctx); err != nil {
+		slog.Error("verify webmentions", "err", err)
+	}
+	if err := sendWebmentions(ctx); err != nil {
+		slog.Error("send webmentions", "err", err)
+	}
+}
+
+// --------------------------- HTML & microformats ---------------
+// Just enough of an HTML tree to read h-entry markup: elements nest as
+// written, void elements never hold children, stray end tags are ignored
+// and unclosed ones end with their parent.
+
+type htmlNode struct {
+	Tag      string // "" for text
+	Attrs    string // raw attribute source
+	Text     string
+	Children []*htmlNode
+}
+
+var htmlVoid = map[string]bool{"area": true, "base": true, "br": true, "col": true, "embed": true, "hr": true, "img": true, "input": true, "link": true, "meta": true, "source": true, "track": true, "wbr": true}
+
+func parseHTML(src string) *htmlNode {
+	root := &htmlNode{Tag: "#document"}
+	stack := []*htmlNode{root}
+	top := func() *htmlNode { return stack[len(stack)-1] }
+	text := func(s string) {
+		if s != "" {
+			top().Children = append(top().Children, &htmlNode{Text: html.UnescapeString(s)})
+		}
+	}
+	last := 0
+	for _, m := range htmlTagRe.FindAllStringSubmatchIndex(src, -1) {
+		if m[0] < last {
+			continue // inside a skipped script or style
+		}
+		text(src[last:m[0]])
+		last = m[1]
+		if m[4] < 0 {
+			continue // comment
+		}
+		tag := strings.ToLower(src[m[4]:m[5]])
+		if m[3] > m[2] {
+			for i := len(stack) - 1; i > 0; i-- {
+				if stack[i].Tag == tag {
+					stack = stack[:i]
+					break
+				}
+			}
+			continue
+		}
+		if tag == "script" || tag == "style" {
+			end := strings.Index(strings.ToLower(src[last:]), "</"+tag)
+			if end < 0 {
+				last = len(src)
+				break
+			}
+			last += end
+			continue
+		}
+		n := &htmlNode{Tag: tag, Attrs: src[m[6]:m[7]]}
+		top().Children = append(top().Children, n)
+		if !htmlVoid[tag] && !strings.HasSuffix(n.Attrs, "/") {
+			stack = append(stack, n)
+		}
+	}
+	if last < len(src) {
+		text(src[last:])
+	}
+	return root
+}
+
+func (n *htmlNode) attr(name string) string { return htmlAttr(n.Attrs, name) }
+
+func (n *htmlNode) hasAttr(name string) bool {
+	for _, m := range htmlAttrRe.FindAllStringSubmatch(n.Attrs, -1) {
+		if strings.EqualFold(m[1], name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *htmlNode) hasClass(c string) bool { return hasToken(n.attr("class"), c) }
+
+// isRoot reports whether n is a microformats2 root (h-*) element.
+func (n *htmlNode) isRoot() bool {
+	for _, c := range strings.Fields(n.attr("class")) {
+		if strings.HasPrefix(c, "h-") {
+			return true
+		}
+	}
+	return false
+}
+
+// findAll lists the elements under n, n excluded, that match, in document
+// order.
+func (n *htmlNode) findAll(match func(*htmlNode) bool) []*htmlNode {
+	var out []*htmlNode
+	var walk func(*htmlNode)
+	walk = func(n *htmlNode) {
+		for _, c := range n.Children {
+			if c.Tag == "" {
+				continue
+			}
+			if match(c) {
+				out = append(out, c)
+			}
+			walk(c)
+		}
+	}
+	walk(n)
+	return out
+}
+
+var htmlBlocks = map[string]bool{"p": true, "div": true, "br": true, "li": true, "blockquote": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true, "pre": true, "tr": true}
+
+// text is n's text content with whitespace collapsed.
+func (n *htmlNode) text() string {
+	var b strings.Builder
+	var walk func(*htmlNode)
+	walk = func(n *htmlNode) {
+		if n.Tag == "" {
+			b.WriteString(n.Text)
+			return
+		}
+		if n.Tag == "img" {
+			b.WriteString(n.attr("alt"))
+		}
+		for _, c := range n.Children {
+			walk(c)
+		}
+		if htmlBlocks[n.Tag] {
+			b.WriteByte(' ')
+		}
+	}
+	walk(n)
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+// hEntry holds the h-entry properties the blog shows.
+type hEntry struct {
+	Name, Content, URL    string
+	Published             time.Time
+	AuthorName, AuthorURL string
+	InReplyTo, LikeOf     []string
+	RepostOf, BookmarkOf  []string
+}
+
+// parseHEntry reads the properties of the h-entry at n. Nested h-* roots
+// are only looked into for the author's h-card and cited URLs.
+func parseHEntry(n *htmlNode, base *url.URL) hEntry {
+	var h hEntry
+	resolve := func(v string) string {
+		if u, err := base.Parse(strings.TrimSpace(v)); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+			return u.String()
+		}
+		return ""
+	}
+	// u-* values come from href or src, falling back to the text
+	urlValue := func(n *htmlNode) string {
+		for _, a := range []string{"href", "src"} {
+			if n.hasAttr(a) {
+				return resolve(n.attr(a))
+			}
+		}
+		return resolve(n.text())
+	}
+	// cited is a u-in-reply-to (or like) value: a link, or an h-cite's u-url
+	cited := func(n *htmlNode) string {
+		if n.isRoot() {
+			if us := n.findAll(func(c *htmlNode) bool { return c.hasClass("u-url") }); len(us) > 0 {
+				return urlValue(us[0])
+			}
+		}
+		return urlValue(n)
+	}
+	var walk func(*htmlNode)
+	walk = func(p *htmlNode) {
+		for _, c := range p.Children {
+			if c.Tag == "" {
+				continue
+			}
+			switch {
+			case c.hasClass("p-author") || c.hasClass("u-author"):
+				if h.AuthorName == "" {
+					h.AuthorName, h.AuthorURL = parseAuthor(c, urlValue)
+				}
+			case c.hasClass("u-in-reply-to"):
+				h.InReplyTo = append(h.InReplyTo, cited(c))
+			case c.hasClass("u-like-of"):
+				h.LikeOf = append(h.LikeOf, cited(c))
+			case c.hasClass("u-repost-of"):
+				h.RepostOf = append(h.RepostOf, cited(c))
+			case c.hasClass("u-bookmark-of"):
+				h.BookmarkOf = append(h.BookmarkOf, cited(c))
+			}
+			if c.isRoot() {
+				continue
+			}
+			if c.hasClass("p-name") && h.Name == "" {
+				h.Name = c.text()
+			}
+			if c.hasClass("e-content") && h.Content == "" {
+				h.Content = c.text()
+			}
+			if c.hasClass("p-summary") && h.Content == "" {
+				h.Content = c.text()
+			}
+			if c.hasClass("u-url") && h.URL == "" {
+				h.URL = urlValue(c)
+			}
+			if c.hasClass("dt-published") && h.Published.IsZero() {
+				v := c.attr("datetime")
+				if v == "" {
+					v = c.text()
+				}
+				h.Published = parseMF2Time(v)
+			}
+			walk(c)
+		}
+	}
+	walk(n)
+	if h.Name == h.Content {
+		h.Name = "" // an implied name repeats the content
+	}
+	return h
+}
+
+// parseAuthor reads a p-author: an h-card's p-name and u-url, or the
+// element's own text and link.
+func parseAuthor(n *htmlNode, urlValue func(*htmlNode) string) (name, link string) {
+	name = n.text()
+	if n.Tag == "a" {
+		link = urlValue(n)
+	}
+	if !n.hasClass("h-card") {
+		return name, link
+	}
+	if ns := n.findAll(func(c *htmlNode) bool { return c.hasClass("p-name") }); len(ns) > 0 {
+		name = ns[0].text()
+	}
+	if us := n.findAll(func(c *htmlNode) bool { return c.hasClass("u-url") }); len(us) > 0 {
+		link = urlValue(us[0])
+	}
+	return name, link
+}
+
+var mf2TimeLayouts = []string{time.RFC3339, "2006-01-02T15:04:05-0700", "2006-01-02T15:04Z07:00", "2006-01-02 15:04:05Z07:00", "2006-01-02T15:04:05", "2006-01-02 15:04", "2006-01-02"}
+
+func parseMF2Time(s string) time.Time {
+	s = strings.TrimSpace(s)
+	for _, l := range mf2TimeLayouts {
+		if t, err := time.Parse(l, s); err == nil {
+			return t.UTC()
+		}
+	}
+	return time.Time{}
+}
+
+const webmentionsHTML = `{{define "webmentions"}}{{with .Mentions}}
+  <section class="card" id="mentions">
+    <h2 class="mt-0">Mentions ({{len .}})</h2>
+    {{range .}}
+    <div class="comment">
+      <div class="muted">{{if .AuthorURL}}<a href="{{.AuthorURL}}" rel="nofollow ugc">{{.AuthorName}}</a>{{else}}{{.AuthorName}}{{end}} {{.Verb}} · <a href="{{.Link}}" rel="nofollow ugc">{{date .When}}</a></div>
+      {{with .Content}}<div class="comment-body">{{.}}</div>{{else}}{{with .Name}}<div class="comment-body">{{.}}</div>{{end}}{{end}}
+    </div>
+    {{end}}
+  </section>
+{{end}}{{end}}`
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useLocalWebClient lets the worker reach httptest servers on loopback.
+func useLocalWebClient(t *testing.T) {
+	t.Helper()
+	saved := webClient
+	webClient = &http.Client{Timeout: 5 * time.Second}
+	t.Cleanup(func() { webClient = saved })
+}
+
+func sendMention(t *testing.T, base, source, target string) (int, string) {
+	t.Helper()
+	resp, err := http.PostForm(base+"/webmention", url.Values{"source": {source}, "target": {target}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode, resp.Status
+}
+
+func TestWebmention_ReceiveVerifyAndShow(t *testing.T) {
+	resetStorage(t)
+	useLocalWebClient(t)
+	if err := saveArticle(Article{Title: "Talk", Slug: "talk", Content: "x", Published: time.Now().Add(-time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(buildMux())
+	defer ts.Close()
+	target := ts.URL + "/article/talk"
+
+	var mu sync.Mutex
+	pagesBySource := map[string]string{
+		"/reply": `<html><body><div class="h-entry">
+  <a class="p-author h-card" href="/"><img src="/me.jpg" alt=""> <span class="p-name">Robin Example</span></a>
+  <a class="u-in-reply-to" href="` + target + `">in reply to</a>
+  <time class="dt-published" datetime="2024-03-04T05:06:07Z">March 4</time>
+  <div class="e-content">Great <b>post</b>! <script>alert(1)</script>&lt;script&gt;</div>
+  <a class="u-url" href="/reply#entry">permalink</a>
+</div></body></html>`,
+		"/plain":  `<p>I read <a href="` + target + `/">this</a>.</p>`,
+		"/nolink": `<div class="h-entry"><p class="e-content">Nothing to see</p></div>`,
+	}
+	src := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, ok := pagesBySource[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, body)
+	}))
+	defer src.Close()
+
+	for _, p := range []string{"/reply", "/plain", "/nolink"} {
+		if code, status := sendMention(t, ts.URL, src.URL+p, target); code != http.StatusAccepted {
+			t.Fatalf("%s: %s", p, status)
+		}
+	}
+	if _, body := getBody(t, ts.URL, "/article/talk", ""); strings.Contains(body, "Robin") || !strings.Contains(body, `<link rel="webmention" href="/webmention">`) {
+		t.Fatalf("pending mention shown or endpoint not advertised:\n%s", body)
+	}
+
+	processWebmentions(context.Background())
+	_, body := getBody(t, ts.URL, "/article/talk", "")
+	for _, want := range []string{
+		"Mentions (2)",
+		`<a href="` + src.URL + `/" rel="nofollow ugc">Robin Example</a> replied`,
+		`href="` + src.URL + `/reply#entry"`,
+		"Mar 04, 2024",
+		"Great post! &lt;script&gt;",
+		"127.0.0.1 mentioned this",
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("article page lacks %q:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "alert(1)") || strings.Contains(body, "Nothing to see") {
+		t.Fatalf("script or unverified mention shown:\n%s", body)
+	}
+	ms, _ := loadWebmentions("talk")
+	if len(ms) != 3 || ms[2].Status != mentionRejected || ms[2].Error != "source does not link to target" {
+		t.Fatalf("stored mentions: %+v", ms)
+	}
+
+	// the reply is deleted at the source and the sender says so
+	mu.Lock()
+	delete(pagesBySource, "/reply")
+	mu.Unlock()
+	sendMention(t, ts.URL, src.URL+"/reply", target)
+	processWebmentions(context.Background())
+	if _, body := getBody(t, ts.URL, "/article/talk", ""); strings.Contains(body, "Robin") || !strings.Contains(body, "Mentions (1)") {
+		t.Fatalf("deleted reply still shown:\n%s", body)
+	}
+}
+
+func TestWebmention_RejectsBadRequests(t *testing.T) {
+	resetStorage(t)
+	if err := saveArticle(Article{Title: "Talk", Slug: "talk", Content: "x", Published: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveArticle(Article{Title: "Wip", Slug: "wip", Content: "x", Published: time.Now(), Draft: true}); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(buildMux())
+	defer ts.Close()
+	for _, c := range []struct{ source, target string }{
+		{"", ts.URL + "/article/talk"},
+		{"javascript:alert(1)", ts.URL + "/article/talk"},
+		{"https://elsewhere.example/post", ""},
+		{"https://elsewhere.example/post", "https://other.example/article/talk"},
+		{"https://elsewhere.example/post", ts.URL + "/article/missing"},
+		{"https://elsewhere.example/post", ts.URL + "/article/wip"},
+		{"https://elsewhere.example/post", ts.URL + "/article/../admin"},
+		{ts.URL + "/article/talk", ts.URL + "/article/talk#x"},
+	} {
+		if code, status := sendMention(t, ts.URL, c.source, c.target); code != http.StatusBadRequest {
+			t.Fatalf("source %q target %q: %s", c.source, c.target, status)
+		}
+	}
+	if resp, err := http.Get(ts.URL + "/webmention"); err != nil || resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("GET /webmention: %v %v", resp, err)
+	}
+	if ms, _ := loadWebmentions("talk"); len(ms) != 0 {
+		t.Fatalf("stored %d mentions", len(ms))
+	}
+}
+
+func TestWebmention_SentOnPublish(t *testing.T) {
+	resetStorage(t)
+	useLocalWebClient(t)
+	saved := cfg
+	defer func() { cfg = saved }()
+	site := "-base-url=https://blog.example" // the CLI loads its own config
+
+	var mu sync.Mutex
+	var got []url.Values
+	failing := true
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/by-header":
+			w.Header().Add("Link", `<https://cdn.example/style.css>; rel="stylesheet", </endpoint?via=header>; rel="webmention"`)
+		case "/by-link":
+			fmt.Fprint(w, `<html><head><link href="/endpoint?via=html" rel="me webmention"></head></html>`)
+		case "/flaky":
+			fmt.Fprint(w, `<a rel="webmention" href="/flaky-endpoint">wm</a>`)
+		case "/endpoint":
+			_ = r.ParseForm()
+			got = append(got, r.PostForm)
+			w.WriteHeader(http.StatusAccepted)
+		case "/flaky-endpoint":
+			if failing {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer remote.Close()
+
+	content := fmt.Sprintf("See [this](%s/by-header), <%s/by-link> and %s/flaky. Also %s/none and my own https://blog.example/article/older.",
+		remote.URL, remote.URL, remote.URL, remote.URL)
+	if _, err := runCLI(t, content, "new", site, "-title", "Links", "-draft"); err != nil {
+		t.Fatal(err)
+	}
+	if q, _ := loadOutbox(); len(q) != 0 {
+		t.Fatalf("draft queued %d mentions", len(q))
+	}
+	if _, err := runCLI(t, "", "publish", site, "links"); err != nil {
+		t.Fatal(err)
+	}
+	if q, _ := loadOutbox(); len(q) != 4 {
+		t.Fatalf("publish queued %d mentions, want 4: %+v", len(q), q)
+	}
+
+	processWebmentions(context.Background())
+	mu.Lock()
+	if len(got) != 2 || got[0].Get("source") != "https://blog.example/article/links" || got[0].Get("target") != remote.URL+"/by-header" || got[1].Get("target") != remote.URL+"/by-link" {
+		t.Fatalf("endpoint received %v", got)
+	}
+	mu.Unlock()
+	q, _ := loadOutbox()
+	if len(q) != 1 || q[0].Target != remote.URL+"/flaky" || q[0].Attempts != 1 || q[0].NextTry.Before(time.Now()) {
+		t.Fatalf("outbox after first run: %+v", q)
+	}
+
+	// the retry is not due yet; once it is, it goes through
+	processWebmentions(context.Background())
+	if q, _ := loadOutbox(); len(q) != 1 || q[0].Attempts != 1 {
+		t.Fatalf("retried before its time: %+v", q)
+	}
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+	q[0].NextTry = time.Now().Add(-time.Second)
+	if err := saveOutbox(q); err != nil {
+		t.Fatal(err)
+	}
+	processWebmentions(context.Background())
+	if q, _ := loadOutbox(); len(q) != 0 {
+		t.Fatalf("outbox not drained: %+v", q)
+	}
+
+	// deleting tells the targets too, so they can drop their copies
+	if _, err := runCLI(t, "", "delete", site, "links"); err != nil {
+		t.Fatal(err)
+	}
+	if q, _ := loadOutbox(); len(q) != 4 {
+		t.Fatalf("delete queued %d mentions, want 4", len(q))
+	}
+}
+
+func TestWebmention_DefaultClientRefusesPrivateAddresses(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+	if _, err := webClient.Do(req); err == nil || !strings.Contains(err.Error(), "non-public address") {
+		t.Fatalf("fetched a loopback URL: %v", err)
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --------------------------- WordPress import ------------------
+// WordPress "Tools → Export" writes WXR, an RSS 2.0 file with wp:* fields.
+// Posts and pages become articles (pages tagged "page"), categories and
+// tags become tags, and the old permalink becomes an alias.
+
+const wxrContentNS = "http://purl.org/rss/1.0/modules/content/"
+
+type wxrFile struct {
+	Channel struct {
+		Authors []struct {
+			Login   string `xml:"author_login"`
+			Display string `xml:"author_display_name"`
+		} `xml:"author"`
+		Items []wxrItem `xml:"item"`
+	} `xml:"channel"`
+}
+
+type wxrItem struct {
+	Title      string `xml:"title"`
+	Link       string `xml:"link"`
+	PubDate    string `xml:"pubDate"`
+	Creator    string `xml:"creator"`
+	Content    string `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+	PostID     string `xml:"post_id"`
+	PostDate   string `xml:"post_date"`
+	PostGMT    string `xml:"post_date_gmt"`
+	PostName   string `xml:"post_name"`
+	Status     string `xml:"status"`
+	PostType   string `xml:"post_type"`
+	Categories []struct {
+		Domain string `xml:"domain,attr"`
+		Name   string `xml:",chardata"`
+	} `xml:"category"`
+	Comments []wxrComment `xml:"comment"`
+}
+
+type wxrComment struct {
+	ID       string `xml:"comment_id"`
+	Author   string `xml:"comment_author"`
+	Email    string `xml:"comment_author_email"`
+	IP       string `xml:"comment_author_IP"`
+	DateGMT  string `xml:"comment_date_gmt"`
+	Content  string `xml:"comment_content"`
+	Approved string `xml:"comment_approved"` // 1, 0, spam or trash
+	Type     string `xml:"comment_type"`     // "", comment, pingback or trackback
+	Parent   string `xml:"comment_parent"`
+}
+
+// wxrEntries maps the posts and pages of a WXR export onto Articles.
+// Attachments, menu items and trashed posts are left out.
+func wxrEntries(r io.Reader, name string) ([]importEntry, error) {
+	var f wxrFile
+	dec := xml.NewDecoder(r)
+	dec.Strict = false
+	dec.Entity = xml.HTMLEntity
+	if err := dec.Decode(&f); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	authors := map[string]string{}
+	for _, a := range f.Channel.Authors {
+		authors[a.Login] = a.Display
+	}
+
+	var entries []importEntry
+	for i, it := range f.Channel.Items {
+		if (it.PostType != "post" && it.PostType != "page") || it.Status == "trash" || it.Status == "auto-draft" {
+			continue
+		}
+		e := importEntry{Source: fmt.Sprintf("%s post %s", name, it.PostID)}
+		if it.PostID == "" {
+			e.Source = fmt.Sprintf("%s item %d", name, i+1)
+		}
+		a := Article{Title: strings.TrimSpace(it.Title), Content: htmlToMarkdown(it.Content)}
+		a.Author = authors[it.Creator]
+		if a.Author == "" {
+			a.Author = it.Creator
+		}
+
+		a.Slug = it.PostName
+		if a.Slug == "" { // drafts have no post_name yet
+			a.Slug = a.Title
+		}
+		if norm := makeSlug(a.Slug); norm != a.Slug {
+			if it.PostName != "" {
+				e.Note = fmt.Sprintf("slug %q normalised", it.PostName)
+			}
+			a.Slug = norm
+		}
+
+		var err error
+		if a.Published, err = wxrDate(it); err != nil {
+			e.Err = err
+			entries = append(entries, e)
+			continue
+		}
+		// publish and future keep their date; draft, pending and private
+		// posts were not public on the old site either
+		a.Draft = it.Status != "publish" && it.Status != "future"
+
+		var tags []string
+		if it.PostType == "page" {
+			tags = append(tags, "page")
+		}
+		for _, c := range it.Categories {
+			if (c.Domain == "category" || c.Domain == "post_tag") && c.Name != "Uncategorized" {
+				tags = append(tags, html.UnescapeString(c.Name))
+			}
+		}
+		a.Tags = normaliseTags(tags)
+		if al := normaliseAlias(it.Link); al != "" && !strings.Contains(it.Link, "?") {
+			a.Aliases = []string{al}
+		}
+		e.Comments = wxrComments(it.Comments)
+		if n := len(e.Comments); n > 0 {
+			e.Note = strings.TrimPrefix(e.Note+fmt.Sprintf("; %d comments", n), "; ")
+		}
+		e.Article = a
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// wxrComments maps WordPress comments onto Comments, keeping their
+// moderation status and threading. Pingbacks, trackbacks and trashed
+// comments are left out.
+func wxrComments(in []wxrComment) []Comment {
+	status := map[string]string{"1": commentApproved, "0": commentPending, "spam": commentSpam}
+	var out []Comment
+	for _, wc := range in {
+		st, ok := status[wc.Approved]
+		if !ok || (wc.Type != "" && wc.Type != "comment") || strings.TrimSpace(wc.Content) == "" {
+			continue
+		}
+		c := Comment{
+			ID:     "wp" + wc.ID,
+			Name:   strings.TrimSpace(wc.Author),
+			Email:  strings.TrimSpace(wc.Email),
+			IP:     wc.IP,
+			Body:   htmlToMarkdown(wc.Content),
+			Status: st,
+			Score:  0.5,
+		}
+		if c.Name == "" {
+			c.Name = "Anonymous"
+		}
+		if wc.Parent != "" && wc.Parent != "0" {
+			c.Parent = "wp" + wc.Parent
+		}
+		if t, err := time.Parse("2006-01-02 15:04:05", wc.DateGMT); err == nil {
+			c.Created = t
+		}
+		if st != commentPending {
+			c.Moderated = c.Created
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// wxrDate prefers the GMT post date, which drafts leave as zeros, then the
+// local post date, then the RSS pubDate.
+func wxrDate(it wxrItem) (time.Time, error) {
+	const layout = "2006-01-02 15:04:05"
+	if t, err := time.Parse(layout, it.PostGMT); err == nil && t.Year() > 1 {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation(layout, it.PostDate, cfg.Location()); err == nil && t.Year() > 1 {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC1123Z, strings.TrimSpace(it.PubDate)); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("no usable date (post_date %q)", it.PostDate)
+}
+
+// --------------------------- HTML to Markdown ------------------
+
+var (
+	htmlTagRe  = regexp.MustCompile(`(?s)<!--.*?-->|<(/?)([a-zA-Z][a-zA-Z0-9]*)((?:[^>"']|"[^"]*"|'[^']*')*)>`)
+	htmlAttrRe = regexp.MustCompile(`([a-zA-Z_:][-a-zA-Z0-9_:.]*)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+	blankRuns  = regexp.MustCompile(`\n{3,}`)
+)
+
+// htmlDropped are elements whose content is discarded, not converted.
+var htmlDropped = map[string]bool{"script": true, "style": true, "iframe": true, "object": true, "embed": true, "form": true, "noscript": true}
+
+func htmlAttr(attrs, name string) string {
+	for _, m := range htmlAttrRe.FindAllStringSubmatch(attrs, -1) {
+		if strings.EqualFold(m[1], name) {
+			return html.UnescapeString(m[2] + m[3] + m[4])
+		}
+	}
+	return ""
+}
+
+// htmlToMarkdown converts post HTML to Markdown. It covers what the
+// WordPress editors produce (paragraphs, headings, emphasis, links, images,
+// lists, quotes, code); other tags are dropped and their text kept, and
+// scripts, styles and embeds are removed entirely. Like WordPress itself,
+// it treats blank lines in the source as paragraph breaks.
+func htmlToMarkdown(src string) string {
+	var b strings.Builder
+	type list struct {
+		ordered bool
+		n       int
+	}
+	var (
+		lists   []list
+		links   []string
+		pre     int
+		dropped int
+		quote   int
+	)
+	newline := func(n int) {
+		s := b.String()
+		have := len(s) - len(strings.TrimRight(s, "\n"))
+		if len(s) == 0 {
+			return
+		}
+		for ; have < n; have++ {
+			b.WriteByte('\n')
+		}
+		if quote > 0 {
+			b.WriteString(strings.Repeat("> ", quote))
+		}
+	}
+	text := func(s string) {
+		if dropped > 0 {
+			return
+		}
+		s = html.UnescapeString(s)
+		if pre == 0 && quote > 0 {
+			s = strings.ReplaceAll(s, "\n", "\n"+strings.Repeat("> ", quote))
+		}
+		b.WriteString(s)
+	}
+
+	last := 0
+	for _, m := range htmlTagRe.FindAllStringSubmatchIndex(src, -1) {
+		text(src[last:m[0]])
+		last = m[1]
+		if m[4] < 0 {
+			continue // comment, e.g. Gutenberg block markers
+		}
+		closing := m[3] > m[2]
+		tag := strings.ToLower(src[m[4]:m[5]])
+		attrs := src[m[6]:m[7]]
+		if htmlDropped[tag] {
+			if closing {
+				dropped = max(dropped-1, 0)
+			} else if !strings.HasSuffix(attrs, "/") {
+				dropped++
+			}
+			continue
+		}
+		if dropped > 0 {
+			continue
+		}
+		switch tag {
+		case "p", "div", "figure", "table":
+			newline(2)
+		case "br":
+			b.WriteString("  ")
+			newline(1)
+		case "hr":
+			newline(2)
+			b.WriteString("---")
+			newline(2)
+		case "h1", "h2", "h3", "h4", "h5", "h6":
+			newline(2)
+			if !closing {
+				lvl, _ := strconv.Atoi(tag[1:])
+				b.WriteString(strings.Repeat("#", lvl) + " ")
+			}
+		case "strong", "b":
+			b.WriteString("**")
+		case "em", "i":
+			b.WriteString("_")
+		case "code":
+			if pre == 0 {
+				b.WriteString("`")
+			}
+		case "pre":
+			if closing {
+				pre = max(pre-1, 0)
+				newline(1)
+				b.WriteString("```")
+				newline(2)
+			} else {
+				pre++
+				newline(2)
+				b.WriteString("```")
+				newline(1)
+			}
+		case "blockquote":
+			if closing {
+				quote = max(quote-1, 0)
+				newline(2)
+			} else {
+				quote++
+				newline(2)
+			}
+		case "ul", "ol":
+			if closing {
+				if len(lists) > 0 {
+					lists = lists[:len(lists)-1]
+				}
+				newline(2)
+			} else {
+				lists = append(lists, list{ordered: tag == "ol"})
+				newline(1)
+			}
+		case "li":
+			if closing || len(lists) == 0 {
+				continue
+			}
+			newline(1)
+			l := &lists[len(lists)-1]
+			b.WriteString(strings.Repeat("  ", len(lists)-1))
+			if l.ordered {
+				l.n++
+				b.WriteString(strconv.Itoa(l.n) + ". ")
+			} else {
+				b.WriteString("- ")
+			}
+		case "a":
+			if closing {
+				if n := len(links); n > 0 {
+					if links[n-1] != "" {
+						b.WriteString("](" + links[n-1] + ")")
+					}
+					links = links[:n-1]
+				}
+			} else {
+				href := htmlAttr(attrs, "href")
+				if strings.HasPrefix(strings.ToLower(strings.TrimSpace(href)), "javascript:") {
+					href = ""
+				}
+				links = append(links, href)
+				if href != "" {
+					b.WriteString("[")
+				}
+			}
+		case "img":
+			if src := htmlAttr(attrs, "src"); src != "" {
+				b.WriteString("![" + htmlAttr(attrs, "alt") + "](" + src + ")")
+			}
+		}
+	}
+	text(src[last:])
+
+	out := strings.ReplaceAll(b.String(), "\r\n", "\n")
+	lines := strings.Split(out, "\n")
+	for i, l := range lines {
+		if strings.TrimSpace(l) == "" || strings.TrimSpace(l) == ">" {
+			lines[i] = strings.TrimRight(l, " >")
+		}
+	}
+	return strings.TrimSpace(blankRuns.ReplaceAllString(strings.Join(lines, "\n"), "\n\n"))
+}
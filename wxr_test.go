@@ -0,0 +1,185 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+const sampleWXR = `<?xml version="1.0" encoding="UTF-8" ?>
+<rss version="2.0"
+	xmlns:excerpt="http://wordpress.org/export/1.2/excerpt/"
+	xmlns:content="http://purl.org/rss/1.0/modules/content/"
+	xmlns:dc="http://purl.org/dc/elements/1.1/"
+	xmlns:wp="http://wordpress.org/export/1.2/">
+<channel>
+	<title>Old Blog</title>
+	<wp:author><wp:author_login><![CDATA[jdoe]]></wp:author_login><wp:author_display_name><![CDATA[Jo Doe]]></wp:author_display_name></wp:author>
+	<item>
+		<title>Hello &amp; Welcome</title>
+		<link>https://old.example.com/2019/05/hello-world/</link>
+		<pubDate>Mon, 06 May 2019 08:00:00 +0000</pubDate>
+		<dc:creator><![CDATA[jdoe]]></dc:creator>
+		<content:encoded><![CDATA[<!-- wp:paragraph --><p>Some <strong>bold</strong> and <a href="https://go.dev">a link</a>.</p><!-- /wp:paragraph -->
+<h2>Steps</h2>
+<ol><li>one</li><li>two</li></ol>
+<script>alert(1)</script>
+<blockquote>quoted</blockquote>
+<pre><code>x := 1</code></pre>]]></content:encoded>
+		<excerpt:encoded><![CDATA[]]></excerpt:encoded>
+		<wp:post_id>12</wp:post_id>
+		<wp:post_date><![CDATA[2019-05-06 10:00:00]]></wp:post_date>
+		<wp:post_date_gmt><![CDATA[2019-05-06 08:00:00]]></wp:post_date_gmt>
+		<wp:post_name><![CDATA[hello-world]]></wp:post_name>
+		<wp:status><![CDATA[publish]]></wp:status>
+		<wp:post_type><![CDATA[post]]></wp:post_type>
+		<category domain="category" nicename="news"><![CDATA[News]]></category>
+		<category domain="category" nicename="uncategorized"><![CDATA[Uncategorized]]></category>
+		<category domain="post_tag" nicename="go"><![CDATA[Go]]></category>
+		<wp:comment><wp:comment_id>1</wp:comment_id><wp:comment_author><![CDATA[Ann]]></wp:comment_author><wp:comment_author_email><![CDATA[ann@example.com]]></wp:comment_author_email><wp:comment_date_gmt><![CDATA[2019-05-07 09:00:00]]></wp:comment_date_gmt><wp:comment_content><![CDATA[Nice <em>post</em>!]]></wp:comment_content><wp:comment_approved><![CDATA[1]]></wp:comment_approved><wp:comment_type><![CDATA[comment]]></wp:comment_type><wp:comment_parent>0</wp:comment_parent></wp:comment>
+		<wp:comment><wp:comment_id>2</wp:comment_id><wp:comment_author><![CDATA[Jo Doe]]></wp:comment_author><wp:comment_date_gmt><![CDATA[2019-05-07 10:00:00]]></wp:comment_date_gmt><wp:comment_content><![CDATA[Thanks!]]></wp:comment_content><wp:comment_approved><![CDATA[1]]></wp:comment_approved><wp:comment_parent>1</wp:comment_parent></wp:comment>
+		<wp:comment><wp:comment_id>3</wp:comment_id><wp:comment_author><![CDATA[Cheap Pills]]></wp:comment_author><wp:comment_content><![CDATA[buy now]]></wp:comment_content><wp:comment_approved><![CDATA[spam]]></wp:comment_approved><wp:comment_parent>0</wp:comment_parent></wp:comment>
+		<wp:comment><wp:comment_id>4</wp:comment_id><wp:comment_author><![CDATA[Other Blog]]></wp:comment_author><wp:comment_content><![CDATA[linked]]></wp:comment_content><wp:comment_approved><![CDATA[1]]></wp:comment_approved><wp:comment_type><![CDATA[pingback]]></wp:comment_type></wp:comment>
+	</item>
+	<item>
+		<title>Unfinished</title>
+		<link>https://old.example.com/?p=13</link>
+		<dc:creator><![CDATA[someone]]></dc:creator>
+		<content:encoded><![CDATA[First paragraph.
+
+Second paragraph.]]></content:encoded>
+		<wp:post_id>13</wp:post_id>
+		<wp:post_date><![CDATA[2020-01-01 12:00:00]]></wp:post_date>
+		<wp:post_date_gmt><![CDATA[0000-00-00 00:00:00]]></wp:post_date_gmt>
+		<wp:post_name><![CDATA[]]></wp:post_name>
+		<wp:status><![CDATA[draft]]></wp:status>
+		<wp:post_type><![CDATA[post]]></wp:post_type>
+	</item>
+	<item>
+		<title>About</title>
+		<link>https://old.example.com/about/</link>
+		<content:encoded><![CDATA[About me.]]></content:encoded>
+		<wp:post_id>2</wp:post_id>
+		<wp:post_date_gmt><![CDATA[2018-01-01 00:00:00]]></wp:post_date_gmt>
+		<wp:post_name><![CDATA[about]]></wp:post_name>
+		<wp:status><![CDATA[publish]]></wp:status>
+		<wp:post_type><![CDATA[page]]></wp:post_type>
+	</item>
+	<item>
+		<title>photo.jpg</title>
+		<wp:post_id>14</wp:post_id>
+		<wp:post_type><![CDATA[attachment]]></wp:post_type>
+	</item>
+	<item>
+		<title>Binned</title>
+		<wp:post_id>15</wp:post_id>
+		<wp:status><![CDATA[trash]]></wp:status>
+		<wp:post_type><![CDATA[post]]></wp:post_type>
+	</item>
+</channel>
+</rss>`
+
+func TestWXREntries_MapsPostsAndPages(t *testing.T) {
+	entries, err := wxrEntries(strings.NewReader(sampleWXR), "export.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("got %d entries, want post, draft and page", len(entries))
+	}
+
+	post := entries[0].Article
+	if post.Title != "Hello & Welcome" || post.Slug != "hello-world" || post.Author != "Jo Doe" || post.Draft {
+		t.Fatalf("post: %+v", post)
+	}
+	if !post.Published.Equal(time.Date(2019, 5, 6, 8, 0, 0, 0, time.UTC)) {
+		t.Fatalf("post date: %v", post.Published)
+	}
+	if !slices.Equal(post.Tags, []string{"news", "go"}) || !slices.Equal(post.Aliases, []string{"/2019/05/hello-world"}) {
+		t.Fatalf("post tags/aliases: %v %v", post.Tags, post.Aliases)
+	}
+	if cs := entries[0].Comments; len(cs) != 3 || !strings.Contains(entries[0].Note, "3 comments") {
+		t.Fatalf("comments: %+v (note %q)", cs, entries[0].Note)
+	}
+	ann, reply, spam := entries[0].Comments[0], entries[0].Comments[1], entries[0].Comments[2]
+	if ann.ID != "wp1" || ann.Name != "Ann" || ann.Email != "ann@example.com" || ann.Body != "Nice _post_!" || ann.Status != commentApproved || ann.Created.Hour() != 9 {
+		t.Fatalf("comment: %+v", ann)
+	}
+	if reply.Parent != "wp1" || spam.Status != commentSpam {
+		t.Fatalf("reply %+v, spam %+v", reply, spam)
+	}
+
+	draft := entries[1].Article
+	if !draft.Draft || draft.Slug != "unfinished" || draft.Published.Year() != 2020 || draft.Aliases != nil || draft.Author != "someone" {
+		t.Fatalf("draft: %+v", draft)
+	}
+	if draft.Content != "First paragraph.\n\nSecond paragraph." {
+		t.Fatalf("draft content: %q", draft.Content)
+	}
+	if page := entries[2].Article; !slices.Equal(page.Tags, []string{"page"}) || page.Slug != "about" {
+		t.Fatalf("page: %+v", page)
+	}
+}
+
+func TestHTMLToMarkdown(t *testing.T) {
+	got := htmlToMarkdown(`<!-- wp:paragraph --><p>Some <strong>bold</strong>, <em>em</em> and <a href="https://go.dev">a link</a>.</p>
+<h2>Steps</h2><ul><li>one</li><li>two<ol><li>a</li></ol></li></ul>
+<p>line<br/>break &amp; <code>x</code> <img src="/a.png" alt="pic"></p>
+<script>alert(1)</script><a href="javascript:evil()">bad</a>
+<blockquote><p>quoted</p></blockquote>
+<pre><code>if a &lt; b {
+}</code></pre>`)
+	want := "Some **bold**, _em_ and [a link](https://go.dev).\n\n" +
+		"## Steps\n\n" +
+		"- one\n- two\n  1. a\n\n" +
+		"line  \nbreak & `x` ![pic](/a.png)\n\n" +
+		"bad\n\n" +
+		"> quoted\n\n" +
+		"```\nif a < b {\n}\n```"
+	if got != want {
+		t.Fatalf("got:\n%s\n\nwant:\n%s", got, want)
+	}
+}
+
+func TestImport_CLIWordPressRedirects(t *testing.T) {
+	resetStorage(t)
+	file := filepath.Join(t.TempDir(), "export.xml")
+	if err := os.WriteFile(file, []byte(sampleWXR), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := runCLI(t, "", "import", file)
+	if err != nil || !strings.Contains(out, "3 created") {
+		t.Fatalf("import: %v\n%s", err, out)
+	}
+	ts := httptest.NewServer(buildMux())
+	defer ts.Close()
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(ts.URL + "/2019/05/hello-world/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != "/article/hello-world" {
+		t.Fatalf("old permalink: %d %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	_, body := getBody(t, ts.URL, "/article/hello-world", "")
+	if !strings.Contains(body, "by Jo Doe") || strings.Contains(body, "alert(1)") {
+		t.Fatalf("article page:\n%s", body)
+	}
+	if !strings.Contains(body, "Comments (2)") || !strings.Contains(body, "<em>post</em>") || strings.Contains(body, "buy now") {
+		t.Fatalf("imported comments not shown:\n%s", body)
+	}
+
+	// importing again adds no duplicates
+	if _, err := runCLI(t, "", "import", "-overwrite", file); err != nil {
+		t.Fatal(err)
+	}
+	if cs, _ := loadComments("hello-world"); len(cs) != 3 {
+		t.Fatalf("%d comments after re-import, want 3", len(cs))
+	}
+}
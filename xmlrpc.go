@@ -0,0 +1,619 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --------------------------- XML-RPC ---------------------------
+// /xmlrpc speaks the MetaWeblog and Blogger APIs that desktop editors
+// (MarsEdit, Open Live Writer and the like) use. Every call carries a
+// username and password, checked against the admin accounts with the same
+// throttling as the login form. The blog has a single blog ID, "1", and a
+// post's ID is its slug, which editPost keeps unless wp_slug changes it.
+// /rsd.xml lets editors find the endpoint from the home page.
+//
+// Post structs map onto Article fields:
+//
+//	title → Title, description (+ mt_text_more) → Content
+//	categories, mt_keywords → Tags, dateCreated → Published
+//	wp_slug / mt_basename → Slug, publish=false or post_status draft → Draft
+//
+// HTML descriptions are converted to Markdown; plain text is kept as is.
+
+const (
+	xmlrpcBlogID     = "1"
+	xmlrpcMaxBody    = mediaMaxBytes/3*4 + micropubMaxBody // base64 media plus the envelope
+	xmlrpcRecentMax  = 100
+	xmlrpcDateLayout = "20060102T15:04:05"
+)
+
+// XML-RPC fault codes.
+const (
+	faultParse     = -32700
+	faultMethod    = -32601
+	faultParams    = -32602
+	faultAuth      = 403
+	faultNotFound  = 404
+	faultThrottled = 429
+	faultInvalid   = 400
+	faultServer    = 500
+)
+
+var xmlrpcHTMLRe = regexp.MustCompile(`(?i)<(p|div|br|h[1-6]|ul|ol|li|blockquote|pre|img|a|strong|em|b|i|figure|table)[\s/>]`)
+
+type xmlrpcFault struct {
+	Code   int
+	String string
+}
+
+func (f *xmlrpcFault) Error() string { return f.String }
+
+func faultf(code int, format string, args ...any) error {
+	return &xmlrpcFault{code, fmt.Sprintf(format, args...)}
+}
+
+// --------------------------- Wire format -----------------------
+
+// xmlrpcValue is a <value> element; a bare value is a string.
+type xmlrpcValue struct {
+	String   *string `xml:"string"`
+	Int      *string `xml:"int"`
+	I4       *string `xml:"i4"`
+	Boolean  *string `xml:"boolean"`
+	Double   *string `xml:"double"`
+	DateTime *string `xml:"dateTime.iso8601"`
+	Base64   *string `xml:"base64"`
+	Struct   *struct {
+		Members []struct {
+			Name  string      `xml:"name"`
+			Value xmlrpcValue `xml:"value"`
+		} `xml:"member"`
+	} `xml:"struct"`
+	Array *struct {
+		Values []xmlrpcValue `xml:"data>value"`
+	} `xml:"array"`
+	Text string `xml:",chardata"`
+}
+
+type xmlrpcCall struct {
+	Method string        `xml:"methodName"`
+	Params []xmlrpcValue `xml:"params>param>value"`
+}
+
+// decode turns v into string, int, bool, float64, time.Time, []byte,
+// map[string]any or []any.
+func (v xmlrpcValue) decode() (any, error) {
+	switch {
+	case v.String != nil:
+		return *v.String, nil
+	case v.Int != nil, v.I4 != nil:
+		s := v.Int
+		if s == nil {
+			s = v.I4
+		}
+		return strconv.Atoi(strings.TrimSpace(*s))
+	case v.Boolean != nil:
+		return strings.TrimSpace(*v.Boolean) == "1", nil
+	case v.Double != nil:
+		return strconv.ParseFloat(strings.TrimSpace(*v.Double), 64)
+	case v.DateTime != nil:
+		return parseXMLRPCDate(strings.TrimSpace(*v.DateTime))
+	case v.Base64 != nil:
+		return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(*v.Base64), ""))
+	case v.Struct != nil:
+		m := map[string]any{}
+		for _, mem := range v.Struct.Members {
+			x, err := mem.Value.decode()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", mem.Name, err)
+			}
+			m[mem.Name] = x
+		}
+		return m, nil
+	case v.Array != nil:
+		list := []any{}
+		for _, e := range v.Array.Values {
+			x, err := e.decode()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, x)
+		}
+		return list, nil
+	}
+	return v.Text, nil
+}
+
+// parseXMLRPCDate accepts the spec's 20060102T15:04:05 (taken as UTC, which
+// is what editors send) and the ISO 8601 forms some clients use instead.
+func parseXMLRPCDate(s string) (time.Time, error) {
+	for _, layout := range []string{xmlrpcDateLayout, "20060102T15:04:05Z", time.RFC3339, "2006-01-02T15:04:05"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q", s)
+}
+
+// writeXMLRPCValue encodes v as a <value>.
+func writeXMLRPCValue(buf *bytes.Buffer, v any) {
+	buf.WriteString("<value>")
+	switch x := v.(type) {
+	case string:
+		buf.WriteString("<string>")
+		_ = xml.EscapeText(buf, []byte(x))
+		buf.WriteString("</string>")
+	case int:
+		fmt.Fprintf(buf, "<int>%d</int>", x)
+	case bool:
+		b := 0
+		if x {
+			b = 1
+		}
+		fmt.Fprintf(buf, "<boolean>%d</boolean>", b)
+	case time.Time:
+		fmt.Fprintf(buf, "<dateTime.iso8601>%s</dateTime.iso8601>", x.UTC().Format(xmlrpcDateLayout))
+	case []string:
+		buf.WriteString("<array><data>")
+		for _, e := range x {
+			writeXMLRPCValue(buf, e)
+		}
+		buf.WriteString("</data></array>")
+	case []map[string]any:
+		buf.WriteString("<array><data>")
+		for _, e := range x {
+			writeXMLRPCValue(buf, e)
+		}
+		buf.WriteString("</data></array>")
+	case map[string]any:
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf.WriteString("<struct>")
+		for _, k := range keys {
+			fmt.Fprintf(buf, "<member><name>%s</name>", html.EscapeString(k))
+			writeXMLRPCValue(buf, x[k])
+			buf.WriteString("</member>")
+		}
+		buf.WriteString("</struct>")
+	default:
+		panic(fmt.Sprintf("xmlrpc: cannot encode %T", v))
+	}
+	buf.WriteString("</value>")
+}
+
+func writeXMLRPC(w http.ResponseWriter, r *http.Request, result any, err error) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header + "<methodResponse>")
+	if err != nil {
+		var f *xmlrpcFault
+		if !errors.As(err, &f) {
+			// storage errors carry file paths; they go to the log only
+			slog.ErrorContext(r.Context(), "handler error", "method", r.Method, "path", r.URL.Path, "status", http.StatusInternalServerError, "err", err)
+			f = &xmlrpcFault{faultServer, "an unexpected error occurred; it has been logged"}
+		}
+		buf.WriteString("<fault>")
+		writeXMLRPCValue(&buf, map[string]any{"faultCode": f.Code, "faultString": f.String})
+		buf.WriteString("</fault>")
+	} else {
+		buf.WriteString("<params><param>")
+		writeXMLRPCValue(&buf, result)
+		buf.WriteString("</param></params>")
+	}
+	buf.WriteString("</methodResponse>\n")
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	_, _ = w.Write(buf.Bytes())
+}
+
+// --------------------------- Params ----------------------------
+
+// xmlrpcParams are a call's decoded parameters.
+type xmlrpcParams []any
+
+func (p xmlrpcParams) string(i int) (string, error) {
+	if i >= len(p) {
+		return "", faultf(faultParams, "missing parameter %d", i+1)
+	}
+	switch x := p[i].(type) {
+	case string:
+		return x, nil
+	case int:
+		return strconv.Itoa(x), nil // some clients send IDs as ints
+	}
+	return "", faultf(faultParams, "parameter %d must be a string", i+1)
+}
+
+func (p xmlrpcParams) int(i int) (int, error) {
+	if i >= len(p) {
+		return 0, faultf(faultParams, "missing parameter %d", i+1)
+	}
+	if n, ok := p[i].(int); ok {
+		return n, nil
+	}
+	return 0, faultf(faultParams, "parameter %d must be an int", i+1)
+}
+
+// bool reads an optional flag; publish is often left out and means true.
+func (p xmlrpcParams) bool(i int, def bool) (bool, error) {
+	if i >= len(p) {
+		return def, nil
+	}
+	if b, ok := p[i].(bool); ok {
+		return b, nil
+	}
+	return false, faultf(faultParams, "parameter %d must be a boolean", i+1)
+}
+
+func (p xmlrpcParams) structAt(i int) (map[string]any, error) {
+	if i >= len(p) {
+		return nil, faultf(faultParams, "missing parameter %d", i+1)
+	}
+	if m, ok := p[i].(map[string]any); ok {
+		return m, nil
+	}
+	return nil, faultf(faultParams, "parameter %d must be a struct", i+1)
+}
+
+// --------------------------- Auth ------------------------------
+
+// xmlrpcAuth checks the username and password at p[i] and p[i+1] against
+// the admin accounts, sharing the login form's limiter and audit entries.
+func xmlrpcAuth(r *http.Request, p xmlrpcParams, i int) (string, error) {
+	user, err := p.string(i)
+	if err != nil {
+		return "", err
+	}
+	pass, err := p.string(i + 1)
+	if err != nil {
+		return "", err
+	}
+	user = strings.TrimSpace(user)
+	keys := loginKeys(clientIP(r), user)
+	if wait := limiter.check(keys...); wait > 0 {
+		wait = wait.Truncate(time.Second) + time.Second
+		audit(r, "login.throttled", user, "", fmt.Sprintf("xml-rpc; retry in %s", wait))
+		loginFailures.add(1, "throttled")
+		return "", faultf(faultThrottled, "too many failed attempts; try again in %s", wait)
+	}
+	if !authenticate(user, pass) {
+		loginFailures.add(1, "invalid_credentials")
+		if limiter.fail(keys...) {
+			audit(r, "login.failed", user, "", fmt.Sprintf("xml-rpc; locked out for %s", loginLockoutFor))
+		} else {
+			audit(r, "login.failed", user, "", "xml-rpc")
+		}
+		return "", faultf(faultAuth, "invalid username or password")
+	}
+	limiter.succeed(keys...)
+	return user, nil
+}
+
+// --------------------------- Posts -----------------------------
+
+func xmlrpcPost(r *http.Request, a Article) map[string]any {
+	status := "publish"
+	if a.Draft {
+		status = "draft"
+	}
+	tags := append([]string{}, a.Tags...)
+	return map[string]any{
+		"postid":      a.Slug,
+		"title":       a.Title,
+		"description": a.Content,
+		"link":        siteURL(r) + "/article/" + a.Slug,
+		"permaLink":   siteURL(r) + "/article/" + a.Slug,
+		"dateCreated": a.Published,
+		"categories":  tags,
+		"mt_keywords": strings.Join(tags, ", "),
+		"wp_slug":     a.Slug,
+		"post_status": status,
+	}
+}
+
+// applyXMLRPCPost sets a's fields from a post struct; fields left out keep
+// their value, so editPost can send only what changed.
+func applyXMLRPCPost(a *Article, m map[string]any, publish bool) error {
+	str := func(k string) (string, bool) {
+		s, ok := m[k].(string)
+		return strings.TrimSpace(s), ok
+	}
+	if s, ok := str("title"); ok {
+		a.Title = s
+	}
+	if s, ok := str("description"); ok {
+		if more, _ := str("mt_text_more"); more != "" {
+			s += "\n\n" + more
+		}
+		if xmlrpcHTMLRe.MatchString(s) {
+			s = htmlToMarkdown(s)
+		}
+		a.Content = strings.TrimSpace(s)
+	}
+	var tags []string
+	cats, hasCats := m["categories"].([]any)
+	for _, c := range cats {
+		if s, ok := c.(string); ok {
+			tags = append(tags, s)
+		}
+	}
+	kw, hasKW := str("mt_keywords")
+	if hasKW {
+		tags = append(tags, parseTags(kw)...)
+	}
+	if hasCats || hasKW {
+		a.Tags = normaliseTags(tags)
+	}
+	if v, ok := m["dateCreated"]; ok {
+		t, ok := v.(time.Time)
+		if !ok {
+			return faultf(faultParams, "dateCreated must be a date")
+		}
+		a.Published = t
+	}
+	for _, k := range []string{"wp_slug", "mt_basename"} {
+		if s, _ := str(k); s != "" {
+			a.Slug = makeSlug(s)
+		}
+	}
+	if a.Slug == "" {
+		a.Slug = makeSlug(a.Title)
+	}
+	a.Draft = !publish
+	if s, ok := str("post_status"); ok && s != "" {
+		a.Draft = s != "publish"
+	}
+	if err := validateArticle(*a); err != nil {
+		return faultf(faultInvalid, "%v", err)
+	}
+	return nil
+}
+
+// --------------------------- Methods ---------------------------
+
+type xmlrpcMethod func(r *http.Request, p xmlrpcParams) (any, error)
+
+var xmlrpcMethods map[string]xmlrpcMethod
+
+func init() {
+	xmlrpcMethods = map[string]xmlrpcMethod{
+		"blogger.getUsersBlogs":     xmlrpcGetUsersBlogs,
+		"blogger.deletePost":        xmlrpcDeletePost,
+		"metaWeblog.newPost":        xmlrpcNewPost,
+		"metaWeblog.editPost":       xmlrpcEditPost,
+		"metaWeblog.getPost":        xmlrpcGetPost,
+		"metaWeblog.getRecentPosts": xmlrpcGetRecentPosts,
+		"metaWeblog.newMediaObject": xmlrpcNewMediaObject,
+		"metaWeblog.deletePost":     xmlrpcDeletePost,
+	}
+}
+
+// blogger.getUsersBlogs(appkey, username, password)
+func xmlrpcGetUsersBlogs(r *http.Request, p xmlrpcParams) (any, error) {
+	if _, err := xmlrpcAuth(r, p, 1); err != nil {
+		return nil, err
+	}
+	return []map[string]any{{"blogid": xmlrpcBlogID, "blogName": cfg.SiteTitle, "url": siteURL(r) + "/", "isAdmin": true, "xmlrpc": siteURL(r) + "/xmlrpc"}}, nil
+}
+
+// metaWeblog.newPost(blogid, username, password, struct, publish)
+func xmlrpcNewPost(r *http.Request, p xmlrpcParams) (any, error) {
+	user, err := xmlrpcAuth(r, p, 1)
+	if err != nil {
+		return nil, err
+	}
+	m, err := p.structAt(3)
+	if err != nil {
+		return nil, err
+	}
+	publish, err := p.bool(4, true)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	a := Article{Published: now, UpdatedAt: now.UTC()}
+	if err := applyXMLRPCPost(&a, m, publish); err != nil {
+		return nil, err
+	}
+	a.Slug = freeSlug(a.Slug)
+	if err := saveArticle(a); err != nil {
+		return nil, err
+	}
+	audit(r, "article.create", user, a.Slug, fmt.Sprintf("via xml-rpc; title %q; content %d chars; published %s", a.Title, len(a.Content), a.Published.Format("2006-01-02")))
+	articleWritten(Article{}, a)
+	return a.Slug, nil
+}
+
+// metaWeblog.editPost(postid, username, password, struct, publish)
+func xmlrpcEditPost(r *http.Request, p xmlrpcParams) (any, error) {
+	user, err := xmlrpcAuth(r, p, 1)
+	if err != nil {
+		return nil, err
+	}
+	orig, err := xmlrpcArticle(p)
+	if err != nil {
+		return nil, err
+	}
+	m, err := p.structAt(3)
+	if err != nil {
+		return nil, err
+	}
+	publish, err := p.bool(4, true)
+	if err != nil {
+		return nil, err
+	}
+	updated := orig
+	updated.Tags = slices.Clone(orig.Tags)
+	updated.UpdatedAt = time.Now().UTC()
+	if err := applyXMLRPCPost(&updated, m, publish); err != nil {
+		return nil, err
+	}
+	if updated.Slug != orig.Slug && freeSlug(updated.Slug) != updated.Slug {
+		return nil, faultf(faultInvalid, "slug %q is taken", updated.Slug)
+	}
+	if err := updateArticle(orig, updated); err != nil {
+		return nil, err
+	}
+	audit(r, "article.update", user, updated.Slug, "via xml-rpc; "+articleChanges(orig, updated))
+	articleWritten(orig, updated)
+	return true, nil
+}
+
+// metaWeblog.getPost(postid, username, password)
+func xmlrpcGetPost(r *http.Request, p xmlrpcParams) (any, error) {
+	if _, err := xmlrpcAuth(r, p, 1); err != nil {
+		return nil, err
+	}
+	a, err := xmlrpcArticle(p)
+	if err != nil {
+		return nil, err
+	}
+	return xmlrpcPost(r, a), nil
+}
+
+// metaWeblog.getRecentPosts(blogid, username, password, numberOfPosts)
+func xmlrpcGetRecentPosts(r *http.Request, p xmlrpcParams) (any, error) {
+	if _, err := xmlrpcAuth(r, p, 1); err != nil {
+		return nil, err
+	}
+	n, err := p.int(3)
+	if err != nil {
+		return nil, err
+	}
+	n = min(max(n, 1), xmlrpcRecentMax)
+	arts, err := allArticles() // newest first, drafts included
+	if err != nil {
+		return nil, err
+	}
+	posts := []map[string]any{}
+	for _, a := range arts[:min(n, len(arts))] {
+		posts = append(posts, xmlrpcPost(r, a))
+	}
+	return posts, nil
+}
+
+// metaWeblog.newMediaObject(blogid, username, password, {name, type, bits})
+func xmlrpcNewMediaObject(r *http.Request, p xmlrpcParams) (any, error) {
+	user, err := xmlrpcAuth(r, p, 1)
+	if err != nil {
+		return nil, err
+	}
+	m, err := p.structAt(3)
+	if err != nil {
+		return nil, err
+	}
+	bits, ok := m["bits"].([]byte)
+	if !ok {
+		return nil, faultf(faultParams, "bits must be base64")
+	}
+	path, err := saveMedia(bits)
+	var me *micropubError
+	if errors.As(err, &me) {
+		return nil, faultf(faultInvalid, "%s", me.desc)
+	}
+	if err != nil {
+		return nil, err
+	}
+	name, _ := m["name"].(string)
+	audit(r, "media.upload", user, "", fmt.Sprintf("%s from %q via xml-rpc", path, name))
+	return map[string]any{"url": siteURL(r) + path, "file": filepath.Base(path)}, nil
+}
+
+// blogger.deletePost(appkey, postid, username, password, publish); the
+// metaWeblog name that some clients call takes the same parameters.
+func xmlrpcDeletePost(r *http.Request, p xmlrpcParams) (any, error) {
+	user, err := xmlrpcAuth(r, p, 2)
+	if err != nil {
+		return nil, err
+	}
+	slug, err := p.string(1)
+	if err != nil {
+		return nil, err
+	}
+	a, err := loadArticle(slug)
+	if err != nil || slug != makeSlug(slug) {
+		return nil, faultf(faultNotFound, "no post %q", slug)
+	}
+	if err := deleteArticle(slug); err != nil {
+		return nil, err
+	}
+	audit(r, "article.delete", user, slug, fmt.Sprintf("via xml-rpc; title %q", a.Title))
+	articleWritten(a, Article{})
+	return true, nil
+}
+
+// xmlrpcArticle loads the post whose ID is the first parameter.
+func xmlrpcArticle(p xmlrpcParams) (Article, error) {
+	slug, err := p.string(0)
+	if err != nil {
+		return Article{}, err
+	}
+	if slug == "" || slug != makeSlug(slug) {
+		return Article{}, faultf(faultNotFound, "no post %q", slug)
+	}
+	a, err := loadArticle(slug)
+	if errors.Is(err, os.ErrNotExist) {
+		return Article{}, faultf(faultNotFound, "no post %q", slug)
+	}
+	return a, err
+}
+
+// --------------------------- Handlers (XML-RPC) ----------------
+
+func xmlrpcHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, xmlrpcMaxBody)
+	var call xmlrpcCall
+	if err := xml.NewDecoder(r.Body).Decode(&call); err != nil {
+		writeXMLRPC(w, r, nil, faultf(faultParse, "invalid request: %v", err))
+		return
+	}
+	method, ok := xmlrpcMethods[call.Method]
+	if !ok {
+		writeXMLRPC(w, r, nil, faultf(faultMethod, "unknown method %q", call.Method))
+		return
+	}
+	params := make(xmlrpcParams, len(call.Params))
+	for i, v := range call.Params {
+		x, err := v.decode()
+		if err != nil {
+			writeXMLRPC(w, r, nil, faultf(faultParams, "parameter %d: %v", i+1, err))
+			return
+		}
+		params[i] = x
+	}
+	result, err := method(r, params)
+	writeXMLRPC(w, r, result, err)
+}
+
+// rsdHandler serves Really Simple Discovery for the editors' setup screens.
+func rsdHandler(w http.ResponseWriter, r *http.Request) {
+	api := html.EscapeString(siteURL(r) + "/xmlrpc")
+	w.Header().Set("Content-Type", "application/rsd+xml; charset=utf-8")
+	fmt.Fprintf(w, `%s<rsd version="1.0" xmlns="http://archipelago.phrasewise.com/rsd">
+  <service>
+    <engineName>%s</engineName>
+    <homePageLink>%s/</homePageLink>
+    <apis>
+      <api name="MetaWeblog" preferred="true" apiLink="%s" blogID="%s"/>
+      <api name="Blogger" preferred="false" apiLink="%s" blogID="%s"/>
+    </apis>
+  </service>
+</rsd>
+`, xml.Header, html.EscapeString(cfg.SiteTitle), html.EscapeString(siteURL(r)), api, xmlrpcBlogID, api, xmlrpcBlogID)
+}
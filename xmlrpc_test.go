@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// xmlrpcCallBody builds a methodCall from raw <value> contents.
+func xmlrpcCallBody(method string, params ...string) string {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0"?><methodCall><methodName>` + method + `</methodName><params>`)
+	for _, p := range params {
+		b.WriteString("<param><value>" + p + "</value></param>")
+	}
+	b.WriteString("</params></methodCall>")
+	return b.String()
+}
+
+// callXMLRPC posts a call and returns its decoded result or its fault.
+func callXMLRPC(t *testing.T, base, method string, params ...string) (any, *xmlrpcFault) {
+	t.Helper()
+	resp, err := http.Post(base+"/xmlrpc", "text/xml", strings.NewReader(xmlrpcCallBody(method, params...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/xml") {
+		t.Fatalf("%s: %d %q", method, resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	var res struct {
+		Params []xmlrpcValue `xml:"params>param>value"`
+		Fault  *xmlrpcValue  `xml:"fault>value"`
+	}
+	if err := xml.Unmarshal(body, &res); err != nil {
+		t.Fatalf("%s: %v in %s", method, err, body)
+	}
+	if res.Fault != nil {
+		v, _ := res.Fault.decode()
+		m := v.(map[string]any)
+		return nil, &xmlrpcFault{m["faultCode"].(int), m["faultString"].(string)}
+	}
+	v, err := res.Params[0].decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v, nil
+}
+
+func str(s string) string { return "<string>" + s + "</string>" }
+
+func TestXMLRPC_MetaWeblogLifecycle(t *testing.T) {
+	resetStorage(t)
+	ts := httptest.NewServer(buildMux())
+	defer ts.Close()
+	user, pass := str(cfg.AdminUser), str(cfg.AdminPass)
+
+	v, fault := callXMLRPC(t, ts.URL, "blogger.getUsersBlogs", str("key"), user, pass)
+	if fault != nil {
+		t.Fatal(fault)
+	}
+	blogs := v.([]any)
+	if len(blogs) != 1 || blogs[0].(map[string]any)["blogid"] != "1" || blogs[0].(map[string]any)["url"] != ts.URL+"/" {
+		t.Fatalf("blogs: %v", blogs)
+	}
+
+	// an HTML post from an editor becomes Markdown
+	post := `<struct>
+	  <member><name>title</name><value>Desk &amp; Chair</value></member>
+	  <member><name>description</name><value><string>&lt;p&gt;Written &lt;em&gt;offline&lt;/em&gt;.&lt;/p&gt;</string></value></member>
+	  <member><name>categories</name><value><array><data><value>Tools</value><value>writing</value></data></array></value></member>
+	  <member><name>dateCreated</name><value><dateTime.iso8601>20240215T09:30:00</dateTime.iso8601></value></member>
+	</struct>`
+	v, fault = callXMLRPC(t, ts.URL, "metaWeblog.newPost", str("1"), user, pass, post, "<boolean>1</boolean>")
+	if fault != nil {
+		t.Fatal(fault)
+	}
+	id := v.(string)
+	a, err := loadArticle(id)
+	if err != nil || id != "desk--chair" || a.Title != "Desk & Chair" || a.Content != "Written _offline_." || a.Draft ||
+		strings.Join(a.Tags, ",") != "tools,writing" || !a.Published.Equal(time.Date(2024, 2, 15, 9, 30, 0, 0, time.UTC)) {
+		t.Fatalf("new post %q: %+v %v", id, a, err)
+	}
+
+	// a draft with Markdown kept as is
+	v, _ = callXMLRPC(t, ts.URL, "metaWeblog.newPost", str("1"), user, pass,
+		`<struct><member><name>title</name><value>Notes</value></member><member><name>description</name><value># Heading
+
+* one</value></member></struct>`, "<boolean>0</boolean>")
+	if a, _ := loadArticle(v.(string)); !a.Draft || a.Content != "# Heading\n\n* one" {
+		t.Fatalf("draft: %+v", a)
+	}
+
+	v, fault = callXMLRPC(t, ts.URL, "metaWeblog.getPost", str(id), user, pass)
+	if fault != nil {
+		t.Fatal(fault)
+	}
+	got := v.(map[string]any)
+	if got["postid"] != id || got["title"] != "Desk & Chair" || got["link"] != ts.URL+"/article/desk--chair" || got["post_status"] != "publish" {
+		t.Fatalf("getPost: %v", got)
+	}
+
+	// editPost changes only the fields sent and keeps the ID
+	v, fault = callXMLRPC(t, ts.URL, "metaWeblog.editPost", str(id), user, pass,
+		`<struct><member><name>title</name><value>Desk and Chair</value></member><member><name>mt_keywords</name><value>tools, ergonomics</value></member></struct>`, "<boolean>1</boolean>")
+	if fault != nil || v != true {
+		t.Fatalf("editPost: %v %v", v, fault)
+	}
+	if a, _ = loadArticle(id); a.Title != "Desk and Chair" || a.Content != "Written _offline_." || strings.Join(a.Tags, ",") != "tools,ergonomics" {
+		t.Fatalf("edited: %+v", a)
+	}
+
+	v, _ = callXMLRPC(t, ts.URL, "metaWeblog.getRecentPosts", str("1"), user, pass, "<int>1</int>")
+	if posts := v.([]any); len(posts) != 1 || posts[0].(map[string]any)["postid"] != "notes" {
+		t.Fatalf("recent: %v", posts)
+	}
+
+	media := `<struct><member><name>name</name><value>dot.png</value></member><member><name>type</name><value>image/png</value></member><member><name>bits</name><value><base64>` + base64.StdEncoding.EncodeToString(pngBytes) + `</base64></value></member></struct>`
+	v, fault = callXMLRPC(t, ts.URL, "metaWeblog.newMediaObject", str("1"), user, pass, media)
+	if fault != nil {
+		t.Fatal(fault)
+	}
+	u := v.(map[string]any)["url"].(string)
+	resp, err := http.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.HasPrefix(u, ts.URL+"/media/") || !bytes.Equal(b, pngBytes) {
+		t.Fatalf("media %q: %d", u, resp.StatusCode)
+	}
+
+	v, fault = callXMLRPC(t, ts.URL, "blogger.deletePost", str("key"), str(id), user, pass, "<boolean>1</boolean>")
+	if code, _ := getBody(t, ts.URL, "/article/"+id, ""); fault != nil || v != true || code != http.StatusGone {
+		t.Fatalf("deletePost: %v %v, then %d", v, fault, code)
+	}
+	if _, fault = callXMLRPC(t, ts.URL, "metaWeblog.deletePost", str("key"), str(id), user, pass); fault == nil || fault.Code != faultNotFound {
+		t.Fatalf("second delete: %v", fault)
+	}
+
+	entries, _ := readAudit(auditFilter{Slug: id})
+	var actions []string
+	for _, e := range entries {
+		actions = append(actions, e.Action)
+		if e.Actor != cfg.AdminUser || !strings.Contains(e.Summary, "xml-rpc") {
+			t.Fatalf("audit entry: %+v", e)
+		}
+	}
+	if strings.Join(actions, ",") != "article.delete,article.update,article.create" {
+		t.Fatalf("audit: %v", actions)
+	}
+}
+
+func TestXMLRPC_AuthAndFaults(t *testing.T) {
+	resetStorage(t)
+	saved := limiter
+	defer func() { limiter = saved }()
+	limiter = newLoginLimiter()
+	ts := httptest.NewServer(buildMux())
+	defer ts.Close()
+
+	post := `<struct><member><name>title</name><value>Nope</value></member><member><name>description</name><value>x</value></member></struct>`
+	if _, fault := callXMLRPC(t, ts.URL, "metaWeblog.newPost", str("1"), str(cfg.AdminUser), str("wrong"), post); fault == nil || fault.Code != faultAuth {
+		t.Fatalf("bad password: %v", fault)
+	}
+	if arts, _ := allArticles(); len(arts) != 0 {
+		t.Fatalf("created with a bad password: %+v", arts)
+	}
+	if entries, _ := readAudit(auditFilter{Action: "login.failed"}); len(entries) != 1 || entries[0].Summary != "xml-rpc" {
+		t.Fatalf("failed login audit: %+v", entries)
+	}
+
+	// accounts from the user store work too
+	if _, err := runCLI(t, "s3cret-pass\n", "user", "add", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, fault := callXMLRPC(t, ts.URL, "metaWeblog.getRecentPosts", str("1"), str("alice"), str("s3cret-pass"), "<int>10</int>"); fault != nil {
+		t.Fatalf("user store: %v", fault)
+	}
+
+	// repeated failures lock the account, even with the right password
+	for range 10 {
+		callXMLRPC(t, ts.URL, "blogger.getUsersBlogs", str(""), str("alice"), str("guess"))
+	}
+	if _, fault := callXMLRPC(t, ts.URL, "blogger.getUsersBlogs", str(""), str("alice"), str("s3cret-pass")); fault == nil || fault.Code != faultThrottled {
+		t.Fatalf("throttled: %v", fault)
+	}
+	limiter = newLoginLimiter() // the failures above also throttle this IP
+
+	if _, fault := callXMLRPC(t, ts.URL, "wp.getUsers", str("1")); fault == nil || fault.Code != faultMethod {
+		t.Fatalf("unknown method: %v", fault)
+	}
+	if _, fault := callXMLRPC(t, ts.URL, "metaWeblog.getPost", str("../users"), str(cfg.AdminUser), str(cfg.AdminPass)); fault == nil || fault.Code != faultNotFound {
+		t.Fatalf("bad id: %v", fault)
+	}
+	resp, err := http.Post(ts.URL+"/xmlrpc", "text/xml", strings.NewReader("<methodCall><methodName>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(b), "<int>-32700</int>") {
+		t.Fatalf("parse error: %s", b)
+	}
+
+	code, body := getBody(t, ts.URL, "/rsd.xml", "")
+	if code != http.StatusOK || !strings.Contains(body, `apiLink="`+ts.URL+`/xmlrpc"`) {
+		t.Fatalf("rsd: %d %s", code, body)
+	}
+	if _, home := getBody(t, ts.URL, "/", ""); !strings.Contains(home, `href="/rsd.xml"`) {
+		t.Fatal("home page lacks the EditURI link")
+	}
+
+	// storage errors are logged, not sent to the client
+	if err := os.WriteFile(filepath.Join(cfg.StorageDir, mediaDir), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	media := `<struct><member><name>name</name><value>dot.png</value></member><member><name>bits</name><value><base64>` + base64.StdEncoding.EncodeToString(pngBytes) + `</base64></value></member></struct>`
+	if _, fault := callXMLRPC(t, ts.URL, "metaWeblog.newMediaObject", str("1"), str(cfg.AdminUser), str(cfg.AdminPass), media); fault == nil || fault.Code != faultServer || strings.Contains(fault.String, mediaDir) {
+		t.Fatalf("storage error: %v", fault)
+	}
+}